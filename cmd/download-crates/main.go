@@ -1,51 +1,160 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
+	"regexp"
+	"runtime"
 	"strings"
 	"time"
 
 	"github.com/APTlantis/Mirror-Rust-Crates/internal/downloader"
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/index"
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/schema"
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/sidecar"
 )
 
 func main() {
 	defaultConcurrency := downloader.DefaultConcurrency()
 
 	var (
-		listPath   = flag.String("list", "", "Path to newline-delimited URL list")
+		listPath   = flag.String("list", "", "Path to newline-delimited URL list (- reads stdin)")
 		indexDir   = flag.String("index-dir", "", "Path to local crates.io-index directory (e.g., C:\\Rust-Crates\\crates.io-index)")
 		baseURL    = flag.String("crates-base-url", "https://static.crates.io/crates", "Base URL for crates content")
 		includeY   = flag.Bool("include-yanked", false, "Include yanked versions from the index")
 		limit      = flag.Int("limit", 0, "Limit number of crates to process (0 = no limit)")
+		crateLimit = flag.Int("crate-limit", 0, "Stop after N crates, each with all of its versions (0 = all; index mode only)")
 		outDir     = flag.String("out", "out", "Directory to store downloaded files")
 		conc       = flag.Int("concurrency", defaultConcurrency, "Number of concurrent downloads")
+		urlBuf     = flag.Int("url-buffer", -1, "Capacity of the URL queue feeding workers (-1 = 2x -concurrency, 0 = unbuffered; unbuffered while -max-total-bytes is set)")
+		resultBuf  = flag.Int("result-buffer", -1, "Capacity of the record queue feeding the manifest writer (-1 = 2x -concurrency, 0 = unbuffered)")
+		collectors = flag.Int("manifest-collectors", 1, "Goroutines encoding manifest records; more than 1 writes records in batches, in a different order")
 		timeoutSec = flag.Int("timeout", 300, "Per-request timeout in seconds")
-		checksPath = flag.String("checksums", "", "Optional JSONL of {url, sha256}")
-		manifest   = flag.String("manifest", "manifest.jsonl", "Where to write records (JSONL)")
+		checksPath = flag.String("checksums", "", "Optional JSONL of {url, sha256} (- reads stdin)")
+		checks2    = flag.String("checksums-secondary", "", "Independent checksum JSONL file; downloads must match it and the index/-checksums where both list a URL, and disagreements are flagged")
+		samplePct  = flag.Float64("verify-sample-pct", 0, "After the run, re-read and re-hash about this percent of the files it wrote (0 = off)")
+		sampleStr  = flag.Bool("verify-sample-strict", false, "Exit non-zero if -verify-sample-pct finds a corrupted file")
+		verifyConc = flag.Int("verify-concurrency", 0, "Files -verify-sample-pct re-hashes at once, independent of -concurrency (0 = number of CPUs)")
+		tmpSuffix  = flag.String("tmp-suffix", downloader.DefaultTempSuffix, "Suffix for in-progress downloads; a random token is added before it so names stay unique")
+		sideDir    = flag.String("sidecar-dir", "", "Verify crates against the cksum in existing sidecars under this directory (crates without a sidecar are not verified)")
+		sideTmpl   = flag.String("sidecar-name-template", sidecar.DefaultNameTemplate, "Sidecar file name with {name} and {version} placeholders, as given to generate-sidecars (for -sidecar-dir and -with-sidecars)")
+		sideSub    = flag.String("sidecar-subdir", "", "Subdirectory of each crate's shard directory holding sidecars, as given to generate-sidecars (for -sidecar-dir and -with-sidecars)")
+		csWorkers  = flag.Int("checksum-workers", runtime.NumCPU(), "Goroutines parsing the -checksums file (1 = serial)")
+		manifest   = flag.String("manifest", "manifest.jsonl", "Where to write records (JSONL); a .gz or .zst suffix writes it compressed")
+		perShard   = flag.Bool("manifest-per-shard", false, "Write records to manifest.jsonl in each crate's shard directory; -manifest only receives records whose shard file failed")
+		manFields  = flag.String("manifest-fields", "", "Comma-separated manifest fields to write (e.g. url,ok,sha256), or -name entries to drop (e.g. -path,-error); empty writes all")
+		manFail    = flag.Bool("fail-on-manifest-error", false, "Stop dispatching downloads and exit non-zero once a manifest record cannot be written (e.g. disk full)")
+		strictCnt  = flag.Bool("strict-count", false, "Exit non-zero if the run ends with fewer manifest records than input URLs (e.g. a worker dropped items); a -max-total-bytes stop only counts dispatched URLs")
+		manAppend  = flag.Bool("manifest-append", false, "Append to an existing manifest instead of truncating it (for resumed runs)")
 		bundle     = flag.Bool("bundle", false, "Enable rolling tar.zst bundling while downloading")
-		bundleGB   = flag.Int64("bundle-size-gb", 8, "Target bundle size in GB")
-		bundlesOut = flag.String("bundles-out", "bundles", "Directory for .tar.zst bundles")
+		finRounds  = flag.Int("final-retry-rounds", 0, "After the main pass, re-try all failed downloads up to this many rounds")
+		finDelay   = flag.Duration("final-retry-delay", downloader.DefaultFinalRetryDelay, "Wait before the first final retry round; doubles each round")
+		maxCreates = flag.Float64("max-creates-per-sec", 0, "Limit download temp file creations per second across all workers, for metadata-bound network filesystems (0 = unlimited)")
+		maxBytes   = flag.String("max-total-bytes", "0", "Stop starting new downloads once this many bytes were downloaded, e.g. 50GB (0 = no limit)")
+		bundleFmt  = flag.String("bundle-format", "tar.zst", "Bundle archive format: tar.zst|tar.br")
+		hdrLayout  = flag.String("bundle-header-layout", "host", "Entry names inside bundles: host (static.crates.io/<file>), shard (path relative to -out) or flat (<file>)")
+		transform  = flag.String("store-transform", "none", "Store crates as served (none), decompressed (gunzip, .tar) or recompressed (zstd, .tar.zst)")
+		bundleSize = flag.String("bundle-size", "8GiB", "Target bundle size, e.g. 512MiB or 8GiB")
+		bundleGB   = flag.Int64("bundle-size-gb", 8, "Deprecated: use -bundle-size. Target bundle size in GB")
+		groupBy    = flag.String("bundle-group-by", "none", "Keep related files in one bundle by putting off rotation: none, crate (all versions of a crate) or shard (one shard dir)")
+		groupSlack = flag.String("bundle-group-slack", "512MiB", "How far past -bundle-size a bundle may grow to keep a -bundle-group-by group together")
+		bundlesOut = flag.String("bundles-out", "bundles", "Directory for bundle archives")
+		skipBndl   = flag.Bool("skip-bundled", false, "Load the bundle indexes in -bundles-out at startup and do not re-add entries they already list (for resumed bundling runs)")
 		logFormat  = flag.String("log-format", "text", "Logging format: text|json")
 		logLevel   = flag.String("log-level", "info", "Logging level: debug|info|warn|error")
 		dryRun     = flag.Bool("dry-run", false, "Validate inputs and estimate work; do not download")
+		sizeHints  = flag.String("size-hints", "", "Manifest from an earlier run whose file sizes weight the eta_bytes estimate in -progress-interval logs")
 		progIntv   = flag.Duration("progress-interval", 0, "Periodic progress logging interval (e.g., 5s; 0=disabled)")
 		progEvery  = flag.Int("progress-every", 0, "Log progress every N processed items (0=disabled)")
 		retries    = flag.Int("retries", 6, "Total retry attempts for transient errors")
 		retryBase  = flag.Duration("retry-base", 500*time.Millisecond, "Base backoff for retries (exponential with jitter)")
 		retryMax   = flag.Duration("retry-max", 30*time.Second, "Max backoff per attempt")
+		urlDL      = flag.Duration("per-url-deadline", 0, "Give up on a URL after this long across all attempts and backoff, recording status deadline (0 = bounded by -timeout)")
+		hardlinks  = flag.Bool("hardlink-dupes", false, "Hardlink crate files with identical SHA256 to the first copy instead of storing them twice")
+		writeProv  = flag.Bool("write-provenance", false, "Write <file>.prov.json next to each downloaded crate (fetch time, base URL, HTTP status, ETag, Last-Modified, SHA256)")
+		minRatio   = flag.Float64("min-success-ratio", 0, "Exit non-zero if fewer than this fraction (0-1) of processed crates succeeded (0 = never)")
+		csRetries  = flag.Int("retry-on-checksum-mismatch", 0, "Delete and re-fetch a crate up to N times when its checksum does not match")
+		validGzip  = flag.Bool("validate-gzip", false, "While hashing, check each crate file is a gzip tarball with a top-level Cargo.toml; bad downloads are quarantined under -out/.quarantine, bad existing files re-downloaded")
+		deepVerify = flag.Bool("deep-verify", false, "Like -validate-gzip, and also require the archive's top-level dir and Cargo.toml name/version to match the URL (status crate-mismatch)")
+		scanCmd    = flag.String("scan-cmd", "", "Stream each download to this command's stdin (split on spaces, no shell; CRATE_URL and CRATE_PATH are set); a non-zero exit records scan-failed and quarantines the file")
 		maxConnsPH = flag.Int("max-conns-per-host", 0, "Override http.Transport MaxConnsPerHost (0=auto)")
 		maxIdle    = flag.Int("max-idle-conns", 0, "Override http.Transport MaxIdleConns (0=auto)")
 		maxIdlePH  = flag.Int("max-idle-per-host", 0, "Override http.Transport MaxIdleConnsPerHost (0=auto)")
+		minTLS     = flag.String("min-tls", "1.2", "Minimum TLS version: 1.2|1.3")
+		tlsCiphers = flag.String("tls-ciphers", "", "Comma-separated TLS 1.2 cipher suites to allow (IANA names; empty = Go defaults)")
 		idleTO     = flag.Duration("idle-timeout", 0, "Override http.Transport IdleConnTimeout (0=auto)")
 		tlsTO      = flag.Duration("tls-timeout", 0, "Override http.Transport TLSHandshakeTimeout (0=auto)")
 		listenAddr = flag.String("listen", "", "Serve Prometheus metrics and pprof at this address (e.g., :9090)")
+		listenReq  = flag.Bool("listen-required", false, "Exit if the -listen address cannot be bound instead of running without metrics")
+		sinceSHA   = flag.String("since-commit", "", "Only read index files changed since this index git commit (defaults to the -state-file commit)")
+		stateFile  = flag.String("state-file", "", "File recording the index HEAD commit after a successful run, for incremental -since-commit runs")
+		runJSON    = flag.String("run-json", "", "Write a JSON summary of the run, including the index git commit, to this path")
+		idxCommit  = flag.String("index-commit", "", "Index commit recorded in -run-json (default: read from -index-dir/.git)")
+		routesFile = flag.String("routes-file", "", "File of -route rules, one per line (# comments); applied after any -route flags")
+		cleanTemps = flag.Bool("clean-temps", false, "Before downloading, remove .part/.tmp files under -out (and -route dirs) left by interrupted runs")
+		cleanAge   = flag.Duration("clean-temps-age", downloader.DefaultCleanTempsAge, "Only remove temps -clean-temps finds unmodified for this long, sparing those of a concurrent run")
+		nameRegex  = flag.String("name-regex", "", "Regex with a capture group (or a group named name) extracting the crate name from URLs that do not follow /{name}/{name}-{version}.crate; non-matching URLs use the default rule")
+		normCase   = flag.Bool("normalize-case", false, "Lowercase crate names in shard dirs and file names; manifest keeps original_name")
+		emptyOut   = flag.String("empty-files-out", "", "Write index files that produced no URLs to this path (one per line)")
+		skipPre    = flag.Bool("skip-prerelease", false, "Skip SemVer pre-release versions such as 1.0.0-rc.1 (index mode only)")
+		minVersion = flag.String("min-version", "", "Skip versions below this SemVer version, e.g. 1.0.0 to drop 0.x (index mode only)")
+		licenseMap = flag.String("license-filter", "", "Crate license map file (lines of: name SPDX-expression, or JSONL {name, license}); with -license-deny/-license-allow, drop crates by license (index mode only)")
+		licDeny    = flag.String("license-deny", "", "Comma-separated license globs to exclude with -license-filter, e.g. GPL-*,AGPL-*")
+		licAllow   = flag.String("license-allow", "", "Comma-separated license globs that -license-filter keeps; crates needing any other license, or missing from the map, are dropped")
+		strict     = flag.Bool("strict", false, "Fail on the first malformed or schema-invalid index line, or unreadable index file, instead of skipping it")
+		validUTF8  = flag.Bool("validate-utf8", false, "Reject index and checksum lines with invalid UTF-8 or control characters in names, versions, URLs or sums")
+		withSide   = flag.Bool("with-sidecars", false, "Write sidecar metadata for each index entry during the index pass (requires -index-dir)")
+		withDL     = flag.Bool("with-downloads", true, "Download crate files; set false with -with-sidecars to only write sidecars")
+		where      = flag.Bool("where", false, "Print where the crate named by the arguments <name> <version> would be stored with the current -out, -normalize-case, -store-transform and -bundle-header-layout, then exit")
+		countOnly  = flag.Bool("count-only", false, "Print resolved URL and crate counts, then exit")
+		countHEAD  = flag.Int("count-sample", 0, "With -count-only, HEAD this many URLs to estimate total bytes (0=skip)")
+		reconcile  = flag.Bool("reconcile", false, "Compare -out against -index-dir, report missing and orphaned crate files, then exit")
+		pruneDry   = flag.Bool("prune-dry-run", false, "Print, as NDJSON with sizes and a total, every crate file in -out that has no -index-dir entry and would be pruned, then exit without deleting anything")
+		chkBundles = flag.Bool("check-bundles", false, "Cross-check -manifest against the bundle indexes in -bundles-out, report discrepancies, then exit")
+		lsBundles  = flag.Bool("list-bundles", false, "Print the entries (name, size) of every bundle archive in -bundles-out by reading their tar headers, then exit")
+		lsJSON     = flag.Bool("list-bundles-json", false, "With -list-bundles, print one JSON object per entry instead of text")
+		cargoCfg   = flag.String("cargo-config", "", "Write a cargo config.toml to this path that replaces crates-io with the mirror, then exit")
+		cargoStyle = flag.String("cargo-config-style", "local-registry", "Cargo source kind for -cargo-config: local-registry or directory")
+		cargoSrc   = flag.String("cargo-config-source", "", "Mirror location (path or file:// URL) written by -cargo-config (default: -out)")
+		regOut     = flag.String("cargo-registry-out", "", "Rebuild a cargo registry in this directory from every -index-dir entry (cargo index layout plus config.json) and link the crate files already in -out, then exit")
+		regBase    = flag.String("cargo-registry-base", "", "URL the -cargo-registry-out directory is served at; config.json dl becomes <base>/{crate}-{version}.crate (default: file:// URL of the directory)")
+		regAPI     = flag.String("cargo-registry-api", "", "api URL for the -cargo-registry-out config.json (default: null)")
+		fromMan    = flag.String("bundle-from-manifest", "", "Build bundles from files recorded in this manifest (no downloads), then exit")
+		doctor     = flag.Bool("doctor", false, "Check index, output dir, base URL and limits, print a checklist, then exit")
+		localReg   = flag.String("emit-local-registry", "", "Also build a cargo registry in this directory: an index/ tree and config.json for the selected entries, with downloaded .crate files linked in (requires -index-dir)")
+		localRegDL = flag.String("local-registry-dl", "", "dl template written to the -emit-local-registry config.json (default: file:// URL of the registry with {crate}-{version}.crate)")
+		catalogOut = flag.String("catalog", "", "Write a sorted JSONL catalog of every crate version seen (name, version, yanked, size, sha256) to this path; an existing catalog is updated")
+		eventsDB   = flag.String("events-sqlite", "", "Also record every download in this SQLite database for querying (needs a build with -tags sqlite)")
+		exemplars  = flag.Bool("metrics-exemplars", false, "Attach crate name/version exemplars to the download duration histogram (served to OpenMetrics scrapers)")
+		traceExs   = flag.Bool("metrics-trace-exemplars", false, "Send a W3C traceparent header with each download attempt and add its trace_id/span_id to the duration exemplars (implies -metrics-exemplars)")
+		idxFormat  = flag.String("index-format", "sharded", "Index layout: sharded (crates.io git tree), flat (files directly in -index-dir) or single (-index-dir is one JSONL file)")
+		reqHTTPS   = flag.Bool("require-https", false, "Reject the run if any URL (from -list or the index) is not https://")
+		printSch   = flag.String("print-schema", "", "Print the JSON Schema of a format (manifest|sidecar) and exit")
+		preflight  = flag.Bool("preflight", false, "Fetch the first URL once before the run to detect the server's HTTP version and warn about HTTP/1.1")
+		h1Conns    = flag.Int("http1-max-conns", 0, "Run the preflight and, if it finds an HTTP/1.1-only server, cap connections per host at this many (0 = off)")
+		probe      = flag.Bool("probe", false, "Download one small crate to check reachability, TLS and HTTP version, then exit")
+		probeCrate = flag.String("probe-crate", downloader.DefaultTestCrate, "Crate path under -crates-base-url fetched by -probe")
+		probeSHA   = flag.String("probe-sha256", "", "Expected SHA256 of -probe-crate (optional)")
+		doctorFree = flag.Float64("doctor-min-free-gb", 10, "Free space required in -out for -doctor to pass (GB)")
 	)
+	var skipFiles, skipDirs, includes, excludes, metricHosts, routeRules, allowHosts stringList
+	flag.Var(&skipFiles, "index-skip", "Glob of index file names to ignore, in addition to the built-ins (repeatable)")
+	flag.Var(&skipDirs, "index-skip-dir", "Glob of index directory names to prune, in addition to .git/.github (repeatable)")
+	flag.Var(&includes, "index-include", "Only read index files whose path relative to -index-dir (or a leading directory of it) matches this glob, e.g. a* (repeatable)")
+	flag.Var(&excludes, "index-exclude", "Skip index files whose relative path (or a leading directory of it) matches this glob (repeatable)")
+	flag.Var(&metricHosts, "metrics-host", "Host that gets its own host label in the download metrics, in addition to the -crates-base-url host; others are labelled \"other\" (repeatable)")
+	flag.Var(&routeRules, "route", "Store crates whose names fall in a prefix range in another output dir, e.g. a..m=/disk1 or serde-json=/disk3; unmatched crates stay in -out (repeatable, first match wins)")
+	flag.Var(&allowHosts, "allowed-hosts", "Only fetch from and connect to this host (or *.domain); other URLs are recorded as host-not-allowed (repeatable; default: any host)")
 	flag.Parse()
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
 
 	// Basic validations and clamps
 	if *conc <= 0 {
@@ -74,6 +183,317 @@ func main() {
 	}
 	slog.SetDefault(slog.New(handler))
 
+	// tuneTransport applies the transport and TLS flags to a downloader's client.
+	tuneTransport := func(dl *downloader.Downloader) {
+		if tr, ok := dl.HTTPTransport().(*http.Transport); ok {
+			if *maxConnsPH > 0 {
+				tr.MaxConnsPerHost = *maxConnsPH
+			}
+			if *maxIdle > 0 {
+				tr.MaxIdleConns = *maxIdle
+			}
+			if *maxIdlePH > 0 {
+				tr.MaxIdleConnsPerHost = *maxIdlePH
+			}
+			if *idleTO > 0 {
+				tr.IdleConnTimeout = *idleTO
+			}
+			if *tlsTO > 0 {
+				tr.TLSHandshakeTimeout = *tlsTO
+			}
+			minVer, err := downloader.ParseTLSVersion(*minTLS)
+			if err != nil {
+				slog.Error("invalid -min-tls", "err", err)
+				os.Exit(2)
+			}
+			ciphers, err := downloader.ParseCipherSuites(*tlsCiphers)
+			if err != nil {
+				slog.Error("invalid -tls-ciphers", "err", err)
+				os.Exit(2)
+			}
+			downloader.ApplyTLSPolicy(tr, minVer, ciphers)
+		}
+	}
+
+	if *printSch != "" {
+		s, err := schema.For(*printSch)
+		if err != nil {
+			slog.Error("invalid -print-schema", "err", err)
+			os.Exit(2)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(s); err != nil {
+			slog.Error("print schema failed", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *probe {
+		u := strings.TrimRight(*baseURL, "/") + "/" + strings.TrimLeft(*probeCrate, "/")
+		sums := map[string]string{}
+		if *probeSHA != "" {
+			sums[u] = *probeSHA
+		}
+		dl := downloader.NewDownloader(*outDir, 1, time.Duration(*timeoutSec)*time.Second, sums, io.Discard, nil)
+		tuneTransport(dl)
+		dl.SetAllowedHosts(allowHosts)
+		res := dl.Probe(context.Background(), u)
+		res.Print(os.Stdout)
+		if !res.OK() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *doctor {
+		dl := downloader.NewDownloader(*outDir, 1, time.Duration(*timeoutSec)*time.Second, nil, io.Discard, nil)
+		tuneTransport(dl)
+		dl.SetAllowedHosts(allowHosts)
+		checks := dl.Doctor(context.Background(), downloader.DoctorConfig{
+			IndexDir:     *indexDir,
+			OutDir:       *outDir,
+			BaseURL:      *baseURL,
+			Concurrency:  *conc,
+			MinFreeBytes: uint64(*doctorFree * (1 << 30)),
+		})
+		if !downloader.PrintDoctor(os.Stdout, checks) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if !strings.HasPrefix(*tmpSuffix, ".") || len(*tmpSuffix) < 2 || strings.ContainsAny(*tmpSuffix, `/\`) {
+		slog.Error("-tmp-suffix must start with a dot and not contain path separators", "value", *tmpSuffix)
+		os.Exit(2)
+	}
+	if *minRatio < 0 || *minRatio > 1 {
+		slog.Error("-min-success-ratio must be between 0 and 1", "value", *minRatio)
+		os.Exit(2)
+	}
+
+	format, err := downloader.ParseBundleFormat(*bundleFmt)
+	if err != nil {
+		slog.Error("invalid -bundle-format", "err", err)
+		os.Exit(2)
+	}
+	fields, err := downloader.ParseManifestFields(*manFields)
+	if err != nil {
+		slog.Error("invalid -manifest-fields", "err", err)
+		os.Exit(2)
+	}
+	bundleBytes, err := downloader.ParseByteSize(*bundleSize)
+	if err != nil {
+		slog.Error("invalid -bundle-size", "err", err)
+		os.Exit(2)
+	}
+	if setFlags["bundle-size-gb"] {
+		if setFlags["bundle-size"] {
+			slog.Error("-bundle-size-gb and -bundle-size are mutually exclusive")
+			os.Exit(2)
+		}
+		slog.Warn("-bundle-size-gb is deprecated; use -bundle-size", "value", fmt.Sprintf("%dGiB", *bundleGB))
+		bundleBytes = *bundleGB << 30
+	}
+	byteBudget, err := downloader.ParseByteSize(*maxBytes)
+	if err != nil {
+		slog.Error("invalid -max-total-bytes", "err", err)
+		os.Exit(2)
+	}
+	bundleGroup, err := downloader.ParseBundleGroupBy(*groupBy)
+	if err != nil {
+		slog.Error("invalid -bundle-group-by", "err", err)
+		os.Exit(2)
+	}
+	groupSlackBytes, err := downloader.ParseByteSize(*groupSlack)
+	if err != nil {
+		slog.Error("invalid -bundle-group-slack", "err", err)
+		os.Exit(2)
+	}
+	headerLayout, err := downloader.ParseHeaderLayout(*hdrLayout)
+	if err != nil {
+		slog.Error("invalid -bundle-header-layout", "err", err)
+		os.Exit(2)
+	}
+	storeTr, err := downloader.ParseStoreTransform(*transform)
+	if err != nil {
+		slog.Error("invalid -store-transform", "err", err)
+		os.Exit(2)
+	}
+	var nameRe *regexp.Regexp
+	if *nameRegex != "" {
+		if nameRe, err = downloader.ParseNameRegex(*nameRegex); err != nil {
+			slog.Error("invalid -name-regex", "err", err)
+			os.Exit(2)
+		}
+	}
+
+	var routes []downloader.Route
+	for _, rule := range routeRules {
+		r, err := downloader.ParseRoute(rule)
+		if err != nil {
+			slog.Error("invalid -route", "err", err)
+			os.Exit(2)
+		}
+		routes = append(routes, r)
+	}
+	if *routesFile != "" {
+		rs, err := downloader.ReadRoutes(*routesFile)
+		if err != nil {
+			slog.Error("invalid -routes-file", "err", err)
+			os.Exit(2)
+		}
+		routes = append(routes, rs...)
+	}
+
+	if *cargoCfg != "" {
+		style, err := downloader.ParseCargoSourceStyle(*cargoStyle)
+		if err != nil {
+			slog.Error("invalid -cargo-config-style", "err", err)
+			os.Exit(2)
+		}
+		src := *cargoSrc
+		if src == "" {
+			src = *outDir
+		}
+		if err := downloader.WriteCargoSourceConfigStyle(src, *cargoCfg, style); err != nil {
+			slog.Error("write cargo config failed", "path", *cargoCfg, "err", err)
+			os.Exit(1)
+		}
+		slog.Info("cargo config written", "path", *cargoCfg, "style", style, "source", src)
+		return
+	}
+
+	if *regOut != "" {
+		if *indexDir == "" {
+			slog.Error("-cargo-registry-out requires -index-dir")
+			os.Exit(2)
+		}
+		dlTmpl := ""
+		if *regBase != "" {
+			dlTmpl = strings.TrimRight(*regBase, "/") + "/{crate}-{version}.crate"
+		}
+		reg, err := downloader.NewLocalRegistry(*regOut, dlTmpl)
+		if err != nil {
+			slog.Error("local registry init failed", "dir", *regOut, "err", err)
+			os.Exit(1)
+		}
+		reg.SetAPI(*regAPI)
+		// Cargo needs yanked versions in the index to keep existing lockfiles working.
+		res, err := downloader.ReadIndex(*indexDir, downloader.IndexOptions{
+			BaseURL:       *baseURL,
+			IncludeYanked: true,
+			Strict:        *strict,
+			Walk:          index.Options{SkipFiles: skipFiles, SkipDirs: skipDirs, Include: includes, Exclude: excludes, Layout: index.Layout(*idxFormat)},
+			OnEntry:       reg.AddIndexLine,
+		})
+		if err != nil {
+			slog.Error("read index failed", "err", err)
+			os.Exit(1)
+		}
+		dl := downloader.NewDownloader(*outDir, 1, time.Second, nil, io.Discard, nil)
+		dl.SetNormalizeCase(*normCase)
+		dl.SetStoreTransform(storeTr)
+		dl.SetNameRegex(nameRe)
+		dl.SetRoutes(routes)
+		missing := dl.FillLocalRegistry(reg, res.URLs)
+		crates, linked, errs, err := reg.Close()
+		if err != nil {
+			slog.Error("write local registry failed", "dir", *regOut, "err", err)
+			os.Exit(1)
+		}
+		slog.Info("cargo registry written", "dir", *regOut, "crates", crates, "versions", len(res.URLs), "linked", linked, "not_downloaded", missing, "errors", errs)
+		if errs > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *where {
+		if flag.NArg() != 2 {
+			slog.Error("-where needs two arguments: <name> <version>", "args", flag.Args())
+			os.Exit(2)
+		}
+		bndl, _ := downloader.NewBundlerBytes(false, *bundlesOut, bundleBytes, format)
+		bndl.SetHeaderLayout(headerLayout, *outDir)
+		dl := downloader.NewDownloader(*outDir, 1, time.Second, nil, io.Discard, bndl)
+		dl.SetNormalizeCase(*normCase)
+		dl.SetStoreTransform(storeTr)
+		dl.SetNameRegex(nameRe)
+		dl.SetRoutes(routes)
+		dl.Where(downloader.CrateURL(*baseURL, flag.Arg(0), flag.Arg(1))).Print(os.Stdout)
+		return
+	}
+
+	if *fromMan != "" {
+		bndl, err := downloader.NewBundlerBytes(true, *bundlesOut, bundleBytes, format)
+		if err != nil {
+			slog.Error("bundler init failed", "err", err)
+			os.Exit(1)
+		}
+		bndl.SetHeaderLayout(headerLayout, *outDir)
+		bndl.SetGroupBy(bundleGroup, groupSlackBytes)
+		if err := bndl.SetSkipBundled(*skipBndl); err != nil {
+			slog.Error("bundler init failed", "err", err)
+			os.Exit(1)
+		}
+		n, err := downloader.BundleFromManifest(*fromMan, bndl)
+		if cerr := bndl.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			slog.Error("bundle from manifest failed", "manifest", *fromMan, "err", err)
+			os.Exit(1)
+		}
+		slog.Info("bundled from manifest", "files", n, "manifest", *fromMan, "out", *bundlesOut)
+		return
+	}
+
+	if *lsBundles {
+		w := bufio.NewWriter(os.Stdout)
+		enc := json.NewEncoder(w)
+		var bundles, entries, total int64
+		last := ""
+		err := downloader.ListBundles(*bundlesOut, func(e downloader.BundleListEntry) error {
+			if e.Bundle != last {
+				bundles++
+				last = e.Bundle
+			}
+			entries++
+			total += e.Size
+			if *lsJSON {
+				return enc.Encode(e)
+			}
+			_, err := fmt.Fprintf(w, "bundle=%s name=%s size=%d\n", e.Bundle, e.Name, e.Size)
+			return err
+		})
+		if err == nil && !*lsJSON {
+			fmt.Fprintf(w, "bundles=%d entries=%d bytes=%d\n", bundles, entries, total)
+		}
+		if ferr := w.Flush(); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			slog.Error("list bundles failed", "bundles", *bundlesOut, "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *chkBundles {
+		c, err := downloader.CheckBundles(*manifest, *bundlesOut)
+		if err != nil {
+			slog.Error("check bundles failed", "manifest", *manifest, "bundles", *bundlesOut, "err", err)
+			os.Exit(1)
+		}
+		c.Print(os.Stdout)
+		if !c.OK() {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if *listPath == "" && *indexDir == "" {
 		slog.Error("missing required flag: provide -index-dir or -list")
 		flag.CommandLine.SetOutput(os.Stderr)
@@ -87,21 +507,190 @@ func main() {
 			os.Exit(2)
 		}
 	}
+	if *withSide && *indexDir == "" {
+		slog.Error("-with-sidecars requires -index-dir")
+		os.Exit(2)
+	}
+	stdinUsers := 0
+	for _, p := range []string{*listPath, *checksPath, *checks2, *licenseMap} {
+		if p == downloader.StdinPath {
+			stdinUsers++
+		}
+	}
+	if stdinUsers > 1 {
+		slog.Error("only one of -list, -checksums, -checksums-secondary and -license-filter can read stdin (-)")
+		os.Exit(2)
+	}
+
+	if *pruneDry {
+		if *indexDir == "" {
+			slog.Error("-prune-dry-run requires -index-dir")
+			os.Exit(2)
+		}
+		dl := downloader.NewDownloader(*outDir, 1, time.Second, nil, io.Discard, nil)
+		dl.SetNormalizeCase(*normCase)
+		dl.SetStoreTransform(storeTr)
+		dl.SetNameRegex(nameRe)
+		dl.SetRoutes(routes)
+		entries, total, err := dl.PrunePlan(*indexDir, *baseURL, index.Layout(*idxFormat))
+		if err != nil {
+			slog.Error("prune preview failed", "err", err)
+			os.Exit(1)
+		}
+		out := bufio.NewWriter(os.Stdout)
+		if err := downloader.WritePrunePlan(out, entries, total); err == nil {
+			err = out.Flush()
+		}
+		if err != nil {
+			slog.Error("write prune preview failed", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *reconcile {
+		if *indexDir == "" {
+			slog.Error("-reconcile requires -index-dir")
+			os.Exit(2)
+		}
+		dl := downloader.NewDownloader(*outDir, 1, time.Second, nil, io.Discard, nil)
+		dl.SetNormalizeCase(*normCase)
+		dl.SetStoreTransform(storeTr)
+		dl.SetNameRegex(nameRe)
+		dl.SetRoutes(routes)
+		rep, err := dl.Reconcile(*indexDir, *baseURL, index.Layout(*idxFormat))
+		if err != nil {
+			slog.Error("reconcile failed", "err", err)
+			os.Exit(1)
+		}
+		rep.Print(os.Stdout)
+		if !rep.Complete() {
+			os.Exit(1)
+		}
+		return
+	}
 
 	var (
 		urls []string
 		sums map[string]string
-		err  error
 	)
 
+	var (
+		indexHead string
+		sideW     *sidecar.Writer
+		started   = time.Now() // before the index is read; see -run-json
+	)
+	// -count-only and -dry-run only read the index; the per-entry writers
+	// are left out so neither mode touches the mirror.
+	writeOut := !*countOnly && !*dryRun
+	var catalog *downloader.Catalog
+	if *catalogOut != "" && writeOut {
+		if catalog, err = downloader.LoadCatalog(*catalogOut); err != nil {
+			slog.Error("read catalog failed", "path", *catalogOut, "err", err)
+			os.Exit(1)
+		}
+	}
+	var registry *downloader.LocalRegistry
+	if *localReg != "" && *indexDir == "" {
+		slog.Error("-emit-local-registry requires -index-dir")
+		os.Exit(2)
+	}
+	if *localReg != "" && writeOut {
+		if registry, err = downloader.NewLocalRegistry(*localReg, *localRegDL); err != nil {
+			slog.Error("local registry init failed", "dir", *localReg, "err", err)
+			os.Exit(1)
+		}
+	}
 	if *indexDir != "" {
-		urls, sums, err = downloader.ReadCratesFromIndex(*indexDir, *baseURL, *includeY, *limit)
+		opts := downloader.IndexOptions{BaseURL: *baseURL, IncludeYanked: *includeY, Limit: *limit, CrateLimit: *crateLimit, Strict: *strict}
+		opts.SkipPrerelease, opts.MinVersion = *skipPre, *minVersion
+		opts.ValidateUTF8 = *validUTF8
+		if *licenseMap != "" {
+			if *licDeny == "" && *licAllow == "" {
+				slog.Error("-license-filter needs -license-deny or -license-allow")
+				os.Exit(2)
+			}
+			licenses, err := downloader.ReadLicenseMap(*licenseMap)
+			if err != nil {
+				slog.Error("read license map failed", "path", *licenseMap, "err", err)
+				os.Exit(1)
+			}
+			if opts.License, err = downloader.NewLicenseFilter(licenses, strings.Split(*licDeny, ","), strings.Split(*licAllow, ",")); err != nil {
+				slog.Error("invalid license pattern", "err", err)
+				os.Exit(2)
+			}
+		}
+		opts.Walk = index.Options{SkipFiles: skipFiles, SkipDirs: skipDirs, Include: includes, Exclude: excludes, Layout: index.Layout(*idxFormat)}
+		if *withSide && writeOut {
+			if sideW, err = sidecar.NewWriter(sidecar.Config{OutDir: *outDir, IncludeYanked: *includeY, BaseURL: *baseURL, NormalizeCase: *normCase, NameTemplate: *sideTmpl, Subdir: *sideSub}); err != nil {
+				slog.Error("sidecar init failed", "err", err)
+				os.Exit(1)
+			}
+			opts.OnEntry = sideW.WriteLine
+		}
+		if catalog != nil {
+			if next := opts.OnEntry; next != nil {
+				opts.OnEntry = func(rel string, line []byte) {
+					catalog.AddIndexLine(rel, line)
+					next(rel, line)
+				}
+			} else {
+				opts.OnEntry = catalog.AddIndexLine
+			}
+		}
+		if registry != nil {
+			if next := opts.OnEntry; next != nil {
+				opts.OnEntry = func(rel string, line []byte) {
+					registry.AddIndexLine(rel, line)
+					next(rel, line)
+				}
+			} else {
+				opts.OnEntry = registry.AddIndexLine
+			}
+		}
+		since := *sinceSHA
+		if *stateFile != "" {
+			if indexHead, err = downloader.IndexHead(*indexDir); err != nil {
+				slog.Error("read index HEAD failed", "err", err)
+				os.Exit(1)
+			}
+			if since == "" {
+				if since, err = downloader.ReadIndexState(*stateFile); err != nil {
+					slog.Error("read state file failed", "path", *stateFile, "err", err)
+					os.Exit(1)
+				}
+			}
+		}
+		if since != "" {
+			if opts.Files, err = downloader.ChangedIndexFiles(*indexDir, since); err != nil {
+				slog.Error("list changed index files failed", "since", since, "err", err)
+				os.Exit(1)
+			}
+			slog.Info("incremental index read", "since", since, "changed_files", len(opts.Files))
+		}
+		res, err := downloader.ReadIndex(*indexDir, opts)
 		if err != nil {
 			slog.Error("read index failed", "err", err)
 			os.Exit(1)
 		}
+		urls, sums = res.URLs, res.Checksums
+		if res.Rejected > 0 {
+			slog.Warn("index lines rejected by -validate-utf8", "count", res.Rejected)
+		}
+		if opts.License != nil {
+			slog.Info("license_filter", "skipped_versions", res.LicenseSkipped, "skipped_crates", res.LicenseSkippedCrates)
+		}
+		if len(res.EmptyFiles) > 0 {
+			slog.Info("index files with no usable entries", "count", len(res.EmptyFiles), "invalid", len(res.InvalidFiles))
+		}
+		if *emptyOut != "" {
+			if err := writeLines(*emptyOut, res.EmptyFiles); err != nil {
+				slog.Error("write empty files list failed", "path", *emptyOut, "err", err)
+				os.Exit(1)
+			}
+		}
 		if *checksPath != "" {
-			fileSums, err := downloader.ReadChecksums(*checksPath)
+			fileSums, err := downloader.ReadChecksumsWithOptions(*checksPath, downloader.ChecksumOptions{Workers: *csWorkers, ValidateUTF8: *validUTF8})
 			if err != nil {
 				slog.Error("read checksums failed", "err", err)
 				os.Exit(1)
@@ -116,26 +705,132 @@ func main() {
 			slog.Error("read list failed", "err", err)
 			os.Exit(1)
 		}
-		sums, err = downloader.ReadChecksums(*checksPath)
+		sums, err = downloader.ReadChecksumsWithOptions(*checksPath, downloader.ChecksumOptions{Workers: *csWorkers, ValidateUTF8: *validUTF8})
 		if err != nil {
 			slog.Error("read checksums failed", "err", err)
 			os.Exit(1)
 		}
 	}
 
-	bndl, err := downloader.NewBundler(*bundle, *bundlesOut, *bundleGB)
+	var secondSums map[string]string
+	if *checks2 != "" {
+		if secondSums, err = downloader.ReadChecksumsWithOptions(*checks2, downloader.ChecksumOptions{Workers: *csWorkers, ValidateUTF8: *validUTF8}); err != nil {
+			slog.Error("read secondary checksums failed", "path", *checks2, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if *reqHTTPS {
+		if err := downloader.RequireHTTPS(urls); err != nil {
+			slog.Error("-require-https", "err", err)
+			os.Exit(2)
+		}
+	}
+
+	if *countOnly {
+		dl := downloader.NewDownloader(*outDir, 1, time.Duration(*timeoutSec)*time.Second, nil, io.Discard, nil)
+		tuneTransport(dl)
+		dl.SetAllowedHosts(allowHosts)
+		dl.SetNameRegex(nameRe)
+		rep := dl.CountURLs(urls)
+		dl.SampleSizes(context.Background(), &rep, urls, *countHEAD)
+		rep.Print(os.Stdout)
+		return
+	}
+
+	if sideW != nil {
+		st := sideW.Stats()
+		slog.Info("sidecars written", "wrote", st.Wrote, "skipped", st.Skipped, "errors", st.Errors)
+	}
+	commit := *idxCommit
+	if commit == "" {
+		commit = indexHead
+	}
+	if commit == "" && *indexDir != "" && *runJSON != "" {
+		if commit, err = downloader.IndexHead(*indexDir); err != nil {
+			slog.Warn("index commit unknown", "index_dir", *indexDir, "err", err, "hint", "pass -index-commit to record it")
+		}
+	}
+	// finish writes what every run leaves behind, downloads or not: the
+	// catalog, the local registry and the -run-json summary. dl is nil when
+	// nothing was downloaded.
+	finish := func(dl *downloader.Downloader, runErr error) {
+		if catalog != nil {
+			if err := catalog.WriteFile(*catalogOut); err != nil {
+				slog.Error("write catalog failed", "path", *catalogOut, "err", err)
+				os.Exit(1)
+			}
+		}
+		closeLocalRegistry(registry, *localReg)
+		if *runJSON == "" {
+			return
+		}
+		info := downloader.RunInfo{
+			IndexDir:    *indexDir,
+			IndexCommit: commit,
+			StartedAt:   started.UTC().Format(time.RFC3339),
+			FinishedAt:  time.Now().UTC().Format(time.RFC3339),
+			URLs:        len(urls),
+		}
+		if dl != nil {
+			info.Manifest = *manifest
+			info.Processed, info.OK, info.Errors = dl.Counts()
+			info.Bytes = dl.BytesDownloaded()
+		}
+		if runErr != nil {
+			info.Error = runErr.Error()
+		}
+		if err := downloader.WriteRunInfo(*runJSON, info); err != nil {
+			slog.Error("write run info failed", "path", *runJSON, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if *dryRun {
+		// Basic validation and estimation
+		if *indexDir == "" && *listPath == "" {
+			fmt.Println("dry-run: provide -index-dir or -list")
+			os.Exit(2)
+		}
+		if *indexDir != "" {
+			if fi, err := os.Stat(*indexDir); err != nil || !fi.IsDir() {
+				fmt.Println("dry-run: index-dir not found or not a directory")
+				os.Exit(1)
+			}
+		}
+		// Nothing under -out is created or changed: no bundle recovery, no
+		// manifest, no directories.
+		if fi, err := os.Stat(*outDir); err == nil && !fi.IsDir() {
+			fmt.Println("dry-run: out is not a directory:", *outDir)
+			os.Exit(1)
+		}
+		fmt.Printf("dry-run ok: urls=%d concurrency=%d out=%s\n", len(urls), *conc, *outDir)
+		return
+	}
+
+	if !*withDL {
+		finish(nil, nil)
+		return
+	}
+
+	bndl, err := downloader.NewBundlerBytes(*bundle, *bundlesOut, bundleBytes, format)
 	if err != nil {
 		slog.Error("bundler init failed", "err", err)
 		os.Exit(1)
 	}
 	defer bndl.Close()
+	bndl.SetHeaderLayout(headerLayout, *outDir)
+	bndl.SetGroupBy(bundleGroup, groupSlackBytes)
+	if err := bndl.SetSkipBundled(*skipBndl); err != nil {
+		slog.Error("bundler init failed", "err", err)
+		os.Exit(1)
+	}
 
-	recFile, err := os.Create(*manifest)
+	recFile, err := downloader.OpenManifest(*manifest, *manAppend)
 	if err != nil {
-		slog.Error("create manifest failed", "err", err)
+		slog.Error("open manifest failed", "err", err)
 		os.Exit(1)
 	}
-	defer recFile.Close()
 
 	dl := downloader.NewDownloader(*outDir, *conc, time.Duration(*timeoutSec)*time.Second, sums, recFile, bndl)
 	if *progEvery > 0 {
@@ -147,6 +842,51 @@ func main() {
 	if *retries >= 0 {
 		dl.SetRetries(*retries)
 	}
+	dl.SetNormalizeCase(*normCase)
+	dl.SetNameRegex(nameRe)
+	dl.SetRoutes(routes)
+	dl.SetChecksumRetries(*csRetries)
+	dl.SetPerURLDeadline(*urlDL)
+	if *cleanTemps {
+		dl.SetCleanTemps(*cleanAge)
+	}
+	dl.SetValidateGzip(*validGzip)
+	dl.SetDeepVerify(*deepVerify)
+	dl.SetHardlinkDupes(*hardlinks)
+	dl.SetWriteProvenance(*writeProv)
+	dl.SetManifestPerShard(*perShard)
+	dl.SetTempSuffix(*tmpSuffix)
+	dl.SetStoreTransform(storeTr)
+	dl.SetExemplars(*exemplars)
+	dl.SetTraceExemplars(*traceExs)
+	dl.SetMaxTotalBytes(byteBudget)
+	dl.SetMaxCreatesPerSec(*maxCreates)
+	dl.SetChannelBuffers(*urlBuf, *resultBuf)
+	dl.SetManifestCollectors(*collectors)
+	dl.SetManifestFields(fields)
+	dl.SetFailOnManifestError(*manFail)
+	dl.SetStrictCount(*strictCnt)
+	if *sizeHints != "" {
+		hints, err := downloader.LoadSizeHints(*sizeHints)
+		if err != nil {
+			slog.Error("load size hints failed", "path", *sizeHints, "err", err)
+			os.Exit(1)
+		}
+		dl.SetSizeHints(hints)
+	}
+	dl.SetFinalRetries(*finRounds, *finDelay)
+	dl.SetSecondaryChecksums(secondSums)
+	dl.SetVerifySample(*samplePct, *sampleStr)
+	dl.SetVerifyConcurrency(*verifyConc)
+	dl.SetScanCommand(strings.Fields(*scanCmd))
+	if *sideDir != "" {
+		src, err := sidecar.NewChecksumSource(sidecar.Config{OutDir: *sideDir, NormalizeCase: *normCase, NameTemplate: *sideTmpl, Subdir: *sideSub})
+		if err != nil {
+			slog.Error("sidecar checksum source failed", "dir", *sideDir, "err", err)
+			os.Exit(1)
+		}
+		dl.SetChecksumLookup(src.Checksum)
+	}
 	if *retryBase > 0 {
 		dl.SetRetryBase(*retryBase)
 	}
@@ -154,51 +894,125 @@ func main() {
 		dl.SetRetryMax(*retryMax)
 	}
 
-	if tr, ok := dl.HTTPTransport().(*http.Transport); ok {
-		if *maxConnsPH > 0 {
-			tr.MaxConnsPerHost = *maxConnsPH
-		}
-		if *maxIdle > 0 {
-			tr.MaxIdleConns = *maxIdle
-		}
-		if *maxIdlePH > 0 {
-			tr.MaxIdleConnsPerHost = *maxIdlePH
+	tuneTransport(dl)
+	dl.SetMetricHosts(append([]string{*baseURL}, metricHosts...)...)
+	dl.SetAllowedHosts(allowHosts)
+
+	if *listenAddr != "" {
+		if err := downloader.StartMetricsServer(*listenAddr); err != nil {
+			if *listenReq {
+				slog.Error("metrics server failed", "err", err)
+				os.Exit(1)
+			}
+			slog.Warn("metrics server disabled", "err", err, "hint", "pick another -listen address, or set -listen-required to make this fatal")
 		}
-		if *idleTO > 0 {
-			tr.IdleConnTimeout = *idleTO
+	}
+
+	if (*preflight || *h1Conns > 0) && len(urls) > 0 {
+		if _, err := dl.Preflight(context.Background(), urls[0], *h1Conns); err != nil {
+			slog.Warn("preflight failed", "url", urls[0], "err", err)
 		}
-		if *tlsTO > 0 {
-			tr.TLSHandshakeTimeout = *tlsTO
+	}
+
+	if *eventsDB != "" {
+		sink, err := downloader.OpenSQLiteEvents(*eventsDB)
+		if err != nil {
+			slog.Error("events database failed", "path", *eventsDB, "err", err)
+			os.Exit(1)
 		}
+		dl.SetEventSink(sink)
 	}
 
-	if *listenAddr != "" {
-		downloader.StartMetricsServer(*listenAddr)
+	dl.SetCatalog(catalog)
+	if registry != nil {
+		dl.SetLocalRegistry(registry)
+	}
+	ctx := context.Background()
+	runErr := dl.Run(ctx, urls)
+	// Close before any exit so a compressed manifest gets its trailer.
+	if err := recFile.Close(); err != nil {
+		slog.Error("close manifest failed", "path", *manifest, "err", err)
+		os.Exit(1)
+	}
+	finish(dl, runErr)
+	if runErr != nil {
+		fmt.Println("error:", runErr)
+		os.Exit(1)
 	}
 
-	if *dryRun {
-		// Basic validation and estimation
-		if *indexDir == "" && *listPath == "" {
-			fmt.Println("dry-run: provide -index-dir or -list")
-			os.Exit(2)
-		}
-		if *indexDir != "" {
-			if fi, err := os.Stat(*indexDir); err != nil || !fi.IsDir() {
-				fmt.Println("dry-run: index-dir not found or not a directory")
-				os.Exit(1)
+	if *stateFile != "" && indexHead != "" {
+		// Only advance the state when everything landed; otherwise the next
+		// incremental run would never revisit the failed or filtered files.
+		var filters []string
+		for _, f := range []struct {
+			name string
+			set  bool
+		}{
+			{"-limit", *limit > 0},
+			{"-crate-limit", *crateLimit > 0},
+			{"-index-include", len(includes) > 0},
+			{"-index-exclude", len(excludes) > 0},
+			{"-index-skip", len(skipFiles) > 0},
+			{"-index-skip-dir", len(skipDirs) > 0},
+			{"-skip-prerelease", *skipPre},
+			{"-min-version", *minVersion != ""},
+			{"-license-filter", *licenseMap != ""},
+		} {
+			if f.set {
+				filters = append(filters, f.name)
 			}
 		}
-		if err := os.MkdirAll(*outDir, 0o755); err != nil {
-			fmt.Println("dry-run: create out dir:", err)
+		if _, _, errc := dl.Counts(); errc > 0 {
+			slog.Warn("state not updated: run had errors", "errors", errc, "state_file", *stateFile)
+		} else if len(filters) > 0 {
+			slog.Warn("state not updated: run did not cover the whole index", "filters", strings.Join(filters, ","), "state_file", *stateFile)
+		} else if dl.BudgetReached() {
+			slog.Warn("state not updated: -max-total-bytes stopped the run early", "state_file", *stateFile)
+		} else if err := downloader.WriteIndexState(*stateFile, indexHead); err != nil {
+			slog.Error("write state file failed", "path", *stateFile, "err", err)
 			os.Exit(1)
+		} else {
+			slog.Info("index state updated", "commit", indexHead, "state_file", *stateFile)
 		}
-		fmt.Printf("dry-run ok: urls=%d concurrency=%d out=%s\n", len(urls), *conc, *outDir)
-		return
 	}
 
-	ctx := context.Background()
-	if err := dl.Run(ctx, urls); err != nil {
-		fmt.Println("error:", err)
+	if total, ok, _ := dl.Counts(); *minRatio > 0 && total > 0 {
+		if ratio := float64(ok) / float64(total); ratio < *minRatio {
+			slog.Error("success ratio below -min-success-ratio", "ok", ok, "total", total, "ratio", fmt.Sprintf("%.3f", ratio), "min", *minRatio)
+			os.Exit(1)
+		}
+	}
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// writeLines writes one entry per line to path.
+func writeLines(path string, lines []string) error {
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(l)
+		b.WriteByte('\n')
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
+
+// closeLocalRegistry finishes an -emit-local-registry directory, if any.
+func closeLocalRegistry(r *downloader.LocalRegistry, dir string) {
+	if r == nil {
+		return
+	}
+	crates, linked, errs, err := r.Close()
+	if err != nil {
+		slog.Error("write local registry failed", "dir", dir, "err", err)
 		os.Exit(1)
 	}
+	slog.Info("local registry written", "dir", dir, "crates", crates, "linked", linked, "errors", errs)
 }
@@ -8,6 +8,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/index"
 	"github.com/APTlantis/Mirror-Rust-Crates/internal/sidecar"
 )
 
@@ -21,11 +22,34 @@ func main() {
 		limitFlag        = flag.Int64("limit", 0, "Limit number of entries to write (0 = all)")
 		conc             = flag.Int("concurrency", defaultConcurrency, "Number of concurrent index-file workers")
 		baseURL          = flag.String("crates-base-url", "https://static.crates.io/crates", "Base URL for crates content")
+		publicURL        = flag.String("public-base-url", "", "Also write public_url under this base, e.g. the mirror's public address; crate_url keeps -crates-base-url")
 		logFormat        = flag.String("log-format", "text", "Logging format: text|json")
 		logLevel         = flag.String("log-level", "info", "Logging level: debug|info|warn|error")
 		progressInterval = flag.Duration("progress-interval", 0, "Periodic progress logging interval (e.g., 5s; 0=disabled)")
 		progressEvery    = flag.Int("progress-every", 0, "Log progress every N processed items (0=disabled)")
+		emptyOut         = flag.String("empty-files-out", "", "Write index files that produced no sidecar candidates to this path (one per line)")
+		normalizeCase    = flag.Bool("normalize-case", false, "Lowercase crate names in shard dirs and sidecar names (for case-insensitive filesystems)")
+		crateSums        = flag.Bool("write-crate-checksums", false, "Also write {crate}.checksums.json mapping each written version to its cksum")
+		verifyURLs       = flag.Bool("verify-urls", false, fmt.Sprintf("HEAD-check %d random crate_urls before writing and abort if none resolve", sidecar.DefaultVerifySample))
+		nameTemplate     = flag.String("sidecar-name-template", sidecar.DefaultNameTemplate, "Sidecar file name with {name} and {version} placeholders")
+		subdir           = flag.String("sidecar-subdir", "", "Write sidecars into this subdirectory of each crate's shard directory (e.g. .cache)")
+		precount         = flag.Bool("precount", false, "Count index entries first (an extra read of the index) so progress shows percent and ETA")
+		depsGraph        = flag.String("deps-graph", "", "Also write every dependency edge (from, from_version, to, req, kind, optional) to this JSONL file")
+		resumeFrom       = flag.String("resume-from", "", "Skip crates whose name sorts at or before this one (use last_crate from a previous -limit run)")
+		tmpSuffix        = flag.String("tmp-suffix", sidecar.DefaultTempSuffix, "Suffix for sidecars being written; a random token is added before it so names stay unique")
+		tmpMaxAge        = flag.Duration("tmp-max-age", sidecar.DefaultTempMaxAge, "At startup, remove sidecar temp files under -out left by crashed runs once unmodified this long; younger ones may belong to a concurrent run")
+		indexFormat      = flag.String("index-format", "sharded", "Index layout: sharded (crates.io git tree), flat (files directly in -index-dir) or single (-index-dir is one JSONL file)")
+		stamp            = flag.Bool("stamp", false, "Add generated_at (RFC3339) and generator_version to every sidecar written")
+		update           = flag.Bool("update", false, "Rewrite sidecars that already exist instead of skipping them")
+		strict           = flag.Bool("strict", false, "Fail on the first malformed or schema-invalid index line, or unreadable index file, instead of skipping it")
+		minInodes        = flag.Int64("min-free-inodes", 0, "Before writing, abort if the -out filesystem would have fewer free inodes than this after one new file per index entry (0 = only warn when -precount shows too few)")
+		statsOnly        = flag.Bool("stats-only", false, "Count crates, versions and yanked versions in the index, print them with a per-first-letter breakdown, then exit without writing anything")
 	)
+	var skipFiles, skipDirs, includes, excludes stringList
+	flag.Var(&skipFiles, "index-skip", "Glob of index file names to ignore, in addition to the built-ins (repeatable)")
+	flag.Var(&skipDirs, "index-skip-dir", "Glob of index directory names to prune, in addition to .git/.github (repeatable)")
+	flag.Var(&includes, "index-include", "Only read index files whose path relative to -index-dir (or a leading directory of it) matches this glob, e.g. a* (repeatable)")
+	flag.Var(&excludes, "index-exclude", "Skip index files whose relative path (or a leading directory of it) matches this glob (repeatable)")
 	flag.Parse()
 
 	lvl := slog.LevelInfo
@@ -62,13 +86,70 @@ func main() {
 		Limit:            *limitFlag,
 		Concurrency:      *conc,
 		BaseURL:          *baseURL,
+		PublicBaseURL:    *publicURL,
 		ProgressInterval: *progressInterval,
 		ProgressEvery:    *progressEvery,
+		NormalizeCase:    *normalizeCase,
+		Strict:           *strict,
+		CrateChecksums:   *crateSums,
+		NameTemplate:     *nameTemplate,
+		Subdir:           *subdir,
+		Precount:         *precount,
+		DepsGraph:        *depsGraph,
+		ResumeFrom:       *resumeFrom,
+		TempSuffix:       *tmpSuffix,
+		TempMaxAge:       *tmpMaxAge,
+		Stamp:            *stamp,
+		Update:           *update,
+		MinFreeInodes:    *minInodes,
+		Walk:             index.Options{SkipFiles: skipFiles, SkipDirs: skipDirs, Include: includes, Exclude: excludes, Layout: index.Layout(*indexFormat)},
+	}
+	if *verifyURLs {
+		cfg.VerifyURLs = sidecar.DefaultVerifySample
 	}
 
 	ctx := context.Background()
-	if _, err := sidecar.Generate(ctx, cfg); err != nil {
+	if *statsOnly {
+		st, err := sidecar.ScanIndex(ctx, cfg)
+		if err != nil {
+			slog.Error("index scan failed", "err", err)
+			os.Exit(1)
+		}
+		st.Print(os.Stdout)
+		return
+	}
+	stats, err := sidecar.Generate(ctx, cfg)
+	if err != nil {
 		slog.Error("sidecar generation failed", "err", err)
 		os.Exit(1)
 	}
+	if *limitFlag > 0 && stats.LastCrate != "" {
+		slog.Info("to continue this limited run, pass -resume-from", "crate", stats.LastCrate)
+	}
+	if *emptyOut != "" {
+		if err := writeLines(*emptyOut, stats.EmptyFiles); err != nil {
+			slog.Error("write empty files list failed", "path", *emptyOut, "err", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// writeLines writes one entry per line to path.
+func writeLines(path string, lines []string) error {
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(l)
+		b.WriteByte('\n')
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o644)
 }
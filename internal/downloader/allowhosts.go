@@ -0,0 +1,83 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// StatusHostNotAllowed marks a record whose URL names a host outside the
+// SetAllowedHosts list; nothing was fetched or read for it.
+const StatusHostNotAllowed = "host-not-allowed"
+
+// ErrHostNotAllowed is returned for URLs and connections to hosts outside
+// the SetAllowedHosts list.
+var ErrHostNotAllowed = errors.New("host not allowed")
+
+// SetAllowedHosts restricts the downloader to the given hosts. An entry is a
+// host name or IP, matched case-insensitively and on any port, or
+// "*.example.com" for every subdomain of example.com. URLs naming another
+// host are recorded with StatusHostNotAllowed without being fetched, and the
+// dialer refuses connections to other hosts too, which also stops redirects
+// and probes from leaving the list. With an HTTP proxy the proxy host must be
+// listed as well. Call it before Run; an empty list allows every host.
+func (d *Downloader) SetAllowedHosts(hosts []string) {
+	d.allowedHosts = nil
+	for _, h := range hosts {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			d.allowedHosts = append(d.allowedHosts, h)
+		}
+	}
+	tr, ok := d.client.Transport.(*http.Transport)
+	if !ok || len(d.allowedHosts) == 0 {
+		return
+	}
+	if d.dialNoGuard == nil {
+		d.dialNoGuard = tr.DialContext
+	}
+	dial := d.dialNoGuard
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if !d.hostAllowed(host) {
+			return nil, fmt.Errorf("%w: dial %s", ErrHostNotAllowed, addr)
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// hostAllowed reports whether host (without a port) passes SetAllowedHosts.
+func (d *Downloader) hostAllowed(host string) bool {
+	if len(d.allowedHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	for _, h := range d.allowedHosts {
+		if suffix, ok := strings.CutPrefix(h, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == strings.Trim(h, "[]") {
+			return true
+		}
+	}
+	return false
+}
+
+// urlHostAllowed checks the host of a worklist URL; unparseable URLs fail.
+func (d *Downloader) urlHostAllowed(u string) (string, bool) {
+	if len(d.allowedHosts) == 0 {
+		return "", true
+	}
+	pu, err := url.Parse(u)
+	if err != nil {
+		return u, false
+	}
+	return pu.Hostname(), pu.Hostname() != "" && d.hostAllowed(pu.Hostname())
+}
@@ -0,0 +1,178 @@
+package downloader
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// StatusBadGzip marks a record whose file passed (or had no) checksum
+// verification but does not decompress as gzip; see SetValidateGzip.
+const StatusBadGzip = "bad-gzip"
+
+// StatusBadArchive marks a record whose file decompresses but is not a
+// well-formed crate tarball; see SetValidateGzip.
+const StatusBadArchive = "bad-archive"
+
+// errBadGzip wraps archive check failures of the gzip layer itself, which
+// are recorded with StatusBadGzip.
+var errBadGzip = errors.New("invalid gzip")
+
+// StatusReadError marks a record whose stored file could not be read back
+// for verification, as opposed to one whose checksum did not match.
+const StatusReadError = "read-error"
+
+// verifyReadAttempts bounds the reads of a stored file that fails with an
+// I/O error; verifyReadBackoff times the attempt number is waited between.
+const (
+	verifyReadAttempts = 3
+	verifyReadBackoff  = 100 * time.Millisecond
+)
+
+// QuarantineDirName is the directory under the output dir that holds files
+// which failed SetValidateGzip, at their usual relative paths.
+const QuarantineDirName = ".quarantine"
+
+// SetValidateGzip makes verification also read every crate file, downloaded
+// or already on disk, as a gzip-compressed tarball, in the same pass that
+// hashes it. The stream must decompress cleanly and contain a top-level
+// Cargo.toml. This catches garbage even when no checksum is known. Existing
+// files that fail are downloaded again; new downloads that fail are recorded
+// with StatusBadGzip (the stream does not decompress) or StatusBadArchive
+// and moved under QuarantineDirName. Files changed by
+// -store-transform and empty files are not checked.
+func (d *Downloader) SetValidateGzip(on bool) {
+	d.validateGzip = on
+}
+
+// verifyStored is verifyFile for a file of the given size that, with
+// SetValidateGzip, also reports in archErr why the same bytes are not a
+// crate archive. A file that cannot be read is retried a few times and then
+// reported in readErr rather than as a mismatch, since the bytes on disk may
+// well be fine.
+func (d *Downloader) verifyStored(path, url string, size int64) (ok bool, sum string, archErr, readErr error) {
+	check := d.archiveCheckFor(url)
+	if d.transformed() || size <= 0 {
+		check = nil
+	}
+	for attempt := 1; ; attempt++ {
+		sum, archErr, readErr = d.readStored(path, check)
+		if readErr == nil {
+			return d.sumMatches(url, sum), sum, archErr, nil
+		}
+		if attempt == verifyReadAttempts || errors.Is(readErr, fs.ErrNotExist) {
+			return false, "", nil, readErr
+		}
+		slog.Warn("verify_read_retry", "path", path, "attempt", attempt, "max", verifyReadAttempts, "err", readErr)
+		time.Sleep(time.Duration(attempt) * verifyReadBackoff)
+	}
+}
+
+// readStored hashes the stored file at path and, if check is not nil,
+// checks it with checkCrateArchive while reading.
+func (d *Downloader) readStored(path string, check *archiveCheck) (sum string, archErr, err error) {
+	f, err := d.storage().Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	r := io.TeeReader(f, h)
+	if check != nil {
+		archErr = checkCrateArchive(r, *check)
+	}
+	// Hash whatever the archive reader did not consume.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), archErr, nil
+}
+
+// checkCrateArchive reads r to the end as a gzip-compressed tarball and
+// fails unless it has a Cargo.toml one directory deep ("name-version/").
+// With a crate name in want, the SetDeepVerify checks apply too. Failures of
+// the gzip stream wrap errBadGzip and take precedence over the tar errors
+// they cause.
+func checkCrateArchive(r io.Reader, want archiveCheck) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errBadGzip, err)
+	}
+	err = checkCrateTar(zr, want)
+	// Read past the tar end marker so the gzip checksum is verified too.
+	if _, gerr := io.Copy(io.Discard, zr); gerr != nil {
+		return fmt.Errorf("%w: %v", errBadGzip, gerr)
+	}
+	return err
+}
+
+// checkCrateTar reads the tar entries of a crate archive.
+func checkCrateTar(r io.Reader, want archiveCheck) error {
+	tr := tar.NewReader(r)
+	manifest := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		if err := want.checkIdentity(name); err != nil {
+			return err
+		}
+		if strings.Count(name, "/") == 1 && path.Base(name) == "Cargo.toml" {
+			if err := want.checkCargoToml(tr); err != nil {
+				return err
+			}
+			manifest = true
+		}
+	}
+	if !manifest {
+		return errors.New("no top-level Cargo.toml")
+	}
+	return nil
+}
+
+// quarantine moves the stored file at p, under output dir root, to the same
+// relative path under QuarantineDirName and returns the new path. It copies
+// rather than renames so any BlobStore can do it.
+func (d *Downloader) quarantine(root, p string) (string, error) {
+	rel, err := filepath.Rel(root, p)
+	if err != nil || !filepath.IsLocal(rel) {
+		rel = filepath.Base(p)
+	}
+	dst := filepath.Join(root, QuarantineDirName, rel)
+	in, err := d.storage().Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := d.storage().Create(dst)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = d.storage().Remove(dst)
+		return "", err
+	}
+	return dst, d.storage().Remove(p)
+}
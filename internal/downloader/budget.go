@@ -0,0 +1,27 @@
+package downloader
+
+import "log/slog"
+
+// SetMaxTotalBytes stops Run from dispatching new downloads once n body bytes
+// have been downloaded (0 = no limit). Downloads already in flight finish, so
+// a run can end up to concurrency files over the budget.
+func (d *Downloader) SetMaxTotalBytes(n int64) {
+	d.maxBytes = n
+}
+
+// BudgetReached reports whether the last Run stopped early because of
+// SetMaxTotalBytes. Such a run did not attempt every URL.
+func (d *Downloader) BudgetReached() bool {
+	return d.budgetHit.Load()
+}
+
+// overBudget is checked by the feeder before each URL is dispatched; it logs
+// once when the budget is hit, with the number of URLs left undone.
+func (d *Downloader) overBudget(remaining int) bool {
+	if d.maxBytes <= 0 || d.BytesDownloaded() < d.maxBytes {
+		return false
+	}
+	d.budgetHit.Store(true)
+	slog.Warn("byte_budget_reached", "max_total_bytes", d.maxBytes, "downloaded", d.BytesDownloaded(), "not_dispatched", remaining)
+	return true
+}
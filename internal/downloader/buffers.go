@@ -0,0 +1,32 @@
+package downloader
+
+// DefaultBufferPerWorker sizes the URL and result channels of a pass unless
+// SetChannelBuffers says otherwise: this many slots per worker.
+const DefaultBufferPerWorker = 2
+
+// SetChannelBuffers sets the capacity of the channel feeding URLs to workers
+// and of the one carrying records to the collector. Buffers let the feeder,
+// workers and collector run ahead of each other instead of handing over one
+// item at a time, which costs a scheduler round-trip per URL at high
+// concurrency. 0 makes a channel unbuffered; a negative size means
+// DefaultBufferPerWorker times the concurrency. With SetMaxTotalBytes the URL
+// channel stays unbuffered, so URLs queued ahead of the budget check cannot
+// overshoot it.
+func (d *Downloader) SetChannelBuffers(urls, results int) {
+	d.urlBuf, d.resultBuf = urls, results
+}
+
+// channelBuffers resolves the sizes set by SetChannelBuffers.
+func (d *Downloader) channelBuffers() (urls, results int) {
+	urls, results = d.urlBuf, d.resultBuf
+	if urls < 0 {
+		urls = DefaultBufferPerWorker * d.concurrency
+	}
+	if d.maxBytes > 0 {
+		urls = 0
+	}
+	if results < 0 {
+		results = DefaultBufferPerWorker * d.concurrency
+	}
+	return urls, results
+}
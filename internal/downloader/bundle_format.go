@@ -0,0 +1,53 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// BundleFormat selects the compression of bundle archives. Its value is also
+// the bundle file extension.
+type BundleFormat string
+
+const (
+	BundleTarZst BundleFormat = "tar.zst"
+	BundleTarBr  BundleFormat = "tar.br" // brotli, for serving bundles over HTTP
+)
+
+// ParseBundleFormat validates a -bundle-format value.
+func ParseBundleFormat(s string) (BundleFormat, error) {
+	switch f := BundleFormat(s); f {
+	case BundleTarZst, BundleTarBr:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown bundle format %q (want tar.zst or tar.br)", s)
+}
+
+// newWriter wraps w with the format's compressor.
+func (f BundleFormat) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch f {
+	case BundleTarZst:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	case BundleTarBr:
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression), nil
+	}
+	return nil, fmt.Errorf("unknown bundle format %q", string(f))
+}
+
+// newReader wraps r with the format's decompressor.
+func (f BundleFormat) newReader(r io.Reader) (io.ReadCloser, error) {
+	switch f {
+	case BundleTarZst:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case BundleTarBr:
+		return io.NopCloser(brotli.NewReader(r)), nil
+	}
+	return nil, fmt.Errorf("unknown bundle format %q", string(f))
+}
@@ -0,0 +1,87 @@
+package downloader
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// BundleGroupBy selects which files AddFile keeps in one bundle.
+type BundleGroupBy string
+
+const (
+	// GroupNone rotates bundles purely by size. This is the default.
+	GroupNone BundleGroupBy = ""
+	// GroupCrate keeps the versions of a crate together.
+	GroupCrate BundleGroupBy = "crate"
+	// GroupShard keeps the files of one shard directory (se/rd/) together.
+	GroupShard BundleGroupBy = "shard"
+)
+
+// ParseBundleGroupBy validates a -bundle-group-by value; "none" and "" mean
+// GroupNone.
+func ParseBundleGroupBy(s string) (BundleGroupBy, error) {
+	switch g := BundleGroupBy(s); g {
+	case GroupNone, GroupCrate, GroupShard:
+		return g, nil
+	case "none":
+		return GroupNone, nil
+	}
+	return "", fmt.Errorf("unknown bundle grouping %q (want none, crate or shard)", s)
+}
+
+// SetGroupBy makes AddFile put off rotating a full bundle while the next file
+// belongs to the same group as the previous one, so related files are not
+// split across bundles. A bundle may grow up to slackBytes past the target
+// this way; a group larger than that is split after all. Grouping works on
+// arrival order, which follows the index but interleaves a little with
+// concurrent downloads.
+func (b *Bundler) SetGroupBy(g BundleGroupBy, slackBytes int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.groupBy, b.groupSlack = g, max64(0, slackBytes)
+	b.lastGroup = ""
+}
+
+// groupKey is the group of the file at filePath, or "" without grouping.
+func (b *Bundler) groupKey(filePath string) string {
+	switch b.groupBy {
+	case GroupCrate:
+		return crateFromFileName(filepath.Base(filePath))
+	case GroupShard:
+		return filepath.Dir(filePath)
+	}
+	return ""
+}
+
+// keepGroupLocked reports whether a file of group key and size should go
+// into the current, full bundle to stay with the file before it. b.mu must
+// be held.
+func (b *Bundler) keepGroupLocked(key string, size int64) bool {
+	return key != "" && key == b.lastGroup && b.currentBytes > 0 &&
+		b.currentBytes+size <= b.targetBytes+b.groupSlack
+}
+
+// crateFromFileName returns the crate name of a stored file name such as
+// foo-bar-1.0.0-rc.1.crate (or a -store-transform .tar/.tar.zst): the part
+// before the first "-" that starts a valid SemVer version. Names that do not
+// parse are returned whole.
+func crateFromFileName(base string) string {
+	for i := strings.IndexByte(base, '-'); i > 0; {
+		rest := base[i+1:]
+		for _, ext := range []string{".crate", ".tar"} {
+			if j := strings.Index(rest, ext); j >= 0 {
+				rest = rest[:j]
+			}
+		}
+		if _, err := parseSemver(rest); err == nil {
+			return base[:i]
+		}
+		next := strings.IndexByte(base[i+1:], '-')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return base
+}
@@ -0,0 +1,52 @@
+package downloader
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// HeaderLayout selects the entry names written into bundles.
+type HeaderLayout string
+
+const (
+	// HeaderHost prefixes the file name with the download host
+	// (static.crates.io/serde-1.0.0.crate). This is the default.
+	HeaderHost HeaderLayout = "host"
+	// HeaderShard uses the path relative to the mirror root (se/rd/serde-1.0.0.crate),
+	// so extracted bundles drop straight into a mirror tree.
+	HeaderShard HeaderLayout = "shard"
+	// HeaderFlat uses the bare file name.
+	HeaderFlat HeaderLayout = "flat"
+)
+
+// ParseHeaderLayout validates a -bundle-header-layout value.
+func ParseHeaderLayout(s string) (HeaderLayout, error) {
+	switch l := HeaderLayout(s); l {
+	case HeaderHost, HeaderShard, HeaderFlat:
+		return l, nil
+	}
+	return "", fmt.Errorf("unknown bundle header layout %q (want host, shard or flat)", s)
+}
+
+// SetHeaderLayout chooses how entries are named. mirrorRoot is the download
+// output directory that HeaderShard names are relative to.
+func (b *Bundler) SetHeaderLayout(l HeaderLayout, mirrorRoot string) {
+	b.headerLayout, b.mirrorRoot = l, mirrorRoot
+}
+
+// headerName is the tar entry name for the file at path downloaded from url.
+func (b *Bundler) headerName(url, path string) string {
+	base := filepath.Base(path)
+	switch b.headerLayout {
+	case HeaderFlat:
+		return base
+	case HeaderShard:
+		if rel, err := filepath.Rel(b.mirrorRoot, path); err == nil && filepath.IsLocal(rel) {
+			return filepath.ToSlash(rel)
+		}
+		// Not under the mirror root (e.g. a moved manifest): rebuild the
+		// shard directory from the crate name.
+		return filepath.ToSlash(filepath.Join(crateDirFor(crateNameFromURL(url), ""), base))
+	}
+	return headerPathFor(url, base)
+}
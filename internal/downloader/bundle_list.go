@@ -0,0 +1,76 @@
+package downloader
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// BundleListEntry is one archive entry reported by ListBundles.
+type BundleListEntry struct {
+	Bundle string `json:"bundle"`
+	Name   string `json:"name"` // tar header name
+	Size   int64  `json:"size"`
+}
+
+// ListBundles calls fn for every entry of every bundle archive in dir, in
+// bundle and then archive order. Only the tar headers are read, streaming
+// through the decompressor, so nothing is extracted and the per-bundle
+// indexes are not consulted.
+func ListBundles(dir string, fn func(BundleListEntry) error) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	type archive struct {
+		num    int
+		name   string
+		format BundleFormat
+	}
+	var archives []archive
+	for _, e := range entries {
+		num, rest, ok := parseBundleName(e.Name())
+		if !ok || e.IsDir() {
+			continue
+		}
+		if f, err := ParseBundleFormat(rest); err == nil {
+			archives = append(archives, archive{num, e.Name(), f})
+		}
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].num < archives[j].num })
+	for _, a := range archives {
+		if err := listBundle(filepath.Join(dir, a.name), a.format, fn); err != nil {
+			return fmt.Errorf("%s: %w", a.name, err)
+		}
+	}
+	return nil
+}
+
+func listBundle(path string, format BundleFormat, fn func(BundleListEntry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := format.newReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(BundleListEntry{Bundle: filepath.Base(path), Name: hdr.Name, Size: hdr.Size}); err != nil {
+			return err
+		}
+	}
+}
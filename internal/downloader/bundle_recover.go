@@ -0,0 +1,384 @@
+package downloader
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// bundleFiles is what a bundle directory holds for one bundle number.
+type bundleFiles struct {
+	archive string // bundle-NNNN.tar.zst or .tar.br; "" if missing
+	format  BundleFormat
+	index   string // bundle-NNNN.index.jsonl; "" if missing
+}
+
+// recoverBundles returns the number of the next bundle to write in outDir so
+// a new run never overwrites earlier bundles. Rotation closes a bundle before
+// the next is created, so only the last one can be left half-written by a
+// crash. An archive that reads completely is always kept: a missing or
+// stale index is rebuilt from it. A truncated archive is discarded together
+// with its index, as is an empty trailing bundle, whose number is reused.
+func recoverBundles(outDir string) (int, error) {
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		return 0, err
+	}
+	bundles := make(map[int]*bundleFiles)
+	last := -1
+	for _, e := range entries {
+		num, rest, ok := parseBundleName(e.Name())
+		if !ok || e.IsDir() {
+			continue
+		}
+		bf := bundles[num]
+		if bf == nil {
+			bf = &bundleFiles{}
+			bundles[num] = bf
+		}
+		path := filepath.Join(outDir, e.Name())
+		if rest == "index.jsonl" {
+			bf.index = path
+		} else if f, err := ParseBundleFormat(rest); err == nil {
+			bf.archive, bf.format = path, f
+		} else {
+			continue
+		}
+		last = max(last, num)
+	}
+	if last < 0 {
+		return 0, nil
+	}
+
+	bf := bundles[last]
+	reason := ""
+	if bf.archive == "" {
+		reason = "archive missing"
+	} else {
+		if bf.index != "" {
+			n, ok, err := bundleClosed(bf.archive, bf.format, bf.index)
+			if err != nil {
+				return 0, err
+			}
+			if ok && n > 0 {
+				slog.Debug("bundle_recovered", "bundle", filepath.Base(bf.archive), "entries", n)
+				return last + 1, nil
+			}
+		}
+		got, err := readBundleArchive(bf.archive, bf.format)
+		switch {
+		case errors.Is(err, errBundleMismatch):
+			reason = err.Error()
+		case err != nil:
+			return 0, err
+		case len(got) == 0:
+			reason = "empty"
+		default:
+			if err := syncBundleIndex(bf.archive, bf.index, got); err != nil {
+				return 0, err
+			}
+			slog.Debug("bundle_recovered", "bundle", filepath.Base(bf.archive), "entries", len(got))
+			return last + 1, nil
+		}
+	}
+	for _, p := range []string{bf.archive, bf.index} {
+		if p == "" {
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			return 0, err
+		}
+	}
+	if reason != "empty" {
+		slog.Warn("bundle_discarded", "bundle", fmt.Sprintf("bundle-%04d", last), "reason", reason,
+			"hint", "files it held are still on disk; re-bundle them from the manifest")
+	}
+	return last, nil
+}
+
+// parseBundleName splits bundle-0003.tar.zst into 3 and "tar.zst".
+func parseBundleName(name string) (int, string, bool) {
+	rest, ok := strings.CutPrefix(name, "bundle-")
+	if !ok {
+		return 0, "", false
+	}
+	digits, ext, ok := strings.Cut(rest, ".")
+	if !ok {
+		return 0, "", false
+	}
+	num, err := strconv.Atoi(digits)
+	if err != nil || num < 0 {
+		return 0, "", false
+	}
+	return num, ext, true
+}
+
+var errBundleMismatch = errors.New("bundle does not match its index")
+
+// bundleClosed is the cheap check recoverBundles tries first. For tar.zst it
+// walks the zstd frame and block headers without decompressing: the tar end
+// is written before the compressed stream is closed, so a stream that ends
+// on a last block was finished cleanly. The index must parse and its last
+// line name this archive. ok is false when the check cannot tell (tar.br, or
+// anything unfinished), and n is the number of index entries.
+func bundleClosed(archive string, format BundleFormat, index string) (n int, ok bool, err error) {
+	if format != BundleTarZst {
+		return 0, false, nil
+	}
+	want, err := readBundleIndexFile(index)
+	if errors.Is(err, errBundleMismatch) || len(want) == 0 {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if want[len(want)-1].Bundle != filepath.Base(archive) {
+		return 0, false, nil
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	if fi.Size() == 0 || !zstdFramesComplete(f, fi.Size()) {
+		return 0, false, nil
+	}
+	return len(want), true, nil
+}
+
+// zstdFramesComplete reports whether r holds whole zstd frames (and
+// skippable frames) up to exactly size bytes, reading only their headers.
+func zstdFramesComplete(r io.ReaderAt, size int64) bool {
+	var buf [14]byte
+	read := func(off int64, n int) []byte {
+		if off+int64(n) > size {
+			return nil
+		}
+		if _, err := r.ReadAt(buf[:n], off); err != nil {
+			return nil
+		}
+		return buf[:n]
+	}
+	off := int64(0)
+	for off < size {
+		b := read(off, 4)
+		if b == nil {
+			return false
+		}
+		magic := binary.LittleEndian.Uint32(b)
+		if magic&0xFFFFFFF0 == 0x184D2A50 { // skippable frame
+			b = read(off+4, 4)
+			if b == nil {
+				return false
+			}
+			off += 8 + int64(binary.LittleEndian.Uint32(b))
+			continue
+		}
+		if magic != 0xFD2FB528 {
+			return false
+		}
+		b = read(off+4, 1)
+		if b == nil {
+			return false
+		}
+		fhd := b[0]
+		single := fhd&0x20 != 0
+		hdr := int64(1)
+		if !single {
+			hdr++ // window descriptor
+		}
+		hdr += [4]int64{0, 1, 2, 4}[fhd&3]
+		fcs := [4]int64{0, 2, 4, 8}[fhd>>6]
+		if fcs == 0 && single {
+			fcs = 1
+		}
+		off += 4 + hdr + fcs
+		for {
+			b = read(off, 3)
+			if b == nil {
+				return false
+			}
+			bh := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+			off += 3
+			switch (bh >> 1) & 3 {
+			case 0, 2: // raw, compressed
+				off += int64(bh >> 3)
+			case 1: // RLE
+				off++
+			default:
+				return false
+			}
+			if bh&1 != 0 {
+				break
+			}
+		}
+		if fhd&0x04 != 0 {
+			off += 4 // content checksum
+		}
+	}
+	return off == size
+}
+
+// readBundleIndexFile reads every entry of a bundle index. A line that does
+// not parse yields errBundleMismatch along with the entries before it.
+func readBundleIndexFile(index string) ([]BundleEntry, error) {
+	f, err := os.Open(index)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []BundleEntry
+	dec := json.NewDecoder(f)
+	for {
+		var e BundleEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return entries, fmt.Errorf("%w: index line %d: %v", errBundleMismatch, len(entries)+1, err)
+		}
+		entries = append(entries, e)
+	}
+}
+
+// readBundleArchive reads the whole archive and returns its entries, with
+// Source unset. A truncated archive yields errBundleMismatch; errors opening
+// it are returned as is.
+func readBundleArchive(archive string, format BundleFormat) ([]BundleEntry, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := format.newReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBundleMismatch, err)
+	}
+	defer zr.Close()
+	cr := &countReader{r: zr}
+	tr := tar.NewReader(cr)
+	var entries []BundleEntry
+	for {
+		before := cr.n
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			// tar.Reader also stops cleanly where an entry ends with no
+			// end marker (two zero blocks) after it, as a cut stream would.
+			if cr.n-before < 2*512 {
+				return nil, fmt.Errorf("%w: archive has no tar end marker", errBundleMismatch)
+			}
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: archive entry %d: %v", errBundleMismatch, len(entries)+1, err)
+		}
+		size, err := io.Copy(io.Discard, tr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: archive entry %d: %v", errBundleMismatch, len(entries)+1, err)
+		}
+		entries = append(entries, BundleEntry{Bundle: filepath.Base(archive), Name: hdr.Name, Size: size})
+	}
+	// The tar end marker can precede a truncated compressed stream.
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBundleMismatch, err)
+	}
+	return entries, nil
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// bundleMatchesIndex reads the whole archive and reports the number of
+// entries when it is complete and lists exactly the index entries, in order.
+// A truncated archive or index line yields errBundleMismatch; errors opening
+// either file are returned as is.
+func bundleMatchesIndex(archive string, format BundleFormat, index string) (int, error) {
+	want, err := readBundleIndexFile(index)
+	if err != nil {
+		return 0, err
+	}
+	got, err := readBundleArchive(archive, format)
+	if err != nil {
+		return 0, err
+	}
+	if err := sameBundleEntries(got, want); err != nil {
+		return 0, err
+	}
+	return len(got), nil
+}
+
+// sameBundleEntries compares archive entries with index entries by name and
+// size, in order.
+func sameBundleEntries(got, want []BundleEntry) error {
+	for i, e := range got {
+		if i >= len(want) || want[i].Name != e.Name || want[i].Size != e.Size {
+			return fmt.Errorf("%w: archive entry %d (%s) is not in the index", errBundleMismatch, i+1, e.Name)
+		}
+	}
+	if len(got) != len(want) {
+		return fmt.Errorf("%w: index lists %d entries, archive has %d", errBundleMismatch, len(want), len(got))
+	}
+	return nil
+}
+
+// syncBundleIndex rewrites the index of a complete archive whose entries are
+// got, unless index already lists exactly them. Sources are carried over
+// from the old index by entry name; entries it lacks have none.
+func syncBundleIndex(archive, index string, got []BundleEntry) error {
+	var old []BundleEntry
+	reason := "index missing"
+	if index != "" {
+		var err error
+		old, err = readBundleIndexFile(index)
+		if err != nil && !errors.Is(err, errBundleMismatch) {
+			return err
+		}
+		if err == nil {
+			if err = sameBundleEntries(got, old); err == nil {
+				return nil
+			}
+		}
+		reason = err.Error()
+	}
+	sources := make(map[string]string, len(old))
+	for _, e := range old {
+		sources[e.Name] = e.Source
+	}
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	for _, e := range got {
+		e.Source = sources[e.Name]
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	path := bundleIndexPath(archive)
+	if err := os.WriteFile(path+".tmp", []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		_ = os.Remove(path + ".tmp")
+		return err
+	}
+	slog.Warn("bundle_index_rebuilt", "bundle", filepath.Base(archive), "entries", len(got), "reason", reason)
+	return nil
+}
@@ -0,0 +1,47 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// ErrAlreadyBundled is returned by AddFile, with SetSkipBundled on, for a
+// header name that an existing or earlier bundle already holds.
+var ErrAlreadyBundled = errors.New("already bundled")
+
+// SetSkipBundled makes AddFile skip header names already listed in the bundle
+// indexes of the output directory, so a resumed run does not pack the same
+// file into a second bundle. The indexes are loaded once here; names added
+// afterwards are remembered as they are written.
+func (b *Bundler) SetSkipBundled(on bool) error {
+	if !b.enabled {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !on {
+		b.bundled = nil
+		return nil
+	}
+	bundled := make(map[string]struct{})
+	if err := ReadBundleIndexes(b.outDir, func(e BundleEntry) error {
+		bundled[e.Name] = struct{}{}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("load bundle indexes: %w", err)
+	}
+	b.bundled = bundled
+	slog.Info("bundle_index_loaded", "dir", b.outDir, "entries", len(bundled))
+	return nil
+}
+
+// alreadyBundledLocked reports whether headerName is in a bundle, for
+// SetSkipBundled. b.mu must be held.
+func (b *Bundler) alreadyBundledLocked(headerName string) bool {
+	if b.bundled == nil {
+		return false
+	}
+	_, ok := b.bundled[headerName]
+	return ok
+}
@@ -0,0 +1,66 @@
+package downloader
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+)
+
+// bundleJob is one finished file waiting to be added to a bundle.
+type bundleJob struct {
+	url, path, header string
+}
+
+// bundleQueueLen is how many finished files may wait for the bundler before
+// download workers block. Workers only stall once bundling has fallen this
+// far behind, which bounds memory without coupling every download to a bundle
+// write.
+func bundleQueueLen(concurrency int) int {
+	return max(64, 4*concurrency)
+}
+
+// startBundling moves bundle writes off the download workers: fetchOne queues
+// jobs and a single goroutine adds them (the Bundler serializes writes anyway).
+// The returned func closes the queue and waits for it to drain.
+func (d *Downloader) startBundling() (stop func()) {
+	if d.bundler == nil || !d.bundler.enabled {
+		return func() {}
+	}
+	ch := make(chan bundleJob, bundleQueueLen(d.concurrency))
+	d.bundleCh = ch
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for job := range ch {
+			d.addToBundle(job)
+		}
+	}()
+	return func() {
+		close(ch)
+		wg.Wait()
+		d.bundleCh = nil
+	}
+}
+
+// queueBundle hands a finished file to the bundler goroutine, or bundles it
+// inline when fetchOne runs outside Run. A full queue blocks the caller.
+func (d *Downloader) queueBundle(job bundleJob) {
+	if d.bundleCh != nil {
+		d.bundleCh <- job
+		return
+	}
+	d.addToBundle(job)
+}
+
+func (d *Downloader) addToBundle(job bundleJob) {
+	err := d.bundler.AddFile(job.path, job.header)
+	if errors.Is(err, ErrAlreadyBundled) {
+		slog.Debug("bundle_skip_existing", "url", job.url, "name", job.header)
+		return
+	}
+	if err != nil {
+		// Log but keep going
+		slog.Warn("bundle_failed", "url", job.url, "err", err.Error())
+	}
+}
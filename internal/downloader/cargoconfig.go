@@ -0,0 +1,96 @@
+package downloader
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CargoSourceStyle selects the kind of source WriteCargoSourceConfigStyle
+// points crates-io at.
+type CargoSourceStyle string
+
+const (
+	// CargoLocalRegistry is a `local-registry` source: a directory holding
+	// the .crate files next to an index/ tree. This is the default.
+	CargoLocalRegistry CargoSourceStyle = "local-registry"
+	// CargoDirectory is a `directory` source: unpacked crates, each with a
+	// .cargo-checksum.json, as `cargo vendor` writes them.
+	CargoDirectory CargoSourceStyle = "directory"
+)
+
+// CargoSourceName is the name the generated config gives the mirror source.
+const CargoSourceName = "aptlantis-mirror"
+
+// ParseCargoSourceStyle validates a -cargo-config-style value.
+func ParseCargoSourceStyle(s string) (CargoSourceStyle, error) {
+	switch st := CargoSourceStyle(s); st {
+	case CargoLocalRegistry, CargoDirectory:
+		return st, nil
+	}
+	return "", fmt.Errorf("unknown cargo source style %q (want local-registry or directory)", s)
+}
+
+// WriteCargoSourceConfig writes a cargo config to outPath that replaces
+// crates-io with the local registry at mirrorBaseURL; see
+// WriteCargoSourceConfigStyle.
+func WriteCargoSourceConfig(mirrorBaseURL, outPath string) error {
+	return WriteCargoSourceConfigStyle(mirrorBaseURL, outPath, CargoLocalRegistry)
+}
+
+// WriteCargoSourceConfigStyle atomically writes a cargo config (the contents
+// of a .cargo/config.toml) to outPath that makes cargo fetch crates-io
+// dependencies from the mirror instead. Both styles read from the local
+// filesystem, so mirrorBaseURL must be a file:// URL or a path; a relative
+// path is made absolute so the config works from any project.
+func WriteCargoSourceConfigStyle(mirrorBaseURL, outPath string, style CargoSourceStyle) error {
+	if _, err := ParseCargoSourceStyle(string(style)); err != nil {
+		return err
+	}
+	dir, err := cargoSourcePath(mirrorBaseURL)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by download-crates. Put this in .cargo/config.toml (per project)\n")
+	fmt.Fprintf(&b, "# or $CARGO_HOME/config.toml to build from the mirror instead of crates.io.\n")
+	fmt.Fprintf(&b, "[source.crates-io]\nreplace-with = %s\n\n", tomlString(CargoSourceName))
+	fmt.Fprintf(&b, "[source.%s]\n%s = %s\n", CargoSourceName, style, tomlString(dir))
+
+	if d := filepath.Dir(outPath); d != "" {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp := outPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, outPath)
+}
+
+// cargoSourcePath turns a file:// URL or a path into an absolute path.
+func cargoSourcePath(base string) (string, error) {
+	if base == "" {
+		return "", fmt.Errorf("mirror location is required")
+	}
+	if u, err := url.Parse(base); err == nil && u.Scheme != "" && len(u.Scheme) > 1 {
+		if u.Scheme != "file" {
+			return "", fmt.Errorf("mirror %s: local-registry and directory sources need a local path or file:// URL", base)
+		}
+		base = filepath.FromSlash(u.Path)
+	}
+	return filepath.Abs(base)
+}
+
+// tomlString quotes s as a TOML literal string when it can, which keeps
+// Windows paths readable, and as a basic string otherwise.
+func tomlString(s string) string {
+	if !strings.ContainsAny(s, "'\n\r") {
+		return "'" + s + "'"
+	}
+	return strconv.Quote(s)
+}
@@ -0,0 +1,165 @@
+package downloader
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// CatalogEntry is one line of the -catalog file.
+type CatalogEntry struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Yanked  bool   `json:"yanked"`
+	Size    int64  `json:"size,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+}
+
+// Catalog collects every crate version seen in the index and the manifest
+// records of a run, and writes them sorted by name and then SemVer. Entries
+// from an earlier catalog file are kept, so re-running or resuming a mirror
+// only fills in and updates entries; the output for the same inputs is
+// always the same.
+type Catalog struct {
+	mu      sync.Mutex
+	entries map[[2]string]*CatalogEntry // (name, version)
+}
+
+// LoadCatalog starts a catalog from the file at path, if it exists.
+func LoadCatalog(path string) (*Catalog, error) {
+	c := &Catalog{entries: make(map[[2]string]*CatalogEntry)}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		var e CatalogEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		c.entries[[2]string{e.Name, e.Version}] = &e
+	}
+	return c, s.Err()
+}
+
+func (c *Catalog) entry(name, version string) *CatalogEntry {
+	k := [2]string{name, version}
+	e := c.entries[k]
+	if e == nil {
+		e = &CatalogEntry{Name: name, Version: version}
+		c.entries[k] = e
+	}
+	return e
+}
+
+// AddIndexLine records one raw index entry; it fits IndexOptions.OnEntry.
+func (c *Catalog) AddIndexLine(_ string, line []byte) {
+	var ie IndexEntry
+	if json.Unmarshal(line, &ie) != nil || ie.Name == "" || ie.Vers == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entry(ie.Name, ie.Vers)
+	e.Yanked = ie.Yanked
+	if e.SHA256 == "" && ie.Cksum != "" {
+		e.SHA256 = strings.ToLower(ie.Cksum)
+	}
+}
+
+// AddRecord records the size and digest of a successful download. Records
+// of files that were already present carry neither, so the size is taken
+// from the file.
+func (c *Catalog) AddRecord(rec Record) {
+	name, version := crateVersionFromURL(rec.URL)
+	if name == "" || !rec.OK {
+		return
+	}
+	size := rec.Size
+	if size == 0 && rec.Path != "" && rec.Status != StatusEmptyOK {
+		if fi, err := os.Stat(rec.Path); err == nil {
+			size = fi.Size()
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entry(name, version)
+	if size > 0 || rec.Status == StatusEmptyOK {
+		e.Size = size
+	}
+	if rec.SHA256 != "" {
+		e.SHA256 = rec.SHA256
+	}
+}
+
+// Entries returns the catalog sorted by name, then SemVer. Versions that do
+// not parse sort after the ones that do, by string.
+func (c *Catalog) Entries() []CatalogEntry {
+	c.mu.Lock()
+	out := make([]CatalogEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		out = append(out, *e)
+	}
+	c.mu.Unlock()
+	slices.SortFunc(out, func(a, b CatalogEntry) int {
+		if n := strings.Compare(a.Name, b.Name); n != 0 {
+			return n
+		}
+		va, errA := parseSemver(a.Version)
+		vb, errB := parseSemver(b.Version)
+		switch {
+		case errA == nil && errB == nil:
+			if n := va.compare(vb); n != 0 {
+				return n
+			}
+		case errA == nil:
+			return -1
+		case errB == nil:
+			return 1
+		}
+		return strings.Compare(a.Version, b.Version)
+	})
+	return out
+}
+
+// WriteFile writes the sorted catalog as JSONL, replacing path atomically.
+func (c *Catalog) WriteFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range c.Entries() {
+		if err := enc.Encode(e); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// SetCatalog adds every manifest record to c as the collector writes it.
+func (d *Downloader) SetCatalog(c *Catalog) {
+	d.catalog = c
+}
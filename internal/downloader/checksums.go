@@ -0,0 +1,140 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/index"
+)
+
+// ChecksumOptions tunes ReadChecksumsWithOptions.
+type ChecksumOptions struct {
+	Workers int // parser goroutines; <= 1 reads serially like ReadChecksums
+	// ValidateUTF8 skips (and logs) lines that are not valid UTF-8 or whose
+	// url or sha256 holds control characters.
+	ValidateUTF8 bool
+}
+
+// checksumBatchLines is how many lines the reader hands to a parser at once.
+const checksumBatchLines = 4096
+
+type checksumBatch struct {
+	seq   int64 // line number of lines[0]
+	lines [][]byte
+}
+
+type seqSum struct {
+	seq int64
+	sum string
+}
+
+// ReadChecksumsWithOptions is ReadChecksums with line parsing spread over
+// opts.Workers goroutines. A single reader feeds batches of lines to the
+// parsers, each of which fills its own map; the maps are merged at the end.
+// Duplicate URLs keep the value from the last line, as in ReadChecksums.
+func ReadChecksumsWithOptions(path string, opts ChecksumOptions) (map[string]string, error) {
+	if path == "" || opts.Workers <= 1 {
+		return readChecksums(path, opts.ValidateUTF8)
+	}
+	f, err := openInput(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	batches := make(chan checksumBatch, opts.Workers*2)
+	shards := make([]map[string]seqSum, opts.Workers)
+	var wg sync.WaitGroup
+	for i := range shards {
+		shards[i] = make(map[string]seqSum)
+		wg.Add(1)
+		go func(m map[string]seqSum) {
+			defer wg.Done()
+			for b := range batches {
+				for j, line := range b.lines {
+					seq := b.seq + int64(j)
+					ce, ok := parseChecksumLine(line, seq, opts.ValidateUTF8)
+					if !ok {
+						continue
+					}
+					if prev, ok := m[ce.URL]; !ok || seq > prev.seq {
+						m[ce.URL] = seqSum{seq: seq, sum: strings.ToLower(ce.SHA256)}
+					}
+				}
+			}
+		}(shards[i])
+	}
+
+	readErr := readLineBatches(f, batches)
+	close(batches)
+	wg.Wait()
+
+	merged := make(map[string]seqSum, len(shards[0])*len(shards))
+	for _, m := range shards {
+		for u, v := range m {
+			if prev, ok := merged[u]; !ok || v.seq > prev.seq {
+				merged[u] = v
+			}
+		}
+	}
+	out := make(map[string]string, len(merged))
+	for u, v := range merged {
+		out[u] = v.sum
+	}
+	return out, readErr
+}
+
+// readLineBatches splits r into trimmed, non-empty lines and sends them in batches.
+func readLineBatches(r io.Reader, batches chan<- checksumBatch) error {
+	br := bufio.NewReader(r)
+	var (
+		seq int64
+		cur = checksumBatch{lines: make([][]byte, 0, checksumBatchLines)}
+	)
+	for {
+		b, err := br.ReadBytes('\n')
+		if line := bytes.TrimSpace(b); len(line) > 0 {
+			if len(cur.lines) == 0 {
+				cur.seq = seq
+			}
+			cur.lines = append(cur.lines, line)
+			seq++
+			if len(cur.lines) == checksumBatchLines {
+				batches <- cur
+				cur = checksumBatch{lines: make([][]byte, 0, checksumBatchLines)}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(cur.lines) > 0 {
+		batches <- cur
+	}
+	return nil
+}
+
+// parseChecksumLine decodes one non-empty line; seq is its 0-based position
+// among non-empty lines, for the rejection log.
+func parseChecksumLine(line []byte, seq int64, validate bool) (ChecksumEntry, bool) {
+	var ce ChecksumEntry
+	if json.Unmarshal(line, &ce) != nil || ce.URL == "" || ce.SHA256 == "" {
+		return ce, false
+	}
+	if validate {
+		if err := index.CheckText(string(line), ce.URL, ce.SHA256); err != nil {
+			slog.Warn("checksum line rejected", "entry", seq+1, "err", err)
+			return ce, false
+		}
+	}
+	return ce, true
+}
@@ -0,0 +1,79 @@
+package downloader
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultCleanTempsAge is the age below which SetCleanTemps leaves temp files
+// alone unless told otherwise.
+const DefaultCleanTempsAge = time.Hour
+
+// SetCleanTemps makes Run first delete in-progress files (.part, .tmp and the
+// SetTempSuffix suffix) left in the output dirs by interrupted runs. Only
+// files not modified for olderThan are removed, so temps that a concurrently
+// running instance is still writing survive; keep it well above the request
+// timeout. 0 disables the cleanup. It walks the local filesystem, so it does
+// nothing useful with a non-local SetStore.
+func (d *Downloader) SetCleanTemps(olderThan time.Duration) {
+	if olderThan < 0 {
+		olderThan = 0
+	}
+	d.cleanTempsAge = olderThan
+}
+
+// isTempName reports whether a file name is an in-progress download or
+// other temp file, as the bundler also assumes.
+func (d *Downloader) isTempName(name string) bool {
+	if ext := filepath.Ext(name); ext == DefaultTempSuffix || ext == ".tmp" {
+		return true
+	}
+	return d.tmpSuffix != "" && strings.HasSuffix(name, d.tmpSuffix)
+}
+
+// cleanTemps removes temp files older than the SetCleanTemps age from the
+// output dir and route dirs and returns how many it removed.
+func (d *Downloader) cleanTemps() (int, error) {
+	if d.cleanTempsAge <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-d.cleanTempsAge)
+	roots := []string{d.outDir}
+	for _, r := range d.routes {
+		roots = append(roots, r.Dir)
+	}
+	removed := 0
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(path string, de fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if de.IsDir() || !d.isTempName(de.Name()) {
+				return nil
+			}
+			fi, err := de.Info()
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // finished or cleaned up by its writer meanwhile
+			}
+			if err != nil {
+				return err
+			}
+			if !fi.ModTime().Before(cutoff) {
+				return nil
+			}
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			removed++
+			return nil
+		})
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
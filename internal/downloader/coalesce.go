@@ -0,0 +1,30 @@
+package downloader
+
+import "context"
+
+// fetchShared is fetchOne for pass workers. A URL listed more than once (for
+// example by overlapping -list files) can reach two workers at the same time;
+// the second waits for the first fetch and reuses its record rather than
+// downloading to the same path concurrently. A duplicate that arrives after
+// the first fetch finished goes through fetchOne and finds the file on disk.
+func (d *Downloader) fetchShared(ctx context.Context, url string) Record {
+	leader := false
+	v, _, _ := d.flight.Do(url, func() (any, error) {
+		leader = true
+		return d.fetchOne(ctx, url, nil), nil
+	})
+	rec := v.(Record)
+	if leader {
+		return rec
+	}
+	// fetchOne counted the shared result once; count this copy too so the
+	// ok/error totals still add up to the records written.
+	rec.Coalesced = true
+	if rec.OK {
+		d.incOK()
+	} else {
+		d.incErr()
+	}
+	metProcessed.WithLabelValues("coalesced").Inc()
+	return rec
+}
@@ -0,0 +1,132 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// collectorFlushBytes is how much manifest output each of several
+// collectors buffers before writing it out in one piece.
+const collectorFlushBytes = 64 << 10
+
+// SetManifestCollectors sets how many goroutines turn download results into
+// manifest records (default 1). At very high throughput a single collector
+// encoding JSON becomes the bottleneck. With more than one, each collector
+// encodes into its own buffer and writes whole batches of lines, so records
+// are never interleaved but appear in a different order. A failed write then
+// loses the whole batch, and -fail-on-manifest-error notices it one batch
+// late. Per-shard manifests are still written one record at a time.
+func (d *Downloader) SetManifestCollectors(n int) {
+	d.collectors = max(1, n)
+}
+
+func (d *Downloader) collectorCount() int {
+	return max(1, d.collectors)
+}
+
+// manifestSection is one collector's share of the manifest: records encoded
+// but not yet written to the records writer.
+type manifestSection struct {
+	d       *Downloader
+	buf     bytes.Buffer
+	enc     *json.Encoder
+	first   Record // first record in buf, for error reports
+	n       int64  // records in buf
+	flushAt int    // write buf once it holds this many bytes; 0 = every record
+}
+
+func (d *Downloader) newManifestSection() *manifestSection {
+	s := &manifestSection{d: d}
+	if d.collectorCount() > 1 {
+		s.flushAt = collectorFlushBytes
+	}
+	s.enc = json.NewEncoder(&s.buf)
+	return s
+}
+
+// add encodes rec into the section, or into its shard manifest. It returns
+// an encoding or shard write error; failures to write the section itself are
+// reported by flush.
+func (s *manifestSection) add(rec Record) error {
+	before := s.buf.Len()
+	var err error
+	if s.d.manifestPerShard {
+		err = s.d.encodeShardRecord(rec, s.enc)
+	} else {
+		err = s.d.encodeRecord(s.enc, rec)
+	}
+	if s.buf.Len() > before {
+		if s.n == 0 {
+			s.first = rec
+		}
+		s.n++
+	}
+	if s.buf.Len() > s.flushAt {
+		s.flush()
+	}
+	return err
+}
+
+// flush writes the buffered records as one write. The records writer is a
+// SafeWriter, so concurrent flushes do not interleave.
+func (s *manifestSection) flush() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	if _, err := (meteredWriter{s.d.recordsW}).Write(s.buf.Bytes()); err != nil {
+		s.d.noteManifestError(s.first, s.n, err)
+	}
+	s.buf.Reset()
+	s.n = 0
+}
+
+// collect is one collector of a pass: it writes the manifest record of every
+// result and does the per-record bookkeeping, under mu since collectors
+// share it. Records that are not OK are appended to failed.
+func (d *Downloader) collect(results <-chan Record, round int, mu *sync.Mutex, failed *[]string) {
+	sec := d.newManifestSection()
+	defer sec.flush()
+	for rec := range results {
+		var writeStart time.Time
+		if metEnabled.Load() {
+			writeStart = time.Now()
+		}
+		if d.manifestPerShard {
+			mu.Lock() // shard files are shared by all collectors
+		}
+		if err := sec.add(rec); err != nil {
+			d.noteManifestError(rec, 1, err)
+		}
+		if d.manifestPerShard {
+			mu.Unlock()
+		}
+		if !writeStart.IsZero() {
+			metManifestWrite.Observe(time.Since(writeStart).Seconds())
+		}
+
+		mu.Lock()
+		d.noteWritten(rec)
+		d.addEvent(rec)
+		if d.catalog != nil {
+			d.catalog.AddRecord(rec)
+		}
+		if d.localReg != nil {
+			d.localReg.AddRecord(rec)
+		}
+		if !rec.OK {
+			*failed = append(*failed, rec.URL)
+		}
+		if round == 0 { // final rounds were already counted by the main pass
+			processed := d.incTotal()
+			d.eta.done(d, rec.URL)
+			if d.progressEach > 0 && processed%d.progressEach == 0 {
+				ok, errc := d.snapshotCounts()
+				slog.Info("progress", "processed", processed, "ok", ok, "err", errc)
+			}
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,66 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+)
+
+// ErrPathCollision is returned by Run when distinct URLs in the worklist
+// would be stored at the same path and overwrite each other.
+var ErrPathCollision = errors.New("different URLs map to the same output path")
+
+// Collision is one output path claimed by more than one URL.
+type Collision struct {
+	Path string
+	URLs []string
+}
+
+// PathCollisions reports output paths that more than one distinct URL maps
+// to, e.g. the same crate from two hosts or names differing only in case
+// under -normalize-case. Repeats of the same URL are not collisions.
+func (d *Downloader) PathCollisions(urls []string) []Collision {
+	byPath := make(map[string][]string, len(urls))
+	for _, u := range urls {
+		dir, name := d.outPathFor(u)
+		p := filepath.Join(dir, name)
+		byPath[p] = append(byPath[p], u)
+	}
+	var out []Collision
+	for p, us := range byPath {
+		if len(us) < 2 {
+			continue
+		}
+		sort.Strings(us)
+		us = dedupeSorted(us)
+		if len(us) > 1 {
+			out = append(out, Collision{Path: p, URLs: us})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+func dedupeSorted(s []string) []string {
+	out := s[:0]
+	for i, v := range s {
+		if i == 0 || v != s[i-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// checkCollisions logs every collision and returns ErrPathCollision if any.
+func (d *Downloader) checkCollisions(urls []string) error {
+	cs := d.PathCollisions(urls)
+	for _, c := range cs {
+		slog.Error("output path collision", "path", c.Path, "urls", c.URLs)
+	}
+	if len(cs) > 0 {
+		return fmt.Errorf("%w: %d paths", ErrPathCollision, len(cs))
+	}
+	return nil
+}
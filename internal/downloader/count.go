@@ -0,0 +1,88 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// CountReport summarizes a resolved worklist without downloading it.
+type CountReport struct {
+	URLs           int
+	Crates         int
+	Sampled        int   // URLs whose size was obtained via HEAD
+	SampledBytes   int64 // sum of Content-Length over sampled URLs
+	EstimatedBytes int64 // SampledBytes scaled to the whole worklist
+}
+
+// CountURLs reports the number of URLs and distinct crate names in urls.
+// It assumes crates.io-shaped URLs; see Downloader.CountURLs.
+func CountURLs(urls []string) CountReport {
+	return (&Downloader{}).CountURLs(urls)
+}
+
+// CountURLs is CountURLs with crate names taken the way d places files, so
+// SetNameRegex applies.
+func (d *Downloader) CountURLs(urls []string) CountReport {
+	crates := make(map[string]struct{})
+	for _, u := range urls {
+		crates[d.crateName(u)] = struct{}{}
+	}
+	return CountReport{URLs: len(urls), Crates: len(crates)}
+}
+
+// SampleSizes issues HEAD requests for up to n evenly spaced URLs and folds the
+// Content-Length values into r, extrapolating an estimate for the full list.
+// It uses a plain client; see Downloader.SampleSizes.
+func (r *CountReport) SampleSizes(ctx context.Context, urls []string, n int, timeout time.Duration) {
+	(&Downloader{client: &http.Client{Timeout: timeout}}).SampleSizes(ctx, r, urls, n)
+}
+
+// SampleSizes is CountReport.SampleSizes through d's HTTP client, so the
+// SetAllowedHosts and TLS settings apply. URLs on hosts that are not
+// allowed are not sampled.
+func (d *Downloader) SampleSizes(ctx context.Context, r *CountReport, urls []string, n int) {
+	if n <= 0 || len(urls) == 0 {
+		return
+	}
+	n = min(n, len(urls))
+	step := len(urls) / n
+	for i := 0; i < n; i++ {
+		if ctx.Err() != nil {
+			break
+		}
+		u := urls[i*step]
+		if _, ok := d.urlHostAllowed(u); !ok {
+			continue
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+		if err != nil {
+			continue
+		}
+		req.Header.Set("User-Agent", "Aptlantis-crates-mirror/0.1")
+		resp, err := d.client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+			continue
+		}
+		r.Sampled++
+		r.SampledBytes += resp.ContentLength
+	}
+	if r.Sampled > 0 {
+		r.EstimatedBytes = r.SampledBytes / int64(r.Sampled) * int64(r.URLs)
+	}
+}
+
+// Print writes the report as a single key=value line.
+func (r CountReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "urls=%d crates=%d", r.URLs, r.Crates)
+	if r.Sampled > 0 {
+		fmt.Fprintf(w, " sampled=%d est_bytes=%d est_gib=%.2f", r.Sampled, r.EstimatedBytes, float64(r.EstimatedBytes)/(1<<30))
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,54 @@
+package downloader
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SetMaxCreatesPerSec limits how fast download temp files are created,
+// across all workers (0 = unlimited). On network filesystems file creation is
+// a metadata round-trip that can saturate the server long before bandwidth
+// does; this caps that rate independently of concurrency.
+func (d *Downloader) SetMaxCreatesPerSec(n float64) {
+	if n <= 0 {
+		d.creates = nil
+		return
+	}
+	d.creates = &createLimiter{interval: time.Duration(float64(time.Second) / n)}
+}
+
+// createLimiter hands out evenly spaced slots, one per interval.
+type createLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// wait blocks until the caller's slot, or until ctx is done.
+func (l *createLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	slot := l.next
+	if slot.Before(now) {
+		slot = now
+	}
+	l.next = slot.Add(l.interval)
+	l.mu.Unlock()
+
+	delay := time.Until(slot)
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,109 @@
+package downloader
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// StatusCrateMismatch marks a record whose archive is well formed but holds
+// a different crate than its URL names; see SetDeepVerify.
+const StatusCrateMismatch = "crate-mismatch"
+
+// ErrCrateMismatch is wrapped by archive errors that SetDeepVerify reports
+// as StatusCrateMismatch.
+var ErrCrateMismatch = errors.New("crate mismatch")
+
+// cargoTomlLimit bounds how much of an archived Cargo.toml is read.
+const cargoTomlLimit = 1 << 20
+
+// SetDeepVerify extends SetValidateGzip (and implies it): every entry of the
+// archive must sit under "{name}-{version}/" for the crate and version in the
+// URL, and the [package] name and version in that directory's Cargo.toml
+// must match them. This catches mislabeled or swapped artifacts that a
+// missing or wrong checksum would let through. Failures are handled like
+// other bad archives but recorded with StatusCrateMismatch. URLs whose crate
+// and version cannot be told apart only get the SetValidateGzip checks.
+func (d *Downloader) SetDeepVerify(on bool) {
+	d.deepVerify = on
+}
+
+// archiveCheck is what checkCrateArchive expects of an archive. A zero
+// name skips the crate identity checks.
+type archiveCheck struct {
+	name, version string
+}
+
+// archiveCheckFor returns the checks to run on url's file, or nil for none.
+func (d *Downloader) archiveCheckFor(url string) *archiveCheck {
+	if !d.validateGzip && !d.deepVerify {
+		return nil
+	}
+	if !d.deepVerify {
+		return &archiveCheck{}
+	}
+	crate, version := crateVersionFromURL(url)
+	return &archiveCheck{name: crate, version: version}
+}
+
+// checkIdentity compares an archive entry's path, with any "./" removed,
+// against the expected top-level directory.
+func (c archiveCheck) checkIdentity(name string) error {
+	if c.name == "" {
+		return nil
+	}
+	top, _, _ := strings.Cut(name, "/")
+	if want := c.name + "-" + c.version; top != want {
+		return fmt.Errorf("%w: entry %q is outside %s/", ErrCrateMismatch, name, want)
+	}
+	return nil
+}
+
+// checkCargoToml compares the [package] name and version of a top-level
+// Cargo.toml with the expected crate.
+func (c archiveCheck) checkCargoToml(r io.Reader) error {
+	if c.name == "" {
+		return nil
+	}
+	name, version, err := cargoPackage(io.LimitReader(r, cargoTomlLimit))
+	if err != nil {
+		return fmt.Errorf("read Cargo.toml: %w", err)
+	}
+	if name != c.name || version != c.version {
+		return fmt.Errorf("%w: Cargo.toml declares %s %s, want %s %s", ErrCrateMismatch, name, version, c.name, c.version)
+	}
+	return nil
+}
+
+// cargoPackage returns the name and version keys of the [package] table.
+// Published manifests are normalized by cargo, so plain `key = "value"`
+// lines are all that need handling.
+func cargoPackage(r io.Reader) (name, version string, err error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64<<10), cargoTomlLimit)
+	inPackage := false
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "[") {
+			inPackage = line == "[package]"
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !inPackage || !ok {
+			continue
+		}
+		val = strings.TrimSpace(val)
+		if len(val) < 2 || (val[0] != '"' && val[0] != '\'') || val[len(val)-1] != val[0] {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "name":
+			name = val[1 : len(val)-1]
+		case "version":
+			version = val[1 : len(val)-1]
+		}
+	}
+	return name, version, s.Err()
+}
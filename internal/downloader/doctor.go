@@ -0,0 +1,228 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/fsinfo"
+)
+
+// DoctorConfig describes the setup validated by Doctor.
+type DoctorConfig struct {
+	IndexDir     string
+	OutDir       string
+	BaseURL      string
+	TestCrate    string // "{name}/{name}-{version}.crate" path under BaseURL
+	Concurrency  int
+	MinFreeBytes uint64
+	Timeout      time.Duration
+}
+
+// DoctorCheck is one line of the doctor checklist.
+type DoctorCheck struct {
+	Name       string
+	OK         bool
+	Detail     string
+	Suggestion string
+}
+
+// DefaultTestCrate is a small, long-lived crate used to probe the base URL.
+const DefaultTestCrate = "cfg-if/cfg-if-1.0.0.crate"
+
+// Doctor runs preflight checks against cfg and returns one result per check.
+// Checks never abort early so the user sees every problem at once. The base
+// URL is checked with a plain client; see Downloader.Doctor.
+func Doctor(ctx context.Context, cfg DoctorConfig) []DoctorCheck {
+	return (&Downloader{client: &http.Client{}}).Doctor(ctx, cfg)
+}
+
+// Doctor is Doctor with the base URL checked through d's HTTP client, so the
+// SetAllowedHosts and TLS settings apply.
+func (d *Downloader) Doctor(ctx context.Context, cfg DoctorConfig) []DoctorCheck {
+	if cfg.TestCrate == "" {
+		cfg.TestCrate = DefaultTestCrate
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 15 * time.Second
+	}
+	var checks []DoctorCheck
+	if cfg.IndexDir != "" {
+		checks = append(checks, doctorIndex(cfg.IndexDir))
+	}
+	checks = append(checks, doctorOutDir(cfg.OutDir, cfg.MinFreeBytes)...)
+	checks = append(checks, d.doctorBaseURL(ctx, cfg))
+	checks = append(checks, doctorFileLimit(cfg.Concurrency))
+	return checks
+}
+
+// PrintDoctor writes checks as a checklist and reports whether all passed.
+func PrintDoctor(w io.Writer, checks []DoctorCheck) bool {
+	allOK := true
+	for _, c := range checks {
+		mark := "PASS"
+		if !c.OK {
+			mark = "FAIL"
+			allOK = false
+		}
+		fmt.Fprintf(w, "[%s] %s: %s\n", mark, c.Name, c.Detail)
+		if !c.OK && c.Suggestion != "" {
+			fmt.Fprintf(w, "       hint: %s\n", c.Suggestion)
+		}
+	}
+	return allOK
+}
+
+func doctorIndex(indexDir string) DoctorCheck {
+	c := DoctorCheck{Name: "index-dir"}
+	fi, err := os.Stat(indexDir)
+	if err != nil || !fi.IsDir() {
+		c.Detail = fmt.Sprintf("%s is not a directory", indexDir)
+		c.Suggestion = "clone https://github.com/rust-lang/crates.io-index and pass its path via -index-dir"
+		return c
+	}
+	if _, err := os.Stat(filepath.Join(indexDir, "config.json")); err == nil {
+		c.OK = true
+		c.Detail = fmt.Sprintf("%s has config.json", indexDir)
+		return c
+	}
+	entries, err := os.ReadDir(indexDir)
+	if err != nil {
+		c.Detail = err.Error()
+		return c
+	}
+	shards := 0
+	for _, e := range entries {
+		if e.IsDir() && looksLikeShardDir(e.Name()) {
+			shards++
+		}
+	}
+	if shards == 0 {
+		c.Detail = fmt.Sprintf("%s has no config.json and no shard directories", indexDir)
+		c.Suggestion = "point -index-dir at the root of the crates.io-index checkout, not a parent or subdirectory"
+		return c
+	}
+	c.OK = true
+	c.Detail = fmt.Sprintf("%s has %d shard directories", indexDir, shards)
+	return c
+}
+
+// looksLikeShardDir matches top-level crates.io-index directories: 1, 2, 3 and two-char prefixes.
+func looksLikeShardDir(name string) bool {
+	switch {
+	case name == "1" || name == "2" || name == "3":
+		return true
+	case len(name) == 2 && !strings.HasPrefix(name, "."):
+		return true
+	}
+	return false
+}
+
+func doctorOutDir(outDir string, minFree uint64) []DoctorCheck {
+	w := DoctorCheck{Name: "out-dir"}
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		w.Detail = err.Error()
+		w.Suggestion = "choose an -out directory you can create"
+		return []DoctorCheck{w}
+	}
+	f, err := os.CreateTemp(outDir, ".doctor-*")
+	if err != nil {
+		w.Detail = fmt.Sprintf("%s is not writable: %v", outDir, err)
+		w.Suggestion = "fix permissions or choose another -out directory"
+		return []DoctorCheck{w}
+	}
+	f.Close()
+	_ = os.Remove(f.Name())
+	w.OK = true
+	w.Detail = fmt.Sprintf("%s is writable", outDir)
+
+	s := DoctorCheck{Name: "free-space"}
+	u, err := fsinfo.DiskUsage(outDir)
+	switch {
+	case errors.Is(err, fsinfo.ErrUnsupported):
+		s.OK = true
+		s.Detail = "not available on this platform"
+	case err != nil:
+		s.Detail = err.Error()
+	case u.FreeBytes < minFree:
+		s.Detail = fmt.Sprintf("%.1f GiB free, want at least %.1f GiB", gib(u.FreeBytes), gib(minFree))
+		s.Suggestion = "free up space or point -out at a larger disk"
+	default:
+		s.OK = true
+		s.Detail = fmt.Sprintf("%.1f GiB free", gib(u.FreeBytes))
+	}
+	return []DoctorCheck{w, s}
+}
+
+func gib(n uint64) float64 {
+	return float64(n) / (1 << 30)
+}
+
+func (d *Downloader) doctorBaseURL(ctx context.Context, cfg DoctorConfig) DoctorCheck {
+	u := strings.TrimRight(cfg.BaseURL, "/") + "/" + strings.TrimLeft(cfg.TestCrate, "/")
+	c := DoctorCheck{Name: "base-url"}
+	if host, ok := d.urlHostAllowed(u); !ok {
+		c.Detail = fmt.Sprintf("%s: %v: %s", u, ErrHostNotAllowed, host)
+		c.Suggestion = "add the host to -allowed-hosts or fix -crates-base-url"
+		return c
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	code, err := probeStatus(ctx, d.client, http.MethodHead, u)
+	if err == nil && code == http.StatusMethodNotAllowed {
+		code, err = probeStatus(ctx, d.client, http.MethodGet, u)
+	}
+	switch {
+	case err != nil:
+		c.Detail = fmt.Sprintf("%s: %v", u, err)
+		c.Suggestion = "check DNS, proxy settings (HTTPS_PROXY) and firewall rules"
+	case code != http.StatusOK:
+		c.Detail = fmt.Sprintf("%s: HTTP %d", u, code)
+		c.Suggestion = "check -crates-base-url; it should serve {name}/{name}-{version}.crate"
+	default:
+		c.OK = true
+		c.Detail = fmt.Sprintf("%s: HTTP %d", u, code)
+	}
+	return c
+}
+
+func probeStatus(ctx context.Context, cli *http.Client, method, u string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "Aptlantis-crates-mirror/0.1")
+	resp, err := cli.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func doctorFileLimit(concurrency int) DoctorCheck {
+	c := DoctorCheck{Name: "open-files"}
+	// Each worker holds a socket and a file; leave headroom for logs and the manifest.
+	need := uint64(max(1, concurrency))*2 + 64
+	limit, err := fsinfo.OpenFileLimit()
+	switch {
+	case errors.Is(err, fsinfo.ErrUnsupported):
+		c.OK = true
+		c.Detail = "not available on this platform"
+	case err != nil:
+		c.Detail = err.Error()
+	case limit < need:
+		c.Detail = fmt.Sprintf("limit %d is below %d needed for concurrency %d", limit, need, concurrency)
+		c.Suggestion = fmt.Sprintf("raise it with `ulimit -n %d` or lower -concurrency", need)
+	default:
+		c.OK = true
+		c.Detail = fmt.Sprintf("limit %d covers concurrency %d", limit, concurrency)
+	}
+	return c
+}
@@ -40,26 +40,31 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/klauspost/compress/zstd"
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/index"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/singleflight"
 )
 
 // Record describes one downloaded object for the manifest.
@@ -75,8 +80,29 @@ type Record struct {
 	Error         string `json:"error,omitempty"`
 	Retries       int    `json:"retries,omitempty"`
 	Status        string `json:"status,omitempty"`
+	OriginalName  string `json:"original_name,omitempty"` // file name before -normalize-case, when it differs
+	// ChecksumRetries counts re-fetches after a checksum mismatch; not included in Retries.
+	ChecksumRetries int `json:"checksum_retries,omitempty"`
+	// LinkTarget is the earlier identical file this one was hardlinked to (-hardlink-dupes).
+	LinkTarget string `json:"link_target,omitempty"`
+	// StoredSHA256 is the digest of the file on disk when -store-transform
+	// changed it; SHA256 is always the digest of the bytes as served.
+	StoredSHA256 string `json:"stored_sha256,omitempty"`
+	// FinalRound is the end-of-run retry round (-final-retry-rounds) in
+	// which a download that failed in the main pass succeeded.
+	FinalRound int `json:"final_round,omitempty"`
+	// Root is the output directory chosen by -route, when routes are set.
+	Root string `json:"root,omitempty"`
+	// Coalesced marks a duplicate URL that shared the result of a concurrent
+	// fetch of the same URL instead of downloading it again.
+	Coalesced bool `json:"coalesced,omitempty"`
 }
 
+// StatusEmptyOK marks a successful record whose file is legitimately zero
+// bytes: the server answered 200 with an empty body and any known checksum is
+// the SHA256 of empty input. Size-based truncation checks should skip it.
+const StatusEmptyOK = "empty-ok"
+
 // ChecksumEntry is the line format for optional checksum file (JSONL).
 // Example line: {"url":"https://.../foo.crate","sha256":"ab12..."}
 
@@ -110,28 +136,70 @@ func (sw *SafeWriter) Write(p []byte) (int, error) {
 	return sw.w.Write(p)
 }
 
-// Bundler streams files into rolling tar.zst archives.
+// Bundler streams files into rolling compressed tar archives (tar.zst by default).
+// Each bundle-NNNN.tar.zst gets a bundle-NNNN.index.jsonl listing its entries.
 type Bundler struct {
 	enabled     bool
 	outDir      string
 	targetBytes int64
+	format      BundleFormat
+	tmpSuffix   string // custom in-progress suffix, in addition to .part/.tmp
+
+	headerLayout HeaderLayout // "" means HeaderHost
+	mirrorRoot   string       // for HeaderShard
+
+	bundled map[string]struct{} // header names already bundled; nil unless SetSkipBundled
+
+	groupBy    BundleGroupBy // see SetGroupBy
+	groupSlack int64         // bytes a bundle may exceed the target by to keep a group
 
 	mu           sync.Mutex
 	currentIdx   int
 	currentBytes int64
 	tw           *tar.Writer
-	zw           *zstd.Encoder
+	zw           io.WriteCloser
 	outFile      *os.File
+	indexFile    *os.File
+	indexEnc     *json.Encoder
+	lastGroup    string // group of the last file added
+}
+
+// BundleEntry is one line of a per-bundle index.
+type BundleEntry struct {
+	Bundle string `json:"bundle"`
+	Name   string `json:"name"`   // tar header name
+	Source string `json:"source"` // local file the entry was read from
+	Size   int64  `json:"size"`
 }
 
 func NewBundler(enabled bool, bundlesOut string, targetGB int64) (*Bundler, error) {
+	return NewBundlerFormat(enabled, bundlesOut, targetGB, BundleTarZst)
+}
+
+// NewBundlerFormat is NewBundler with a choice of archive compression.
+func NewBundlerFormat(enabled bool, bundlesOut string, targetGB int64, format BundleFormat) (*Bundler, error) {
+	return NewBundlerBytes(enabled, bundlesOut, targetGB*(1<<30), format)
+}
+
+// NewBundlerBytes is NewBundlerFormat with the target size in bytes. A target
+// of 0 starts a new bundle for every file. Numbering continues after bundles
+// already in bundlesOut; a trailing bundle left inconsistent by a crash is
+// discarded first (see recoverBundles).
+func NewBundlerBytes(enabled bool, bundlesOut string, targetBytes int64, format BundleFormat) (*Bundler, error) {
 	if !enabled {
 		return &Bundler{enabled: false}, nil
 	}
+	if _, err := ParseBundleFormat(string(format)); err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(bundlesOut, 0o755); err != nil {
 		return nil, err
 	}
-	b := &Bundler{enabled: true, outDir: bundlesOut, targetBytes: targetGB * (1 << 30)}
+	next, err := recoverBundles(bundlesOut)
+	if err != nil {
+		return nil, fmt.Errorf("recover bundles: %w", err)
+	}
+	b := &Bundler{enabled: true, outDir: bundlesOut, targetBytes: targetBytes, format: format, currentIdx: next}
 	if err := b.rotateLocked(); err != nil {
 		return nil, err
 	}
@@ -152,32 +220,50 @@ func (b *Bundler) rotateLocked() error {
 	if b.outFile != nil {
 		b.outFile.Close()
 	}
+	if b.indexFile != nil {
+		b.indexFile.Close()
+	}
 
-	name := fmt.Sprintf("bundle-%04d.tar.zst", b.currentIdx)
+	name := fmt.Sprintf("bundle-%04d.%s", b.currentIdx, b.format)
 	path := filepath.Join(b.outDir, name)
 	f, err := os.Create(path)
 	if err != nil {
 		return err
 	}
-	zw, err := zstd.NewWriter(f, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	zw, err := b.format.newWriter(f)
 	if err != nil {
 		f.Close()
 		return err
 	}
 	tw := tar.NewWriter(zw)
+	idx, err := os.Create(bundleIndexPath(path))
+	if err != nil {
+		zw.Close()
+		f.Close()
+		return err
+	}
 
 	b.outFile = f
 	b.zw = zw
 	b.tw = tw
+	b.indexFile = idx
+	b.indexEnc = json.NewEncoder(idx)
 	b.currentBytes = 0
 	b.currentIdx++
 	return nil
 }
 
+// ErrUnfinishedFile is returned by AddFile for in-progress download files.
+var ErrUnfinishedFile = errors.New("refusing to bundle unfinished file")
+
 func (b *Bundler) AddFile(filePath string, headerName string) error {
 	if !b.enabled {
 		return nil
 	}
+	// Only finalized files belong in a bundle; .part/.tmp may still be written to.
+	if ext := filepath.Ext(filePath); ext == ".part" || ext == ".tmp" || (b.tmpSuffix != "" && strings.HasSuffix(filePath, b.tmpSuffix)) {
+		return fmt.Errorf("%w: %s", ErrUnfinishedFile, filePath)
+	}
 	fi, err := os.Stat(filePath)
 	if err != nil {
 		return err
@@ -185,11 +271,16 @@ func (b *Bundler) AddFile(filePath string, headerName string) error {
 	// Rotate if needed (estimate using uncompressed size as proxy)
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	if b.currentBytes+fi.Size() > b.targetBytes {
+	if b.alreadyBundledLocked(headerName) {
+		return fmt.Errorf("%w: %s", ErrAlreadyBundled, headerName)
+	}
+	group := b.groupKey(filePath)
+	if b.currentBytes+fi.Size() > b.targetBytes && !b.keepGroupLocked(group, fi.Size()) {
 		if err := b.rotateLocked(); err != nil {
 			return err
 		}
 	}
+	b.lastGroup = group
 	// Open file and add to tar
 	f, err := os.Open(filePath)
 	if err != nil {
@@ -213,7 +304,19 @@ func (b *Bundler) AddFile(filePath string, headerName string) error {
 		return err
 	}
 	b.currentBytes += n
-	return nil
+	if b.bundled != nil {
+		b.bundled[headerName] = struct{}{}
+	}
+	return b.indexEnc.Encode(BundleEntry{Bundle: filepath.Base(b.outFile.Name()), Name: headerName, Source: filePath, Size: n})
+}
+
+// bundleIndexPath maps bundle-0001.tar.zst to bundle-0001.index.jsonl.
+func bundleIndexPath(bundlePath string) string {
+	base := filepath.Base(bundlePath)
+	if i := strings.Index(base, ".tar"); i >= 0 {
+		base = base[:i]
+	}
+	return filepath.Join(filepath.Dir(bundlePath), base+".index.jsonl")
 }
 
 func (b *Bundler) Close() error {
@@ -222,20 +325,30 @@ func (b *Bundler) Close() error {
 	}
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	if b.tw != nil {
-		if err := b.tw.Close(); err != nil {
-			return err
+	// Close is called by both Run and the CLI; release everything once.
+	var first error
+	keep := func(err error) {
+		if err != nil && first == nil {
+			first = err
 		}
 	}
+	if b.tw != nil {
+		keep(b.tw.Close())
+		b.tw = nil
+	}
 	if b.zw != nil {
-		if err := b.zw.Close(); err != nil {
-			return err
-		}
+		keep(b.zw.Close())
+		b.zw = nil
+	}
+	if b.indexFile != nil {
+		keep(b.indexFile.Close())
+		b.indexFile = nil
 	}
 	if b.outFile != nil {
-		return b.outFile.Close()
+		keep(b.outFile.Close())
+		b.outFile = nil
 	}
-	return nil
+	return first
 }
 
 // Downloader holds state for concurrent fetching.
@@ -243,98 +356,208 @@ type Downloader struct {
 	client       *http.Client
 	outDir       string
 	checksums    map[string]string // url -> sha256 (hex)
+	sumLookup    func(crate, version string) (string, bool)
+	secondary    map[string]string // url -> sha256 from an independent source
 	concurrency  int
 	timeout      time.Duration
 	progressEach int64         // log progress every N files (0=disabled)
 	progressIntv time.Duration // periodic progress interval (0=disabled)
 
 	recordsW *SafeWriter
-	bundler  *Bundler
-
-	countsMu sync.Mutex
-	total    int64
-	okCount  int64
-	errCount int64
+	bundler  *Bundler       // reads finished files from the local filesystem
+	bundleCh chan bundleJob // set by Run; see startBundling
+	events   EventSink      // optional; see SetEventSink
+	catalog  *Catalog       // optional; see SetCatalog
+	localReg *LocalRegistry // optional; see SetLocalRegistry
+	store    BlobStore      // nil means LocalStore
+
+	countsMu  sync.Mutex
+	total     int64
+	okCount   int64
+	errCount  int64
+	csRetries int64 // re-fetches after checksum mismatch
+
+	// bytes counts body bytes of successful downloads, whether or not metrics are served.
+	bytes atomic.Int64
+	// end-of-run retry rounds for failed URLs; see SetFinalRetries
+	finalRounds int
+	finalDelay  time.Duration
+
+	// maxBytes stops dispatch once bytes reaches it; see SetMaxTotalBytes.
+	maxBytes  int64
+	budgetHit atomic.Bool
+
+	// manifest write failures of the current Run; see SetFailOnManifestError
+	failOnManifest bool
+	manifestErrs   atomic.Int64
+	manifestErr    error // first failure, set by the collector
+
+	creates *createLimiter // paces temp file creation; see SetMaxCreatesPerSec
+
+	urlBuf, resultBuf int           // pass channel capacities; -1 = default, see SetChannelBuffers
+	collectors        int           // manifest collector goroutines; see SetManifestCollectors
+	urlDeadline       time.Duration // total time per URL; see SetPerURLDeadline
+	routes            []Route       // per-crate output dirs; see SetRoutes
+	cleanTempsAge     time.Duration // stale temp age removed at start; see SetCleanTemps
+	traceExemplars    bool          // traceparent per attempt, trace IDs in exemplars; see SetTraceExemplars
+	allowedHosts      []string      // empty = any host; see SetAllowedHosts
+	strictCount       bool          // fail Run when records are missing; see SetStrictCount
+	scanCmd           []string      // external scanner fed each download; see SetScanCommand
+	dialNoGuard       func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	manifestFields []recordField // nil = every field; see SetManifestFields
+
+	sizeHints map[string]int64 // expected sizes by URL; see SetSizeHints
+
+	nameRe    *regexp.Regexp // crate name from URL; see SetNameRegex
+	nameGroup int
+	eta       *etaState
+
+	flight singleflight.Group // coalesces concurrent fetches of one URL; see fetchShared
+
+	provenance   bool // write <file>.prov.json after each verified download
+	validateGzip bool // check verified files are crate archives; see SetValidateGzip
+	deepVerify   bool // also match the archive's crate to the URL; see SetDeepVerify
 
 	// retry settings
 	retries   int
 	retryBase time.Duration
 	retryMax  time.Duration
+	// re-fetches allowed after a checksum mismatch (0 = mismatch is terminal)
+	checksumRetries int
 
 	startedAt time.Time
+
+	normalizeCase bool   // lowercase crate names in shard dirs and file names
+	tmpSuffix     string // in-progress download suffix; empty means DefaultTempSuffix
+	transform     StoreTransform
+	exemplars     bool            // attach crate exemplars to metDuration
+	metricHosts   map[string]bool // hosts with their own metrics label; see SetMetricHosts
+
+	samplePct    float64       // re-hash this percentage of written files after Run
+	sampleStrict bool          // fail Run on a sample mismatch
+	verifyConc   int           // sample verify workers; 0 = runtime.NumCPU(), see SetVerifyConcurrency
+	sampled      []sampledFile // collector goroutine only
+	lastWritten  sampledFile   // fallback so a small run still checks one file
+
+	manifestPerShard bool
+	shardManifests   map[string]*shardManifest // open shard dir -> writer; collector goroutine only
+	shardSeen        map[string]struct{}       // shard dirs written this run
+
+	hardlinkDupes bool
+	sumsMu        sync.Mutex
+	pathBySum     map[string]string // sha256 -> first file with that content
 }
 
 // Metrics
 var (
 	metOnce     sync.Once
 	metRequests = prometheus.NewCounterVec(
-		prometheus.CounterOpts{Name: "crates_download_requests_total", Help: "Download attempts by status and HTTP code"},
-		[]string{"status", "code"},
+		prometheus.CounterOpts{Name: "crates_download_requests_total", Help: "Download attempts by status, HTTP code and host"},
+		[]string{"status", "code", "host"},
 	)
-	metBytes     = prometheus.NewCounter(prometheus.CounterOpts{Name: "crates_download_bytes_total", Help: "Total bytes downloaded"})
-	metDuration  = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "crates_download_duration_seconds", Help: "Time spent per download attempt", Buckets: prometheus.DefBuckets})
-	metRetries   = prometheus.NewCounter(prometheus.CounterOpts{Name: "crates_download_retries_total", Help: "Total retry attempts"})
-	metInflight  = prometheus.NewGauge(prometheus.GaugeOpts{Name: "crates_download_inflight", Help: "In-flight HTTP requests"})
-	metProcessed = prometheus.NewCounterVec(
+	metBytes           = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "crates_download_bytes_total", Help: "Total bytes downloaded by host"}, []string{"host"})
+	metDuration        = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "crates_download_duration_seconds", Help: "Time spent per download attempt by host", Buckets: prometheus.DefBuckets}, []string{"host"})
+	metRetries         = prometheus.NewCounter(prometheus.CounterOpts{Name: "crates_download_retries_total", Help: "Total retry attempts"})
+	metChecksumRetries = prometheus.NewCounter(prometheus.CounterOpts{Name: "crates_download_checksum_retries_total", Help: "Re-fetches after a checksum mismatch"})
+	metInflight        = prometheus.NewGauge(prometheus.GaugeOpts{Name: "crates_download_inflight", Help: "In-flight HTTP requests"})
+	metProcessed       = prometheus.NewCounterVec(
 		prometheus.CounterOpts{Name: "crates_processed_total", Help: "Processed records by result"},
 		[]string{"result"},
 	)
+	metManifestWrite = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "crates_manifest_write_seconds", Help: "Time the collector spends writing one manifest record", Buckets: prometheus.ExponentialBuckets(1e-5, 4, 10)})
+	metManifestBytes = prometheus.NewCounter(prometheus.CounterOpts{Name: "crates_manifest_bytes_total", Help: "Bytes written to manifests"})
+
+	// metEnabled is set once metrics are served; collector-side metrics are
+	// only observed then, to keep the hot path free of timing calls otherwise.
+	metEnabled atomic.Bool
 )
 
 func initMetrics() {
 	metOnce.Do(func() {
-		prometheus.MustRegister(metRequests, metBytes, metDuration, metRetries, metInflight, metProcessed)
+		prometheus.MustRegister(metRequests, metBytes, metDuration, metRetries, metChecksumRetries, metInflight, metProcessed, metManifestWrite, metManifestBytes)
+		metEnabled.Store(true)
 	})
 }
 
-func serveMetrics(addr string) {
+// meteredWriter counts manifest bytes when metrics are enabled.
+type meteredWriter struct{ w io.Writer }
+
+func (m meteredWriter) Write(p []byte) (int, error) {
+	n, err := m.w.Write(p)
+	if metEnabled.Load() {
+		metManifestBytes.Add(float64(n))
+	}
+	return n, err
+}
+
+// metricsHandler serves the default registry, negotiating OpenMetrics so
+// scrapers that ask for it also receive exemplars.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
+
+// statusHandler serves /api/status.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	type status struct {
+		Version   string `json:"version"`
+		Processed int64  `json:"processed"`
+		OK        int64  `json:"ok"`
+		Errors    int64  `json:"errors"`
+		UptimeSec int64  `json:"uptime_sec"`
+		Rate      string `json:"rate_per_sec"`
+		// Protocol is what the server negotiated in the preflight request.
+		Protocol string `json:"protocol,omitempty"`
+	}
+	// Best-effort snapshot; rate derived from Prom is non-trivial here, so omit if unknown.
+	// We expose counts via theDownloaderSnapshot helper.
+	processed, ok, errc, startedAt, rate := theDownloaderSnapshot()
+	st := status{
+		Version:   "dev",
+		Processed: processed,
+		OK:        ok,
+		Errors:    errc,
+		UptimeSec: int64(time.Since(startedAt).Seconds()),
+		Rate:      rate,
+		Protocol:  detectedProtocol(),
+	}
+	b, _ := json.Marshal(st)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func serveMetrics(ln net.Listener) {
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/metrics", metricsHandler())
 	// Minimal JSON status endpoint for future GUI
-	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
-		type status struct {
-			Version   string `json:"version"`
-			Processed int64  `json:"processed"`
-			OK        int64  `json:"ok"`
-			Errors    int64  `json:"errors"`
-			UptimeSec int64  `json:"uptime_sec"`
-			Rate      string `json:"rate_per_sec"`
-		}
-		// Best-effort snapshot; rate derived from Prom is non-trivial here, so omit if unknown.
-		// We expose counts via theDownloaderSnapshot helper.
-		processed, ok, errc, startedAt, rate := theDownloaderSnapshot()
-		st := status{
-			Version:   "dev",
-			Processed: processed,
-			OK:        ok,
-			Errors:    errc,
-			UptimeSec: int64(time.Since(startedAt).Seconds()),
-			Rate:      rate,
-		}
-		b, _ := json.Marshal(st)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(b)
-	})
+	mux.HandleFunc("/api/status", statusHandler)
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	go func() {
-		slog.Info("metrics/pprof listening", "addr", addr)
-		if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Info("metrics/pprof listening", "addr", ln.Addr().String())
+		if err := http.Serve(ln, mux); err != nil {
 			slog.Error("metrics server error", "err", err)
 		}
 	}()
 }
 
 // StartMetricsServer exposes Prometheus metrics and pprof handlers when addr is non-empty.
-func StartMetricsServer(addr string) {
+// The address is bound before it returns, so a port already in use is reported
+// to the caller instead of only being logged later.
+func StartMetricsServer(addr string) error {
 	if addr == "" {
-		return
+		return nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("metrics listen %s: %w", addr, err)
 	}
 	initMetrics()
-	serveMetrics(addr)
+	serveMetrics(ln)
+	return nil
 }
 
 // global snapshot hooks for status (set by NewDownloader)
@@ -366,6 +589,24 @@ func (d *Downloader) incErr() {
 	d.countsMu.Unlock()
 }
 
+func (d *Downloader) incChecksumRetries() {
+	d.countsMu.Lock()
+	d.csRetries++
+	d.countsMu.Unlock()
+}
+
+// BytesDownloaded returns the body bytes of all successful downloads so far.
+func (d *Downloader) BytesDownloaded() int64 {
+	return d.bytes.Load()
+}
+
+// ChecksumRetries returns how many downloads were re-fetched after a checksum mismatch.
+func (d *Downloader) ChecksumRetries() int64 {
+	d.countsMu.Lock()
+	defer d.countsMu.Unlock()
+	return d.csRetries
+}
+
 func (d *Downloader) incTotal() int64 {
 	d.countsMu.Lock()
 	d.total++
@@ -382,6 +623,13 @@ func (d *Downloader) snapshotCounts() (ok int64, err int64) {
 	return
 }
 
+// Counts returns the number of processed, successful and failed records so far.
+func (d *Downloader) Counts() (total, ok, errs int64) {
+	d.countsMu.Lock()
+	defer d.countsMu.Unlock()
+	return d.total, d.okCount, d.errCount
+}
+
 // DefaultConcurrency returns an aggressive yet safe default for high-throughput mirroring.
 func DefaultConcurrency() int {
 	return max(64, runtime.NumCPU()*32)
@@ -398,6 +646,7 @@ func NewDownloader(outDir string, concurrency int, timeout time.Duration, checks
 		MaxConnsPerHost:       concurrency * 2,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
+		TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
 		ExpectContinueTimeout: 1 * time.Second,
 	}
 	cli := &http.Client{Transport: tr, Timeout: timeout}
@@ -416,6 +665,8 @@ func NewDownloader(outDir string, concurrency int, timeout time.Duration, checks
 		retryBase:    500 * time.Millisecond,
 		retryMax:     30 * time.Second,
 		startedAt:    time.Now(),
+		urlBuf:       -1,
+		resultBuf:    -1,
 	}
 	snapMu.Lock()
 	snapFunc = func() (int64, int64, int64, time.Time, string) {
@@ -499,46 +750,221 @@ func crateDirFor(crateName string, outDir string) string {
 	return filepath.Join(outDir, firstDir, secondDir)
 }
 
+// outPathFor returns the directory and file name a URL is stored under.
+func (d *Downloader) outPathFor(url string) (dir, name string) {
+	name = sanitizeName(url)
+	crate := d.crateName(url)
+	if d.normalizeCase {
+		name = strings.ToLower(name)
+		crate = strings.ToLower(crate)
+	}
+	return crateDirFor(crate, d.rootFor(crate)), d.transform.storedName(name)
+}
+
 func (d *Downloader) fetchOne(ctx context.Context, url string, filesCh chan<- string) Record {
 	rec := Record{SchemaVersion: 1, URL: url, StartedAt: time.Now().UTC().Format(time.RFC3339)}
-	name := sanitizeName(url)
-	crate := crateNameFromURL(url)
-	crateDir := crateDirFor(crate, d.outDir)
-	if err := os.MkdirAll(crateDir, 0o755); err != nil {
-		rec.Error = err.Error()
-		rec.Status = "error"
+	if host, ok := d.urlHostAllowed(url); !ok {
+		// Checked before the URL decides any local path.
+		rec.Error = fmt.Sprintf("%v: %s", ErrHostNotAllowed, host)
+		rec.Status = StatusHostNotAllowed
+		rec.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+		slog.Warn("host_not_allowed", "url", url, "host", host)
 		d.incErr()
 		metProcessed.WithLabelValues("error").Inc()
 		return rec
 	}
+	crateDir, name := d.outPathFor(url)
+	if d.routes != nil {
+		rec.Root = d.rootFor(d.crateName(url))
+	}
+	if orig := sanitizeName(url); orig != name {
+		rec.OriginalName = orig
+	}
 	outPath := filepath.Join(crateDir, name)
 
-	// Skip if exists and checksum (if any) matches
-	if _, err := os.Stat(outPath); err == nil {
-		if ok, _ := d.verifyFile(outPath, url); ok {
+	// Skip if exists and checksum (if any) matches. Transformed files cannot be
+	// checked against the served checksum, so existing ones are trusted.
+	if fi, err := d.storage().Stat(outPath); err == nil {
+		ok, sum, archErr, readErr := d.verifyStored(outPath, url, fi.Size())
+		if readErr != nil {
+			// Re-downloading over a file that may be fine would hide a failing disk.
+			return d.readErrorRecord(rec, outPath, readErr)
+		}
+		if archErr != nil && ok {
+			slog.Warn("existing file is not a valid crate archive, refetching", "path", outPath, "err", archErr)
+		} else if ok || d.transformed() {
+			d.firstWithSum(sum, outPath)
 			rec.Path = outPath
 			rec.FinishedAt = time.Now().UTC().Format(time.RFC3339)
 			rec.OK = true
 			rec.Status = "ok"
+			if fi != nil && fi.Size() == 0 {
+				rec.Status = StatusEmptyOK
+			}
 			d.incOK()
 			metProcessed.WithLabelValues("skipped").Inc()
 			return rec
 		}
 	}
 
-	// Create file tmp then rename with retries for transient failures
-	tmpPath := outPath + ".part"
+	// Download, then re-fetch up to checksumRetries times if the body does not verify.
 	var (
-		n          int64
-		lastErr    error
-		attemptCnt int
+		n       int64
+		ok      bool
+		sum     string
+		body    fetched
+		archErr error
+		readErr error
 	)
+	for {
+		var attemptCnt int
+		var err error
+		body, attemptCnt, err = d.download(ctx, url, outPath)
+		n = body.stored
+		rec.Retries += max(0, attemptCnt-1)
+		if err != nil {
+			rec.Error = err.Error()
+			rec.Status = "error"
+			if deadlineExceeded(ctx) {
+				rec.Error = fmt.Sprintf("%v after %d attempts: %v", ErrURLDeadline, attemptCnt, err)
+				rec.Status = StatusDeadline
+			}
+			d.incErr()
+			metProcessed.WithLabelValues("error").Inc()
+			return rec
+		}
+		if d.transformed() {
+			// The stored bytes differ from the served ones; check what was hashed in flight.
+			sum = body.sum
+			ok = d.sumMatches(url, sum)
+			rec.StoredSHA256 = body.storedSum
+		} else {
+			ok, sum, archErr, readErr = d.verifyStored(outPath, url, n)
+			if readErr != nil {
+				rec.Size = n
+				return d.readErrorRecord(rec, outPath, readErr)
+			}
+		}
+		if ok || rec.ChecksumRetries >= d.checksumRetries || ctx.Err() != nil {
+			break
+		}
+		if _, _, bad := d.sourcesDisagree(url); bad {
+			break // no body can match both sources; re-fetching will not help
+		}
+		rec.ChecksumRetries++
+		d.incChecksumRetries()
+		metChecksumRetries.Inc()
+		slog.Warn("checksum mismatch, refetching", "attempt", rec.ChecksumRetries, "max", d.checksumRetries, "url", url, "sha256", sum)
+		_ = d.storage().Remove(outPath)
+	}
+
+	// A bad archive only decides the outcome when the checksum was fine. A
+	// scanner's rejection always does: the file must not stay in the mirror.
+	scanFailed := body.scanErr != nil
+	badArchive := ok && archErr != nil && !scanFailed
+	if badArchive || scanFailed {
+		ok = false
+	}
+
+	rec.Path = outPath
+	rec.Size = n
+	rec.SHA256 = sum
+	rec.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	rec.OK = ok
+	if !ok {
+		d.incErr()
+		rec.Error = "checksum mismatch"
+		rec.Status = "error"
+		if scanFailed {
+			rec.Error = body.scanErr.Error()
+			rec.Status = StatusScanFailed
+			if qp, err := d.quarantine(d.rootFor(d.crateName(url)), outPath); err != nil {
+				slog.Warn("quarantine_failed", "path", outPath, "err", err)
+			} else {
+				rec.Path = qp
+			}
+			slog.Error("scan_failed", "url", url, "path", rec.Path, "err", body.scanErr)
+		} else if badArchive {
+			rec.Error = "bad archive: " + archErr.Error()
+			rec.Status = StatusBadArchive
+			switch {
+			case errors.Is(archErr, errBadGzip):
+				rec.Error = archErr.Error()
+				rec.Status = StatusBadGzip
+			case errors.Is(archErr, ErrCrateMismatch):
+				rec.Error = archErr.Error()
+				rec.Status = StatusCrateMismatch
+			}
+			if qp, err := d.quarantine(d.rootFor(d.crateName(url)), outPath); err != nil {
+				slog.Warn("quarantine_failed", "path", outPath, "err", err)
+			} else {
+				rec.Path = qp
+			}
+			slog.Error("bad_archive", "url", url, "path", rec.Path, "err", archErr)
+		} else if primary, secondary, bad := d.sourcesDisagree(url); bad {
+			rec.Error = fmt.Sprintf("checksum sources disagree: primary %s, secondary %s", primary, secondary)
+			rec.Status = StatusChecksumDisagreement
+			slog.Error("checksum_disagreement", "url", url, "primary", primary, "secondary", secondary, "sha256", sum)
+		}
+		metProcessed.WithLabelValues("error").Inc()
+		// keep the file for debugging; caller may decide to delete
+	} else {
+		if first := d.firstWithSum(sum, outPath); first != outPath {
+			rec.LinkTarget = d.linkDupe(first, outPath)
+		}
+		d.incOK()
+		rec.Status = "ok"
+		if n == 0 {
+			// A verified zero-byte body is a real (if odd) artifact, not a truncation.
+			rec.Status = StatusEmptyOK
+			slog.Info("empty_crate", "url", url, "checksum_checked", d.expectedSum(url) != "")
+		}
+		metProcessed.WithLabelValues("ok").Inc()
+		if d.provenance {
+			d.writeProvenance(rec, body)
+		}
+		// Send to bundler
+		if d.bundler != nil && d.bundler.enabled {
+			// header path inside tar mirrors subdir structure by url host/path
+			d.queueBundle(bundleJob{url: url, path: outPath, header: d.bundler.headerName(url, outPath)})
+		}
+		if filesCh != nil {
+			filesCh <- outPath
+		}
+	}
+
+	return rec
+}
+
+// DefaultTempSuffix ends the names of in-progress downloads unless
+// SetTempSuffix overrides it.
+const DefaultTempSuffix = ".part"
+
+// tempPath returns a unique in-progress name for outPath. The random token
+// keeps concurrent downloads of the same target from sharing a temp file.
+func (d *Downloader) tempPath(outPath string) string {
+	suffix := d.tmpSuffix
+	if suffix == "" {
+		suffix = DefaultTempSuffix
+	}
+	return fmt.Sprintf("%s.%08x%s", outPath, rand.Uint32(), suffix)
+}
+
+// download fetches url into a temp file next to outPath, retrying transient
+// failures with backoff. It returns the bytes written and attempts made.
+func (d *Downloader) download(ctx context.Context, url, outPath string) (body fetched, attemptCnt int, lastErr error) {
 	attempts := max(1, d.retries)
+	host := d.metricHost(url)
 	for attempt := 1; attempt <= attempts; attempt++ {
 		attemptCnt = attempt
-		// ensure previous partial is removed
-		_ = os.Remove(tmpPath)
-		f, err := os.Create(tmpPath)
+		// A fresh name per attempt: duplicate URLs in the worklist can have two
+		// workers downloading the same target at once.
+		tmpPath := d.tempPath(outPath)
+		if err := d.creates.wait(ctx); err != nil {
+			lastErr = err
+			break
+		}
+		f, err := d.storage().Create(tmpPath)
 		if err != nil {
 			lastErr = err
 			break
@@ -546,27 +972,37 @@ func (d *Downloader) fetchOne(ctx context.Context, url string, filesCh chan<- st
 
 		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 		req.Header.Set("User-Agent", "Aptlantis-crates-mirror/0.1")
+		tc := d.attemptTrace()
+		if tc.valid() {
+			req.Header.Set("traceparent", tc.traceparent())
+		}
 		metInflight.Inc()
 		attemptStart := time.Now()
 		decInflight := true
 		resp, err := d.client.Do(req)
 		if err != nil {
 			f.Close()
-			_ = os.Remove(tmpPath)
+			_ = d.storage().Remove(tmpPath)
 			lastErr = err
-			metDuration.Observe(time.Since(attemptStart).Seconds())
-			metRequests.WithLabelValues("error", "net").Inc()
+			d.observeDuration(url, host, time.Since(attemptStart), tc)
+			metRequests.WithLabelValues("error", "net", host).Inc()
 		} else {
 			if resp.StatusCode == http.StatusOK {
-				n, err = io.Copy(f, resp.Body)
+				scan := d.startScan(ctx, url, outPath)
+				body, err = d.writeBody(f, scan.tee(resp.Body))
+				body.status = resp.StatusCode
+				body.etag = resp.Header.Get("ETag")
+				body.lastModified = resp.Header.Get("Last-Modified")
 				resp.Body.Close()
 				f.Close()
+				body.scanErr = scan.finish(err == nil)
 				if err == nil {
-					if err := os.Rename(tmpPath, outPath); err == nil {
+					if err := d.storage().Rename(tmpPath, outPath); err == nil {
 						lastErr = nil
-						metBytes.Add(float64(n))
-						metDuration.Observe(time.Since(attemptStart).Seconds())
-						metRequests.WithLabelValues("ok", strconv.Itoa(resp.StatusCode)).Inc()
+						d.bytes.Add(body.n)
+						metBytes.WithLabelValues(host).Add(float64(body.n))
+						d.observeDuration(url, host, time.Since(attemptStart), tc)
+						metRequests.WithLabelValues("ok", strconv.Itoa(resp.StatusCode), host).Inc()
 						metInflight.Dec()
 						decInflight = false
 						break
@@ -575,15 +1011,16 @@ func (d *Downloader) fetchOne(ctx context.Context, url string, filesCh chan<- st
 				} else {
 					lastErr = err
 				}
+				_ = d.storage().Remove(tmpPath)
 			} else {
 				// treat 408/425/429 and 5xx as retryable
 				retryable := resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooEarly || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
 				lastErr = fmt.Errorf("HTTP %d", resp.StatusCode)
 				resp.Body.Close()
 				f.Close()
-				_ = os.Remove(tmpPath)
-				metDuration.Observe(time.Since(attemptStart).Seconds())
-				metRequests.WithLabelValues("error", strconv.Itoa(resp.StatusCode)).Inc()
+				_ = d.storage().Remove(tmpPath)
+				d.observeDuration(url, host, time.Since(attemptStart), tc)
+				metRequests.WithLabelValues("error", strconv.Itoa(resp.StatusCode), host).Inc()
 				if !retryable {
 					metInflight.Dec()
 					decInflight = false
@@ -609,54 +1046,30 @@ func (d *Downloader) fetchOne(ctx context.Context, url string, filesCh chan<- st
 			if back > d.retryMax {
 				back = d.retryMax
 			}
-			jitter := 0.5 + (float64(time.Now().UnixNano()&0x3ff) / 1024.0) // pseudo randomness without math/rand
+			jitter := 0.5 + rand.Float64() // 0.5x to 1.5x the backoff
 			sleep := time.Duration(float64(back) * jitter)
 			slog.Warn("retrying", "attempt", attempt, "max", attempts, "backoff", sleep.String(), "url", url, "err", lastErr)
 			metRetries.Inc()
-			time.Sleep(sleep)
-		}
-	}
-	rec.Retries = max(0, attemptCnt-1)
-	if lastErr != nil {
-		rec.Error = lastErr.Error()
-		rec.Status = "error"
-		d.incErr()
-		metProcessed.WithLabelValues("error").Inc()
-		return rec
-	}
-
-	// Verify checksum if provided
-	ok, sum := d.verifyFile(outPath, url)
-	rec.Path = outPath
-	rec.Size = n
-	rec.SHA256 = sum
-	rec.FinishedAt = time.Now().UTC().Format(time.RFC3339)
-	rec.OK = ok
-	if !ok {
-		d.incErr()
-		rec.Error = "checksum mismatch"
-		rec.Status = "error"
-		metProcessed.WithLabelValues("error").Inc()
-		// keep the file for debugging; caller may decide to delete
-	} else {
-		d.incOK()
-		rec.Status = "ok"
-		metProcessed.WithLabelValues("ok").Inc()
-		// Send to bundler
-		if d.bundler != nil && d.bundler.enabled {
-			// header path inside tar mirrors subdir structure by url host/path
-			headerName := headerPathFor(url, name)
-			if err := d.bundler.AddFile(outPath, headerName); err != nil {
-				// Log but keep going
-				slog.Warn("bundle_failed", "url", url, "err", err.Error())
+			if err := sleepCtx(ctx, sleep); err != nil {
+				lastErr = err
+				break
 			}
 		}
-		if filesCh != nil {
-			filesCh <- outPath
-		}
 	}
+	return body, attemptCnt, lastErr
+}
 
-	return rec
+// sleepCtx waits for d or until ctx is done, whichever comes first.
+// It returns ctx.Err() when the wait was interrupted.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
 }
 
 func headerPathFor(url string, base string) string {
@@ -681,23 +1094,60 @@ func headerPathFor(url string, base string) string {
 	return filepath.Join(host, base)
 }
 
-func (d *Downloader) verifyFile(path, url string) (bool, string) {
-	want, ok := d.checksums[url]
-	// compute regardless to record sum
-	f, err := os.Open(path)
-	if err != nil {
-		return false, ""
+// crateVersionFromURL splits a crates download URL into crate name and
+// version; it returns empty strings for URLs of any other shape.
+func crateVersionFromURL(u string) (crate, version string) {
+	crate = crateNameFromURL(u)
+	base := u[strings.LastIndex(u, "/")+1:]
+	version, ok := strings.CutPrefix(strings.TrimSuffix(base, ".crate"), crate+"-")
+	if crate == "" || !ok || version == "" {
+		return "", ""
 	}
-	defer f.Close()
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return false, ""
+	return crate, version
+}
+
+// expectedSum returns the known SHA256 for url, consulting the checksum map
+// first and then the lookup set by SetChecksumLookup. Empty means unknown.
+func (d *Downloader) expectedSum(url string) string {
+	if want := d.checksums[url]; want != "" {
+		return want
 	}
-	got := hex.EncodeToString(h.Sum(nil))
-	if ok && want != "" {
-		return strings.EqualFold(want, got), got
+	if d.sumLookup == nil {
+		return ""
 	}
-	return true, got
+	crate, version := crateVersionFromURL(url)
+	if crate == "" {
+		return ""
+	}
+	want, ok := d.sumLookup(crate, version)
+	if !ok {
+		slog.Debug("no checksum for crate", "crate", crate, "version", version)
+	}
+	return want
+}
+
+// readErrorRecord finishes rec for a stored file that could not be read
+// back for verification.
+func (d *Downloader) readErrorRecord(rec Record, path string, err error) Record {
+	rec.Path = path
+	rec.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	rec.Error = "read stored file: " + err.Error()
+	rec.Status = StatusReadError
+	slog.Error("verify_read_failed", "url", rec.URL, "path", path, "err", err)
+	d.incErr()
+	metProcessed.WithLabelValues("error").Inc()
+	return rec
+}
+
+func (d *Downloader) verifyFile(path, url string) (bool, string) {
+	ok, sum, _, _ := d.verifyStored(path, url, 0)
+	return ok, sum
+}
+
+// hashFile returns the hex SHA256 of a stored file.
+func (d *Downloader) hashFile(path string) (string, error) {
+	sum, _, err := d.readStored(path, nil)
+	return sum, err
 }
 
 // ProgressEach enables logging after every n processed items when n>0.
@@ -715,6 +1165,78 @@ func (d *Downloader) SetRetries(n int) {
 	d.retries = n
 }
 
+// SetHardlinkDupes makes byte-identical crate files share storage: later
+// copies are replaced by hardlinks to the first file with the same SHA256.
+// It only applies to the local filesystem store.
+func (d *Downloader) SetHardlinkDupes(v bool) {
+	d.hardlinkDupes = v
+}
+
+// firstWithSum returns the first path recorded for sum, recording path if
+// there is none yet. It returns path unchanged when dedupe is off.
+func (d *Downloader) firstWithSum(sum, path string) string {
+	if !d.hardlinkDupes || sum == "" {
+		return path
+	}
+	if _, local := d.storage().(LocalStore); !local {
+		return path
+	}
+	d.sumsMu.Lock()
+	defer d.sumsMu.Unlock()
+	if d.pathBySum == nil {
+		d.pathBySum = make(map[string]string)
+	}
+	if first, ok := d.pathBySum[sum]; ok {
+		return first
+	}
+	d.pathBySum[sum] = path
+	return path
+}
+
+// linkDupe replaces path with a hardlink to first and returns first. If the
+// filesystem cannot hardlink, the downloaded copy is kept and "" is returned.
+func (d *Downloader) linkDupe(first, path string) string {
+	tmp := path + ".link"
+	_ = os.Remove(tmp)
+	if err := os.Link(first, tmp); err != nil {
+		slog.Debug("hardlink_unsupported", "target", first, "path", path, "err", err)
+		return ""
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		slog.Warn("hardlink_failed", "target", first, "path", path, "err", err)
+		return ""
+	}
+	return first
+}
+
+// SetStore replaces the local filesystem as the destination for downloads.
+// Bundling still reads from the local filesystem, so it needs a LocalStore.
+func (d *Downloader) SetStore(s BlobStore) {
+	if s != nil {
+		d.store = s
+	}
+}
+
+func (d *Downloader) storage() BlobStore {
+	if d.store == nil {
+		return LocalStore{}
+	}
+	return d.store
+}
+
+// SetChecksumRetries sets how many times a download whose checksum does not
+// match is deleted and fetched again before it is reported as an error.
+func (d *Downloader) SetChecksumRetries(n int) {
+	d.checksumRetries = max(0, n)
+}
+
+// SetChecksumLookup supplies checksums for URLs missing from the checksum map,
+// e.g. from a sidecar tree. Crates the lookup does not know are not verified.
+func (d *Downloader) SetChecksumLookup(fn func(crate, version string) (sum string, ok bool)) {
+	d.sumLookup = fn
+}
+
 // SetRetryBase adjusts the base exponential backoff duration.
 func (d *Downloader) SetRetryBase(dur time.Duration) {
 	if dur > 0 {
@@ -729,6 +1251,23 @@ func (d *Downloader) SetRetryMax(dur time.Duration) {
 	}
 }
 
+// SetNormalizeCase lowercases crate names when building shard paths and file
+// names so a mirror can move between case-sensitive and case-insensitive
+// filesystems. Records keep the original name in OriginalName.
+func (d *Downloader) SetNormalizeCase(on bool) {
+	d.normalizeCase = on
+}
+
+// SetTempSuffix changes the suffix of in-progress downloads (default .part),
+// for destinations watched by tools that match on it. The bundler is told too,
+// so it keeps refusing unfinished files.
+func (d *Downloader) SetTempSuffix(suffix string) {
+	d.tmpSuffix = suffix
+	if d.bundler != nil {
+		d.bundler.tmpSuffix = suffix
+	}
+}
+
 // HTTPTransport exposes the underlying transport for advanced tuning.
 func (d *Downloader) HTTPTransport() http.RoundTripper {
 	return d.client.Transport
@@ -738,44 +1277,25 @@ func (d *Downloader) Run(ctx context.Context, urls []string) error {
 	if err := os.MkdirAll(d.outDir, 0o755); err != nil {
 		return err
 	}
+	for _, r := range d.routes {
+		if err := os.MkdirAll(r.Dir, 0o755); err != nil {
+			return err
+		}
+	}
+	if n, err := d.cleanTemps(); err != nil {
+		return fmt.Errorf("clean temps: %w", err)
+	} else if n > 0 {
+		slog.Info("temp_cleanup", "removed", n, "older_than", d.cleanTempsAge.String())
+	}
+	if err := d.checkCollisions(urls); err != nil {
+		return err
+	}
 
 	slog.Info("starting", "urls", len(urls), "concurrency", d.concurrency, "out", d.outDir)
 	start := time.Now()
 
-	urlsCh := make(chan string)
-	resultsCh := make(chan Record)
-	var wg sync.WaitGroup
-
-	// workers
-	for i := 0; i < d.concurrency; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for u := range urlsCh {
-				ctxTimeout, cancel := context.WithTimeout(ctx, d.timeout)
-				rec := d.fetchOne(ctxTimeout, u, nil)
-				cancel()
-				resultsCh <- rec
-			}
-		}()
-	}
-
-	// result collector
-	var doneCollect sync.WaitGroup
-	doneCollect.Add(1)
-	go func() {
-		defer doneCollect.Done()
-		enc := json.NewEncoder(d.recordsW)
-		var processed int64
-		for rec := range resultsCh {
-			enc.Encode(rec)
-			processed = d.incTotal()
-			if d.progressEach > 0 && processed%d.progressEach == 0 {
-				ok, errc := d.snapshotCounts()
-				slog.Info("progress", "processed", processed, "ok", ok, "err", errc)
-			}
-		}
-	}()
+	stopBundling := d.startBundling()
+	d.eta = d.startETA(urls)
 
 	// optional periodic progress reporter
 	var progressDone chan struct{}
@@ -798,7 +1318,8 @@ func (d *Downloader) Run(ctx context.Context, urls []string) error {
 					if elapsed > 0 {
 						rate = float64(processed) / elapsed.Seconds()
 					}
-					slog.Info("progress", "processed", processed, "ok", ok, "err", errc, "elapsed", elapsed.String(), "rate_per_sec", fmt.Sprintf("%.1f", rate))
+					attrs := []any{"processed", processed, "ok", ok, "err", errc, "elapsed", elapsed.String(), "rate_per_sec", fmt.Sprintf("%.1f", rate)}
+					slog.Info("progress", append(attrs, d.eta.attrs(processed, elapsed)...)...)
 					last = processed
 				case <-progressDone:
 					return
@@ -807,17 +1328,19 @@ func (d *Downloader) Run(ctx context.Context, urls []string) error {
 		}()
 	}
 
-	// feed
-	go func() {
-		for _, u := range urls {
-			urlsCh <- u
-		}
-		close(urlsCh)
-	}()
-
-	wg.Wait()
-	close(resultsCh)
-	doneCollect.Wait()
+	d.budgetHit.Store(false)
+	d.resetManifestErrors()
+	before := d.getTotal()
+	failed, sent := d.pass(ctx, urls, 0)
+	processed := d.getTotal() - before
+	for round := 1; round <= d.finalRounds && len(failed) > 0 && !d.BudgetReached() && !d.manifestAbort() && ctx.Err() == nil; round++ {
+		failed = d.finalRetryRound(ctx, failed, round)
+	}
+	stopBundling()
+	d.closeShardManifests()
+	if err := d.closeEvents(); err != nil {
+		slog.Error("events_close_failed", "err", err)
+	}
 	if progressDone != nil {
 		close(progressDone)
 	}
@@ -828,13 +1351,86 @@ func (d *Downloader) Run(ctx context.Context, urls []string) error {
 
 	dur := time.Since(start)
 	ok, errc := d.snapshotCounts()
-	slog.Info("done", "total", d.getTotal(), "ok", ok, "err", errc, "elapsed", dur.String())
+	bytes := d.BytesDownloaded()
+	var mibps float64
+	if dur > 0 {
+		mibps = float64(bytes) / (1 << 20) / dur.Seconds()
+	}
+	slog.Info("done", "total", d.getTotal(), "ok", ok, "err", errc, "checksum_retries", d.ChecksumRetries(), "bytes", bytes, "mib_per_sec", fmt.Sprintf("%.1f", mibps), "elapsed", dur.String())
+	if err := d.manifestErrorsResult(); err != nil {
+		return err
+	}
+	if err := d.countResult(len(urls), sent, processed); err != nil {
+		return err
+	}
+	if d.samplePct > 0 {
+		return d.verifySample(ctx)
+	}
 	return nil
 }
 
-// ReadURLs loads newline-delimited URLs from listPath, skipping blanks and comments.
+// pass downloads urls with d.concurrency workers and the collectors that
+// write the manifest (see SetManifestCollectors). round is 0 for the main pass and counts final retry
+// rounds after it. It returns the URLs whose records were not OK and how many
+// of urls were dispatched; the rest were held back by the byte budget.
+func (d *Downloader) pass(ctx context.Context, urls []string, round int) (failed []string, sent int) {
+	urlBuf, resultBuf := d.channelBuffers()
+	urlsCh := make(chan string, urlBuf)
+	resultsCh := make(chan Record, resultBuf)
+	var wg sync.WaitGroup
+
+	// workers
+	for i := 0; i < d.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range urlsCh {
+				ctxTimeout, cancel := d.urlContext(ctx)
+				rec := d.fetchRecovered(ctxTimeout, u)
+				cancel()
+				if round > 0 && rec.OK {
+					rec.FinalRound = round
+				}
+				resultsCh <- rec
+			}
+		}()
+	}
+
+	// result collectors
+	var (
+		doneCollect sync.WaitGroup
+		collectMu   sync.Mutex
+	)
+	for i := 0; i < d.collectorCount(); i++ {
+		doneCollect.Add(1)
+		go func() {
+			defer doneCollect.Done()
+			d.collect(resultsCh, round, &collectMu, &failed)
+		}()
+	}
+
+	// feed
+	go func() {
+		for i, u := range urls {
+			if d.overBudget(len(urls)-i) || d.manifestAbort() {
+				break
+			}
+			urlsCh <- u
+			sent++
+		}
+		close(urlsCh)
+	}()
+
+	wg.Wait()
+	close(resultsCh)
+	doneCollect.Wait()
+	return failed, sent
+}
+
+// ReadURLs loads newline-delimited URLs from listPath, skipping blanks and
+// comments. StdinPath reads standard input.
 func ReadURLs(listPath string) ([]string, error) {
-	f, err := os.Open(listPath)
+	f, err := openInput(listPath)
 	if err != nil {
 		return nil, err
 	}
@@ -853,26 +1449,30 @@ func ReadURLs(listPath string) ([]string, error) {
 }
 
 // ReadChecksums loads expected SHA-256 values from a JSONL file of {url, sha256}.
+// StdinPath reads standard input.
 func ReadChecksums(path string) (map[string]string, error) {
+	return readChecksums(path, false)
+}
+
+func readChecksums(path string, validate bool) (map[string]string, error) {
 	if path == "" {
 		return map[string]string{}, nil
 	}
-	f, err := os.Open(path)
+	f, err := openInput(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 	r := bufio.NewReader(f)
 	out := make(map[string]string)
+	var seq int64
 	for {
 		b, err := r.ReadBytes('\n')
-		if len(b) > 0 {
-			var ce ChecksumEntry
-			if json.Unmarshal(bytes.TrimSpace(b), &ce) == nil {
-				if ce.URL != "" && ce.SHA256 != "" {
-					out[ce.URL] = strings.ToLower(ce.SHA256)
-				}
+		if line := bytes.TrimSpace(b); len(line) > 0 {
+			if ce, ok := parseChecksumLine(line, seq, validate); ok {
+				out[ce.URL] = strings.ToLower(ce.SHA256)
 			}
+			seq++
 		}
 		if errors.Is(err, io.EOF) {
 			break
@@ -884,76 +1484,237 @@ func ReadChecksums(path string) (map[string]string, error) {
 	return out, nil
 }
 
-// ReadCratesFromIndex walks a local crates.io-index tree and returns crate URLs plus checksum hints. walks a local crates.io-index directory and produces crate URLs and checksums.
+// ReadCratesFromIndex walks a local crates.io-index tree and returns crate URLs plus checksum hints.
 // - baseURL: typically https://static.crates.io/crates
 // - includeYanked: if false, skip entries with yanked=true
 // - limit: if >0, stop after collecting this many URLs
 func ReadCratesFromIndex(indexDir, baseURL string, includeYanked bool, limit int) ([]string, map[string]string, error) {
-	var urls []string
-	checks := make(map[string]string)
-	baseURL = strings.TrimRight(baseURL, "/")
-	stopWalk := errors.New("stopWalk")
+	res, err := ReadIndex(indexDir, IndexOptions{BaseURL: baseURL, IncludeYanked: includeYanked, Limit: limit})
+	if err != nil {
+		return nil, nil, err
+	}
+	return res.URLs, res.Checksums, nil
+}
 
-	err := filepath.Walk(indexDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if limit > 0 && len(urls) >= limit {
-			return stopWalk
-		}
-		name := info.Name()
-		if info.IsDir() {
-			if name == ".git" || name == ".github" || name == ".gitignore" {
-				return filepath.SkipDir
+// IndexOptions controls how ReadIndex expands a crates.io-index tree into URLs.
+type IndexOptions struct {
+	BaseURL       string
+	IncludeYanked bool
+	Limit         int // stop after this many URLs (0 = no limit)
+	// CrateLimit stops after this many crates, each with all of its versions
+	// (0 = no limit). Unlike Limit it never cuts a crate short.
+	CrateLimit int
+	// Files restricts reading to these index files, relative to the index root.
+	// Nil reads the whole tree; an empty non-nil slice reads nothing.
+	Files []string
+	// Walk augments the built-in rules for non-index files and directories.
+	Walk index.Options
+	// OnEntry, if set, is called with the raw line of every entry that produced
+	// a URL, so callers can derive more outputs from the same index pass.
+	OnEntry func(relIndex string, line []byte)
+	// Strict fails with an *index.LineError on the first malformed or
+	// schema-invalid line instead of skipping it, and on index files that
+	// cannot be read or decompressed.
+	Strict bool
+	// SkipPrerelease drops versions with a SemVer pre-release part (1.0.0-rc.1).
+	SkipPrerelease bool
+	// MinVersion drops versions below this SemVer version, e.g. "1.0.0" to skip 0.x.
+	MinVersion string
+	// ValidateUTF8 rejects lines that are not valid UTF-8 or whose name or vers
+	// holds control characters. They are logged and counted in
+	// IndexResult.Rejected, or fail the read when Strict is set.
+	ValidateUTF8 bool
+	// License, if set, drops crates whose license it does not allow. They are
+	// counted in IndexResult.LicenseSkipped.
+	License *LicenseFilter
+
+	versions versionFilter // parsed from SkipPrerelease and MinVersion by ReadIndex
+}
+
+// IndexResult is what ReadIndex collected from the index.
+type IndexResult struct {
+	URLs      []string
+	Checksums map[string]string // url -> sha256 (hex)
+	// EmptyFiles lists index files (relative, slash-separated) that yielded no
+	// URLs, either because they hold no entries or because filters such as
+	// -include-yanked excluded all of them.
+	EmptyFiles []string
+	// InvalidFiles is the subset of EmptyFiles with no valid (name, vers) line
+	// at all, or that could not be read or decompressed, which points at
+	// corrupt or truncated index data.
+	InvalidFiles []string
+	// Crates is the number of crates that yielded URLs.
+	Crates int
+	// Rejected counts lines dropped by IndexOptions.ValidateUTF8.
+	Rejected int
+	// LicenseSkipped counts versions, and LicenseSkippedCrates distinct
+	// crates, dropped by IndexOptions.License.
+	LicenseSkipped, LicenseSkippedCrates int
+}
+
+// ReadIndex walks indexDir (or only opts.Files) and produces crate URLs and checksums.
+func ReadIndex(indexDir string, opts IndexOptions) (IndexResult, error) {
+	res := IndexResult{Checksums: make(map[string]string)}
+	if err := opts.Walk.Validate(); err != nil {
+		return IndexResult{}, err
+	}
+	opts.BaseURL = strings.TrimRight(opts.BaseURL, "/")
+	vf, err := newVersionFilter(opts.SkipPrerelease, opts.MinVersion)
+	if err != nil {
+		return IndexResult{}, err
+	}
+	opts.versions = vf
+	full := func() bool {
+		return (opts.Limit > 0 && len(res.URLs) >= opts.Limit) ||
+			(opts.CrateLimit > 0 && res.Crates >= opts.CrateLimit)
+	}
+
+	if opts.Files != nil {
+		for _, rel := range opts.Files {
+			if full() {
+				break
+			}
+			if opts.Walk.SkipPath(rel) {
+				continue
+			}
+			path := filepath.Join(indexDir, filepath.FromSlash(rel))
+			if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() {
+				continue // deleted upstream or not a file
+			}
+			if err := readIndexFile(indexDir, path, opts, &res); err != nil {
+				return IndexResult{}, err
 			}
-			return nil
-		}
-		// skip non-regular files
-		if !info.Mode().IsRegular() {
-			return nil
 		}
-		// skip config/readme and other non-index files at root
-		if name == "config.json" || strings.EqualFold(name, "README.md") || strings.HasSuffix(name, ".keep") {
-			return nil
+		return res, nil
+	}
+
+	err = index.Walk(indexDir, opts.Walk, func(path string) error {
+		if full() {
+			return filepath.SkipAll
 		}
+		return readIndexFile(indexDir, path, opts, &res)
+	})
+	if err != nil {
+		return IndexResult{}, err
+	}
+	return res, nil
+}
 
-		f, err := os.Open(path)
-		if err != nil {
+// readIndexFile appends the URLs and checksums of one index file to res. A
+// file that cannot be opened or decompressed, such as a corrupt .gz shard,
+// is logged and listed in res.InvalidFiles (keeping any entries read before
+// the damage) unless opts.Strict is set.
+func readIndexFile(root, path string, opts IndexOptions, res *IndexResult) error {
+	rel := index.RelPath(root, path)
+	f, err := index.Open(path)
+	if err != nil {
+		if opts.Strict {
 			return err
 		}
-		s := bufio.NewScanner(f)
-		s.Buffer(make([]byte, 0, 1024*1024), 64*1024*1024)
-		for s.Scan() {
-			if limit > 0 && len(urls) >= limit {
-				break
-			}
-			line := strings.TrimSpace(s.Text())
-			if line == "" || strings.HasPrefix(line, "#") {
-				continue
+		slog.Warn("index file unreadable, skipping", "file", rel, "err", err)
+		res.EmptyFiles = append(res.EmptyFiles, rel)
+		res.InvalidFiles = append(res.InvalidFiles, rel)
+		return nil
+	}
+	defer f.Close()
+	emitted, valid, lineNo := 0, 0, 0
+	// Crates are counted by name so CrateLimit also works for flat and single
+	// layouts, where one file holds many crates (each crate's lines contiguous).
+	crate, crateEmitted := "", false
+	licenseSkipped := "" // last crate dropped by opts.License
+	truncated := false
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 1024*1024), 64*1024*1024)
+	for s.Scan() {
+		lineNo++
+		if opts.Limit > 0 && len(res.URLs) >= opts.Limit {
+			truncated = true
+			break
+		}
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var ie IndexEntry
+		if err := json.Unmarshal([]byte(line), &ie); err != nil {
+			if opts.Strict {
+				return &index.LineError{File: rel, Line: lineNo, Err: err}
 			}
-			var ie IndexEntry
-			if err := json.Unmarshal([]byte(line), &ie); err != nil {
-				continue // ignore malformed lines
+			continue // ignore malformed lines
+		}
+		if ie.Name == "" || ie.Vers == "" {
+			if opts.Strict {
+				return &index.LineError{File: rel, Line: lineNo, Err: index.ErrMissingField}
 			}
-			if ie.Name == "" || ie.Vers == "" {
+			continue
+		}
+		if opts.ValidateUTF8 {
+			if err := index.CheckText(line, ie.Name, ie.Vers); err != nil {
+				if opts.Strict {
+					return &index.LineError{File: rel, Line: lineNo, Err: err}
+				}
+				slog.Warn("index line rejected", "file", rel, "line", lineNo, "err", err)
+				res.Rejected++
 				continue
 			}
-			if !includeYanked && ie.Yanked {
-				continue
+		}
+		valid++
+		if !opts.IncludeYanked && ie.Yanked {
+			continue
+		}
+		if keep, err := opts.versions.allow(ie.Vers); err != nil {
+			slog.Warn("unparseable version, keeping", "file", rel, "line", lineNo, "vers", ie.Vers, "err", err)
+		} else if !keep {
+			continue
+		}
+		if opts.License != nil && !opts.License.Allows(ie.Name) {
+			if ie.Name != licenseSkipped {
+				res.LicenseSkippedCrates++
+				licenseSkipped = ie.Name
 			}
-			u := fmt.Sprintf("%s/%s/%s-%s.crate", baseURL, ie.Name, ie.Name, ie.Vers)
-			urls = append(urls, u)
-			if ie.Cksum != "" {
-				checks[u] = strings.ToLower(ie.Cksum)
+			res.LicenseSkipped++
+			continue
+		}
+		if ie.Name != crate {
+			if crateEmitted {
+				res.Crates++
+			}
+			if opts.CrateLimit > 0 && res.Crates >= opts.CrateLimit {
+				truncated = true
+				crateEmitted = false
+				break
 			}
+			crate, crateEmitted = ie.Name, false
 		}
-		f.Close()
-		return s.Err()
-	})
-	if err != nil && !errors.Is(err, stopWalk) {
-		return nil, nil, err
+		u := CrateURL(opts.BaseURL, ie.Name, ie.Vers)
+		res.URLs = append(res.URLs, u)
+		crateEmitted = true
+		if ie.Cksum != "" {
+			res.Checksums[u] = strings.ToLower(ie.Cksum)
+		}
+		if opts.OnEntry != nil {
+			opts.OnEntry(rel, []byte(line))
+		}
+		emitted++
 	}
-	return urls, checks, nil
+	if err := s.Err(); err != nil {
+		if opts.Strict {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		slog.Warn("index file unreadable, skipping the rest", "file", rel, "line", lineNo, "err", err)
+	}
+	if crateEmitted {
+		res.Crates++
+	}
+	if emitted == 0 && !truncated {
+		slog.Debug("index file produced no entries", "file", rel)
+		res.EmptyFiles = append(res.EmptyFiles, rel)
+		if valid == 0 {
+			slog.Warn("index file has no valid entries", "file", rel)
+			res.InvalidFiles = append(res.InvalidFiles, rel)
+		}
+	}
+	return nil
 }
 
 // removed bytesTrimSpace helper in favor of bytes.TrimSpace
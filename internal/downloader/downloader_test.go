@@ -1,14 +1,41 @@
 package downloader
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/index"
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/sidecar"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestCrateDirFor(t *testing.T) {
@@ -147,3 +174,3918 @@ func TestReadCratesFromIndex_FlagsAndLimit(t *testing.T) {
 		t.Fatalf("limit not applied, got %d", got)
 	}
 }
+
+func TestFetchOneCancelDuringBackoff(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	d := NewDownloader(t.TempDir(), 1, 5*time.Second, map[string]string{}, io.Discard, nil)
+	d.SetRetries(3)
+	d.SetRetryBase(10 * time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan Record, 1)
+	go func() {
+		done <- d.fetchOne(ctx, srv.URL+"/crates/serde/serde-1.0.0.crate", nil)
+	}()
+
+	// Let the first attempt fail and the worker enter its backoff.
+	time.Sleep(100 * time.Millisecond)
+	cancelled := time.Now()
+	cancel()
+
+	select {
+	case rec := <-done:
+		if waited := time.Since(cancelled); waited > 50*time.Millisecond {
+			t.Fatalf("fetchOne returned %s after cancel", waited)
+		}
+		if rec.OK || !strings.Contains(rec.Error, context.Canceled.Error()) {
+			t.Fatalf("expected canceled error, got ok=%v err=%q", rec.OK, rec.Error)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("fetchOne did not return after cancel")
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/crates/"+DefaultTestCrate {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	idx := t.TempDir()
+	if err := os.WriteFile(filepath.Join(idx, "config.json"), []byte(`{"dl":"x"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DoctorConfig{IndexDir: idx, OutDir: filepath.Join(t.TempDir(), "out"), BaseURL: srv.URL + "/crates", Concurrency: 1}
+	var sb strings.Builder
+	if !PrintDoctor(&sb, Doctor(context.Background(), cfg)) {
+		t.Fatalf("expected all checks to pass:\n%s", sb.String())
+	}
+
+	cfg.IndexDir = t.TempDir() // empty: no config.json, no shards
+	cfg.BaseURL = srv.URL + "/wrong"
+	sb.Reset()
+	if PrintDoctor(&sb, Doctor(context.Background(), cfg)) {
+		t.Fatalf("expected failures:\n%s", sb.String())
+	}
+	for _, want := range []string{"[FAIL] index-dir", "[FAIL] base-url", "[PASS] out-dir"} {
+		if !strings.Contains(sb.String(), want) {
+			t.Fatalf("missing %q in:\n%s", want, sb.String())
+		}
+	}
+}
+
+func TestDoctorAndSampleSizesHonorAllowedHosts(t *testing.T) {
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer srv.Close()
+
+	d := NewDownloader(t.TempDir(), 1, 5*time.Second, nil, io.Discard, nil)
+	d.SetAllowedHosts([]string{"static.crates.io"})
+	var sb strings.Builder
+	PrintDoctor(&sb, d.Doctor(context.Background(), DoctorConfig{OutDir: t.TempDir(), BaseURL: srv.URL + "/crates", Concurrency: 1}))
+	if !strings.Contains(sb.String(), "[FAIL] base-url") || !strings.Contains(sb.String(), ErrHostNotAllowed.Error()) {
+		t.Fatalf("doctor output does not refuse the host:\n%s", sb.String())
+	}
+
+	urls := []string{srv.URL + "/crates/serde/serde-1.0.0.crate"}
+	rep := d.CountURLs(urls)
+	d.SampleSizes(context.Background(), &rep, urls, 1)
+	if rep.Sampled != 0 {
+		t.Fatalf("sampled %d URLs on a host that is not allowed", rep.Sampled)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Fatalf("server saw %d requests, want 0", n)
+	}
+}
+
+func TestCountURLsMatchesFilteredIndex(t *testing.T) {
+	tmp := t.TempDir()
+	write := func(rel, data string) {
+		p := filepath.Join(tmp, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("s/er/serde", `{"name":"serde","vers":"1.0.0","yanked":false}`+"\n"+`{"name":"serde","vers":"1.0.1","yanked":true}`+"\n"+`{"name":"serde","vers":"1.0.2","yanked":false}`+"\n")
+	write("3/l/log", `{"name":"log","vers":"0.4.0","yanked":false}`+"\n")
+
+	urls, _, err := ReadCratesFromIndex(tmp, "https://static.crates.io/crates", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sb strings.Builder
+	CountURLs(urls).Print(&sb)
+	if got, want := sb.String(), "urls=3 crates=2\n"; got != want {
+		t.Fatalf("count output %q, want %q", got, want)
+	}
+}
+
+func TestCountURLsHonorsNameRegex(t *testing.T) {
+	urls := []string{
+		"https://mirror.example/flat/serde_1.0.0.crate",
+		"https://mirror.example/flat/serde_1.0.1.crate",
+		"https://mirror.example/flat/log_0.4.0.crate",
+	}
+	re, err := ParseNameRegex(`/flat/(?P<name>[^/_]+)_[^/]+\.crate$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDownloader(t.TempDir(), 1, time.Second, nil, io.Discard, nil)
+	d.SetNameRegex(re)
+	if rep := d.CountURLs(urls); rep.URLs != 3 || rep.Crates != 2 {
+		t.Fatalf("count %+v, want 3 urls in 2 crates", rep)
+	}
+}
+
+func TestChangedIndexFilesSinceCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	idx := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", idx, "-c", "user.name=t", "-c", "user.email=t@example.com"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	write := func(rel, data string) {
+		p := filepath.Join(idx, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("init", "-q")
+	write("config.json", `{"dl":"x"}`)
+	write("s/er/serde", `{"name":"serde","vers":"1.0.0"}`+"\n")
+	write("3/l/log", `{"name":"log","vers":"0.4.0"}`+"\n")
+	git("add", "-A")
+	git("commit", "-qm", "one")
+	since, err := IndexHead(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("s/er/serde", `{"name":"serde","vers":"1.0.0"}`+"\n"+`{"name":"serde","vers":"1.0.1"}`+"\n")
+	write("to/ki/tokio", `{"name":"tokio","vers":"1.0.0"}`+"\n")
+	write("config.json", `{"dl":"y"}`)
+	git("add", "-A")
+	git("commit", "-qm", "two")
+
+	files, err := ChangedIndexFiles(idx, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ReadIndex(idx, IndexOptions{BaseURL: "https://static.crates.io/crates", Files: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"https://static.crates.io/crates/serde/serde-1.0.0.crate",
+		"https://static.crates.io/crates/serde/serde-1.0.1.crate",
+		"https://static.crates.io/crates/tokio/tokio-1.0.0.crate",
+	}
+	if strings.Join(res.URLs, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("urls = %v, want %v", res.URLs, want)
+	}
+
+	state := filepath.Join(t.TempDir(), "state")
+	head, _ := IndexHead(idx)
+	if err := WriteIndexState(state, head); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ReadIndexState(state); got != head {
+		t.Fatalf("state = %q, want %q", got, head)
+	}
+}
+
+func TestReadIndexGzipMatchesPlain(t *testing.T) {
+	data := `{"name":"serde","vers":"1.0.0","cksum":"` + strings.Repeat("a", 64) + `","yanked":false}` + "\n" +
+		`{"name":"serde","vers":"1.0.1","cksum":"` + strings.Repeat("b", 64) + `","yanked":false}` + "\n"
+
+	plain := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(plain, "s", "er"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(plain, "s", "er", "serde"), []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	gz := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(gz, "s", "er"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(data))
+	zw.Close()
+	if err := os.WriteFile(filepath.Join(gz, "s", "er", "serde.gz"), buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	want, wantSums, err := ReadCratesFromIndex(plain, "https://static.crates.io/crates", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, gotSums, err := ReadCratesFromIndex(gz, "https://static.crates.io/crates", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != 2 || strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("gzip urls %v, plain urls %v", got, want)
+	}
+	for u, sum := range wantSums {
+		if gotSums[u] != sum {
+			t.Fatalf("checksum for %s: got %q want %q", u, gotSums[u], sum)
+		}
+	}
+}
+
+func TestFetchOneNormalizeCase(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("crate"))
+	}))
+	defer srv.Close()
+
+	out := t.TempDir()
+	d := NewDownloader(out, 1, 5*time.Second, map[string]string{}, io.Discard, nil)
+	d.SetNormalizeCase(true)
+	rec := d.fetchOne(context.Background(), srv.URL+"/crates/Inflector/Inflector-0.11.4.crate", nil)
+	if !rec.OK {
+		t.Fatalf("fetch failed: %s", rec.Error)
+	}
+	if want := filepath.Join(out, "i", "nf", "inflector-0.11.4.crate"); rec.Path != want {
+		t.Fatalf("path %q, want %q", rec.Path, want)
+	}
+	if rec.OriginalName != "Inflector-0.11.4.crate" {
+		t.Fatalf("original name %q not recorded", rec.OriginalName)
+	}
+}
+
+// bundleEntries returns the tar header names stored in a bundle-NNNN.tar.zst file.
+func bundleEntries(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read %s: %v", path, err)
+		}
+		names = append(names, hdr.Name)
+	}
+	return names
+}
+
+func TestBundleFromManifest(t *testing.T) {
+	tmp := t.TempDir()
+	out := filepath.Join(tmp, "out")
+	var manifest bytes.Buffer
+	enc := json.NewEncoder(&manifest)
+	for _, v := range []string{"1.0.0", "1.0.1"} {
+		p := filepath.Join(crateDirFor("serde", out), "serde-"+v+".crate")
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("crate "+v), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		enc.Encode(Record{URL: "https://static.crates.io/crates/serde/serde-" + v + ".crate", Path: p, OK: true})
+	}
+	enc.Encode(Record{URL: "https://static.crates.io/crates/serde/serde-2.0.0.crate", Error: "HTTP 404"})
+	manPath := filepath.Join(tmp, "manifest.jsonl")
+	if err := os.WriteFile(manPath, manifest.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	bundles := filepath.Join(tmp, "bundles")
+	b, err := NewBundler(true, bundles, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := BundleFromManifest(manPath, b)
+	if err != nil {
+		t.Fatalf("BundleFromManifest: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("added %d files, want 2", n)
+	}
+	got := bundleEntries(t, filepath.Join(bundles, "bundle-0000.tar.zst"))
+	want := []string{
+		filepath.Join("static.crates.io", "serde-1.0.0.crate"),
+		filepath.Join("static.crates.io", "serde-1.0.1.crate"),
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("bundle entries %v, want %v", got, want)
+	}
+	idx, err := os.ReadFile(filepath.Join(bundles, "bundle-0000.index.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(idx), "\n"); lines != 2 {
+		t.Fatalf("bundle index has %d lines, want 2", lines)
+	}
+}
+
+func TestReadIndexCustomSkip(t *testing.T) {
+	tmp := t.TempDir()
+	for rel, data := range map[string]string{
+		"s/er/serde":       `{"name":"serde","vers":"1.0.0"}` + "\n",
+		"s/er/serde.orig":  `{"name":"serde","vers":"0.0.1"}` + "\n",
+		"audit/report.txt": `{"name":"bogus","vers":"9.9.9"}` + "\n",
+	} {
+		p := filepath.Join(tmp, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := ReadIndex(tmp, IndexOptions{
+		BaseURL: "https://static.crates.io/crates",
+		Walk:    index.Options{SkipFiles: []string{"*.orig"}, SkipDirs: []string{"audit"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.URLs) != 1 || res.URLs[0] != "https://static.crates.io/crates/serde/serde-1.0.0.crate" {
+		t.Fatalf("urls = %v", res.URLs)
+	}
+}
+
+func TestReadIndexReportsEmptyFiles(t *testing.T) {
+	tmp := t.TempDir()
+	for rel, data := range map[string]string{
+		"s/er/serde":  `{"name":"serde","vers":"1.0.0"}` + "\n",
+		"o/ld/oldie":  `{"name":"oldie","vers":"0.1.0","yanked":true}` + "\n",
+		"e/mp/empty0": "\n",
+	} {
+		p := filepath.Join(tmp, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := ReadIndex(tmp, IndexOptions{BaseURL: "https://static.crates.io/crates"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(res.EmptyFiles, ","); got != "e/mp/empty0,o/ld/oldie" {
+		t.Fatalf("empty files = %q", got)
+	}
+}
+
+func TestReadIndexCountsInvalidFiles(t *testing.T) {
+	tmp := t.TempDir()
+	for rel, data := range map[string]string{
+		"s/er/serde": `{"name":"serde","vers":"1.0.0"}` + "\n",
+		"b/ro/broke": "{not json\n" + `{"name":"broke"}` + "\n" + `{"vers":"1.0.0"}` + "\n",
+	} {
+		p := filepath.Join(tmp, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := ReadIndex(tmp, IndexOptions{BaseURL: "https://static.crates.io/crates"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.InvalidFiles) != 1 || res.InvalidFiles[0] != "b/ro/broke" {
+		t.Fatalf("invalid files = %v", res.InvalidFiles)
+	}
+	if len(res.URLs) != 1 {
+		t.Fatalf("urls = %v", res.URLs)
+	}
+}
+
+func TestReadIndexSkipsCorruptGzip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`{"name":"trunc","vers":"1.0.0"}` + "\n" + strings.Repeat(" ", 4096)))
+	zw.Close()
+	tmp := t.TempDir()
+	for rel, data := range map[string][]byte{
+		"s/er/serde":    []byte(`{"name":"serde","vers":"1.0.0"}` + "\n"),
+		"b/ad/bad.gz":   []byte("\x1f\x8bnot really gzip"),
+		"t/ru/trunc.gz": buf.Bytes()[:buf.Len()-8],
+	} {
+		p := filepath.Join(tmp, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := ReadIndex(tmp, IndexOptions{BaseURL: "https://static.crates.io/crates"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.URLs) != 2 {
+		t.Fatalf("urls = %v, want serde and the entry read before the damage", res.URLs)
+	}
+	if len(res.InvalidFiles) != 1 || res.InvalidFiles[0] != "b/ad/bad.gz" {
+		t.Fatalf("invalid files = %v", res.InvalidFiles)
+	}
+	if _, err := ReadIndex(tmp, IndexOptions{BaseURL: "https://static.crates.io/crates", Strict: true}); err == nil {
+		t.Fatal("strict read of a corrupt shard succeeded")
+	}
+}
+
+func TestReadIndexOnEntryWritesSidecars(t *testing.T) {
+	tmp := t.TempDir()
+	for rel, data := range map[string]string{
+		"s/er/serde": `{"name":"serde","vers":"1.0.0"}` + "\n" + `{"name":"serde","vers":"1.0.1","yanked":true}` + "\n",
+		"3/l/log":    `{"name":"log","vers":"0.4.0"}` + "\n",
+	} {
+		p := filepath.Join(tmp, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := t.TempDir()
+	w, err := sidecar.NewWriter(sidecar.Config{OutDir: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ReadIndex(tmp, IndexOptions{BaseURL: "https://static.crates.io/crates", OnEntry: w.WriteLine})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := w.Stats(); st.Wrote != int64(len(res.URLs)) || st.Errors != 0 {
+		t.Fatalf("sidecar stats = %+v, urls = %d", st, len(res.URLs))
+	}
+	for _, p := range []string{"s/er/serde-1.0.0.crate.json", "log/log-0.4.0.crate.json"} {
+		if _, err := os.Stat(filepath.Join(out, filepath.FromSlash(p))); err != nil {
+			t.Errorf("missing sidecar: %v", err)
+		}
+	}
+}
+
+func TestReadIndexStrict(t *testing.T) {
+	tmp := t.TempDir()
+	p := filepath.Join(tmp, "s", "er", "serde")
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	data := `{"name":"serde","vers":"1.0.0"}` + "\n\n" + `{"name":"serde"}` + "\n"
+	if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ReadIndex(tmp, IndexOptions{BaseURL: "https://static.crates.io/crates"})
+	if err != nil || len(res.URLs) != 1 {
+		t.Fatalf("lenient: urls=%d err=%v", len(res.URLs), err)
+	}
+	_, err = ReadIndex(tmp, IndexOptions{BaseURL: "https://static.crates.io/crates", Strict: true})
+	if err == nil || err.Error() != "s/er/serde:3: entry missing name or vers" {
+		t.Fatalf("strict: got %v", err)
+	}
+}
+
+func TestFetchOneRetriesChecksumMismatch(t *testing.T) {
+	body := []byte("crate bytes")
+	var hits int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if hits == 1 {
+			w.Write(body[:4]) // truncated body from a flaky proxy
+			return
+		}
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	sum := sha256.Sum256(body)
+	url := srv.URL + "/crates/serde/serde-1.0.0.crate"
+	checksums := map[string]string{url: hex.EncodeToString(sum[:])}
+
+	d := NewDownloader(t.TempDir(), 1, 5*time.Second, checksums, io.Discard, nil)
+	if rec := d.fetchOne(context.Background(), url, nil); rec.OK {
+		t.Fatal("expected mismatch without checksum retries")
+	}
+
+	hits = 0
+	d = NewDownloader(t.TempDir(), 1, 5*time.Second, checksums, io.Discard, nil)
+	d.SetChecksumRetries(2)
+	rec := d.fetchOne(context.Background(), url, nil)
+	if !rec.OK || rec.ChecksumRetries != 1 || rec.Retries != 0 {
+		t.Fatalf("got ok=%v checksum_retries=%d retries=%d err=%q", rec.OK, rec.ChecksumRetries, rec.Retries, rec.Error)
+	}
+	if got := d.ChecksumRetries(); got != 1 {
+		t.Fatalf("ChecksumRetries() = %d, want 1", got)
+	}
+}
+
+func TestBytesDownloadedWithoutMetrics(t *testing.T) {
+	body := []byte(strings.Repeat("x", 1000))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	d := NewDownloader(t.TempDir(), 2, 5*time.Second, map[string]string{}, io.Discard, nil)
+	urls := []string{srv.URL + "/crates/a/a-1.0.0.crate", srv.URL + "/crates/b/b-1.0.0.crate"}
+	if err := d.Run(context.Background(), urls); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.BytesDownloaded(); got != 2000 {
+		t.Fatalf("BytesDownloaded() = %d, want 2000", got)
+	}
+}
+
+func TestBundlerBrotli(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "a.crate")
+	if err := os.WriteFile(src, []byte("crate A"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(tmp, "bundles")
+	b, err := NewBundlerFormat(true, out, 1, BundleTarBr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddFile(src, "a/a.crate"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(out, "bundle-0000.tar.br"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(brotli.NewReader(f))
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(tr)
+	if err != nil || hdr.Name != "a/a.crate" || string(data) != "crate A" {
+		t.Fatalf("entry %q = %q, err %v", hdr.Name, data, err)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Fatalf("expected a single entry, got %v", err)
+	}
+}
+
+// memStore is an in-memory BlobStore standing in for an object store.
+type memStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+type memWriter struct {
+	bytes.Buffer
+	s    *memStore
+	path string
+}
+
+func (w *memWriter) Close() error {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	w.s.blobs[w.path] = w.Bytes()
+	return nil
+}
+
+func (s *memStore) Create(path string) (io.WriteCloser, error) {
+	return &memWriter{s: s, path: path}, nil
+}
+
+func (s *memStore) Open(path string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.blobs[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *memStore) Stat(path string) (fs.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blobs[path]; !ok {
+		return nil, os.ErrNotExist
+	}
+	return nil, nil
+}
+
+func (s *memStore) Rename(oldPath, newPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.blobs[oldPath]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(s.blobs, oldPath)
+	s.blobs[newPath] = b
+	return nil
+}
+
+func (s *memStore) Remove(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, path)
+	return nil
+}
+
+func TestFetchOneWritesThroughStore(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("crate bytes"))
+	}))
+	defer srv.Close()
+
+	out := t.TempDir()
+	store := &memStore{blobs: map[string][]byte{}}
+	d := NewDownloader(out, 1, 5*time.Second, map[string]string{}, io.Discard, nil)
+	d.SetStore(store)
+	rec := d.fetchOne(context.Background(), srv.URL+"/crates/serde/serde-1.0.0.crate", nil)
+	if !rec.OK {
+		t.Fatalf("fetchOne: %s", rec.Error)
+	}
+	if got := string(store.blobs[rec.Path]); got != "crate bytes" || len(store.blobs) != 1 {
+		t.Fatalf("store = %v", store.blobs)
+	}
+	if entries, _ := os.ReadDir(out); len(entries) != 0 {
+		t.Fatalf("wrote %d entries to the local out dir", len(entries))
+	}
+}
+
+func TestManifestAppendAcrossRuns(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	out := t.TempDir()
+	manifest := filepath.Join(t.TempDir(), "manifest.jsonl")
+	run := func(urls ...string) {
+		f, err := OpenManifest(manifest, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		d := NewDownloader(out, 1, 5*time.Second, map[string]string{}, f, nil)
+		if err := d.Run(context.Background(), urls); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(srv.URL + "/crates/a/a-1.0.0.crate")
+	// Simulate a run killed mid-write.
+	f, err := os.OpenFile(manifest, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"schema_version":1,"url":"tor`)
+	f.Close()
+	run(srv.URL+"/crates/b/b-1.0.0.crate", srv.URL+"/crates/a/a-1.0.0.crate")
+
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("want 3 records, got %d:\n%s", len(lines), data)
+	}
+	for i, l := range lines {
+		var rec Record
+		if err := json.Unmarshal([]byte(l), &rec); err != nil || !rec.OK {
+			t.Fatalf("line %d: ok=%v err=%v: %s", i+1, rec.OK, err, l)
+		}
+	}
+}
+
+func TestCompressedManifestAppend(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	for _, ext := range []string{".gz", ".zst"} {
+		t.Run(ext, func(t *testing.T) {
+			out := t.TempDir()
+			manifest := filepath.Join(t.TempDir(), "manifest.jsonl"+ext)
+			run := func(urls ...string) {
+				f, err := OpenManifest(manifest, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				d := NewDownloader(out, 1, 5*time.Second, map[string]string{}, f, nil)
+				if err := d.Run(context.Background(), urls); err != nil {
+					t.Fatal(err)
+				}
+				if err := f.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			run(srv.URL + "/crates/a/a-1.0.0.crate")
+			// Simulate a run killed before its stream was finished.
+			f, err := os.OpenFile(manifest, os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			enc, _ := newManifestEncoder(f, manifestCodec(manifest))
+			enc.Write([]byte(`{"schema_version":1,"url":"tor`))
+			if fl, ok := enc.(interface{ Flush() error }); ok {
+				fl.Flush()
+			}
+			f.Close()
+			run(srv.URL + "/crates/b/b-1.0.0.crate")
+
+			var got []string
+			if err := ReadManifest(manifest, func(rec Record) error {
+				if !rec.OK {
+					t.Errorf("record %s not ok", rec.URL)
+				}
+				got = append(got, filepath.Base(rec.URL))
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, ",") != "a-1.0.0.crate,b-1.0.0.crate" {
+				t.Fatalf("records %v, want a then b", got)
+			}
+			if data, _ := os.ReadFile(manifest); bytes.Contains(data, []byte("schema_version")) {
+				t.Fatal("manifest is not compressed")
+			}
+		})
+	}
+}
+
+func TestReadIndexCrateLimitKeepsWholeCrates(t *testing.T) {
+	tmp := t.TempDir()
+	for rel, data := range map[string]string{
+		"a/b/abcd": `{"name":"abcd","vers":"0.1.0"}` + "\n" + `{"name":"abcd","vers":"0.2.0"}` + "\n" + `{"name":"abcd","vers":"0.3.0"}` + "\n",
+		"b/c/bcde": `{"name":"bcde","vers":"1.0.0"}` + "\n" + `{"name":"bcde","vers":"1.1.0"}` + "\n",
+		"c/d/cdef": `{"name":"cdef","vers":"2.0.0"}` + "\n",
+	} {
+		p := filepath.Join(tmp, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := ReadIndex(tmp, IndexOptions{BaseURL: "https://static.crates.io/crates", CrateLimit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Crates != 2 || len(res.URLs) != 5 {
+		t.Fatalf("crates=%d urls=%v", res.Crates, res.URLs)
+	}
+}
+
+func TestCheckBundlesReportsDiscrepancies(t *testing.T) {
+	tmp := t.TempDir()
+	manifest := filepath.Join(tmp, "manifest.jsonl")
+	var mb strings.Builder
+	enc := json.NewEncoder(&mb)
+	for _, rec := range []Record{
+		{URL: "u/a", Path: "/m/a.crate", OK: true},
+		{URL: "u/b", Path: "/m/b.crate", OK: true}, // never bundled
+		{URL: "u/c", Path: "/m/c.crate", OK: false},
+	} {
+		enc.Encode(rec)
+	}
+	if err := os.WriteFile(manifest, []byte(mb.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var ib strings.Builder
+	enc = json.NewEncoder(&ib)
+	enc.Encode(BundleEntry{Bundle: "bundle-0000.tar.zst", Name: "a", Source: "/m/a.crate"})
+	enc.Encode(BundleEntry{Bundle: "bundle-0000.tar.zst", Name: "x", Source: "/m/x.crate"}) // not downloaded
+	if err := os.WriteFile(filepath.Join(tmp, "bundle-0000.index.jsonl"), []byte(ib.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := CheckBundles(manifest, tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.OK() || strings.Join(c.NotBundled, ",") != "/m/b.crate" || strings.Join(c.NotInManifest, ",") != "/m/x.crate" || len(c.MultiBundled) != 0 {
+		t.Fatalf("unexpected check result: %+v", c)
+	}
+}
+
+func TestReconcileReportsGapsAndOrphans(t *testing.T) {
+	idx := t.TempDir()
+	p := filepath.Join(idx, "s", "er", "serde")
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	data := `{"name":"serde","vers":"1.0.0"}` + "\n" + `{"name":"serde","vers":"1.0.1"}` + "\n" + `{"name":"serde","vers":"1.0.2","yanked":true}` + "\n"
+	if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	dir := filepath.Join(out, "s", "er")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"serde-1.0.0.crate", "serde-1.0.2.crate", "serde-0.9.0.crate", "serde-1.0.1.crate.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rep, err := Reconcile(idx, out, "https://static.crates.io/crates/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Expected != 2 || rep.Present != 1 || rep.Missing != 1 || rep.Orphans != 1 || rep.Complete() {
+		t.Fatalf("unexpected report: %+v", rep)
+	}
+	if rep.MissingSample[0] != "https://static.crates.io/crates/serde/serde-1.0.1.crate" || filepath.Base(rep.OrphanSample[0]) != "serde-0.9.0.crate" {
+		t.Fatalf("unexpected samples: %+v", rep)
+	}
+}
+
+func TestReconcileFollowsDownloaderLayout(t *testing.T) {
+	idx := t.TempDir()
+	data := `{"name":"Serde","vers":"1.0.0"}` + "\n" + `{"name":"tokio","vers":"1.0.0"}` + "\n"
+	if err := os.WriteFile(filepath.Join(idx, "all.json"), []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, disk2 := t.TempDir(), t.TempDir()
+	for _, p := range []string{
+		filepath.Join(disk2, "s", "er", "serde-1.0.0.crate"),
+		filepath.Join(disk2, "s", "er", "serde-0.9.0.crate"),
+		filepath.Join(out, "t", "ok", "tokio-1.0.0.crate"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := NewDownloader(out, 1, time.Second, nil, io.Discard, nil)
+	d.SetNormalizeCase(true)
+	d.SetRoutes([]Route{{From: "s", To: "s", Dir: disk2}, {From: "x", To: "z", Dir: filepath.Join(out, "none")}})
+	rep, err := d.Reconcile(idx, "https://static.crates.io/crates", index.LayoutFlat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Expected != 2 || rep.Present != 2 || rep.Missing != 0 || rep.Orphans != 1 {
+		t.Fatalf("unexpected report: %+v", rep)
+	}
+	if rep.OrphanSample[0] != filepath.Join(disk2, "s", "er", "serde-0.9.0.crate") {
+		t.Fatalf("orphans = %v", rep.OrphanSample)
+	}
+	entries, _, err := d.PrunePlan(idx, "https://static.crates.io/crates", index.LayoutFlat)
+	if err != nil || len(entries) != 1 || entries[0].Path != rep.OrphanSample[0] {
+		t.Fatalf("prune plan = %+v, %v", entries, err)
+	}
+}
+
+func TestPrunePlanListsStrayFiles(t *testing.T) {
+	idx := t.TempDir()
+	p := filepath.Join(idx, "s", "er", "serde")
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	data := `{"name":"serde","vers":"1.0.0"}` + "\n" + `{"name":"serde","vers":"1.0.1","yanked":true}` + "\n"
+	if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	files := map[string]int{
+		"s/er/serde-1.0.0.crate":      10, // indexed
+		"s/er/serde-1.0.1.crate":      20, // yanked, kept
+		"s/er/serde-1.0.0.crate.json": 30, // not a crate file
+		"s/er/serde-0.9.0.crate":      100,
+		"s/er/serde-2.0.0.crate":      1000,
+		"g/on/gone-0.1.0.crate":       7,
+		"s/er/serde-0.1.0.crate":      0,
+	}
+	for rel, size := range files {
+		p := filepath.Join(out, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, bytes.Repeat([]byte("x"), size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, total, err := PrunePlan(idx, out, "https://static.crates.io/crates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		rel, _ := filepath.Rel(out, e.Path)
+		got = append(got, fmt.Sprintf("%s:%d", filepath.ToSlash(rel), e.Size))
+	}
+	want := "g/on/gone-0.1.0.crate:7 s/er/serde-0.1.0.crate:0 s/er/serde-0.9.0.crate:100 s/er/serde-2.0.0.crate:1000"
+	if strings.Join(got, " ") != want || total != 1107 {
+		t.Fatalf("plan = %s total %d\nwant %s total 1107", strings.Join(got, " "), total, want)
+	}
+	var buf bytes.Buffer
+	if err := WritePrunePlan(&buf, entries, total); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 || lines[4] != `{"total_files":4,"total_bytes":1107}` {
+		t.Fatalf("preview:\n%s", buf.String())
+	}
+	for rel, size := range files {
+		if fi, err := os.Stat(filepath.Join(out, filepath.FromSlash(rel))); err != nil || fi.Size() != int64(size) {
+			t.Errorf("%s changed by the preview: %v", rel, err)
+		}
+	}
+}
+
+func TestBundlerRejectsUnfinishedFiles(t *testing.T) {
+	tmp := t.TempDir()
+	b, err := NewBundler(true, filepath.Join(tmp, "bundles"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for _, name := range []string{"a.crate.part", "a.crate.tmp", "a.crate"} {
+		if err := os.WriteFile(filepath.Join(tmp, name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"a.crate.part", "a.crate.tmp"} {
+		if err := b.AddFile(filepath.Join(tmp, name), name); !errors.Is(err, ErrUnfinishedFile) {
+			t.Fatalf("AddFile(%s) = %v, want ErrUnfinishedFile", name, err)
+		}
+	}
+	if err := b.AddFile(filepath.Join(tmp, "a.crate"), "a.crate"); err != nil {
+		t.Fatalf("AddFile finalized: %v", err)
+	}
+}
+
+func TestHardlinkDupes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("same tarball"))
+	}))
+	defer srv.Close()
+
+	out := t.TempDir()
+	var manifest bytes.Buffer
+	d := NewDownloader(out, 1, 5*time.Second, map[string]string{}, &manifest, nil)
+	d.SetHardlinkDupes(true)
+	urls := []string{srv.URL + "/crates/foo/foo-1.0.0.crate", srv.URL + "/crates/foo/foo-1.0.1.crate"}
+	if err := d.Run(context.Background(), urls); err != nil {
+		t.Fatal(err)
+	}
+
+	var recs []Record
+	dec := json.NewDecoder(&manifest)
+	for dec.More() {
+		var rec Record
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != 2 || !recs[0].OK || !recs[1].OK {
+		t.Fatalf("records: %+v", recs)
+	}
+	a, err := os.Stat(recs[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(recs[1].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Fatal("identical downloads were not hardlinked")
+	}
+	if recs[1].LinkTarget != recs[0].Path {
+		t.Fatalf("link_target = %q, want %q", recs[1].LinkTarget, recs[0].Path)
+	}
+}
+
+func TestFetchOneZeroByteBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "0")
+	}))
+	defer srv.Close()
+
+	empty := sha256.Sum256(nil)
+	ok := srv.URL + "/crates/tiny/tiny-0.0.1.crate"
+	bad := srv.URL + "/crates/tiny/tiny-0.0.2.crate"
+	checksums := map[string]string{ok: hex.EncodeToString(empty[:]), bad: strings.Repeat("a", 64)}
+	d := NewDownloader(t.TempDir(), 1, 5*time.Second, checksums, io.Discard, nil)
+
+	rec := d.fetchOne(context.Background(), ok, nil)
+	if !rec.OK || rec.Status != StatusEmptyOK || rec.Size != 0 {
+		t.Fatalf("empty body with empty hash: ok=%v status=%q size=%d err=%q", rec.OK, rec.Status, rec.Size, rec.Error)
+	}
+	// A second pass finds the file on disk and keeps the status.
+	if rec := d.fetchOne(context.Background(), ok, nil); rec.Status != StatusEmptyOK {
+		t.Fatalf("existing empty file: status=%q", rec.Status)
+	}
+	if rec := d.fetchOne(context.Background(), bad, nil); rec.OK || rec.Status != "error" {
+		t.Fatalf("empty body with other hash: ok=%v status=%q", rec.OK, rec.Status)
+	}
+}
+
+func TestMinTLSRejectsOldServer(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("x"))
+	}))
+	srv.TLS = &tls.Config{MinVersion: tls.VersionTLS11, MaxVersion: tls.VersionTLS11}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	d := NewDownloader(t.TempDir(), 1, 5*time.Second, map[string]string{}, io.Discard, nil)
+	d.SetRetries(1)
+	tr := d.HTTPTransport().(*http.Transport)
+	minVer, err := ParseTLSVersion("1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ApplyTLSPolicy(tr, minVer, nil)
+	tr.TLSClientConfig.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	rec := d.fetchOne(context.Background(), srv.URL+"/crates/a/a-1.0.0.crate", nil)
+	if rec.OK || !strings.Contains(rec.Error, "protocol version") {
+		t.Fatalf("expected TLS version failure, got ok=%v err=%q", rec.OK, rec.Error)
+	}
+	if _, err := ParseTLSVersion("1.1"); err == nil {
+		t.Fatal("ParseTLSVersion accepted 1.1")
+	}
+}
+
+func TestSemverCompare(t *testing.T) {
+	ordered := []string{"0.9.9", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0+build.5", "1.0.1", "1.10.0"}
+	for i := 0; i+1 < len(ordered); i++ {
+		a, err := parseSemver(ordered[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := parseSemver(ordered[i+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.compare(b) != -1 || b.compare(a) != 1 {
+			t.Errorf("want %s < %s", ordered[i], ordered[i+1])
+		}
+	}
+	for _, bad := range []string{"1.0", "v1.0.0", "1.0.0-", "1.0.0-a..b", "x.y.z"} {
+		if _, err := parseSemver(bad); err == nil {
+			t.Errorf("parseSemver(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestReadIndexVersionFilters(t *testing.T) {
+	tmp := t.TempDir()
+	p := filepath.Join(tmp, "s", "er", "serde")
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	var data string
+	for _, v := range []string{"0.9.0", "1.0.0-rc.1", "1.0.0", "1.0.1+meta", "1.1.0-beta", "weird"} {
+		data += `{"name":"serde","vers":"` + v + `"}` + "\n"
+	}
+	if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	versions := func(opts IndexOptions) string {
+		t.Helper()
+		opts.BaseURL = "https://x"
+		res, err := ReadIndex(tmp, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var vs []string
+		for _, u := range res.URLs {
+			vs = append(vs, strings.TrimSuffix(strings.TrimPrefix(u, "https://x/serde/serde-"), ".crate"))
+		}
+		return strings.Join(vs, ",")
+	}
+	if got := versions(IndexOptions{SkipPrerelease: true}); got != "0.9.0,1.0.0,1.0.1+meta,weird" {
+		t.Errorf("skip prerelease: %s", got)
+	}
+	if got := versions(IndexOptions{MinVersion: "1.0.0"}); got != "1.0.0,1.0.1+meta,1.1.0-beta,weird" {
+		t.Errorf("min version: %s", got)
+	}
+	if _, err := ReadIndex(tmp, IndexOptions{MinVersion: "1.0"}); err == nil {
+		t.Error("invalid -min-version accepted")
+	}
+}
+
+func TestReadIndexLicenseFilter(t *testing.T) {
+	tmp := t.TempDir()
+	crates := []string{"dual", "gpl", "both", "excepted", "legacy", "unknown", "Mixed"}
+	for _, name := range crates {
+		p := filepath.Join(tmp, filepath.FromSlash(crateDirFor(strings.ToLower(name), "")), strings.ToLower(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		data := `{"name":"` + name + `","vers":"1.0.0"}` + "\n" + `{"name":"` + name + `","vers":"1.1.0"}` + "\n"
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mapPath := filepath.Join(t.TempDir(), "licenses.txt")
+	mapData := `# name license
+dual MIT OR GPL-3.0-only
+gpl GPL-3.0-or-later
+both MIT AND (GPL-2.0 OR LGPL-2.1)
+excepted GPL-2.0 WITH Classpath-exception-2.0
+legacy MIT/Apache-2.0
+{"name":"mixed","license":"Apache-2.0 AND AGPL-3.0"}
+`
+	if err := os.WriteFile(mapPath, []byte(mapData), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	licenses, err := ReadLicenseMap(mapPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := func(deny, allow []string) (string, IndexResult) {
+		t.Helper()
+		f, err := NewLicenseFilter(licenses, deny, allow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ReadIndex(tmp, IndexOptions{BaseURL: "https://x", License: f})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := map[string]bool{}
+		var names []string
+		for _, u := range res.URLs {
+			if name := crateNameFromURL(u); !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return strings.Join(names, ","), res
+	}
+
+	got, res := kept([]string{"gpl-*", "AGPL-*"}, nil)
+	if got != "both,dual,legacy,unknown" {
+		t.Errorf("deny GPL/AGPL kept %s", got)
+	}
+	if res.LicenseSkipped != 6 || res.LicenseSkippedCrates != 3 {
+		t.Errorf("skipped %d versions of %d crates, want 6 of 3", res.LicenseSkipped, res.LicenseSkippedCrates)
+	}
+	if got, _ := kept(nil, []string{"MIT", "Apache-2.0"}); got != "dual,legacy" {
+		t.Errorf("allow MIT/Apache kept %s", got)
+	}
+	if _, err := NewLicenseFilter(licenses, []string{"["}, nil); err == nil {
+		t.Error("bad license pattern accepted")
+	}
+}
+
+func writeChecksumFile(tb testing.TB, lines int) string {
+	tb.Helper()
+	var sb strings.Builder
+	enc := json.NewEncoder(&sb)
+	for i := 0; i < lines; i++ {
+		// Every URL appears three times so last-write-wins is exercised across batches.
+		u := "https://static.crates.io/crates/c/c-" + strconv.Itoa(i%(lines/3+1)) + ".crate"
+		enc.Encode(ChecksumEntry{URL: u, SHA256: strings.Repeat(strconv.Itoa(i%10), 64)})
+		if i%1000 == 0 {
+			sb.WriteString("not json\n\n")
+		}
+	}
+	p := filepath.Join(tb.TempDir(), "checksums.jsonl")
+	if err := os.WriteFile(p, []byte(sb.String()), 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	return p
+}
+
+func TestReadFromStdin(t *testing.T) {
+	pipeIn := func(data string) {
+		t.Helper()
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			w.Write([]byte(data))
+			w.Close()
+		}()
+		old := stdin
+		stdin = r
+		t.Cleanup(func() {
+			stdin = old
+			r.Close()
+		})
+	}
+
+	pipeIn("# list\nhttps://x/crates/a/a-1.0.0.crate\n\nhttps://x/crates/b/b-1.0.0.crate\n")
+	urls, err := ReadURLs(StdinPath)
+	if err != nil || len(urls) != 2 || urls[1] != "https://x/crates/b/b-1.0.0.crate" {
+		t.Fatalf("ReadURLs(-) = %v, %v", urls, err)
+	}
+
+	line := `{"url":"https://x/crates/a/a-1.0.0.crate","sha256":"AB12"}` + "\n"
+	pipeIn(line)
+	if sums, err := ReadChecksums(StdinPath); err != nil || sums["https://x/crates/a/a-1.0.0.crate"] != "ab12" {
+		t.Fatalf("ReadChecksums(-) = %v, %v", sums, err)
+	}
+	pipeIn(line)
+	if sums, err := ReadChecksumsWithOptions(StdinPath, ChecksumOptions{Workers: 4}); err != nil || len(sums) != 1 {
+		t.Fatalf("ReadChecksumsWithOptions(-) = %v, %v", sums, err)
+	}
+}
+
+func TestReadChecksumsParallelMatchesSerial(t *testing.T) {
+	p := writeChecksumFile(t, 30000)
+	serial, err := ReadChecksums(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parallel, err := ReadChecksumsWithOptions(p, ChecksumOptions{Workers: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serial) != len(parallel) {
+		t.Fatalf("serial has %d entries, parallel %d", len(serial), len(parallel))
+	}
+	for u, want := range serial {
+		if got := parallel[u]; got != want {
+			t.Fatalf("%s: parallel %s, serial %s", u, got, want)
+		}
+	}
+}
+
+func BenchmarkReadChecksums(b *testing.B) {
+	p := writeChecksumFile(b, 300000)
+	for _, workers := range []int{1, 4, 16} {
+		b.Run("workers="+strconv.Itoa(workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := ReadChecksumsWithOptions(p, ChecksumOptions{Workers: workers}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestManifestFields(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "missing") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("x"))
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		spec       string
+		want, omit []string
+	}{
+		{spec: "-path,-error", want: []string{"schema_version", "url", "sha256", "ok", "status"}, omit: []string{"path", "error"}},
+		{spec: "url,ok", want: []string{"schema_version", "url", "ok"}, omit: []string{"path", "error", "size", "sha256", "status"}},
+	} {
+		fields, err := ParseManifestFields(tc.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var manifest bytes.Buffer
+		d := NewDownloader(t.TempDir(), 1, 5*time.Second, map[string]string{}, &manifest, nil)
+		d.SetRetries(1)
+		d.SetManifestFields(fields)
+		d.Run(context.Background(), []string{srv.URL + "/crates/a/a-1.0.0.crate", srv.URL + "/crates/missing/missing-1.0.0.crate"})
+		for _, line := range strings.Split(strings.TrimSpace(manifest.String()), "\n") {
+			var m map[string]any
+			if err := json.Unmarshal([]byte(line), &m); err != nil {
+				t.Fatalf("%s: %v: %s", tc.spec, err, line)
+			}
+			for _, k := range tc.want {
+				if _, ok := m[k]; !ok {
+					t.Errorf("%s: missing %s in %s", tc.spec, k, line)
+				}
+			}
+			for _, k := range tc.omit {
+				if _, ok := m[k]; ok {
+					t.Errorf("%s: %s not omitted in %s", tc.spec, k, line)
+				}
+			}
+		}
+	}
+	for _, bad := range []string{"nope", "url,-path"} {
+		if _, err := ParseManifestFields(bad); err == nil {
+			t.Errorf("ParseManifestFields(%q) accepted", bad)
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("no space left on device") }
+
+func TestManifestWriteErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("x"))
+	}))
+	defer srv.Close()
+	var urls []string
+	for i := range 20 {
+		urls = append(urls, fmt.Sprintf("%s/crates/c%d/c%d-1.0.0.crate", srv.URL, i, i))
+	}
+
+	d := NewDownloader(t.TempDir(), 1, 5*time.Second, map[string]string{}, failingWriter{}, nil)
+	if err := d.Run(context.Background(), urls); err != nil {
+		t.Fatalf("run without -fail-on-manifest-error: %v", err)
+	}
+	if n := d.ManifestErrors(); n != 20 {
+		t.Fatalf("ManifestErrors = %d, want 20", n)
+	}
+
+	d = NewDownloader(t.TempDir(), 1, 5*time.Second, map[string]string{}, failingWriter{}, nil)
+	d.SetFailOnManifestError(true)
+	err := d.Run(context.Background(), urls)
+	if !errors.Is(err, ErrManifestWrite) {
+		t.Fatalf("Run err = %v, want ErrManifestWrite", err)
+	}
+	if total, _, _ := d.Counts(); total >= 20 || d.ManifestErrors() != total {
+		t.Fatalf("processed %d URLs with %d manifest errors; want the run cut short", total, d.ManifestErrors())
+	}
+}
+
+func TestManifestPerShard(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "missing") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	out := t.TempDir()
+	var main bytes.Buffer
+	d := NewDownloader(out, 2, 5*time.Second, map[string]string{}, &main, nil)
+	d.SetRetries(1)
+	d.SetManifestPerShard(true)
+	urls := []string{
+		srv.URL + "/crates/serde/serde-1.0.0.crate",
+		srv.URL + "/crates/serde_json/serde_json-1.0.0.crate",
+		srv.URL + "/crates/log/log-0.4.0.crate",
+		srv.URL + "/crates/missing/missing-0.1.0.crate",
+	}
+	if err := d.Run(context.Background(), urls); err != nil {
+		t.Fatal(err)
+	}
+	if main.Len() != 0 {
+		t.Fatalf("main manifest got records: %s", main.String())
+	}
+	want := map[string][]string{
+		filepath.Join(out, "s", "er"): {"serde-1.0.0.crate", "serde_json-1.0.0.crate"},
+		filepath.Join(out, "log"):     {"log-0.4.0.crate"},
+		filepath.Join(out, "m", "is"): {"missing-0.1.0.crate"},
+	}
+	for dir, names := range want {
+		data, err := os.ReadFile(filepath.Join(dir, "manifest.jsonl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var rec Record
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, sanitizeName(rec.URL))
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(names, ",") {
+			t.Errorf("%s: got %v, want %v", dir, got, names)
+		}
+	}
+}
+
+func TestProbeReportsNegotiatedDetails(t *testing.T) {
+	body := []byte("probe crate")
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	u := srv.URL + "/crates/" + DefaultTestCrate
+	sum := sha256.Sum256(body)
+	d := NewDownloader(t.TempDir(), 1, 5*time.Second, map[string]string{u: hex.EncodeToString(sum[:])}, io.Discard, nil)
+	d.HTTPTransport().(*http.Transport).TLSClientConfig.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	res := d.Probe(context.Background(), u)
+	if !res.OK() {
+		t.Fatalf("probe failed: %+v", res)
+	}
+	if res.Proto != "HTTP/2.0" || res.TLSVersion != "TLS 1.3" || !res.ChecksumKnown || !res.ChecksumOK || res.Bytes != int64(len(body)) {
+		t.Fatalf("unexpected probe result: %+v", res)
+	}
+	var sb strings.Builder
+	res.Print(&sb)
+	if !strings.Contains(sb.String(), "proto=HTTP/2.0") || !strings.Contains(sb.String(), "checksum: match") {
+		t.Fatalf("unexpected output:\n%s", sb.String())
+	}
+}
+
+func TestProbeHonorsAllowedHosts(t *testing.T) {
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer srv.Close()
+
+	d := NewDownloader(t.TempDir(), 1, 5*time.Second, nil, io.Discard, nil)
+	d.SetAllowedHosts([]string{"static.crates.io"})
+	res := d.Probe(context.Background(), srv.URL+"/crates/"+DefaultTestCrate)
+	if res.OK() || !errors.Is(res.Err, ErrHostNotAllowed) {
+		t.Fatalf("probe result %+v, want %v", res, ErrHostNotAllowed)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Fatalf("server saw %d requests, want 0", n)
+	}
+}
+
+func TestFetchOneChecksumFromSidecars(t *testing.T) {
+	body := []byte("crate bytes")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	sideDir := t.TempDir()
+	w, err := sidecar.NewWriter(sidecar.Config{OutDir: sideDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(body)
+	w.WriteLine("se/rd/serde", []byte(`{"name":"serde","vers":"1.0.0","cksum":"`+hex.EncodeToString(sum[:])+`"}`))
+	w.WriteLine("se/rd/serde", []byte(`{"name":"serde","vers":"1.0.1","cksum":"`+strings.Repeat("0", 64)+`"}`))
+	src, err := sidecar.NewChecksumSource(sidecar.Config{OutDir: sideDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDownloader(t.TempDir(), 1, 5*time.Second, map[string]string{}, io.Discard, nil)
+	d.SetChecksumLookup(src.Checksum)
+	for _, tc := range []struct {
+		vers string
+		ok   bool
+	}{
+		{"1.0.0", true},  // matching sidecar cksum
+		{"1.0.1", false}, // mismatching sidecar cksum
+		{"2.0.0", true},  // no sidecar: not verified
+	} {
+		rec := d.fetchOne(context.Background(), srv.URL+"/crates/serde/serde-"+tc.vers+".crate", nil)
+		if rec.OK != tc.ok {
+			t.Errorf("serde %s: ok = %v, want %v (err %q)", tc.vers, rec.OK, tc.ok, rec.Error)
+		}
+	}
+}
+
+func TestCrateVersionFromURL(t *testing.T) {
+	for _, tc := range []struct{ url, crate, version string }{
+		{"https://static.crates.io/crates/serde/serde-1.0.0.crate", "serde", "1.0.0"},
+		{"https://static.crates.io/crates/foo-bar/foo-bar-0.1.0-rc.1.crate", "foo-bar", "0.1.0-rc.1"},
+		{"https://example.com/other/file.tar", "", ""},
+	} {
+		crate, version := crateVersionFromURL(tc.url)
+		if crate != tc.crate || version != tc.version {
+			t.Errorf("crateVersionFromURL(%q) = %q, %q; want %q, %q", tc.url, crate, version, tc.crate, tc.version)
+		}
+	}
+}
+
+func TestConcurrentDownloadsOfSameTarget(t *testing.T) {
+	body := []byte(strings.Repeat("crate bytes ", 1000))
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hold both responses until both writers have created their temp files.
+		arrived.Done()
+		arrived.Wait()
+		w.Write(body[:len(body)/2])
+		w.(http.Flusher).Flush()
+		time.Sleep(10 * time.Millisecond)
+		w.Write(body[len(body)/2:])
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	outPath := filepath.Join(dir, "serde-1.0.0.crate")
+	d := NewDownloader(dir, 2, 5*time.Second, map[string]string{}, io.Discard, nil)
+	d.SetTempSuffix(".inprogress")
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, errs[i] = d.download(context.Background(), srv.URL+"/crates/serde/serde-1.0.0.crate", outPath)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("writer %d: %v", i, err)
+		}
+	}
+	got, err := os.ReadFile(outPath)
+	if err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("target corrupted: %d bytes, err %v", len(got), err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Fatalf("leftover files: %v", names)
+	}
+}
+
+// rotStore corrupts a file on every read after the first, like a drive that
+// returns bad data once the write cache has been flushed.
+type rotStore struct {
+	*memStore
+	mu    sync.Mutex
+	reads map[string]int
+	rot   string
+}
+
+func (s *rotStore) Open(path string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	s.reads[path]++
+	n := s.reads[path]
+	s.mu.Unlock()
+	rc, err := s.memStore.Open(path)
+	if err != nil || n == 1 || !strings.HasSuffix(path, s.rot) {
+		return rc, err
+	}
+	b, _ := io.ReadAll(rc)
+	b[0] ^= 0xff
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func TestRunVerifySample(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+	urls := []string{srv.URL + "/crates/serde/serde-1.0.0.crate", srv.URL + "/crates/tokio/tokio-1.0.0.crate"}
+
+	for _, tc := range []struct {
+		rot     string
+		strict  bool
+		wantErr bool
+	}{
+		{rot: "none", strict: true},
+		{rot: "tokio-1.0.0.crate", strict: false},
+		{rot: "tokio-1.0.0.crate", strict: true, wantErr: true},
+	} {
+		d := NewDownloader(t.TempDir(), 2, 5*time.Second, map[string]string{}, io.Discard, nil)
+		d.SetStore(&rotStore{memStore: &memStore{blobs: map[string][]byte{}}, reads: map[string]int{}, rot: tc.rot})
+		d.SetVerifySample(100, tc.strict)
+		err := d.Run(context.Background(), urls)
+		if gotErr := errors.Is(err, ErrSampleMismatch); gotErr != tc.wantErr {
+			t.Errorf("rot=%s strict=%v: Run err = %v, want mismatch error %v", tc.rot, tc.strict, err, tc.wantErr)
+		}
+	}
+}
+
+// slowOpenStore is an in-memory store whose reads are slow and counted, to
+// measure how many files are read at once.
+type slowOpenStore struct {
+	*memStore
+	inflight, peak atomic.Int32
+}
+
+func (s *slowOpenStore) Open(path string) (io.ReadCloser, error) {
+	n := s.inflight.Add(1)
+	defer s.inflight.Add(-1)
+	for p := s.peak.Load(); n > p && !s.peak.CompareAndSwap(p, n); p = s.peak.Load() {
+	}
+	time.Sleep(20 * time.Millisecond)
+	return s.memStore.Open(path)
+}
+
+func TestVerifySampleHonorsVerifyConcurrency(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+	var urls []string
+	for i := range 12 {
+		urls = append(urls, fmt.Sprintf("%s/crates/c%d/c%d-1.0.0.crate", srv.URL, i, i))
+	}
+	for _, verify := range []int{1, 3} {
+		store := &slowOpenStore{memStore: &memStore{blobs: map[string][]byte{}}}
+		d := NewDownloader(t.TempDir(), 8, 5*time.Second, map[string]string{}, io.Discard, nil)
+		d.SetStore(store)
+		d.SetVerifySample(100, true)
+		d.SetVerifyConcurrency(verify)
+		if err := d.Run(context.Background(), urls); err != nil {
+			t.Fatal(err)
+		}
+		// The download pass reads files too; measure the verify pass alone.
+		store.peak.Store(0)
+		if err := d.verifySample(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := store.peak.Load(); got != int32(verify) {
+			t.Errorf("verify concurrency %d: %d files read at once", verify, got)
+		}
+	}
+	if got := (&Downloader{concurrency: 256}).verifyWorkers(); got != runtime.NumCPU() {
+		t.Errorf("default verify workers = %d, want runtime.NumCPU() = %d", got, runtime.NumCPU())
+	}
+}
+
+func TestFetchOneDuplicateURLConcurrently(t *testing.T) {
+	body := []byte(strings.Repeat("0123456789", 5000))
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		arrived.Wait()
+		for i := 0; i < len(body); i += 10000 {
+			w.Write(body[i : i+10000])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	url := srv.URL + "/crates/serde/serde-1.0.0.crate"
+	sum := sha256.Sum256(body)
+	d := NewDownloader(t.TempDir(), 2, 5*time.Second, map[string]string{url: hex.EncodeToString(sum[:])}, io.Discard, nil)
+	recs := make([]Record, 2)
+	var wg sync.WaitGroup
+	for i := range recs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recs[i] = d.fetchOne(context.Background(), url, nil)
+		}()
+	}
+	wg.Wait()
+	for i, rec := range recs {
+		if !rec.OK {
+			t.Fatalf("fetch %d failed: %s", i, rec.Error)
+		}
+	}
+	got, err := os.ReadFile(recs[0].Path)
+	if err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("final file not intact: %d bytes, err %v", len(got), err)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(recs[0].Path))
+	if len(entries) != 1 {
+		t.Fatalf("expected only the final file, found %d entries", len(entries))
+	}
+}
+
+func TestFetchOneStoreTransforms(t *testing.T) {
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	content := []byte("fn main() {}\n")
+	tw.WriteHeader(&tar.Header{Name: "serde-1.0.0/src/main.rs", Mode: 0o644, Size: int64(len(content))})
+	tw.Write(content)
+	tw.Close()
+	var gzBuf bytes.Buffer
+	zw := gzip.NewWriter(&gzBuf)
+	zw.Write(tarBuf.Bytes())
+	zw.Close()
+	crate := gzBuf.Bytes()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(crate)
+	}))
+	defer srv.Close()
+	url := srv.URL + "/crates/serde/serde-1.0.0.crate"
+	sum := sha256.Sum256(crate)
+	good := map[string]string{url: hex.EncodeToString(sum[:])}
+	bad := map[string]string{url: strings.Repeat("0", 64)}
+
+	decode := map[StoreTransform]func([]byte) ([]byte, error){
+		TransformNone: func(b []byte) ([]byte, error) {
+			zr, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			return io.ReadAll(zr)
+		},
+		TransformGunzip: func(b []byte) ([]byte, error) { return b, nil },
+		TransformZstd: func(b []byte) ([]byte, error) {
+			zr, err := zstd.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+			return io.ReadAll(zr)
+		},
+	}
+	wantName := map[StoreTransform]string{TransformNone: "serde-1.0.0.crate", TransformGunzip: "serde-1.0.0.tar", TransformZstd: "serde-1.0.0.tar.zst"}
+
+	for tr, dec := range decode {
+		d := NewDownloader(t.TempDir(), 1, 5*time.Second, good, io.Discard, nil)
+		d.SetStoreTransform(tr)
+		rec := d.fetchOne(context.Background(), url, nil)
+		if !rec.OK {
+			t.Fatalf("%s: fetch failed: %s", tr, rec.Error)
+		}
+		if filepath.Base(rec.Path) != wantName[tr] || rec.SHA256 != good[url] {
+			t.Errorf("%s: stored %s sha256 %s; want %s with the served digest", tr, filepath.Base(rec.Path), rec.SHA256, wantName[tr])
+		}
+		stored, err := os.ReadFile(rec.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr != TransformNone {
+			if s := sha256.Sum256(stored); rec.StoredSHA256 != hex.EncodeToString(s[:]) {
+				t.Errorf("%s: stored_sha256 does not match the file", tr)
+			}
+		}
+		got, err := dec(stored)
+		if err != nil || !bytes.Equal(got, tarBuf.Bytes()) {
+			t.Errorf("%s: stored file does not decode to the original tar (err %v)", tr, err)
+		}
+
+		d = NewDownloader(t.TempDir(), 1, 5*time.Second, bad, io.Discard, nil)
+		d.SetStoreTransform(tr)
+		if rec := d.fetchOne(context.Background(), url, nil); rec.OK {
+			t.Errorf("%s: accepted a body with the wrong checksum", tr)
+		}
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"0":       0,
+		"1048576": 1 << 20,
+		"512MiB":  512 << 20,
+		"8GiB":    8 << 30,
+		"8g":      8 << 30,
+		"1.5 GB":  1_500_000_000,
+		"100kb":   100_000,
+	} {
+		if got, err := ParseByteSize(in); err != nil || got != want {
+			t.Errorf("ParseByteSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "GiB", "12XB", "-1MiB", "1.2.3MB"} {
+		if _, err := ParseByteSize(in); err == nil {
+			t.Errorf("ParseByteSize(%q) accepted", in)
+		}
+	}
+}
+
+func TestNewBundlerBytesRotatesBelowOneGB(t *testing.T) {
+	src := t.TempDir()
+	for _, name := range []string{"a.crate", "b.crate", "c.crate"} {
+		if err := os.WriteFile(filepath.Join(src, name), bytes.Repeat([]byte{'x'}, 600), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := t.TempDir()
+	b, err := NewBundlerBytes(true, out, 1000, BundleTarZst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.crate", "b.crate", "c.crate"} {
+		if err := b.AddFile(filepath.Join(src, name), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bundles, _ := filepath.Glob(filepath.Join(out, "bundle-*.tar.zst"))
+	if len(bundles) != 3 {
+		t.Fatalf("got %d bundles, want one per 600-byte file with a 1000-byte target", len(bundles))
+	}
+}
+
+func TestBundleGroupByCrateKeepsVersionsTogether(t *testing.T) {
+	src := t.TempDir()
+	files := []string{"foo-bar-1.0.0.crate", "foo-bar-1.1.0.crate", "foo-bar-2.0.0-rc.1.crate", "zed-0.1.0.crate"}
+	for _, name := range files {
+		if err := os.WriteFile(filepath.Join(src, name), bytes.Repeat([]byte{'x'}, 600), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bundleOf := func(g BundleGroupBy, slack int64) map[string]string {
+		out := t.TempDir()
+		b, err := NewBundlerBytes(true, out, 1000, BundleTarZst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.SetGroupBy(g, slack)
+		for _, name := range files {
+			if err := b.AddFile(filepath.Join(src, name), name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		if err := ReadBundleIndexes(out, func(e BundleEntry) error {
+			got[e.Name] = e.Bundle
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	got := bundleOf(GroupCrate, 2000)
+	if got[files[0]] != got[files[1]] || got[files[0]] != got[files[2]] {
+		t.Fatalf("foo-bar versions split across bundles: %v", got)
+	}
+	if got[files[3]] == got[files[0]] {
+		t.Fatalf("zed joined the foo-bar bundle past the target: %v", got)
+	}
+	// Without enough slack the group is split like before.
+	if got := bundleOf(GroupCrate, 100); got[files[0]] == got[files[1]] {
+		t.Fatalf("group kept together beyond the slack: %v", got)
+	}
+	if got := bundleOf(GroupNone, 2000); got[files[0]] == got[files[1]] {
+		t.Fatalf("files grouped without -bundle-group-by: %v", got)
+	}
+
+	for in, want := range map[string]string{
+		"serde-1.0.0.crate":     "serde",
+		"foo-2-1.0.0.crate":     "foo-2",
+		"a-b-0.1.0-alpha.crate": "a-b",
+		"serde-1.0.0.tar.zst":   "serde",
+		"notacrate.txt":         "notacrate.txt",
+	} {
+		if got := crateFromFileName(in); got != want {
+			t.Errorf("crateFromFileName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestListBundles(t *testing.T) {
+	src := t.TempDir()
+	added := map[string]int{"a.crate": 600, "b.crate": 10, "c.crate": 700}
+	for name, n := range added {
+		if err := os.WriteFile(filepath.Join(src, name), bytes.Repeat([]byte{'x'}, n), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := t.TempDir()
+	for _, format := range []BundleFormat{BundleTarZst, BundleTarBr} {
+		b, err := NewBundlerBytes(true, out, 1000, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"a.crate", "b.crate", "c.crate"} {
+			if err := b.AddFile(filepath.Join(src, name), string(format)+"/"+name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []BundleListEntry
+	if err := ListBundles(out, func(e BundleListEntry) error {
+		got = append(got, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var want []BundleListEntry
+	if err := ReadBundleIndexes(out, func(e BundleEntry) error {
+		want = append(want, BundleListEntry{Bundle: e.Bundle, Name: e.Name, Size: e.Size})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 6 || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("listed %v\nwant     %v", got, want)
+	}
+	for _, e := range got {
+		name := e.Name[strings.LastIndex(e.Name, "/")+1:]
+		if int64(added[name]) != e.Size {
+			t.Errorf("%s: size %d, want %d", e.Name, e.Size, added[name])
+		}
+	}
+}
+
+func TestRunRejectsPathCollisions(t *testing.T) {
+	d := NewDownloader(t.TempDir(), 1, 5*time.Second, map[string]string{}, io.Discard, nil)
+	d.SetNormalizeCase(true)
+	urls := []string{
+		"https://a.example/crates/serde/serde-1.0.0.crate",
+		"https://a.example/crates/serde/serde-1.0.0.crate", // repeat: not a collision
+		"https://b.example/crates/serde/serde-1.0.0.crate",
+		"https://a.example/crates/Inflector/Inflector-0.11.4.crate",
+		"https://a.example/crates/inflector/inflector-0.11.4.crate",
+		"https://a.example/crates/tokio/tokio-1.0.0.crate",
+	}
+	cs := d.PathCollisions(urls)
+	if len(cs) != 2 || len(cs[0].URLs) != 2 || len(cs[1].URLs) != 2 {
+		t.Fatalf("collisions = %+v, want 2 paths with 2 URLs each", cs)
+	}
+	if err := d.Run(context.Background(), urls); !errors.Is(err, ErrPathCollision) {
+		t.Fatalf("Run err = %v, want ErrPathCollision", err)
+	}
+	if got := d.PathCollisions(urls[:2]); len(got) != 0 {
+		t.Fatalf("repeated URL reported as collision: %+v", got)
+	}
+}
+
+func TestRequireHTTPS(t *testing.T) {
+	ok := []string{"https://static.crates.io/crates/serde/serde-1.0.0.crate", "HTTPS://mirror.example/crates/a/a-1.0.0.crate"}
+	if err := RequireHTTPS(ok); err != nil {
+		t.Fatalf("https-only list rejected: %v", err)
+	}
+	mixed := append(ok, "http://mirror.internal/crates/b/b-1.0.0.crate", "ftp://x/y", "https-ish/c")
+	err := RequireHTTPS(mixed)
+	if !errors.Is(err, ErrPlainHTTP) || !strings.Contains(err.Error(), "http://mirror.internal/crates/b/b-1.0.0.crate") || !strings.Contains(err.Error(), "3 of 5") {
+		t.Fatalf("RequireHTTPS(mixed) = %v", err)
+	}
+}
+
+func TestManifestWriteMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("x"))
+	}))
+	defer srv.Close()
+
+	initMetrics()
+	var beforeHist dto.Metric
+	metManifestWrite.Write(&beforeHist)
+	beforeBytes := testutil.ToFloat64(metManifestBytes)
+
+	var manifest bytes.Buffer
+	d := NewDownloader(t.TempDir(), 1, 5*time.Second, map[string]string{}, &manifest, nil)
+	if err := d.Run(context.Background(), []string{srv.URL + "/crates/a/a-1.0.0.crate", srv.URL + "/crates/b/b-1.0.0.crate"}); err != nil {
+		t.Fatal(err)
+	}
+	var afterHist dto.Metric
+	metManifestWrite.Write(&afterHist)
+	if got := afterHist.GetHistogram().GetSampleCount() - beforeHist.GetHistogram().GetSampleCount(); got != 2 {
+		t.Errorf("manifest write observations = %d, want 2", got)
+	}
+	if got := testutil.ToFloat64(metManifestBytes) - beforeBytes; got != float64(manifest.Len()) {
+		t.Errorf("manifest bytes metric = %v, want %d", got, manifest.Len())
+	}
+}
+
+func TestMetricsPerHost(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("x"))
+	})
+	a, b := httptest.NewServer(handler), httptest.NewServer(handler)
+	defer a.Close()
+	defer b.Close()
+	// A second listener on the loopback name gives an unconfigured host.
+	c := httptest.NewUnstartedServer(handler)
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Listener = ln
+	c.Start()
+	defer c.Close()
+
+	initMetrics()
+	d := NewDownloader(t.TempDir(), 2, 5*time.Second, map[string]string{}, io.Discard, nil)
+	d.SetMetricHosts(a.URL, strings.TrimPrefix(b.URL, "http://"))
+	urls := []string{a.URL + "/crates/a/a-1.0.0.crate", b.URL + "/crates/b/b-1.0.0.crate", c.URL + "/crates/c/c-1.0.0.crate"}
+	if err := d.Run(context.Background(), urls); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := httptest.NewServer(metricsHandler())
+	defer metrics.Close()
+	resp, err := http.Get(metrics.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, host := range []string{strings.TrimPrefix(a.URL, "http://"), strings.TrimPrefix(b.URL, "http://"), OtherHost} {
+		for _, series := range []string{
+			`crates_download_requests_total{code="200",host="` + host + `",status="ok"}`,
+			`crates_download_bytes_total{host="` + host + `"}`,
+			`crates_download_duration_seconds_count{host="` + host + `"}`,
+		} {
+			if !strings.Contains(string(body), series) {
+				t.Errorf("missing series %s", series)
+			}
+		}
+	}
+	if strings.Contains(string(body), `host="`+strings.TrimPrefix(c.URL, "http://")+`"`) {
+		t.Error("unconfigured host got its own label")
+	}
+}
+
+func TestDurationExemplarsOverOpenMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("x"))
+	}))
+	defer srv.Close()
+
+	initMetrics()
+	d := NewDownloader(t.TempDir(), 1, 5*time.Second, map[string]string{}, io.Discard, nil)
+	d.SetExemplars(true)
+	if err := d.Run(context.Background(), []string{srv.URL + "/crates/exemplary/exemplary-0.3.1.crate"}); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := httptest.NewServer(metricsHandler())
+	defer metrics.Close()
+	req, _ := http.NewRequest(http.MethodGet, metrics.URL, nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, line := range strings.Split(string(body), "\n") {
+		_, exemplar, ok := strings.Cut(line, " # {")
+		if ok && strings.HasPrefix(line, "crates_download_duration_seconds_bucket") &&
+			strings.Contains(exemplar, `crate="exemplary"`) && strings.Contains(exemplar, `version="0.3.1"`) {
+			return
+		}
+	}
+	t.Fatalf("no duration bucket with the crate exemplar in:\n%s", body)
+}
+
+func TestExemplarLabelsStayWithinLimit(t *testing.T) {
+	long := strings.Repeat("v", 120)
+	if l := exemplarLabels("https://x/crates/serde/serde-"+long+".crate", traceContext{}); l["crate"] != "serde" || l["version"] != "" {
+		t.Errorf("long version: labels = %v, want crate only", l)
+	}
+	if l := exemplarLabels("https://x/crates/"+long+long+"/"+long+long+"-1.0.0.crate", traceContext{}); len(l) != 0 {
+		t.Errorf("oversized crate name: labels = %v, want none", l)
+	}
+	if l := exemplarLabels("https://x/crates/"+long+"/"+long+"-1.0.0.crate", newTraceContext()); l["crate"] != "" || len(l["trace_id"]) != 32 || len(l["span_id"]) != 16 {
+		t.Errorf("trace labels should win over a long crate name: labels = %v", l)
+	}
+}
+
+func TestTraceExemplarsMatchTraceparent(t *testing.T) {
+	var mu sync.Mutex
+	var parents []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		parents = append(parents, r.Header.Get("traceparent"))
+		mu.Unlock()
+		w.Write([]byte("x"))
+	}))
+	defer srv.Close()
+
+	initMetrics()
+	d := NewDownloader(t.TempDir(), 1, 5*time.Second, map[string]string{}, io.Discard, nil)
+	d.SetTraceExemplars(true)
+	if err := d.Run(context.Background(), []string{srv.URL + "/crates/traced/traced-1.0.0.crate"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(parents) != 1 {
+		t.Fatalf("got %d requests, want 1", len(parents))
+	}
+	parts := strings.Split(parents[0], "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || parts[3] != "01" {
+		t.Fatalf("traceparent = %q, want 00-<32 hex>-<16 hex>-01", parents[0])
+	}
+
+	metrics := httptest.NewServer(metricsHandler())
+	defer metrics.Close()
+	req, _ := http.NewRequest(http.MethodGet, metrics.URL, nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, line := range strings.Split(string(body), "\n") {
+		_, exemplar, ok := strings.Cut(line, " # {")
+		if ok && strings.Contains(exemplar, `crate="traced"`) {
+			if !strings.Contains(exemplar, `trace_id="`+parts[1]+`"`) || !strings.Contains(exemplar, `span_id="`+parts[2]+`"`) {
+				t.Fatalf("exemplar %q does not match traceparent %s", exemplar, parents[0])
+			}
+			return
+		}
+	}
+	t.Fatalf("no duration bucket with the traced exemplar in:\n%s", body)
+}
+
+func TestReadIndexSingleFileLayout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.jsonl")
+	lines := `{"name":"serde","vers":"1.0.0","cksum":"aa"}
+{"name":"serde","vers":"1.0.1","cksum":"bb"}
+{"name":"tokio","vers":"1.0.0","cksum":"cc"}
+{"name":"log","vers":"0.4.0","cksum":"dd"}
+`
+	if err := os.WriteFile(path, []byte(lines), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := IndexOptions{BaseURL: "https://static.crates.io/crates", Walk: index.Options{Layout: index.LayoutSingle}}
+	res, err := ReadIndex(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.URLs) != 4 || res.Crates != 3 {
+		t.Fatalf("got %d urls from %d crates, want 4 from 3", len(res.URLs), res.Crates)
+	}
+
+	opts.CrateLimit = 2
+	res, err = ReadIndex(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.URLs) != 3 || res.Crates != 2 {
+		t.Fatalf("crate limit 2: got %d urls from %d crates, want 3 from 2", len(res.URLs), res.Crates)
+	}
+}
+
+func TestNewBundlerRecoversAfterCrash(t *testing.T) {
+	src := t.TempDir()
+	for _, name := range []string{"a.crate", "b.crate", "c.crate"} {
+		if err := os.WriteFile(filepath.Join(src, name), bytes.Repeat([]byte(name), 100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := t.TempDir()
+	b, err := NewBundler(true, out, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.crate", "b.crate"} {
+		if err := b.AddFile(filepath.Join(src, name), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second run keeps bundle-0000 and dies with bundle-0001 unflushed:
+	// its index lists c.crate but the archive is truncated.
+	b, err = NewBundler(true, out, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddFile(filepath.Join(src, "c.crate"), "c.crate"); err != nil {
+		t.Fatal(err)
+	}
+	b.outFile.Close()
+	b.indexFile.Close()
+	if _, err := os.Stat(filepath.Join(out, "bundle-0001.index.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = NewBundler(true, out, 8)
+	if err != nil {
+		t.Fatalf("recovery: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := bundleEntries(t, filepath.Join(out, "bundle-0000.tar.zst")); strings.Join(got, ",") != "a.crate,b.crate" {
+		t.Fatalf("bundle-0000 entries %v, want [a.crate b.crate]", got)
+	}
+	if n, err := bundleMatchesIndex(filepath.Join(out, "bundle-0001.tar.zst"), BundleTarZst, filepath.Join(out, "bundle-0001.index.jsonl")); err != nil || n != 0 {
+		t.Fatalf("bundle-0001 was not replaced by an empty bundle: %d entries, %v", n, err)
+	}
+
+	// An empty trailing bundle is reused rather than left behind.
+	b, err = NewBundler(true, out, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if got, _ := filepath.Glob(filepath.Join(out, "bundle-*.tar.zst")); len(got) != 2 {
+		t.Fatalf("bundles %v, want bundle-0000 and bundle-0001", got)
+	}
+}
+
+func TestRecoverBundlesKeepsCompleteArchive(t *testing.T) {
+	src := t.TempDir()
+	for _, name := range []string{"a.crate", "b.crate"} {
+		if err := os.WriteFile(filepath.Join(src, name), bytes.Repeat([]byte(name), 100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bundle := func(format BundleFormat) string {
+		out := t.TempDir()
+		b, err := NewBundlerBytes(true, out, 1<<20, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"a.crate", "b.crate"} {
+			if err := b.AddFile(filepath.Join(src, name), name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	indexLines := func(path string) []BundleEntry {
+		t.Helper()
+		entries, err := readBundleIndexFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	for _, format := range []BundleFormat{BundleTarZst, BundleTarBr} {
+		out := bundle(format)
+		archive := filepath.Join(out, "bundle-0000."+string(format))
+		index := filepath.Join(out, "bundle-0000.index.jsonl")
+		if closed, _ := os.ReadFile(archive); format == BundleTarZst {
+			if !zstdFramesComplete(bytes.NewReader(closed), int64(len(closed))) {
+				t.Fatal("closed tar.zst not seen as complete")
+			}
+			if zstdFramesComplete(bytes.NewReader(closed), int64(len(closed)-1)) {
+				t.Fatal("cut tar.zst seen as complete")
+			}
+		}
+
+		// A missing index is rebuilt from the archive, which is kept.
+		if err := os.Remove(index); err != nil {
+			t.Fatal(err)
+		}
+		if next, err := recoverBundles(out); err != nil || next != 1 {
+			t.Fatalf("%s: recoverBundles = %d, %v; want 1", format, next, err)
+		}
+		if got := indexLines(index); len(got) != 2 || got[0].Name != "a.crate" || got[1].Size != 700 || got[1].Source != "" {
+			t.Fatalf("%s: rebuilt index %+v", format, got)
+		}
+
+		// So is an index with a torn last line, keeping the sources it had.
+		stale, _ := json.Marshal(BundleEntry{Bundle: filepath.Base(archive), Name: "a.crate", Source: "/src/a.crate", Size: 700})
+		if err := os.WriteFile(index, append(stale, "\n{\"bundle\":\"bundle-0000"...), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if next, err := recoverBundles(out); err != nil || next != 1 {
+			t.Fatalf("%s: recoverBundles = %d, %v; want 1", format, next, err)
+		}
+		if got := indexLines(index); len(got) != 2 || got[0].Source != "/src/a.crate" || got[1].Name != "b.crate" {
+			t.Fatalf("%s: rebuilt index %+v", format, got)
+		}
+		if n, err := bundleMatchesIndex(archive, format, index); err != nil || n != 2 {
+			t.Fatalf("%s: archive changed: %d entries, %v", format, n, err)
+		}
+	}
+}
+
+func TestBundlerSkipBundled(t *testing.T) {
+	src := t.TempDir()
+	for _, name := range []string{"a.crate", "b.crate", "c.crate"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := t.TempDir()
+	add := func(b *Bundler, names ...string) []error {
+		var errs []error
+		for _, name := range names {
+			errs = append(errs, b.AddFile(filepath.Join(src, name), name))
+		}
+		return errs
+	}
+	b, err := NewBundler(true, out, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add(b, "a.crate", "b.crate")
+	b.Close()
+
+	b, err = NewBundler(true, out, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetSkipBundled(true); err != nil {
+		t.Fatal(err)
+	}
+	errs := add(b, "a.crate", "c.crate", "c.crate")
+	b.Close()
+	if !errors.Is(errs[0], ErrAlreadyBundled) || errs[1] != nil || !errors.Is(errs[2], ErrAlreadyBundled) {
+		t.Fatalf("AddFile errors %v, want [already-bundled nil already-bundled]", errs)
+	}
+	counts := make(map[string]int)
+	if err := ReadBundleIndexes(out, func(e BundleEntry) error {
+		counts[e.Name]++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 3 || counts["a.crate"] != 1 || counts["c.crate"] != 1 {
+		t.Fatalf("bundled entries %v, want a, b and c once each", counts)
+	}
+}
+
+// lineCounter counts manifest records as the collector writes them.
+type lineCounter struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.n += bytes.Count(p, []byte("\n"))
+	c.mu.Unlock()
+	return len(p), nil
+}
+
+func (c *lineCounter) lines() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func TestRunChannelBuffers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	var urls []string
+	for i := range 50 {
+		urls = append(urls, fmt.Sprintf("%s/crates/c%d/c%d-1.0.0.crate", srv.URL, i, i))
+	}
+	for _, sizes := range [][2]int{{0, 0}, {1, 1}, {3, 0}, {0, 3}, {64, 64}, {-1, -1}} {
+		var manifest lineCounter
+		d := NewDownloader(t.TempDir(), 4, 5*time.Second, map[string]string{}, &manifest, nil)
+		d.SetChannelBuffers(sizes[0], sizes[1])
+		if err := d.Run(context.Background(), urls); err != nil {
+			t.Fatal(err)
+		}
+		if total, ok, _ := d.Counts(); total != 50 || ok != 50 || manifest.lines() != 50 {
+			t.Errorf("buffers %v: total=%d ok=%d records=%d, want 50 each", sizes, total, ok, manifest.lines())
+		}
+	}
+}
+
+// BenchmarkRunChannelBuffers compares handing URLs and records over one at a
+// time with the default per-worker buffers, against a local server.
+func BenchmarkRunChannelBuffers(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("x"))
+	}))
+	defer srv.Close()
+	var urls []string
+	for i := range 500 {
+		urls = append(urls, fmt.Sprintf("%s/crates/c%d/c%d-1.0.0.crate", srv.URL, i, i))
+	}
+	for _, buf := range []int{0, -1} {
+		b.Run("buffer="+strconv.Itoa(buf), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				d := NewDownloader(b.TempDir(), 64, 5*time.Second, map[string]string{}, io.Discard, nil)
+				d.SetChannelBuffers(buf, buf)
+				if err := d.Run(context.Background(), urls); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRunSlowBundlerDoesNotStallDownloads(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+	var urls []string
+	for i := range 16 {
+		urls = append(urls, fmt.Sprintf("%s/crates/c%d/c%d-1.0.0.crate", srv.URL, i, i))
+	}
+	bundles := t.TempDir()
+	b, err := NewBundler(true, bundles, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := &lineCounter{}
+	d := NewDownloader(t.TempDir(), 2, 5*time.Second, map[string]string{}, records, b)
+
+	// Stall the bundler until every download has been recorded.
+	b.mu.Lock()
+	done := make(chan error, 1)
+	go func() { done <- d.Run(context.Background(), urls) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for records.lines() < len(urls) {
+		if time.Now().After(deadline) {
+			b.mu.Unlock()
+			t.Fatalf("only %d of %d downloads finished while bundling was blocked", records.lines(), len(urls))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	b.mu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := bundleEntries(t, filepath.Join(bundles, "bundle-0000.tar.zst")); len(got) != len(urls) {
+		t.Fatalf("bundled %d files, want %d", len(got), len(urls))
+	}
+}
+
+func TestNewEvent(t *testing.T) {
+	ev := NewEvent(Record{
+		URL:             "https://static.crates.io/crates/serde/serde-1.0.0.crate",
+		StartedAt:       "2025-01-02T03:04:05Z",
+		FinishedAt:      "2025-01-02T03:04:12Z",
+		Retries:         2,
+		ChecksumRetries: 1,
+	})
+	if ev.Crate != "serde" || ev.Version != "1.0.0" || ev.Host != "static.crates.io" || ev.Attempts != 4 || ev.DurationS != 7 {
+		t.Fatalf("NewEvent = %+v", ev)
+	}
+	if ev := NewEvent(Record{URL: "https://x/y"}); ev.DurationS != -1 {
+		t.Fatalf("duration without timestamps = %d, want -1", ev.DurationS)
+	}
+}
+
+func TestReadIndexValidateUTF8(t *testing.T) {
+	tmp := t.TempDir()
+	lines := "{\"name\":\"serde\",\"vers\":\"1.0.0\"}\n" +
+		"{\"name\":\"ser\xffde\",\"vers\":\"1.0.1\"}\n" + // invalid byte
+		"{\"name\":\"serde\",\"vers\":\"1.0.2\\u0007\"}\n" // control character
+	p := filepath.Join(tmp, "s", "er", "serde")
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(lines), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := IndexOptions{BaseURL: "https://static.crates.io/crates"}
+	res, err := ReadIndex(tmp, opts)
+	if err != nil || len(res.URLs) != 3 {
+		t.Fatalf("lenient read: %d urls, err %v; want all 3", len(res.URLs), err)
+	}
+
+	opts.ValidateUTF8 = true
+	res, err = ReadIndex(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.URLs) != 1 || res.URLs[0] != "https://static.crates.io/crates/serde/serde-1.0.0.crate" || res.Rejected != 2 {
+		t.Fatalf("validated read: urls %v, rejected %d; want only serde 1.0.0 and 2 rejected", res.URLs, res.Rejected)
+	}
+	opts.Strict = true
+	var le *index.LineError
+	if _, err := ReadIndex(tmp, opts); !errors.As(err, &le) || le.Line != 2 || !errors.Is(err, index.ErrInvalidText) {
+		t.Fatalf("strict read err = %v, want invalid text on line 2", err)
+	}
+
+	sums := filepath.Join(tmp, "sums.jsonl")
+	if err := os.WriteFile(sums, []byte("{\"url\":\"https://x/a.crate\",\"sha256\":\"AA\"}\n{\"url\":\"https://x/\xfe.crate\",\"sha256\":\"bb\"}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{1, 4} {
+		got, err := ReadChecksumsWithOptions(sums, ChecksumOptions{Workers: workers, ValidateUTF8: true})
+		if err != nil || len(got) != 1 || got["https://x/a.crate"] != "aa" {
+			t.Fatalf("workers=%d: checksums %v (err %v), want only a.crate", workers, got, err)
+		}
+	}
+}
+
+func TestBundleHeaderLayouts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+	u := srv.URL + "/crates/serde/serde-1.0.0.crate"
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	for layout, want := range map[HeaderLayout]string{
+		HeaderHost:  filepath.Join(host, "serde-1.0.0.crate"),
+		HeaderShard: "s/er/serde-1.0.0.crate",
+		HeaderFlat:  "serde-1.0.0.crate",
+	} {
+		out, bundles := t.TempDir(), t.TempDir()
+		b, err := NewBundler(true, bundles, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.SetHeaderLayout(layout, out)
+		d := NewDownloader(out, 1, 5*time.Second, map[string]string{}, io.Discard, b)
+		if err := d.Run(context.Background(), []string{u}); err != nil {
+			t.Fatal(err)
+		}
+		if got := bundleEntries(t, filepath.Join(bundles, "bundle-0000.tar.zst")); len(got) != 1 || got[0] != want {
+			t.Errorf("%s: entries %v, want [%s]", layout, got, want)
+		}
+	}
+
+	// A file outside the mirror root still gets a shard path.
+	b := &Bundler{headerLayout: HeaderShard, mirrorRoot: t.TempDir()}
+	if got := b.headerName(u, "/elsewhere/serde-1.0.0.crate"); got != "s/er/serde-1.0.0.crate" {
+		t.Errorf("shard name outside root = %q", got)
+	}
+	if _, err := ParseHeaderLayout("tree"); err == nil {
+		t.Error("accepted unknown header layout")
+	}
+}
+
+func TestETAWeightedBySize(t *testing.T) {
+	d := NewDownloader(t.TempDir(), 1, time.Second, nil, io.Discard, nil)
+	d.SetSizeHints(map[string]int64{"u/big": 800, "u/small": 100})
+	e := d.startETA([]string{"u/big", "u/small", "u/unknown"})
+	if e.total != 1350 {
+		t.Fatalf("expected total = %d, want 1350 (unknown counts as the 450 mean)", e.total)
+	}
+	e.done(d, "u/small")
+	attrs := e.attrs(1, 10*time.Second)
+	want := []any{"eta", "20s", "eta_bytes", "2m5s", "bytes_percent", "7.4"}
+	if fmt.Sprint(attrs) != fmt.Sprint(want) {
+		t.Fatalf("attrs = %v, want %v", attrs, want)
+	}
+
+	d.SetSizeHints(nil)
+	e = d.startETA([]string{"u/big", "u/small"})
+	e.done(d, "u/small")
+	if attrs := e.attrs(1, 10*time.Second); fmt.Sprint(attrs) != "[eta 10s]" {
+		t.Fatalf("without hints attrs = %v, want only eta", attrs)
+	}
+}
+
+func TestNameRegexPlacesFlatMirrorURLs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	out := t.TempDir()
+	d := NewDownloader(out, 1, 5*time.Second, map[string]string{}, io.Discard, nil)
+	re, err := ParseNameRegex(`/pool/(?P<name>[a-z0-9_-]+?)-\d+\.\d+\.\d+[^/]*\.crate$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetNameRegex(re)
+	urls := []string{srv.URL + "/pool/serde_json-1.0.0.crate", srv.URL + "/crates/log/log-0.4.0.crate"}
+	if err := d.Run(context.Background(), urls); err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range []string{"s/er/serde_json-1.0.0.crate", "log/log-0.4.0.crate"} {
+		if _, err := os.Stat(filepath.Join(out, filepath.FromSlash(rel))); err != nil {
+			t.Errorf("%s: %v", rel, err)
+		}
+	}
+	if _, err := ParseNameRegex(`/pool/.*\.crate`); err == nil {
+		t.Error("regex without a capture group accepted")
+	}
+}
+
+func TestWhere(t *testing.T) {
+	out := t.TempDir()
+	b, _ := NewBundlerBytes(false, "", 0, BundleTarZst)
+	b.SetHeaderLayout(HeaderShard, out)
+	d := NewDownloader(out, 1, time.Second, nil, io.Discard, b)
+	d.SetNormalizeCase(true)
+	d.SetStoreTransform(TransformGunzip)
+	p := d.Where(CrateURL("https://static.crates.io/crates/", "Inflector", "0.11.4"))
+	want := Placement{
+		URL:         "https://static.crates.io/crates/Inflector/Inflector-0.11.4.crate",
+		Dir:         filepath.Join(out, "i", "nf"),
+		Name:        "inflector-0.11.4.tar",
+		Path:        filepath.Join(out, "i", "nf", "inflector-0.11.4.tar"),
+		BundleEntry: "i/nf/inflector-0.11.4.tar",
+	}
+	if p != want {
+		t.Fatalf("Where = %+v, want %+v", p, want)
+	}
+	if err := os.MkdirAll(p.Dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p.Path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !d.Where(p.URL).Exists {
+		t.Fatal("Exists = false for a file on disk")
+	}
+}
+
+func TestMaxCreatesPerSec(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("x"))
+	}))
+	defer srv.Close()
+
+	d := NewDownloader(t.TempDir(), 5, 5*time.Second, map[string]string{}, io.Discard, nil)
+	d.SetMaxCreatesPerSec(20)
+	var urls []string
+	for i := range 5 {
+		urls = append(urls, fmt.Sprintf("%s/crates/c%d/c%d-1.0.0.crate", srv.URL, i, i))
+	}
+	start := time.Now()
+	if err := d.Run(context.Background(), urls); err != nil {
+		t.Fatal(err)
+	}
+	// Five creates at 20/s need at least four 50ms gaps.
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Fatalf("5 downloads took %v, want >= 200ms at 20 creates/s", elapsed)
+	}
+	if _, ok, _ := d.Counts(); ok != 5 {
+		t.Fatalf("ok = %d, want 5", ok)
+	}
+}
+
+func TestRunStopsAtByteBudget(t *testing.T) {
+	body := bytes.Repeat([]byte{'x'}, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer srv.Close()
+	var urls []string
+	for i := range 10 {
+		urls = append(urls, fmt.Sprintf("%s/crates/c%d/c%d-1.0.0.crate", srv.URL, i, i))
+	}
+	records := &lineCounter{}
+	d := NewDownloader(t.TempDir(), 1, 5*time.Second, map[string]string{}, records, nil)
+	d.SetMaxTotalBytes(250)
+	if err := d.Run(context.Background(), urls); err != nil {
+		t.Fatal(err)
+	}
+	// The budget is hit after the third file; with one worker at most one
+	// more dispatch can be in flight by then.
+	if n := records.lines(); n < 3 || n > 4 {
+		t.Fatalf("ran %d downloads, want 3 or 4 with a 250-byte budget", n)
+	}
+	if !d.BudgetReached() || d.BytesDownloaded() < 250 {
+		t.Fatalf("budget reached = %v after %d bytes", d.BudgetReached(), d.BytesDownloaded())
+	}
+}
+
+func TestStrictCountCatchesDroppedRecords(t *testing.T) {
+	body := bytes.Repeat([]byte{'x'}, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer srv.Close()
+	var urls []string
+	for i := range 6 {
+		urls = append(urls, fmt.Sprintf("%s/crates/c%d/c%d-1.0.0.crate", srv.URL, i, i))
+	}
+	d := NewDownloader(t.TempDir(), 2, 5*time.Second, map[string]string{}, io.Discard, nil)
+	d.SetStrictCount(true)
+	if err := d.Run(context.Background(), urls); err != nil {
+		t.Fatalf("complete run: %v", err)
+	}
+	// A second run on the same Downloader is counted on its own.
+	if err := d.Run(context.Background(), urls[:3]); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if err := d.countResult(len(urls), len(urls), 4); !errors.Is(err, ErrCountMismatch) {
+		t.Fatalf("2 dropped records: err = %v, want ErrCountMismatch", err)
+	}
+
+	// A budget stop is held only to the URLs it dispatched.
+	d = NewDownloader(t.TempDir(), 1, 5*time.Second, map[string]string{}, io.Discard, nil)
+	d.SetStrictCount(true)
+	d.SetMaxTotalBytes(250)
+	if err := d.Run(context.Background(), urls); err != nil || !d.BudgetReached() {
+		t.Fatalf("budget run: err = %v, budget reached = %v", err, d.BudgetReached())
+	}
+	if err := d.countResult(len(urls), 3, 2); !errors.Is(err, ErrCountMismatch) {
+		t.Fatalf("dropped record after a budget stop: err = %v", err)
+	}
+
+	d.SetStrictCount(false)
+	if err := d.countResult(len(urls), len(urls), 0); err != nil {
+		t.Fatalf("without strict count: %v", err)
+	}
+}
+
+// panicStore is the local filesystem, except that looking up a path
+// containing "boom" panics, as a bug on an unexpected input would.
+type panicStore struct{ LocalStore }
+
+func (s panicStore) Stat(path string) (fs.FileInfo, error) {
+	if strings.Contains(path, "boom") {
+		var m map[string]int
+		m[path]++ // nil map write
+	}
+	return s.LocalStore.Stat(path)
+}
+
+func TestWorkerPanicBecomesErrorRecord(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+	var urls []string
+	for _, name := range []string{"a", "boom", "b", "boom", "c", "d"} {
+		urls = append(urls, fmt.Sprintf("%s/crates/%s/%s-1.0.0.crate", srv.URL, name, name))
+	}
+	var buf bytes.Buffer
+	d := NewDownloader(t.TempDir(), 2, 5*time.Second, map[string]string{}, &buf, nil)
+	d.SetStore(panicStore{})
+	d.SetStrictCount(true)
+	done := make(chan error, 1)
+	go func() { done <- d.Run(context.Background(), urls) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("run did not finish after a worker panic")
+	}
+
+	var okCount, panics int
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec Record
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case strings.Contains(rec.URL, "boom"):
+			if rec.OK || rec.Status != StatusPanic || !strings.Contains(rec.Error, "panic") {
+				t.Errorf("boom record = %+v", rec)
+			}
+			panics++
+		case rec.OK:
+			okCount++
+		default:
+			t.Errorf("unexpected failure: %+v", rec)
+		}
+	}
+	if okCount != 4 || panics != 2 {
+		t.Fatalf("got %d ok and %d panic records, want 4 and 2", okCount, panics)
+	}
+	if total, ok, errc := d.Counts(); total != 6 || ok != 4 || errc != 2 {
+		t.Fatalf("counts = %d/%d/%d, want 6/4/2", total, ok, errc)
+	}
+}
+
+func TestRunFinalRetryRounds(t *testing.T) {
+	var mu sync.Mutex
+	hits := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		n := hits[r.URL.Path]
+		mu.Unlock()
+		switch {
+		case strings.Contains(r.URL.Path, "gone"):
+			http.NotFound(w, r)
+		case strings.Contains(r.URL.Path, "flaky") && n <= 2:
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(r.URL.Path))
+		}
+	}))
+	defer srv.Close()
+	urls := []string{
+		srv.URL + "/crates/serde/serde-1.0.0.crate",
+		srv.URL + "/crates/flaky/flaky-1.0.0.crate",
+		srv.URL + "/crates/gone/gone-1.0.0.crate",
+	}
+	var manifest bytes.Buffer
+	d := NewDownloader(t.TempDir(), 2, 5*time.Second, map[string]string{}, &manifest, nil)
+	d.SetRetries(0)
+	d.SetFinalRetries(3, time.Millisecond)
+	if err := d.Run(context.Background(), urls); err != nil {
+		t.Fatal(err)
+	}
+	if total, ok, errc := d.Counts(); total != 3 || ok != 2 || errc != 1 {
+		t.Fatalf("counts total=%d ok=%d err=%d, want 3/2/1", total, ok, errc)
+	}
+	var flakyRound int
+	dec := json.NewDecoder(&manifest)
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if rec.OK && strings.Contains(rec.URL, "flaky") {
+			flakyRound = rec.FinalRound
+		}
+		if rec.OK && rec.FinalRound != 0 && !strings.Contains(rec.URL, "flaky") {
+			t.Errorf("%s has final_round %d", rec.URL, rec.FinalRound)
+		}
+	}
+	if flakyRound != 2 {
+		t.Fatalf("flaky crate recovered in round %d, want 2", flakyRound)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if hits["/crates/gone/gone-1.0.0.crate"] != 4 {
+		t.Fatalf("gone crate fetched %d times, want main pass + 3 rounds", hits["/crates/gone/gone-1.0.0.crate"])
+	}
+}
+
+func TestFetchOneSecondaryChecksums(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+	sumOf := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	agree := srv.URL + "/crates/serde/serde-1.0.0.crate"
+	split := srv.URL + "/crates/tokio/tokio-1.0.0.crate"
+	primary := map[string]string{
+		agree: sumOf("/crates/serde/serde-1.0.0.crate"),
+		split: sumOf("/crates/tokio/tokio-1.0.0.crate"), // the file matches this one
+	}
+	d := NewDownloader(t.TempDir(), 1, 5*time.Second, primary, io.Discard, nil)
+	d.SetChecksumRetries(2)
+	d.SetSecondaryChecksums(map[string]string{
+		agree: strings.ToUpper(primary[agree]),
+		split: sumOf("tampered"),
+	})
+
+	if rec := d.fetchOne(context.Background(), agree, nil); !rec.OK || rec.Status != "ok" {
+		t.Fatalf("agreeing sources: %+v", rec)
+	}
+	rec := d.fetchOne(context.Background(), split, nil)
+	if rec.OK || rec.Status != StatusChecksumDisagreement || rec.SHA256 != primary[split] || rec.ChecksumRetries != 0 {
+		t.Fatalf("disagreeing sources: %+v", rec)
+	}
+	// A second run must not accept the file left on disk either.
+	if rec := d.fetchOne(context.Background(), split, nil); rec.OK || rec.Status != StatusChecksumDisagreement {
+		t.Fatalf("existing file with disagreeing sources: %+v", rec)
+	}
+}
+
+func TestPreflightClampsHTTP1(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("crate"))
+	}))
+	defer srv.Close()
+	d := NewDownloader(t.TempDir(), 512, 5*time.Second, map[string]string{}, io.Discard, nil)
+	tr := d.HTTPTransport().(*http.Transport)
+
+	proto, err := d.Preflight(context.Background(), srv.URL+"/crates/a/a-1.0.0.crate", 0)
+	if err != nil || proto != "HTTP/1.1" {
+		t.Fatalf("Preflight = %q, %v; want HTTP/1.1", proto, err)
+	}
+	if tr.MaxConnsPerHost != 1024 {
+		t.Fatalf("warn-only preflight changed MaxConnsPerHost to %d", tr.MaxConnsPerHost)
+	}
+	if _, err := d.Preflight(context.Background(), srv.URL+"/crates/a/a-1.0.0.crate", 16); err != nil {
+		t.Fatal(err)
+	}
+	if tr.MaxConnsPerHost != 16 || tr.MaxIdleConnsPerHost != 16 {
+		t.Fatalf("conns per host = %d (idle %d), want 16", tr.MaxConnsPerHost, tr.MaxIdleConnsPerHost)
+	}
+
+	rr := httptest.NewRecorder()
+	statusHandler(rr, httptest.NewRequest(http.MethodGet, "/api/status", nil))
+	var st struct {
+		Protocol string `json:"protocol"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &st); err != nil || st.Protocol != "HTTP/1.1" {
+		t.Fatalf("/api/status protocol = %q (err %v), body %s", st.Protocol, err, rr.Body)
+	}
+}
+
+func TestCatalogSortedAndIdempotent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+	idx := t.TempDir()
+	for rel, data := range map[string]string{
+		"s/er/serde": `{"name":"serde","vers":"1.0.10"}` + "\n" +
+			`{"name":"serde","vers":"1.0.2"}` + "\n" +
+			`{"name":"serde","vers":"1.0.3","yanked":true}` + "\n" +
+			`{"name":"serde","vers":"1.0.0-rc.1"}` + "\n",
+		"an/yh/anyhow": `{"name":"anyhow","vers":"1.0.0"}` + "\n",
+	} {
+		p := filepath.Join(idx, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := t.TempDir()
+	catPath := filepath.Join(t.TempDir(), "catalog.jsonl")
+	run := func() []byte {
+		t.Helper()
+		cat, err := LoadCatalog(catPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ReadIndex(idx, IndexOptions{BaseURL: srv.URL + "/crates", IncludeYanked: true, OnEntry: cat.AddIndexLine})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := NewDownloader(out, 2, 5*time.Second, map[string]string{}, io.Discard, nil)
+		d.SetCatalog(cat)
+		if err := d.Run(context.Background(), res.URLs); err != nil {
+			t.Fatal(err)
+		}
+		if err := cat.WriteFile(catPath); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(catPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	first := run()
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(first)), "\n") {
+		var e CatalogEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		body := "/crates/" + e.Name + "/" + e.Name + "-" + e.Version + ".crate"
+		h := sha256.Sum256([]byte(body))
+		if e.Size != int64(len(body)) || e.SHA256 != hex.EncodeToString(h[:]) {
+			t.Errorf("%s %s: size %d sha256 %s", e.Name, e.Version, e.Size, e.SHA256)
+		}
+		got = append(got, fmt.Sprintf("%s@%s:%v", e.Name, e.Version, e.Yanked))
+	}
+	want := "anyhow@1.0.0:false serde@1.0.0-rc.1:false serde@1.0.2:false serde@1.0.3:true serde@1.0.10:false"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("catalog order\n got %s\nwant %s", strings.Join(got, " "), want)
+	}
+	// The second run finds every file present; the catalog must not change.
+	if second := run(); !bytes.Equal(first, second) {
+		t.Fatalf("catalog changed on re-run:\n%s\nvs\n%s", first, second)
+	}
+}
+
+func TestLocalRegistryLayout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+	idx := t.TempDir()
+	for rel, data := range map[string]string{
+		"s/er/serde": `{"name":"serde","vers":"1.0.0"}` + "\n" +
+			`{"name":"serde","vers":"1.0.1","yanked":true}` + "\n" +
+			`{"name":"serde","vers":"1.0.2"}` + "\n",
+		"3/s/syn": `{"name":"syn","vers":"2.0.0"}` + "\n",
+		"2/cc":    `{"name":"cc","vers":"1.0.0"}` + "\n",
+	} {
+		p := filepath.Join(idx, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, regDir := t.TempDir(), t.TempDir()
+	run := func() {
+		t.Helper()
+		reg, err := NewLocalRegistry(regDir, "https://mirror.example/{crate}-{version}.crate")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ReadIndex(idx, IndexOptions{BaseURL: srv.URL + "/crates", OnEntry: reg.AddIndexLine})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := NewDownloader(out, 2, 5*time.Second, map[string]string{}, io.Discard, nil)
+		d.SetLocalRegistry(reg)
+		if err := d.Run(context.Background(), res.URLs); err != nil {
+			t.Fatal(err)
+		}
+		crates, linked, errs, err := reg.Close()
+		if err != nil || crates != 3 || linked != 4 || errs != 0 {
+			t.Fatalf("Close = %d crates, %d linked, %d errors, %v", crates, linked, errs, err)
+		}
+	}
+
+	// The second run finds every file present; nothing may be duplicated.
+	run()
+	run()
+	for rel, want := range map[string]string{
+		"index/se/rd/serde": `{"name":"serde","vers":"1.0.0"}` + "\n" + `{"name":"serde","vers":"1.0.2"}` + "\n",
+		"index/3/s/syn":     `{"name":"syn","vers":"2.0.0"}` + "\n",
+		"index/2/cc":        `{"name":"cc","vers":"1.0.0"}` + "\n",
+		"serde-1.0.2.crate": "/crates/serde/serde-1.0.2.crate",
+		"cc-1.0.0.crate":    "/crates/cc/cc-1.0.0.crate",
+	} {
+		data, err := os.ReadFile(filepath.Join(regDir, filepath.FromSlash(rel)))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v; want %q", rel, data, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(regDir, "serde-1.0.1.crate")); !os.IsNotExist(err) {
+		t.Errorf("yanked version linked: %v", err)
+	}
+	var cfg map[string]any
+	data, err := os.ReadFile(filepath.Join(regDir, "index", "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg["dl"] != "https://mirror.example/{crate}-{version}.crate" {
+		t.Errorf("config.json = %s", data)
+	}
+}
+
+func TestCargoRegistryFromSingleFileIndex(t *testing.T) {
+	// One JSONL file holding every entry is re-laid out in cargo's sharding.
+	idx := filepath.Join(t.TempDir(), "index.jsonl")
+	lines := []string{
+		`{"name":"Serde","vers":"1.0.0","deps":[],"cksum":"aa","features":{},"yanked":false}`,
+		`{"name":"Serde","vers":"1.0.1","deps":[],"cksum":"bb","features":{},"yanked":true}`,
+		`{"name":"a","vers":"0.1.0","deps":[],"cksum":"cc","features":{},"yanked":false}`,
+	}
+	if err := os.WriteFile(idx, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, regDir := t.TempDir(), t.TempDir()
+	stored := filepath.Join(crateDirFor("Serde", out), "Serde-1.0.0.crate")
+	if err := os.MkdirAll(filepath.Dir(stored), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stored, []byte("crate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := NewLocalRegistry(regDir, "https://mirror.example/registry/{crate}-{version}.crate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.SetAPI("https://mirror.example/registry")
+	res, err := ReadIndex(idx, IndexOptions{BaseURL: "https://static.crates.io/crates", IncludeYanked: true, Walk: index.Options{Layout: index.LayoutSingle}, OnEntry: reg.AddIndexLine})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDownloader(out, 1, time.Second, nil, io.Discard, nil)
+	if missing := d.FillLocalRegistry(reg, res.URLs); missing != 2 {
+		t.Errorf("missing = %d, want 2", missing)
+	}
+	if crates, linked, errs, err := reg.Close(); err != nil || crates != 2 || linked != 1 || errs != 0 {
+		t.Fatalf("Close = %d crates, %d linked, %d errors, %v", crates, linked, errs, err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(regDir, "index", "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg map[string]any
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg) != 2 || cfg["dl"] != "https://mirror.example/registry/{crate}-{version}.crate" || cfg["api"] != "https://mirror.example/registry" {
+		t.Errorf("config.json = %s", data)
+	}
+	data, err = os.ReadFile(filepath.Join(regDir, "index", "se", "rd", "serde"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(got) != 2 || got[0] != lines[0] || got[1] != lines[1] {
+		t.Errorf("index/se/rd/serde:\n%s", data)
+	}
+	for _, line := range got {
+		var ie IndexEntry
+		if err := json.Unmarshal([]byte(line), &ie); err != nil || ie.Name != "Serde" || ie.Cksum == "" {
+			t.Errorf("index line %s: %+v %v", line, ie, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(regDir, "index", "1", "a")); err != nil {
+		t.Error(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(regDir, "Serde-1.0.0.crate")); err != nil || string(b) != "crate" {
+		t.Errorf("linked crate = %q, %v", b, err)
+	}
+
+	if got := CargoIndexPath("ab"); got != "2/ab" {
+		t.Errorf("CargoIndexPath(ab) = %s", got)
+	}
+	if got := CargoIndexPath("Syn"); got != "3/s/syn" {
+		t.Errorf("CargoIndexPath(Syn) = %s", got)
+	}
+}
+
+func TestStartMetricsServerPortInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if err := StartMetricsServer(ln.Addr().String()); err == nil {
+		t.Fatal("StartMetricsServer on a bound port returned nil")
+	}
+	if err := StartMetricsServer(""); err != nil {
+		t.Fatalf("empty address: %v", err)
+	}
+}
+
+func TestRunCoalescesDuplicateURLs(t *testing.T) {
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		time.Sleep(200 * time.Millisecond) // keep the first fetch in flight while the copies arrive
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	u := srv.URL + "/crates/dup/dup-1.0.0.crate"
+	var manifest bytes.Buffer
+	d := NewDownloader(t.TempDir(), 4, 5*time.Second, map[string]string{}, &manifest, nil)
+	if err := d.Run(context.Background(), []string{u, u, u, u}); err != nil {
+		t.Fatal(err)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("server hit %d times, want 1", n)
+	}
+	var coalesced int
+	dec := json.NewDecoder(&manifest)
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if !rec.OK || rec.URL != u {
+			t.Fatalf("record %+v, want ok for %s", rec, u)
+		}
+		if rec.Coalesced {
+			coalesced++
+		}
+	}
+	if coalesced != 3 {
+		t.Fatalf("%d coalesced records, want 3", coalesced)
+	}
+	if total, ok, errc := d.Counts(); total != 4 || ok != 4 || errc != 0 {
+		t.Fatalf("counts total=%d ok=%d err=%d, want 4/4/0", total, ok, errc)
+	}
+}
+
+func TestWriteProvenance(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Write([]byte("serde"))
+	}))
+	defer srv.Close()
+
+	out := t.TempDir()
+	u := srv.URL + "/crates/serde/serde-1.0.0.crate"
+	sum := sha256.Sum256([]byte("serde"))
+	d := NewDownloader(out, 1, 5*time.Second, map[string]string{u: hex.EncodeToString(sum[:])}, io.Discard, nil)
+	d.SetWriteProvenance(true)
+	if err := d.Run(context.Background(), []string{u}); err != nil {
+		t.Fatal(err)
+	}
+	path := d.Where(u).Path + ProvenanceSuffix
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p Provenance
+	if err := json.Unmarshal(data, &p); err != nil {
+		t.Fatal(err)
+	}
+	want := Provenance{
+		SchemaVersion: 1, Crate: "serde", Version: "1.0.0", URL: u, BaseURL: srv.URL + "/crates",
+		FetchedAt: p.FetchedAt, HTTPStatus: 200, ETag: `"abc"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT",
+		Size: 5, SHA256: hex.EncodeToString(sum[:]), ChecksumVerified: true,
+	}
+	if p != want || p.FetchedAt == "" {
+		t.Fatalf("provenance %+v, want %+v", p, want)
+	}
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*"+DefaultTempSuffix))
+	if len(matches) != 0 {
+		t.Fatalf("temp files left behind: %v", matches)
+	}
+
+	// A second run skips the existing file and leaves its provenance alone.
+	os.Remove(path)
+	d = NewDownloader(out, 1, 5*time.Second, map[string]string{}, io.Discard, nil)
+	d.SetWriteProvenance(true)
+	if err := d.Run(context.Background(), []string{u}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("provenance written for a skipped file (stat err %v)", err)
+	}
+}
+
+func TestValidateGzip(t *testing.T) {
+	crate := func(files ...string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(zw)
+		for _, name := range files {
+			data := []byte("[package]\n")
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data))})
+			tw.Write(data)
+		}
+		tw.Close()
+		zw.Close()
+		return buf.Bytes()
+	}
+	valid := crate("good-1.0.0/Cargo.toml", "good-1.0.0/src/lib.rs")
+	corrupt := bytes.Clone(valid)
+	corrupt[len(corrupt)/2] ^= 0xff
+	bodies := map[string][]byte{
+		"good":    valid,
+		"corrupt": corrupt,
+		"notgzip": []byte("<html>not found</html>"),
+		"nocargo": crate("nocargo-1.0.0/src/lib.rs", "nocargo-1.0.0/sub/Cargo.toml"),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bodies[strings.Split(r.URL.Path, "/")[2]])
+	}))
+	defer srv.Close()
+	urlOf := func(name string) string { return fmt.Sprintf("%s/crates/%s/%s-1.0.0.crate", srv.URL, name, name) }
+
+	out := t.TempDir()
+	var manifest bytes.Buffer
+	d := NewDownloader(out, 2, 5*time.Second, map[string]string{}, &manifest, nil)
+	d.SetValidateGzip(true)
+	if err := d.Run(context.Background(), []string{urlOf("good"), urlOf("corrupt"), urlOf("notgzip"), urlOf("nocargo")}); err != nil {
+		t.Fatal(err)
+	}
+	recs := map[string]Record{}
+	dec := json.NewDecoder(&manifest)
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		recs[rec.URL] = rec
+	}
+	if rec := recs[urlOf("good")]; !rec.OK || rec.Status != "ok" {
+		t.Fatalf("good crate record %+v, want ok", rec)
+	}
+	for name, status := range map[string]string{"corrupt": StatusBadGzip, "notgzip": StatusBadGzip, "nocargo": StatusBadArchive} {
+		rec := recs[urlOf(name)]
+		prefix := map[string]string{StatusBadGzip: "invalid gzip", StatusBadArchive: "bad archive"}[status]
+		if rec.OK || rec.Status != status || !strings.HasPrefix(rec.Error, prefix) {
+			t.Errorf("%s record %+v, want status %s", name, rec, status)
+		}
+		if !strings.Contains(rec.Path, string(filepath.Separator)+QuarantineDirName+string(filepath.Separator)) {
+			t.Errorf("%s: record path %s is not quarantined", name, rec.Path)
+		}
+		if _, err := os.Stat(rec.Path); err != nil {
+			t.Errorf("%s: quarantined file: %v", name, err)
+		}
+		if _, err := os.Stat(d.Where(urlOf(name)).Path); !os.IsNotExist(err) {
+			t.Errorf("%s: bad file left in the mirror (stat err %v)", name, err)
+		}
+	}
+
+	// An existing file is only trusted without the flag; with it, garbage is refetched.
+	good := d.Where(urlOf("good")).Path
+	if err := os.WriteFile(good, []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d = NewDownloader(out, 1, 5*time.Second, map[string]string{}, io.Discard, nil)
+	d.SetValidateGzip(true)
+	if err := d.Run(context.Background(), []string{urlOf("good")}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(good); !bytes.Equal(got, valid) {
+		t.Fatal("existing garbage file was not refetched")
+	}
+}
+
+func TestScanCommandQuarantinesRejectedFiles(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	big := bytes.Repeat([]byte("clean "), 200_000) // more than a pipe buffer
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "evil") {
+			w.Write([]byte("payload EICAR payload"))
+			return
+		}
+		w.Write(big)
+	}))
+	defer srv.Close()
+	urls := []string{srv.URL + "/crates/good/good-1.0.0.crate", srv.URL + "/crates/evil/evil-1.0.0.crate"}
+	records := func(d *Downloader, buf *bytes.Buffer) map[string]Record {
+		t.Helper()
+		if err := d.Run(context.Background(), urls); err != nil {
+			t.Fatal(err)
+		}
+		recs := map[string]Record{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var rec Record
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatal(err)
+			}
+			recs[crateNameFromURL(rec.URL)] = rec
+		}
+		return recs
+	}
+
+	out := t.TempDir()
+	var buf bytes.Buffer
+	d := NewDownloader(out, 2, 5*time.Second, map[string]string{}, &buf, nil)
+	d.SetScanCommand([]string{"sh", "-c", `case "$CRATE_URL" in */crates/*.crate) ;; *) exit 3 ;; esac; if grep -q EICAR; then echo infected >&2; exit 1; fi`})
+	recs := records(d, &buf)
+	if good := recs["good"]; !good.OK || good.Size != int64(len(big)) {
+		t.Errorf("good record = %+v", good)
+	}
+	evil := recs["evil"]
+	if evil.OK || evil.Status != StatusScanFailed || !strings.Contains(evil.Error, "infected") {
+		t.Fatalf("evil record = %+v", evil)
+	}
+	if want := filepath.Join(out, QuarantineDirName, "e", "vi", "evil-1.0.0.crate"); evil.Path != want {
+		t.Errorf("evil path = %s, want %s", evil.Path, want)
+	}
+	if _, err := os.Stat(filepath.Join(out, "e", "vi", "evil-1.0.0.crate")); !os.IsNotExist(err) {
+		t.Errorf("rejected file left in the mirror: %v", err)
+	}
+
+	// A scanner that exits without reading its input must not break downloads.
+	buf.Reset()
+	d = NewDownloader(t.TempDir(), 2, 5*time.Second, map[string]string{}, &buf, nil)
+	d.SetScanCommand([]string{"true"})
+	for name, rec := range records(d, &buf) {
+		if !rec.OK {
+			t.Errorf("%s with a scanner ignoring stdin: %+v", name, rec)
+		}
+	}
+}
+
+func TestDeepVerifyCatchesSwappedCrates(t *testing.T) {
+	crate := func(dir, toml string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(zw)
+		files := map[string]string{dir + "/Cargo.toml": toml, dir + "/src/lib.rs": ""}
+		for name, data := range files {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data))})
+			tw.Write([]byte(data))
+		}
+		tw.Close()
+		zw.Close()
+		return buf.Bytes()
+	}
+	manifest := func(name, version string) string {
+		return fmt.Sprintf("[package]\nedition = \"2021\"\nname = \"%s\"\nversion = \"%s\"\n\n[dependencies.serde]\nversion = \"1\"\n", name, version)
+	}
+	bodies := map[string][]byte{
+		"good":    crate("good-1.0.0", manifest("good", "1.0.0")),
+		"renamed": crate("renamed-1.0.0", manifest("other", "1.0.0")),
+		"swapped": crate("other-2.0.0", manifest("other", "2.0.0")),
+		"oldver":  crate("oldver-1.0.0", manifest("oldver", "0.9.0")),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bodies[strings.Split(r.URL.Path, "/")[2]])
+	}))
+	defer srv.Close()
+	urlOf := func(name string) string { return fmt.Sprintf("%s/crates/%s/%s-1.0.0.crate", srv.URL, name, name) }
+
+	var manifestOut bytes.Buffer
+	d := NewDownloader(t.TempDir(), 2, 5*time.Second, map[string]string{}, &manifestOut, nil)
+	d.SetDeepVerify(true)
+	var urls []string
+	for name := range bodies {
+		urls = append(urls, urlOf(name))
+	}
+	if err := d.Run(context.Background(), urls); err != nil {
+		t.Fatal(err)
+	}
+	recs := map[string]Record{}
+	dec := json.NewDecoder(&manifestOut)
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		recs[rec.URL] = rec
+	}
+	if rec := recs[urlOf("good")]; !rec.OK || rec.Status != "ok" {
+		t.Fatalf("good crate record %+v, want ok", rec)
+	}
+	for _, name := range []string{"renamed", "swapped", "oldver"} {
+		rec := recs[urlOf(name)]
+		if rec.OK || rec.Status != StatusCrateMismatch || !strings.HasPrefix(rec.Error, ErrCrateMismatch.Error()) {
+			t.Errorf("%s record %+v, want status %s", name, rec, StatusCrateMismatch)
+		}
+		if !strings.Contains(rec.Path, QuarantineDirName) {
+			t.Errorf("%s: record path %s is not quarantined", name, rec.Path)
+		}
+	}
+
+	// Plain -validate-gzip only checks the structure.
+	d = NewDownloader(t.TempDir(), 1, 5*time.Second, map[string]string{}, io.Discard, nil)
+	d.SetValidateGzip(true)
+	if err := d.Run(context.Background(), []string{urlOf("renamed")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(d.Where(urlOf("renamed")).Path); err != nil {
+		t.Fatalf("renamed crate rejected without -deep-verify: %v", err)
+	}
+}
+
+func TestManifestCollectorsKeepEveryRecord(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/e") {
+			http.Error(w, "gone", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	var urls []string
+	for i := range 300 {
+		name := "c" + strconv.Itoa(i)
+		if i%10 == 0 {
+			name = "e" + strconv.Itoa(i)
+		}
+		urls = append(urls, fmt.Sprintf("%s/crates/%s/%s-1.0.0.crate", srv.URL, name, name))
+	}
+	for _, n := range []int{1, 4, 16} {
+		var manifest bytes.Buffer
+		d := NewDownloader(t.TempDir(), 8, 5*time.Second, map[string]string{}, &manifest, nil)
+		d.SetManifestCollectors(n)
+		d.SetRetries(1)
+		if err := d.Run(context.Background(), urls); err != nil {
+			t.Fatal(err)
+		}
+		seen := map[string]int{}
+		var failed int
+		dec := json.NewDecoder(&manifest)
+		for {
+			var rec Record
+			if err := dec.Decode(&rec); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("collectors=%d: %v", n, err)
+			}
+			seen[rec.URL]++
+			if !rec.OK {
+				failed++
+			}
+		}
+		for _, u := range urls {
+			if seen[u] != 1 {
+				t.Fatalf("collectors=%d: %s has %d records, want 1", n, u, seen[u])
+			}
+		}
+		total, ok, errc := d.Counts()
+		if len(seen) != len(urls) || failed != 30 || total != 300 || ok != 270 || errc != 30 {
+			t.Fatalf("collectors=%d: records=%d failed=%d total=%d ok=%d err=%d", n, len(seen), failed, total, ok, errc)
+		}
+	}
+}
+
+// BenchmarkManifestCollectors measures how fast 1 and several collectors turn
+// results into manifest records, without any downloading.
+func BenchmarkManifestCollectors(b *testing.B) {
+	rec := Record{SchemaVersion: 1, URL: "https://static.crates.io/crates/serde/serde-1.0.0.crate", Path: "out/se/rd/serde-1.0.0.crate",
+		Size: 77000, SHA256: strings.Repeat("ab", 32), StartedAt: "2025-01-01T00:00:00Z", FinishedAt: "2025-01-01T00:00:01Z", OK: true, Status: "ok"}
+	for _, n := range []int{1, 4} {
+		b.Run("collectors="+strconv.Itoa(n), func(b *testing.B) {
+			d := NewDownloader(b.TempDir(), 1, time.Second, map[string]string{}, io.Discard, nil)
+			d.SetManifestCollectors(n)
+			results := make(chan Record, 1024)
+			var (
+				wg     sync.WaitGroup
+				mu     sync.Mutex
+				failed []string
+			)
+			for range n {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					d.collect(results, 0, &mu, &failed)
+				}()
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				results <- rec
+			}
+			close(results)
+			wg.Wait()
+		})
+	}
+}
+
+func TestPerURLDeadline(t *testing.T) {
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "flaky") {
+			hits.Add(1)
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	flaky := srv.URL + "/crates/flaky/flaky-1.0.0.crate"
+	fine := srv.URL + "/crates/fine/fine-1.0.0.crate"
+	var manifest bytes.Buffer
+	d := NewDownloader(t.TempDir(), 2, 5*time.Second, map[string]string{}, &manifest, nil)
+	d.SetRetries(100)
+	d.SetRetryBase(50 * time.Millisecond)
+	d.SetRetryMax(50 * time.Millisecond)
+	d.SetPerURLDeadline(300 * time.Millisecond)
+	start := time.Now()
+	if err := d.Run(context.Background(), []string{flaky, fine}); err != nil {
+		t.Fatal(err)
+	}
+	if el := time.Since(start); el > 3*time.Second {
+		t.Fatalf("run took %v; the deadline did not cut retries short", el)
+	}
+	if n := hits.Load(); n < 2 || n >= 100 {
+		t.Fatalf("flaky URL tried %d times, want a few", n)
+	}
+	dec := json.NewDecoder(&manifest)
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		switch rec.URL {
+		case flaky:
+			if rec.OK || rec.Status != StatusDeadline || !strings.Contains(rec.Error, ErrURLDeadline.Error()) {
+				t.Errorf("flaky record %+v, want status %s", rec, StatusDeadline)
+			}
+		case fine:
+			if !rec.OK {
+				t.Errorf("fine record %+v, want ok", rec)
+			}
+		}
+	}
+}
+
+func TestIndexHeadFromGitDir(t *testing.T) {
+	const (
+		loose  = "0123456789abcdef0123456789abcdef01234567"
+		packed = "89abcdef0123456789abcdef0123456789abcdef"
+	)
+	write := func(root, rel, data string) {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{"loose ref", map[string]string{".git/HEAD": "ref: refs/heads/master\n", ".git/refs/heads/master": loose + "\n"}, loose},
+		{"packed ref", map[string]string{".git/HEAD": "ref: refs/heads/master\n", ".git/packed-refs": "# pack-refs with: peeled\n" + packed + " refs/heads/master\n"}, packed},
+		{"detached", map[string]string{".git/HEAD": strings.ToUpper(loose) + "\n"}, loose},
+		{"gitdir file", map[string]string{".git": "gitdir: real.git\n", "real.git/HEAD": "ref: refs/heads/main\n", "real.git/refs/heads/main": packed}, packed},
+	} {
+		root := t.TempDir()
+		for rel, data := range tc.files {
+			write(root, rel, data)
+		}
+		got, err := IndexHead(root)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: IndexHead = %q, %v; want %s", tc.name, got, err, tc.want)
+		}
+	}
+	if _, err := IndexHead(t.TempDir()); err == nil {
+		t.Error("IndexHead succeeded outside a git repo")
+	}
+
+	root := t.TempDir()
+	write(root, ".git/HEAD", "ref: refs/heads/master\n")
+	write(root, ".git/refs/heads/master", loose+"\n")
+	commit, err := IndexHead(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "run.json")
+	if err := WriteRunInfo(path, RunInfo{IndexDir: root, IndexCommit: commit, URLs: 3}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info RunInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.IndexCommit != loose || info.SchemaVersion != 1 || info.URLs != 3 {
+		t.Fatalf("run info %+v, want index_commit %s", info, loose)
+	}
+}
+
+func TestRoutesSplitMirrorAcrossDirs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	tmp := t.TempDir()
+	out, disk1, disk2, disk3 := filepath.Join(tmp, "out"), filepath.Join(tmp, "disk1"), filepath.Join(tmp, "disk2"), filepath.Join(tmp, "disk3")
+	var routes []Route
+	for _, rule := range []string{"serde-json=" + disk3, "foo-bar-a..foo-bar-c=" + disk3, "a..m=" + disk1, "N..Z=" + disk2} {
+		r, err := ParseRoute(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes = append(routes, r)
+	}
+	for _, bad := range []string{"a..m", "=x", "m..a=/x", "..a=/x", "a..=/x"} {
+		if _, err := ParseRoute(bad); err == nil {
+			t.Errorf("ParseRoute(%q) accepted a bad rule", bad)
+		}
+	}
+
+	var manifest bytes.Buffer
+	d := NewDownloader(out, 2, 5*time.Second, map[string]string{}, &manifest, nil)
+	d.SetRoutes(routes)
+	want := map[string]string{
+		"Anyhow": disk1, "mz": disk1, "serde": disk2, "zz": disk2, "3d": out, "_x": out,
+		"serde-json": disk3, "serde-json-core": disk3, "serde_json": disk2,
+		"foo-bar-baz": disk3, "foo-bar-c": disk3, "foo-bar-d": disk1,
+	}
+	var urls []string
+	for name := range want {
+		urls = append(urls, fmt.Sprintf("%s/crates/%s/%s-1.0.0.crate", srv.URL, name, name))
+	}
+	if err := d.Run(context.Background(), urls); err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(&manifest)
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		name := crateNameFromURL(rec.URL)
+		root := want[name]
+		if !rec.OK || rec.Root != root || rec.Path != filepath.Join(crateDirFor(name, root), name+"-1.0.0.crate") {
+			t.Errorf("%s: record %+v, want it under %s", name, rec, root)
+		}
+		if _, err := os.Stat(rec.Path); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if p := d.Where(rec.URL); p.Root != root || p.Path != rec.Path {
+			t.Errorf("%s: Where %+v disagrees with the record", name, p)
+		}
+	}
+}
+
+// eioStore fails the first fails Opens of every path with an I/O error.
+type eioStore struct {
+	LocalStore
+	mu    sync.Mutex
+	fails int
+	seen  map[string]int
+}
+
+func (s *eioStore) Open(path string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	s.seen[path]++
+	n := s.seen[path]
+	s.mu.Unlock()
+	if n <= s.fails {
+		return nil, &fs.PathError{Op: "read", Path: path, Err: syscall.EIO}
+	}
+	return s.LocalStore.Open(path)
+}
+
+func TestVerifyReadErrorsAreNotMismatches(t *testing.T) {
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte("serde"))
+	}))
+	defer srv.Close()
+	u := srv.URL + "/crates/serde/serde-1.0.0.crate"
+	sum := sha256.Sum256([]byte("serde"))
+	sums := map[string]string{u: hex.EncodeToString(sum[:])}
+	out := t.TempDir()
+
+	// A transient error is retried and the download verifies.
+	var manifest bytes.Buffer
+	d := NewDownloader(out, 1, 5*time.Second, sums, &manifest, nil)
+	d.SetStore(&eioStore{fails: verifyReadAttempts - 1, seen: map[string]int{}})
+	if err := d.Run(context.Background(), []string{u}); err != nil {
+		t.Fatal(err)
+	}
+	var rec Record
+	if err := json.Unmarshal(manifest.Bytes(), &rec); err != nil || !rec.OK || rec.ChecksumRetries != 0 {
+		t.Fatalf("record %+v (err %v), want ok after read retries", rec, err)
+	}
+
+	// A persistent error on the existing file is reported as such, and the
+	// file is neither re-downloaded nor removed.
+	manifest.Reset()
+	before := hits.Load()
+	d = NewDownloader(out, 1, 5*time.Second, sums, &manifest, nil)
+	d.SetStore(&eioStore{fails: verifyReadAttempts, seen: map[string]int{}})
+	d.SetChecksumRetries(2)
+	if err := d.Run(context.Background(), []string{u}); err != nil {
+		t.Fatal(err)
+	}
+	rec = Record{}
+	if err := json.Unmarshal(manifest.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.OK || rec.Status != StatusReadError || !strings.Contains(rec.Error, "input/output error") {
+		t.Fatalf("record %+v, want status %s", rec, StatusReadError)
+	}
+	if hits.Load() != before {
+		t.Fatal("unreadable existing file was downloaded again")
+	}
+	if _, err := os.Stat(rec.Path); err != nil {
+		t.Fatalf("existing file removed: %v", err)
+	}
+}
+
+func TestCleanTempsRemovesOnlyStaleTemps(t *testing.T) {
+	out := t.TempDir()
+	shard := filepath.Join(out, "se", "rd")
+	if err := os.MkdirAll(shard, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	files := map[string]bool{ // name -> should survive
+		"serde-1.0.0.crate.0badf00d.part": false,
+		"serde-1.0.1.crate.0badf00d.dl":   false,
+		"catalog.1234.tmp":                false,
+		"serde-1.0.2.crate.1badf00d.part": true, // fresh: another run may own it
+		"serde-1.0.0.crate":               true,
+	}
+	for name, keep := range files {
+		p := filepath.Join(shard, name)
+		if err := os.WriteFile(p, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if !keep || !strings.Contains(name, ".part") {
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	d := NewDownloader(out, 1, time.Second, map[string]string{}, io.Discard, nil)
+	d.SetTempSuffix(".dl")
+	d.SetCleanTemps(time.Hour)
+	if err := d.Run(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, keep := range files {
+		_, err := os.Stat(filepath.Join(shard, name))
+		if exists := err == nil; exists != keep {
+			t.Errorf("%s: exists=%v, want %v", name, exists, keep)
+		}
+	}
+}
+
+func TestWriteCargoSourceConfig(t *testing.T) {
+	dir := t.TempDir()
+	mirror := filepath.Join(dir, "mirror")
+	out := filepath.Join(dir, ".cargo", "config.toml")
+	if err := WriteCargoSourceConfig("file://"+filepath.ToSlash(mirror), out); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[source.crates-io]\nreplace-with = '" + CargoSourceName + "'\n\n" +
+		"[source." + CargoSourceName + "]\nlocal-registry = '" + mirror + "'\n"
+	if !strings.HasSuffix(string(got), want) {
+		t.Fatalf("config:\n%s\nwant it to end with:\n%s", got, want)
+	}
+
+	if err := WriteCargoSourceConfigStyle("vendor", out, CargoDirectory); err != nil {
+		t.Fatal(err)
+	}
+	abs, _ := filepath.Abs("vendor")
+	if got, _ := os.ReadFile(out); !strings.Contains(string(got), "\ndirectory = '"+abs+"'\n") {
+		t.Fatalf("directory config:\n%s", got)
+	}
+	if err := WriteCargoSourceConfig("https://mirror.example/crates", out); err == nil {
+		t.Error("remote mirror accepted for a local-registry source")
+	}
+	if _, err := ParseCargoSourceStyle("git"); err == nil {
+		t.Error("unknown style accepted")
+	}
+}
+
+func TestAllowedHostsRejectsOtherHosts(t *testing.T) {
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if strings.Contains(r.URL.Path, "redirected") {
+			// Same server, but under a host name that is not allowed.
+			http.Redirect(w, r, "http://"+strings.Replace(r.Host, "127.0.0.1", "localhost", 1)+"/crates/a/a-1.0.0.crate", http.StatusFound)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	out := t.TempDir()
+	var manifest bytes.Buffer
+	d := NewDownloader(out, 2, 5*time.Second, map[string]string{}, &manifest, nil)
+	d.SetRetries(1)
+	d.SetAllowedHosts([]string{"127.0.0.1", "*.crates.example"})
+	urls := []string{
+		srv.URL + "/crates/a/a-1.0.0.crate",
+		"https://evil.example/crates/b/b-1.0.0.crate",
+		"https://crates.example.evil.example/crates/c/c-1.0.0.crate",
+		srv.URL + "/crates/redirected/redirected-1.0.0.crate",
+	}
+	if err := d.Run(context.Background(), urls); err != nil {
+		t.Fatal(err)
+	}
+	recs := map[string]Record{}
+	dec := json.NewDecoder(&manifest)
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		recs[rec.URL] = rec
+	}
+	if !recs[urls[0]].OK {
+		t.Fatalf("allowed host failed: %+v", recs[urls[0]])
+	}
+	for _, u := range urls[1:3] {
+		if rec := recs[u]; rec.OK || rec.Status != StatusHostNotAllowed {
+			t.Errorf("%s: record %+v, want status %s", u, rec, StatusHostNotAllowed)
+		}
+	}
+	if rec := recs[urls[3]]; rec.OK || !strings.Contains(rec.Error, ErrHostNotAllowed.Error()) {
+		t.Errorf("redirect off the allowlist: record %+v, want a dial refusal", rec)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("server saw %d requests, want 2 (the redirect target must not be reached)", n)
+	}
+	if d.hostAllowed("crates.example") || !d.hostAllowed("static.crates.example") {
+		t.Error("*.crates.example should match subdomains only")
+	}
+}
@@ -0,0 +1,92 @@
+package downloader
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// SetSizeHints gives the expected size in bytes of some URLs, e.g. from an
+// earlier manifest (see LoadSizeHints). With hints, periodic progress logs
+// add eta_bytes, an estimate weighted by the bytes left rather than the
+// files left, which stays steady when a few huge crates dominate a run. URLs
+// without a hint are assumed to be of the average hinted size.
+func (d *Downloader) SetSizeHints(hints map[string]int64) {
+	d.sizeHints = hints
+}
+
+// LoadSizeHints reads the sizes of successful downloads from a manifest, for
+// SetSizeHints.
+func LoadSizeHints(manifestPath string) (map[string]int64, error) {
+	hints := make(map[string]int64)
+	err := ReadManifest(manifestPath, func(rec Record) error {
+		if rec.OK && rec.Size > 0 {
+			hints[rec.URL] = rec.Size
+		}
+		return nil
+	})
+	return hints, err
+}
+
+// etaState tracks expected bytes for one Run.
+type etaState struct {
+	urls     int64
+	mean     int64 // weight of a URL without a hint
+	total    int64 // expected bytes of the whole worklist
+	doneWant atomic.Int64
+}
+
+// startETA sizes the worklist; the byte-weighted estimate is off (nil) when
+// no URL has a hint.
+func (d *Downloader) startETA(urls []string) *etaState {
+	e := &etaState{urls: int64(len(urls))}
+	var hinted, hintedBytes int64
+	for _, u := range urls {
+		if n, ok := d.sizeHints[u]; ok {
+			hinted++
+			hintedBytes += n
+		}
+	}
+	if hinted == 0 {
+		return e
+	}
+	e.mean = hintedBytes / hinted
+	e.total = hintedBytes + (e.urls-hinted)*e.mean
+	return e
+}
+
+// done records that url was processed by the main pass.
+func (e *etaState) done(d *Downloader, url string) {
+	if e == nil || e.total == 0 {
+		return
+	}
+	n, ok := d.sizeHints[url]
+	if !ok {
+		n = e.mean
+	}
+	e.doneWant.Add(n)
+}
+
+// attrs returns the item-based eta and, with size hints, eta_bytes and the
+// percentage of expected bytes done.
+func (e *etaState) attrs(processed int64, elapsed time.Duration) []any {
+	if e == nil || processed <= 0 || elapsed <= 0 {
+		return nil
+	}
+	var attrs []any
+	if left := e.urls - processed; left > 0 {
+		attrs = append(attrs, "eta", roundETA(time.Duration(float64(elapsed)*float64(left)/float64(processed))))
+	}
+	done := e.doneWant.Load()
+	if e.total > 0 && done > 0 {
+		if left := e.total - done; left > 0 {
+			attrs = append(attrs, "eta_bytes", roundETA(time.Duration(float64(elapsed)*float64(left)/float64(done))))
+		}
+		attrs = append(attrs, "bytes_percent", fmt.Sprintf("%.1f", 100*float64(done)/float64(e.total)))
+	}
+	return attrs
+}
+
+func roundETA(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
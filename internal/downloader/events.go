@@ -0,0 +1,74 @@
+package downloader
+
+import (
+	"errors"
+	"log/slog"
+	"net/url"
+	"time"
+)
+
+// EventSink receives every manifest record as the collector writes it, for
+// stores that are easier to query than JSONL. Add is only called from the
+// collector goroutine; Close is called once when Run finishes.
+type EventSink interface {
+	Add(Record) error
+	Close() error
+}
+
+// ErrNoSQLite is returned by OpenSQLiteEvents in builds without the sqlite
+// build tag.
+var ErrNoSQLite = errors.New("built without SQLite support; rebuild with -tags sqlite")
+
+// SetEventSink sends each record to s in addition to the manifest. Run closes
+// s when it returns.
+func (d *Downloader) SetEventSink(s EventSink) {
+	d.events = s
+}
+
+// addEvent forwards rec to the event sink. After the first failure the sink is
+// dropped so a broken database cannot slow the run down; the manifest remains
+// the record of truth.
+func (d *Downloader) addEvent(rec Record) {
+	if d.events == nil {
+		return
+	}
+	if err := d.events.Add(rec); err != nil {
+		slog.Error("events_write_failed", "err", err, "hint", "no further events are recorded for this run")
+		d.events.Close()
+		d.events = nil
+	}
+}
+
+func (d *Downloader) closeEvents() error {
+	if d.events == nil {
+		return nil
+	}
+	err := d.events.Close()
+	d.events = nil
+	return err
+}
+
+// Event is a Record flattened into the columns of the events table.
+type Event struct {
+	Crate, Version, Host string
+	Attempts             int
+	// DurationS is whole seconds between the record timestamps, -1 when
+	// either is missing.
+	DurationS int64
+	Record
+}
+
+// NewEvent derives the query columns of rec.
+func NewEvent(rec Record) Event {
+	ev := Event{Record: rec, Attempts: rec.Retries + rec.ChecksumRetries + 1, DurationS: -1}
+	ev.Crate, ev.Version = crateVersionFromURL(rec.URL)
+	if u, err := url.Parse(rec.URL); err == nil {
+		ev.Host = u.Host
+	}
+	start, err1 := time.Parse(time.RFC3339, rec.StartedAt)
+	end, err2 := time.Parse(time.RFC3339, rec.FinishedAt)
+	if err1 == nil && err2 == nil {
+		ev.DurationS = int64(end.Sub(start) / time.Second)
+	}
+	return ev
+}
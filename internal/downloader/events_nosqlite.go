@@ -0,0 +1,8 @@
+//go:build !sqlite
+
+package downloader
+
+// OpenSQLiteEvents needs the sqlite build tag; see events_sqlite.go.
+func OpenSQLiteEvents(path string) (EventSink, error) {
+	return nil, ErrNoSQLite
+}
@@ -0,0 +1,111 @@
+//go:build sqlite
+
+package downloader
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "modernc.org/sqlite" // pure-Go driver, registered as "sqlite"
+)
+
+// eventsBatch is how many rows go into one transaction.
+const eventsBatch = 500
+
+const eventsSchema = `
+CREATE TABLE IF NOT EXISTS downloads (
+	id               INTEGER PRIMARY KEY,
+	crate            TEXT    NOT NULL,
+	version          TEXT    NOT NULL,
+	host             TEXT    NOT NULL,
+	url              TEXT    NOT NULL,
+	path             TEXT    NOT NULL,
+	size             INTEGER NOT NULL,
+	sha256           TEXT    NOT NULL,
+	ok               INTEGER NOT NULL,
+	status           TEXT    NOT NULL,
+	error            TEXT    NOT NULL,
+	attempts         INTEGER NOT NULL,
+	retries          INTEGER NOT NULL,
+	checksum_retries INTEGER NOT NULL,
+	started_at       TEXT    NOT NULL,
+	finished_at      TEXT    NOT NULL,
+	duration_s       INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS downloads_crate_version ON downloads (crate, version);
+CREATE INDEX IF NOT EXISTS downloads_status ON downloads (status);
+CREATE INDEX IF NOT EXISTS downloads_host ON downloads (host);
+CREATE INDEX IF NOT EXISTS downloads_duration ON downloads (duration_s);
+CREATE INDEX IF NOT EXISTS downloads_finished ON downloads (finished_at);
+`
+
+const eventsInsert = `INSERT INTO downloads
+	(crate, version, host, url, path, size, sha256, ok, status, error, attempts, retries, checksum_retries, started_at, finished_at, duration_s)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// sqliteEvents writes records to the downloads table of a SQLite database in
+// batched transactions. Rows from earlier runs are kept.
+type sqliteEvents struct {
+	db      *sql.DB
+	pending []Event
+}
+
+// OpenSQLiteEvents opens or creates the events database at path.
+func OpenSQLiteEvents(path string) (EventSink, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode=WAL", "PRAGMA synchronous=NORMAL", eventsSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("events db %s: %w", path, err)
+		}
+	}
+	return &sqliteEvents{db: db}, nil
+}
+
+func (s *sqliteEvents) Add(rec Record) error {
+	s.pending = append(s.pending, NewEvent(rec))
+	if len(s.pending) < eventsBatch {
+		return nil
+	}
+	return s.flush()
+}
+
+func (s *sqliteEvents) flush() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(eventsInsert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, ev := range s.pending {
+		if _, err := stmt.Exec(ev.Crate, ev.Version, ev.Host, ev.URL, ev.Path, ev.Size, ev.SHA256, ev.OK, ev.Status, ev.Error,
+			ev.Attempts, ev.Retries, ev.ChecksumRetries, ev.StartedAt, ev.FinishedAt, ev.DurationS); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.pending = s.pending[:0]
+	return nil
+}
+
+func (s *sqliteEvents) Close() error {
+	err := s.flush()
+	if cerr := s.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
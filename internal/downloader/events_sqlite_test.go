@@ -0,0 +1,62 @@
+//go:build sqlite
+
+package downloader
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunSQLiteEvents(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/crates/gone/gone-1.0.0.crate" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+	urls := []string{srv.URL + "/crates/serde/serde-1.0.0.crate", srv.URL + "/crates/gone/gone-1.0.0.crate"}
+
+	dbPath := filepath.Join(t.TempDir(), "events.db")
+	for run := 1; run <= 2; run++ {
+		sink, err := OpenSQLiteEvents(dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := NewDownloader(t.TempDir(), 2, 5*time.Second, map[string]string{}, io.Discard, nil)
+		d.SetRetries(0)
+		d.SetEventSink(sink)
+		if err := d.Run(context.Background(), urls); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var total, ok int
+	var size int64
+	if err := db.QueryRow(`SELECT COUNT(*), SUM(ok), SUM(size) FROM downloads`).Scan(&total, &ok, &size); err != nil {
+		t.Fatal(err)
+	}
+	if total != 4 || ok != 2 || size != 2*int64(len("/crates/serde/serde-1.0.0.crate")) {
+		t.Fatalf("downloads: total=%d ok=%d size=%d, want 4 rows over two runs with 2 ok", total, ok, size)
+	}
+	var crate, version, host, status string
+	var attempts int
+	if err := db.QueryRow(`SELECT crate, version, host, status, attempts FROM downloads WHERE ok = 0 LIMIT 1`).Scan(&crate, &version, &host, &status, &attempts); err != nil {
+		t.Fatal(err)
+	}
+	if crate != "gone" || version != "1.0.0" || host != srv.Listener.Addr().String() || status == "ok" || attempts != 1 {
+		t.Fatalf("failed row = %s %s %s %s attempts=%d", crate, version, host, status, attempts)
+	}
+}
@@ -0,0 +1,100 @@
+package downloader
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand/v2"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SetExemplars attaches the crate name and version as an exemplar to each
+// download duration observation, so a slow histogram bucket leads to a
+// specific crate. Exemplars are only exposed to OpenMetrics scrapers.
+func (d *Downloader) SetExemplars(on bool) {
+	d.exemplars = on
+}
+
+// SetTraceExemplars starts a W3C trace context for every download attempt:
+// the attempt's request carries it in a traceparent header, and its trace_id
+// and span_id are added to the duration exemplar (implying SetExemplars). The
+// downloader exports no spans itself; the IDs find the attempt in traces kept
+// by a tracing proxy or mirror in front of the upstream. A histogram bucket
+// keeps its latest exemplar, so a slow bucket points at a slow attempt.
+func (d *Downloader) SetTraceExemplars(on bool) {
+	d.traceExemplars = on
+}
+
+// traceContext identifies one download attempt in W3C Trace Context terms.
+// The zero value means tracing is off.
+type traceContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+func newTraceContext() traceContext {
+	var tc traceContext
+	binary.BigEndian.PutUint64(tc.traceID[:8], rand.Uint64())
+	binary.BigEndian.PutUint64(tc.traceID[8:], rand.Uint64())
+	binary.BigEndian.PutUint64(tc.spanID[:], rand.Uint64())
+	return tc
+}
+
+func (tc traceContext) valid() bool { return tc != traceContext{} }
+
+// traceparent formats tc as a sampled version-00 traceparent header.
+func (tc traceContext) traceparent() string {
+	return "00-" + hex.EncodeToString(tc.traceID[:]) + "-" + hex.EncodeToString(tc.spanID[:]) + "-01"
+}
+
+// attemptTrace returns a new trace context when SetTraceExemplars is on.
+func (d *Downloader) attemptTrace() traceContext {
+	if !d.traceExemplars {
+		return traceContext{}
+	}
+	return newTraceContext()
+}
+
+// observeDuration records one download attempt in metDuration.
+func (d *Downloader) observeDuration(url, host string, dur time.Duration, tc traceContext) {
+	obs := metDuration.WithLabelValues(host)
+	eo, ok := obs.(prometheus.ExemplarObserver)
+	if !(d.exemplars || d.traceExemplars) || !ok {
+		obs.Observe(dur.Seconds())
+		return
+	}
+	eo.ObserveWithExemplar(dur.Seconds(), exemplarLabels(url, tc))
+}
+
+// exemplarLabels names the crate behind url and, when tc is valid, the
+// attempt's trace. OpenMetrics caps an exemplar's label names and values at
+// 128 runes in total; ObserveWithExemplar panics past that, so the version,
+// then the crate, is dropped when too long. The trace IDs always fit.
+func exemplarLabels(url string, tc traceContext) prometheus.Labels {
+	crate, version := crateVersionFromURL(url)
+	if crate == "" {
+		crate = sanitizeName(url)
+	}
+	labels := prometheus.Labels{"crate": crate, "version": version}
+	if tc.valid() {
+		labels["trace_id"] = hex.EncodeToString(tc.traceID[:])
+		labels["span_id"] = hex.EncodeToString(tc.spanID[:])
+	}
+	if version == "" || exemplarRunes(labels) > prometheus.ExemplarMaxRunes {
+		delete(labels, "version")
+	}
+	if exemplarRunes(labels) > prometheus.ExemplarMaxRunes {
+		delete(labels, "crate")
+	}
+	return labels
+}
+
+func exemplarRunes(labels prometheus.Labels) int {
+	n := 0
+	for k, v := range labels {
+		n += utf8.RuneCountInString(k) + utf8.RuneCountInString(v)
+	}
+	return n
+}
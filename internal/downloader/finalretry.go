@@ -0,0 +1,50 @@
+package downloader
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// DefaultFinalRetryDelay is the wait before the first final retry round.
+const DefaultFinalRetryDelay = 30 * time.Second
+
+// SetFinalRetries re-runs every URL that failed the main pass up to rounds
+// more times once it is done. The wait before round n is delay<<(n-1), so
+// CDN errors that clear within minutes get a chance to, unlike per-request
+// retries which happen back to back. Records of recovered downloads carry
+// final_round; delay <= 0 means DefaultFinalRetryDelay.
+func (d *Downloader) SetFinalRetries(rounds int, delay time.Duration) {
+	if delay <= 0 {
+		delay = DefaultFinalRetryDelay
+	}
+	d.finalRounds, d.finalDelay = max(rounds, 0), delay
+}
+
+// finalRetryRound waits, then re-downloads failed and returns the URLs that
+// still fail. The main pass already counted these URLs as errors; those
+// counts are taken back so each URL ends up counted once, by its last result.
+func (d *Downloader) finalRetryRound(ctx context.Context, failed []string, round int) []string {
+	wait := d.finalDelay << (round - 1)
+	slog.Info("final_retry_round", "round", round, "urls", len(failed), "wait", wait.String())
+	t := time.NewTimer(wait)
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		t.Stop()
+		return failed
+	}
+	d.countsMu.Lock()
+	d.errCount -= int64(len(failed))
+	d.countsMu.Unlock()
+	still, sent := d.pass(ctx, failed, round)
+	if held := failed[sent:]; len(held) > 0 {
+		// Stopped by the byte budget: these keep their main-pass error.
+		d.countsMu.Lock()
+		d.errCount += int64(len(held))
+		d.countsMu.Unlock()
+		still = append(still, held...)
+	}
+	slog.Info("final_retry_round_done", "round", round, "recovered", len(failed)-len(still), "still_failing", len(still))
+	return still
+}
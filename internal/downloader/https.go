@@ -0,0 +1,30 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrPlainHTTP is returned by RequireHTTPS for URLs that are not https://.
+var ErrPlainHTTP = errors.New("non-https URL")
+
+// RequireHTTPS rejects the worklist if any URL is not https://, naming the
+// first offender and how many there are in total.
+func RequireHTTPS(urls []string) error {
+	var first string
+	bad := 0
+	for _, u := range urls {
+		if len(u) >= len("https://") && strings.EqualFold(u[:len("https://")], "https://") {
+			continue
+		}
+		if bad == 0 {
+			first = u
+		}
+		bad++
+	}
+	if bad > 0 {
+		return fmt.Errorf("%w: %q (%d of %d URLs)", ErrPlainHTTP, first, bad, len(urls))
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// IndexHead returns the commit currently checked out in the index git
+// repository. HEAD, loose refs and packed-refs are read under .git directly
+// (see readGitHead), so no git binary is needed; anything else, such as a
+// reftable repository, is left to git rev-parse.
+func IndexHead(indexDir string) (string, error) {
+	commit, err := readGitHead(indexDir)
+	if err == nil {
+		return commit, nil
+	}
+	out, gerr := gitOutput(indexDir, "rev-parse", "HEAD")
+	if gerr != nil {
+		return "", fmt.Errorf("%w (%v)", err, gerr)
+	}
+	return commitID(out)
+}
+
+// ChangedIndexFiles lists index files added, modified or renamed between the
+// since commit and HEAD, as slash-separated paths relative to indexDir.
+// Deleted files are omitted; a crate that disappeared has nothing to fetch.
+func ChangedIndexFiles(indexDir, since string) ([]string, error) {
+	out, err := gitOutput(indexDir, "diff", "--name-only", "--no-renames", "--diff-filter=AM", since, "HEAD", "--")
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// readGitHead resolves HEAD by reading HEAD, loose refs and packed-refs
+// under indexDir/.git. It fails if indexDir is not a git checkout.
+func readGitHead(indexDir string) (string, error) {
+	gitDir := filepath.Join(indexDir, ".git")
+	if b, err := os.ReadFile(gitDir); err == nil {
+		// Worktrees and submodules have a .git file pointing at the real dir.
+		dir, ok := strings.CutPrefix(strings.TrimSpace(string(b)), "gitdir:")
+		if !ok {
+			return "", fmt.Errorf("%s: not a git dir", gitDir)
+		}
+		if dir = strings.TrimSpace(dir); !filepath.IsAbs(dir) {
+			dir = filepath.Join(indexDir, dir)
+		}
+		gitDir = dir
+	}
+	head, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	ref, symbolic := strings.CutPrefix(strings.TrimSpace(string(head)), "ref:")
+	if !symbolic {
+		return commitID(ref)
+	}
+	ref = strings.TrimSpace(ref)
+	dirs := []string{gitDir}
+	if b, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		common := strings.TrimSpace(string(b))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(gitDir, common)
+		}
+		dirs = append(dirs, common)
+	}
+	for _, dir := range dirs {
+		if b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(ref))); err == nil {
+			return commitID(string(b))
+		}
+		b, err := os.ReadFile(filepath.Join(dir, "packed-refs"))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if sha, name, ok := strings.Cut(strings.TrimSpace(line), " "); ok && name == ref {
+				return commitID(sha)
+			}
+		}
+	}
+	return "", fmt.Errorf("%s: %s not found", gitDir, ref)
+}
+
+// commitID checks that s is a SHA-1 or SHA-256 object name.
+func commitID(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) != 40 && len(s) != 64 {
+		return "", fmt.Errorf("bad commit id %q", s)
+	}
+	if _, err := hex.DecodeString(s); err != nil {
+		return "", fmt.Errorf("bad commit id %q", s)
+	}
+	return s, nil
+}
+
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// ReadIndexState returns the commit recorded by a previous run, or "" if the
+// state file does not exist yet.
+func ReadIndexState(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// WriteIndexState atomically records commit as the last fully mirrored index revision.
+func WriteIndexState(path, commit string) error {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(commit+"\n"), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
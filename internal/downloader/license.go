@@ -0,0 +1,180 @@
+package downloader
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// LicenseFilter decides from a crate-name-to-license map which crates
+// ReadIndex keeps; see IndexOptions.License. The index does not carry
+// licenses, so the map comes from elsewhere, e.g. the crates.io API or
+// database dump.
+type LicenseFilter struct {
+	licenses map[string]string // lowercased crate name -> SPDX expression
+	deny     []string          // lowercased path.Match patterns
+	allow    []string          // lowercased path.Match patterns; empty allows all
+}
+
+// NewLicenseFilter returns a filter over licenses (crate name -> SPDX
+// expression, names matched case-insensitively). A license is acceptable
+// when it matches no deny pattern and, if allow is not empty, matches an
+// allow pattern. Patterns are path.Match globs ("GPL-*") compared without
+// regard to case. A crate is kept when its expression can be satisfied with
+// acceptable licenses: one side of an OR (or the legacy "/") suffices, both
+// sides of an AND are needed, and "X WITH exception" is judged by X. Crates
+// missing from the map, or with an expression that does not parse, are kept
+// unless allow is set.
+func NewLicenseFilter(licenses map[string]string, deny, allow []string) (*LicenseFilter, error) {
+	f := &LicenseFilter{licenses: make(map[string]string, len(licenses))}
+	for name, lic := range licenses {
+		f.licenses[strings.ToLower(name)] = lic
+	}
+	for _, list := range []struct {
+		in  []string
+		out *[]string
+	}{{deny, &f.deny}, {allow, &f.allow}} {
+		for _, p := range list.in {
+			p = strings.ToLower(strings.TrimSpace(p))
+			if p == "" {
+				continue
+			}
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("bad license pattern %q: %w", p, err)
+			}
+			*list.out = append(*list.out, p)
+		}
+	}
+	return f, nil
+}
+
+// ReadLicenseMap reads a crate license map. Each line is either
+// `name license expression` (the expression may contain spaces) or a JSON
+// object with name and license fields. Blank lines and # comments are
+// skipped; later lines win. StdinPath reads standard input.
+func ReadLicenseMap(p string) (map[string]string, error) {
+	f, err := openInput(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := make(map[string]string)
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	for lineNo := 1; s.Scan(); lineNo++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var e struct {
+			Name    string `json:"name"`
+			License string `json:"license"`
+		}
+		if strings.HasPrefix(line, "{") {
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", p, lineNo, err)
+			}
+		} else if fields := strings.Fields(line); len(fields) > 1 {
+			e.Name, e.License = fields[0], strings.Join(fields[1:], " ")
+		}
+		if e.Name == "" || e.License == "" {
+			return nil, fmt.Errorf("%s:%d: want a crate name and a license", p, lineNo)
+		}
+		m[e.Name] = e.License
+	}
+	return m, s.Err()
+}
+
+// Allows reports whether crate's license passes the filter.
+func (f *LicenseFilter) Allows(crate string) bool {
+	expr, ok := f.licenses[strings.ToLower(crate)]
+	if !ok {
+		return len(f.allow) == 0
+	}
+	p := licenseParser{toks: licenseTokens(expr)}
+	keep, ok := p.or(f.acceptable)
+	if !ok || p.pos != len(p.toks) {
+		return len(f.allow) == 0
+	}
+	return keep
+}
+
+func (f *LicenseFilter) acceptable(id string) bool {
+	matches := func(patterns []string) bool {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, id); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return !matches(f.deny) && (len(f.allow) == 0 || matches(f.allow))
+}
+
+// licenseTokens splits an SPDX expression into parentheses, lowercased
+// operators and license ids. The legacy "/" separator becomes "or".
+func licenseTokens(expr string) []string {
+	r := strings.NewReplacer("(", " ( ", ")", " ) ", "/", " or ")
+	toks := strings.Fields(r.Replace(expr))
+	for i, t := range toks {
+		toks[i] = strings.ToLower(t)
+	}
+	return toks
+}
+
+// licenseParser evaluates tokens from licenseTokens with AND binding tighter
+// than OR. Each method reports whether the expression so far parsed.
+type licenseParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *licenseParser) or(ok func(string) bool) (bool, bool) {
+	v, good := p.and(ok)
+	for good && p.pos < len(p.toks) && p.toks[p.pos] == "or" {
+		p.pos++
+		var w bool
+		w, good = p.and(ok)
+		v = v || w
+	}
+	return v, good
+}
+
+func (p *licenseParser) and(ok func(string) bool) (bool, bool) {
+	v, good := p.term(ok)
+	for good && p.pos < len(p.toks) && p.toks[p.pos] == "and" {
+		p.pos++
+		var w bool
+		w, good = p.term(ok)
+		v = v && w
+	}
+	return v, good
+}
+
+func (p *licenseParser) term(ok func(string) bool) (bool, bool) {
+	if p.pos >= len(p.toks) {
+		return false, false
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	switch t {
+	case "(":
+		v, good := p.or(ok)
+		if !good || p.pos >= len(p.toks) || p.toks[p.pos] != ")" {
+			return false, false
+		}
+		p.pos++
+		return v, true
+	case ")", "and", "or", "with":
+		return false, false
+	}
+	if p.pos < len(p.toks) && p.toks[p.pos] == "with" {
+		p.pos += 2 // the exception does not change which license applies
+		if p.pos > len(p.toks) {
+			return false, false
+		}
+	}
+	return ok(t), true
+}
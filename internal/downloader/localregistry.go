@@ -0,0 +1,224 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// LocalRegistry builds a registry cargo can use directly next to a mirror
+// run: an index/ tree in cargo's own sharding (1/, 2/, 3/a/, se/rd/), which
+// differs from the crateDirFor layout of the downloads, an index/config.json
+// with a dl template, and the .crate files hardlinked (or copied) flat into
+// the registry root as {crate}-{version}.crate. That is the layout of a cargo
+// local-registry source, and serving the root over HTTP with dl pointing at
+// it gives a sparse registry. Only entries the index pass selected are
+// written, and a crate's index file is rewritten whole on every run.
+type LocalRegistry struct {
+	dir string
+	dl  string
+	api string // config.json api; empty writes null
+
+	mu      sync.Mutex
+	crate   string   // crate whose lines are in pending
+	pending [][]byte // index lines of crate, in index order
+	written map[string]bool
+	crates  int
+	linked  int
+	errs    int
+}
+
+// NewLocalRegistry starts a registry in dir. dl is the config.json download
+// template; empty uses file://{dir}/{crate}-{version}.crate.
+func NewLocalRegistry(dir, dl string) (*LocalRegistry, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(abs, "index"), 0o755); err != nil {
+		return nil, err
+	}
+	if dl == "" {
+		u := url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}
+		dl = u.String() + "/{crate}-{version}.crate"
+	}
+	return &LocalRegistry{dir: abs, dl: dl, written: make(map[string]bool)}, nil
+}
+
+// SetAPI sets the api URL written to config.json. Cargo only uses it for
+// publishing, searching and the like, which a mirror does not serve; empty
+// (the default) writes null.
+func (r *LocalRegistry) SetAPI(api string) {
+	r.api = api
+}
+
+// CargoIndexPath returns the slash-separated path of a crate's file in a
+// cargo registry index: 1/a, 2/ab, 3/a/abc, ab/cd/abcd. Names are lowercased.
+func CargoIndexPath(name string) string {
+	name = strings.ToLower(name)
+	switch len(name) {
+	case 0:
+		return ""
+	case 1, 2:
+		return fmt.Sprintf("%d/%s", len(name), name)
+	case 3:
+		return "3/" + name[:1] + "/" + name
+	}
+	return name[:2] + "/" + name[2:4] + "/" + name
+}
+
+// AddIndexLine queues one raw index entry; it fits IndexOptions.OnEntry.
+// A crate's lines are written out when the next crate starts and by Close.
+func (r *LocalRegistry) AddIndexLine(_ string, line []byte) {
+	var ie IndexEntry
+	if json.Unmarshal(line, &ie) != nil || ie.Name == "" || ie.Vers == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name := strings.ToLower(ie.Name); name != r.crate {
+		r.flushLocked()
+		r.crate = name
+	}
+	r.pending = append(r.pending, bytes.Clone(line))
+}
+
+// flushLocked writes the pending lines of r.crate. Lines of a crate seen
+// again later in the same run are appended, not written over.
+func (r *LocalRegistry) flushLocked() {
+	if r.crate == "" || len(r.pending) == 0 {
+		return
+	}
+	path := filepath.Join(r.dir, "index", filepath.FromSlash(CargoIndexPath(r.crate)))
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if r.written[r.crate] {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(path, flags, 0o644); err == nil {
+			_, err = f.Write(append(bytes.Join(r.pending, []byte("\n")), '\n'))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	if err != nil {
+		slog.Warn("local_registry_index_failed", "crate", r.crate, "path", path, "err", err)
+		r.errs++
+	} else if !r.written[r.crate] {
+		r.written[r.crate] = true
+		r.crates++
+	}
+	r.pending = r.pending[:0]
+}
+
+// AddRecord links the file of a successful download into the registry root.
+// Files changed by a store transform are not valid .crate files and are
+// skipped.
+func (r *LocalRegistry) AddRecord(rec Record) {
+	name, version := crateVersionFromURL(rec.URL)
+	if name == "" || !rec.OK || rec.Path == "" || rec.StoredSHA256 != "" {
+		return
+	}
+	dst := filepath.Join(r.dir, name+"-"+version+".crate")
+	err := linkOrCopy(rec.Path, dst)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		slog.Warn("local_registry_link_failed", "url", rec.URL, "path", rec.Path, "err", err)
+		r.errs++
+		return
+	}
+	r.linked++
+}
+
+// linkOrCopy replaces dst with a hardlink to src, or a copy if the
+// filesystem cannot link them.
+func linkOrCopy(src, dst string) error {
+	tmp := dst + ".tmp"
+	_ = os.Remove(tmp)
+	if err := os.Link(src, tmp); err != nil {
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Close writes the last pending crate and index/config.json, and returns how
+// many crates were indexed, how many files were linked and how many of
+// either failed.
+func (r *LocalRegistry) Close() (crates, linked, errs int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushLocked()
+	var api *string
+	if r.api != "" {
+		api = &r.api
+	}
+	cfg, err := json.MarshalIndent(struct {
+		DL  string  `json:"dl"`
+		API *string `json:"api"`
+	}{DL: r.dl, API: api}, "", "  ")
+	if err != nil {
+		return r.crates, r.linked, r.errs, err
+	}
+	path := filepath.Join(r.dir, "index", "config.json")
+	if err := os.WriteFile(path+".tmp", append(cfg, '\n'), 0o644); err != nil {
+		return r.crates, r.linked, r.errs, err
+	}
+	return r.crates, r.linked, r.errs, os.Rename(path+".tmp", path)
+}
+
+// SetLocalRegistry links every successful download into r as the collector
+// records it.
+func (d *Downloader) SetLocalRegistry(r *LocalRegistry) {
+	d.localReg = r
+}
+
+// FillLocalRegistry links the files already stored for urls, wherever the
+// current settings place them (see Where), into r. It returns how many URLs
+// have no stored file. Files changed by a store transform are not valid
+// .crate files, so none are linked while one is set.
+func (d *Downloader) FillLocalRegistry(r *LocalRegistry, urls []string) (missing int) {
+	if d.transformed() {
+		slog.Warn("local_registry_skip_files", "reason", "files are stored transformed")
+		return len(urls)
+	}
+	for _, u := range urls {
+		p := d.Where(u)
+		if !p.Exists {
+			missing++
+			continue
+		}
+		r.AddRecord(Record{URL: u, Path: p.Path, OK: true})
+	}
+	return missing
+}
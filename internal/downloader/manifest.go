@@ -0,0 +1,247 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// OpenManifest opens the JSONL manifest for writing. With appendMode, records
+// from earlier runs are kept and new ones are appended; a torn final line left
+// by an interrupted run is cut off so the file stays valid NDJSON. Manifests
+// have no header line, so appending never repeats one.
+//
+// Paths ending in .gz or .zst are written through a gzip or zstd encoder;
+// appending adds a new stream after the existing ones.
+func OpenManifest(path string, appendMode bool) (io.WriteCloser, error) {
+	if codec := manifestCodec(path); codec != "" {
+		return openCompressedManifest(path, codec, appendMode)
+	}
+	if !appendMode {
+		return os.Create(path)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := trimTornLine(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.Close()
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+}
+
+// trimTornLine truncates f after its last newline if it does not end in one.
+func trimTornLine(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return err
+	}
+	const chunk = 64 * 1024
+	buf := make([]byte, chunk)
+	end := fi.Size()
+	for end > 0 {
+		start := max64(0, end-chunk)
+		n, err := f.ReadAt(buf[:end-start], start)
+		if err != nil && n < int(end-start) {
+			return err
+		}
+		if end == fi.Size() && buf[n-1] == '\n' {
+			return nil
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			slog.Warn("manifest_torn_line", "path", f.Name(), "dropped_bytes", fi.Size()-(start+int64(i)+1))
+			return f.Truncate(start + int64(i) + 1)
+		}
+		end = start
+	}
+	slog.Warn("manifest_torn_line", "path", f.Name(), "dropped_bytes", fi.Size())
+	return f.Truncate(0)
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// ReadManifest calls fn for every record in a JSONL manifest, skipping blank
+// and unparseable lines. Manifests ending in .gz or .zst are decompressed.
+func ReadManifest(path string, fn func(Record) error) error {
+	f, err := openManifestReader(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 1024*1024), 64*1024*1024)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			continue
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// BundleFromManifest feeds every successfully downloaded file recorded in the
+// manifest into b, without any network access. Files listed more than once
+// (e.g. from repeated runs) are bundled once; files missing on disk are logged
+// and skipped. With SetSkipBundled, entries already in a bundle are skipped
+// too. It returns the number of files added.
+func BundleFromManifest(manifestPath string, b *Bundler) (int, error) {
+	if b == nil || !b.enabled {
+		return 0, fmt.Errorf("bundler is not enabled")
+	}
+	seen := make(map[string]struct{})
+	added := 0
+	err := ReadManifest(manifestPath, func(rec Record) error {
+		if !rec.OK || rec.Path == "" {
+			return nil
+		}
+		if _, dup := seen[rec.Path]; dup {
+			return nil
+		}
+		seen[rec.Path] = struct{}{}
+		if _, err := os.Stat(rec.Path); err != nil {
+			slog.Warn("bundle_source_missing", "path", rec.Path, "err", err)
+			return nil
+		}
+		err := b.AddFile(rec.Path, b.headerName(rec.URL, rec.Path))
+		if errors.Is(err, ErrAlreadyBundled) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("bundle %s: %w", rec.Path, err)
+		}
+		added++
+		return nil
+	})
+	return added, err
+}
+
+// ReadBundleIndexes calls fn for every entry of every bundle-*.index.jsonl in dir.
+func ReadBundleIndexes(dir string, fn func(BundleEntry) error) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "bundle-*.index.jsonl"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if err := readBundleIndex(p, fn); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+func readBundleIndex(path string, fn func(BundleEntry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var e BundleEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// BundleCheck is the result of CheckBundles. File lists hold local paths and
+// are sorted.
+type BundleCheck struct {
+	ManifestFiles int // distinct successfully downloaded files
+	BundledFiles  int // distinct files across all bundle indexes
+	NotBundled    []string
+	NotInManifest []string
+	MultiBundled  []string // present in more than one bundle entry
+}
+
+// OK reports whether every downloaded file is in exactly one bundle and
+// nothing else was bundled.
+func (c BundleCheck) OK() bool {
+	return len(c.NotBundled) == 0 && len(c.NotInManifest) == 0 && len(c.MultiBundled) == 0
+}
+
+// Print writes a summary line followed by one line per discrepancy.
+func (c BundleCheck) Print(w io.Writer) {
+	fmt.Fprintf(w, "manifest_files=%d bundled_files=%d not_bundled=%d not_in_manifest=%d multi_bundled=%d\n",
+		c.ManifestFiles, c.BundledFiles, len(c.NotBundled), len(c.NotInManifest), len(c.MultiBundled))
+	for _, p := range c.NotBundled {
+		fmt.Fprintf(w, "not_bundled %s\n", p)
+	}
+	for _, p := range c.NotInManifest {
+		fmt.Fprintf(w, "not_in_manifest %s\n", p)
+	}
+	for _, p := range c.MultiBundled {
+		fmt.Fprintf(w, "multi_bundled %s\n", p)
+	}
+}
+
+// CheckBundles cross-checks the successful records of a manifest against the
+// per-bundle indexes in bundlesDir, matching manifest paths to entry sources.
+func CheckBundles(manifestPath, bundlesDir string) (BundleCheck, error) {
+	var c BundleCheck
+	downloaded := make(map[string]struct{})
+	if err := ReadManifest(manifestPath, func(rec Record) error {
+		if rec.OK && rec.Path != "" {
+			downloaded[rec.Path] = struct{}{}
+		}
+		return nil
+	}); err != nil {
+		return c, err
+	}
+	bundled := make(map[string]int)
+	if err := ReadBundleIndexes(bundlesDir, func(e BundleEntry) error {
+		bundled[e.Source]++
+		return nil
+	}); err != nil {
+		return c, err
+	}
+	c.ManifestFiles, c.BundledFiles = len(downloaded), len(bundled)
+	for p := range downloaded {
+		if bundled[p] == 0 {
+			c.NotBundled = append(c.NotBundled, p)
+		}
+	}
+	for p, n := range bundled {
+		if _, ok := downloaded[p]; !ok {
+			c.NotInManifest = append(c.NotInManifest, p)
+		}
+		if n > 1 {
+			c.MultiBundled = append(c.MultiBundled, p)
+		}
+	}
+	sort.Strings(c.NotBundled)
+	sort.Strings(c.NotInManifest)
+	sort.Strings(c.MultiBundled)
+	return c, nil
+}
@@ -0,0 +1,189 @@
+package downloader
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// manifestCodec returns "gzip" or "zstd" for manifest paths ending in .gz or
+// .zst, and "" for plain JSONL.
+func manifestCodec(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return "gzip"
+	case strings.HasSuffix(path, ".zst"):
+		return "zstd"
+	}
+	return ""
+}
+
+func newManifestEncoder(w io.Writer, codec string) (io.WriteCloser, error) {
+	if codec == "zstd" {
+		return zstd.NewWriter(w)
+	}
+	return gzip.NewWriter(w), nil
+}
+
+func newManifestDecoder(r io.Reader, codec string) (io.ReadCloser, error) {
+	if codec == "zstd" {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return gzip.NewReader(r)
+}
+
+// compressedManifest is the manifest writer for .gz and .zst paths. Close
+// finishes the stream before closing the file; records still buffered in the
+// encoder are lost if the process dies first.
+type compressedManifest struct {
+	enc io.WriteCloser
+	f   *os.File
+}
+
+func (m *compressedManifest) Write(p []byte) (int, error) { return m.enc.Write(p) }
+
+func (m *compressedManifest) Close() error {
+	err := m.enc.Close()
+	if cerr := m.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// openCompressedManifest starts a new gzip member or zstd frame at the end of
+// the file (or of an empty file); both formats read back concatenated streams
+// as one.
+func openCompressedManifest(path, codec string, appendMode bool) (io.WriteCloser, error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendMode {
+		if err := repairCompressedManifest(path, codec); err != nil {
+			return nil, err
+		}
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flag, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := newManifestEncoder(f, codec)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &compressedManifest{enc: enc, f: f}, nil
+}
+
+// repairCompressedManifest is trimTornLine for compressed manifests. A run
+// killed mid-write leaves an unterminated stream that would hide anything
+// appended after it, so the complete lines that still decode are rewritten
+// into a fresh stream.
+func repairCompressedManifest(path, codec string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || fi.Size() == 0 {
+		return err
+	}
+	var lines [][]byte
+	var kept int64
+	readErr := func() error {
+		zr, err := newManifestDecoder(f, codec)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		br := bufio.NewReader(zr)
+		for {
+			line, err := br.ReadBytes('\n')
+			if err != nil {
+				if err == io.EOF && len(line) == 0 {
+					return nil
+				}
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			lines = append(lines, line)
+			kept += int64(len(line))
+		}
+	}()
+	if readErr == nil {
+		return nil
+	}
+	slog.Warn("manifest_torn_stream", "path", path, "kept_bytes", kept, "err", readErr)
+
+	tmp := path + ".repair"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc, err := newManifestEncoder(out, codec)
+	if err == nil {
+		for _, l := range lines {
+			if _, err = enc.Write(l); err != nil {
+				break
+			}
+		}
+		if cerr := enc.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("repair %s: %w", path, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// openManifestReader opens a manifest for reading, decompressing .gz and .zst
+// paths.
+func openManifestReader(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	codec := manifestCodec(path)
+	if codec == "" {
+		return f, nil
+	}
+	zr, err := newManifestDecoder(bufio.NewReader(f), codec)
+	if err == io.EOF {
+		// Empty file: the run exited before writing anything.
+		return f, nil
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return manifestReader{zr, f}, nil
+}
+
+type manifestReader struct {
+	io.ReadCloser
+	f *os.File
+}
+
+func (r manifestReader) Close() error {
+	r.ReadCloser.Close()
+	return r.f.Close()
+}
@@ -0,0 +1,124 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// recordField is one JSON field of Record.
+type recordField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+var recordFields = func() []recordField {
+	t := reflect.TypeOf(Record{})
+	fields := make([]recordField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, opts, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields = append(fields, recordField{name: name, index: i, omitEmpty: opts == "omitempty"})
+	}
+	return fields
+}()
+
+// ParseManifestFields parses a comma-separated list of manifest field names
+// (the JSON keys of Record) for SetManifestFields. Either list the fields to
+// keep ("url,ok,sha256") or prefix every name with "-" to drop it from the
+// full set ("-path,-error"). schema_version is always kept.
+func ParseManifestFields(s string) ([]string, error) {
+	known := make(map[string]bool, len(recordFields))
+	for _, f := range recordFields {
+		known[f.name] = true
+	}
+	var keep, drop []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		excl := strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		if !known[name] {
+			return nil, fmt.Errorf("unknown manifest field %q", name)
+		}
+		if excl {
+			drop = append(drop, name)
+		} else {
+			keep = append(keep, name)
+		}
+	}
+	if len(keep) > 0 && len(drop) > 0 {
+		return nil, fmt.Errorf("manifest fields %q mixes kept and -dropped names", s)
+	}
+	if len(drop) == 0 {
+		return keep, nil
+	}
+	dropped := make(map[string]bool, len(drop))
+	for _, name := range drop {
+		dropped[name] = true
+	}
+	for _, f := range recordFields {
+		if !dropped[f.name] {
+			keep = append(keep, f.name)
+		}
+	}
+	return keep, nil
+}
+
+// SetManifestFields limits manifest records, including per-shard ones, to the
+// named fields, e.g. to keep local paths or error details out of a manifest
+// that is shared. nil or empty writes every field. schema_version is always
+// written. Readers such as ReadManifest treat missing fields as zero, so
+// dropping url, path or ok limits what -manifest-append, -check-bundles and
+// -bundle-from-manifest can do with the file.
+func (d *Downloader) SetManifestFields(names []string) {
+	if len(names) == 0 {
+		d.manifestFields = nil
+		return
+	}
+	want := map[string]bool{"schema_version": true}
+	for _, n := range names {
+		want[n] = true
+	}
+	d.manifestFields = d.manifestFields[:0]
+	for _, f := range recordFields {
+		if want[f.name] {
+			d.manifestFields = append(d.manifestFields, f)
+		}
+	}
+}
+
+// encodeRecord writes rec to enc, restricted to the SetManifestFields
+// selection. Fields are written in Record order, honouring omitempty.
+func (d *Downloader) encodeRecord(enc *json.Encoder, rec Record) error {
+	if d.manifestFields == nil {
+		return enc.Encode(rec)
+	}
+	v := reflect.ValueOf(rec)
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, f := range d.manifestFields {
+		fv := v.Field(f.index)
+		if f.omitEmpty && fv.IsZero() {
+			continue
+		}
+		val, err := json.Marshal(fv.Interface())
+		if err != nil {
+			return err
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%q:", f.name)
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return enc.Encode(json.RawMessage(buf.Bytes()))
+}
@@ -0,0 +1,59 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// ErrManifestWrite is returned by Run, with SetFailOnManifestError, when a
+// record could not be written to the manifest.
+var ErrManifestWrite = errors.New("manifest write failed")
+
+// SetFailOnManifestError makes the first failed manifest write stop Run from
+// dispatching further URLs; Run then returns ErrManifestWrite. Without it,
+// failed writes are counted and logged and the run continues, so downloads
+// land on disk without a record.
+func (d *Downloader) SetFailOnManifestError(on bool) {
+	d.failOnManifest = on
+}
+
+// ManifestErrors is the number of records the last Run failed to write.
+func (d *Downloader) ManifestErrors() int64 {
+	return d.manifestErrs.Load()
+}
+
+func (d *Downloader) resetManifestErrors() {
+	d.manifestErrs.Store(0)
+	d.manifestErr = nil
+}
+
+// noteManifestError is called by a collector for the n records, starting
+// with rec, that it could not write. Only the first failure is logged in
+// full; a full disk would otherwise log every record.
+func (d *Downloader) noteManifestError(rec Record, n int64, err error) {
+	if d.manifestErrs.Add(n) == n {
+		d.manifestErr = err
+		slog.Error("manifest_write_failed", "url", rec.URL, "err", err, "abort", d.failOnManifest,
+			"hint", "records are being lost; check free space on the manifest's filesystem")
+	}
+}
+
+// manifestAbort reports whether dispatch should stop after a failed write.
+func (d *Downloader) manifestAbort() bool {
+	return d.failOnManifest && d.manifestErrs.Load() > 0
+}
+
+// manifestErrorsResult summarizes failed writes at the end of Run and returns
+// ErrManifestWrite when they abort the run.
+func (d *Downloader) manifestErrorsResult() error {
+	n := d.manifestErrs.Load()
+	if n == 0 {
+		return nil
+	}
+	slog.Error("manifest_write_errors", "records_lost", n, "first_err", d.manifestErr)
+	if d.failOnManifest {
+		return fmt.Errorf("%w: %d records not written: %v", ErrManifestWrite, n, d.manifestErr)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package downloader
+
+import (
+	"net/url"
+	"strings"
+)
+
+// OtherHost is the host label for downloads from hosts not passed to
+// SetMetricHosts.
+const OtherHost = "other"
+
+// SetMetricHosts lists the hosts that get their own "host" label on the
+// request, byte and duration metrics. Anything else is counted as OtherHost,
+// so URL lists pointing at arbitrary hosts cannot blow up series cardinality.
+// Entries may be bare hosts ("static.crates.io") or URLs.
+func (d *Downloader) SetMetricHosts(hosts ...string) {
+	d.metricHosts = make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		if u, err := url.Parse(h); err == nil && u.Host != "" {
+			h = u.Host
+		}
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			d.metricHosts[h] = true
+		}
+	}
+}
+
+// metricHost is the metrics host label for rawURL.
+func (d *Downloader) metricHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return OtherHost
+	}
+	if h := strings.ToLower(u.Host); d.metricHosts[h] {
+		return h
+	}
+	return OtherHost
+}
@@ -0,0 +1,43 @@
+package downloader
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// ParseNameRegex compiles a -name-regex pattern for SetNameRegex. The crate
+// name is the group named "name" if there is one, else the first group.
+func ParseNameRegex(s string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, fmt.Errorf("name regex: %w", err)
+	}
+	if re.NumSubexp() == 0 {
+		return nil, fmt.Errorf("name regex %q has no capture group for the crate name", s)
+	}
+	return re, nil
+}
+
+// SetNameRegex extracts crate names, which pick the shard directory, from
+// URLs that do not follow the crates.io /{name}/{name}-{version}.crate shape,
+// e.g. a flat mirror. URLs the regex does not match, or where the group is
+// empty, fall back to the default rule. nil restores the default.
+func (d *Downloader) SetNameRegex(re *regexp.Regexp) {
+	d.nameRe = re
+	d.nameGroup = 1
+	if re != nil {
+		if i := re.SubexpIndex("name"); i > 0 {
+			d.nameGroup = i
+		}
+	}
+}
+
+// crateName is the crate name used to place url.
+func (d *Downloader) crateName(url string) string {
+	if d.nameRe != nil {
+		if m := d.nameRe.FindStringSubmatch(url); m != nil && m[d.nameGroup] != "" {
+			return m[d.nameGroup]
+		}
+	}
+	return crateNameFromURL(url)
+}
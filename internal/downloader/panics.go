@@ -0,0 +1,40 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+// StatusPanic marks a record whose fetch panicked. The worker recovered and
+// went on with the next URL; the file, if any, was left as the panic found
+// it.
+const StatusPanic = "panic"
+
+// fetchRecovered is fetchShared for pass workers. A panic while fetching url
+// is logged with its stack and turned into an error record, so the worker
+// stays alive and every URL still produces exactly one record instead of the
+// run stalling with fewer workers.
+func (d *Downloader) fetchRecovered(ctx context.Context, url string) (rec Record) {
+	started := time.Now().UTC().Format(time.RFC3339)
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		slog.Error("worker_panic", "url", url, "panic", p, "stack", string(debug.Stack()))
+		rec = Record{
+			SchemaVersion: 1,
+			URL:           url,
+			StartedAt:     started,
+			FinishedAt:    time.Now().UTC().Format(time.RFC3339),
+			Error:         fmt.Sprintf("panic: %v", p),
+			Status:        StatusPanic,
+		}
+		d.incErr()
+		metProcessed.WithLabelValues("error").Inc()
+	}()
+	return d.fetchShared(ctx, url)
+}
@@ -0,0 +1,50 @@
+package downloader
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// detectedProto is the protocol found by the last Preflight, for /api/status.
+var detectedProto atomic.Value // string
+
+// Preflight fetches url once, like Probe, to learn which protocol the server
+// negotiates, and returns it (e.g. "HTTP/2.0"). Over HTTP/1.1 every
+// concurrent download needs its own connection, so a high concurrency can
+// overwhelm a small mirror: Preflight then logs a warning and, if maxConns is
+// positive, caps the transport's connections per host at maxConns. Errors
+// are returned without changing the transport.
+func (d *Downloader) Preflight(ctx context.Context, url string, maxConns int) (string, error) {
+	r := d.Probe(ctx, url)
+	if r.Err != nil {
+		return "", r.Err
+	}
+	detectedProto.Store(r.Proto)
+	slog.Info("preflight", "url", url, "status", r.Status, "proto", r.Proto, "latency", r.Latency.String())
+	if !strings.HasPrefix(r.Proto, "HTTP/1.") {
+		return r.Proto, nil
+	}
+	tr, _ := d.client.Transport.(*http.Transport)
+	conns := d.concurrency
+	if tr != nil && tr.MaxConnsPerHost > 0 {
+		conns = min(conns, tr.MaxConnsPerHost)
+	}
+	if maxConns <= 0 || conns <= maxConns || tr == nil {
+		slog.Warn("server only speaks HTTP/1.1; each concurrent download opens its own connection",
+			"proto", r.Proto, "connections_per_host", conns, "hint", "lower -concurrency or set -http1-max-conns")
+		return r.Proto, nil
+	}
+	tr.MaxConnsPerHost = maxConns
+	tr.MaxIdleConnsPerHost = maxConns
+	slog.Warn("server only speaks HTTP/1.1; capping connections per host",
+		"proto", r.Proto, "connections_per_host", maxConns, "was", conns)
+	return r.Proto, nil
+}
+
+func detectedProtocol() string {
+	p, _ := detectedProto.Load().(string)
+	return p
+}
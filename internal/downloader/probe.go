@@ -0,0 +1,109 @@
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ProbeResult describes one test download made by Probe.
+type ProbeResult struct {
+	URL        string
+	Status     int
+	Proto      string        // negotiated HTTP version, e.g. HTTP/2.0
+	TLSVersion string        // empty for plain HTTP
+	Latency    time.Duration // until response headers arrived
+	Total      time.Duration // until the body was fully read
+	Bytes      int64
+	SHA256     string
+	// ChecksumKnown is set when an expected checksum was available;
+	// ChecksumOK is only meaningful then.
+	ChecksumKnown bool
+	ChecksumOK    bool
+	Err           error
+}
+
+// OK reports whether the probe downloaded the crate and, if a checksum was
+// known, it matched.
+func (r ProbeResult) OK() bool {
+	return r.Err == nil && r.Status == http.StatusOK && (!r.ChecksumKnown || r.ChecksumOK)
+}
+
+// Print writes the probe result as a few key=value lines.
+func (r ProbeResult) Print(w io.Writer) {
+	if r.Err != nil {
+		fmt.Fprintf(w, "probe %s: FAIL: %v\n", r.URL, r.Err)
+		return
+	}
+	fmt.Fprintf(w, "probe %s: status=%d proto=%s tls=%s latency=%s total=%s bytes=%d\n",
+		r.URL, r.Status, r.Proto, orDash(r.TLSVersion), r.Latency.Round(time.Millisecond), r.Total.Round(time.Millisecond), r.Bytes)
+	switch {
+	case !r.ChecksumKnown:
+		fmt.Fprintf(w, "checksum: sha256=%s (no expected value)\n", r.SHA256)
+	case r.ChecksumOK:
+		fmt.Fprintf(w, "checksum: match sha256=%s\n", r.SHA256)
+	default:
+		fmt.Fprintf(w, "checksum: MISMATCH sha256=%s\n", r.SHA256)
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Probe downloads url once through the downloader's HTTP client, without
+// writing to disk, and reports latency, negotiated protocol and checksum.
+// The expected checksum comes from the downloader's checksum map. A url
+// outside SetAllowedHosts fails with ErrHostNotAllowed.
+func (d *Downloader) Probe(ctx context.Context, url string) ProbeResult {
+	r := ProbeResult{URL: url}
+	if host, ok := d.urlHostAllowed(url); !ok {
+		r.Err = fmt.Errorf("%w: %s", ErrHostNotAllowed, host)
+		return r
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	req.Header.Set("User-Agent", "Aptlantis-crates-mirror/0.1")
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	defer resp.Body.Close()
+	r.Latency = time.Since(start)
+	r.Status = resp.StatusCode
+	r.Proto = resp.Proto
+	if resp.TLS != nil {
+		r.TLSVersion = tls.VersionName(resp.TLS.Version)
+	}
+	if resp.StatusCode != http.StatusOK {
+		r.Err = fmt.Errorf("HTTP %d", resp.StatusCode)
+		return r
+	}
+	h := sha256.New()
+	r.Bytes, err = io.Copy(h, resp.Body)
+	r.Total = time.Since(start)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	r.SHA256 = hex.EncodeToString(h.Sum(nil))
+	if want := d.expectedSum(url); want != "" {
+		r.ChecksumKnown = true
+		r.ChecksumOK = strings.EqualFold(want, r.SHA256)
+	}
+	return r
+}
@@ -0,0 +1,96 @@
+package downloader
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+)
+
+// ProvenanceSuffix is appended to a crate file's path to name its provenance
+// record; see SetWriteProvenance.
+const ProvenanceSuffix = ".prov.json"
+
+// Provenance is the per-file record written by SetWriteProvenance.
+type Provenance struct {
+	SchemaVersion int    `json:"schema_version"`
+	Crate         string `json:"crate,omitempty"`
+	Version       string `json:"version,omitempty"`
+	URL           string `json:"url"`
+	BaseURL       string `json:"base_url"`
+	FetchedAt     string `json:"fetched_at"`
+	HTTPStatus    int    `json:"http_status"`
+	ETag          string `json:"etag,omitempty"`
+	LastModified  string `json:"last_modified,omitempty"`
+	Size          int64  `json:"size"`
+	SHA256        string `json:"sha256"`
+	// ChecksumVerified is false when no expected checksum was known, so
+	// SHA256 is only what was received.
+	ChecksumVerified bool `json:"checksum_verified"`
+	// StoredSHA256 is the digest of the file on disk when -store-transform
+	// changed it.
+	StoredSHA256 string `json:"stored_sha256,omitempty"`
+}
+
+// SetWriteProvenance writes a <file>.prov.json next to every crate downloaded
+// and verified in this run, recording where and when it was fetched, the HTTP
+// status, the server's ETag and Last-Modified, and the SHA256. Files skipped
+// because they already exist keep whatever provenance they had.
+func (d *Downloader) SetWriteProvenance(on bool) {
+	d.provenance = on
+}
+
+// baseURLOf strips the "/{name}/{file}" tail that CrateURL adds, or just the
+// file name for URLs of any other shape.
+func baseURLOf(url string) string {
+	dir := url[:strings.LastIndex(url, "/")+1]
+	if crate, _ := crateVersionFromURL(url); crate != "" {
+		if base, ok := strings.CutSuffix(dir, "/"+crate+"/"); ok {
+			return base
+		}
+	}
+	return strings.TrimSuffix(dir, "/")
+}
+
+// writeProvenance stores the provenance of a verified download next to it,
+// via a temp file renamed into place so readers never see a partial record.
+// Failures are logged; the download itself still counts.
+func (d *Downloader) writeProvenance(rec Record, body fetched) {
+	crate, version := crateVersionFromURL(rec.URL)
+	p := Provenance{
+		SchemaVersion:    1,
+		Crate:            crate,
+		Version:          version,
+		URL:              rec.URL,
+		BaseURL:          baseURLOf(rec.URL),
+		FetchedAt:        rec.FinishedAt,
+		HTTPStatus:       body.status,
+		ETag:             body.etag,
+		LastModified:     body.lastModified,
+		Size:             rec.Size,
+		SHA256:           rec.SHA256,
+		ChecksumVerified: d.expectedSum(rec.URL) != "",
+		StoredSHA256:     rec.StoredSHA256,
+	}
+	path := rec.Path + ProvenanceSuffix
+	tmp := d.tempPath(path)
+	err := func() error {
+		f, err := d.storage().Create(tmp)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(p)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = d.storage().Rename(tmp, path)
+		}
+		return err
+	}()
+	if err != nil {
+		_ = d.storage().Remove(tmp)
+		slog.Warn("provenance_write_failed", "path", path, "err", err)
+	}
+}
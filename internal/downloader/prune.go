@@ -0,0 +1,63 @@
+package downloader
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/index"
+)
+
+// PruneEntry is one file a prune of the mirror would delete.
+type PruneEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// PrunePlan lists the files under outDir that a prune would delete: the
+// .crate files with no index entry at all, as counted in
+// ReconcileReport.Orphans. Files of yanked versions are kept. Entries are
+// sorted by path; total is the sum of their sizes. Nothing is modified.
+// It assumes the default layout; see Downloader.PrunePlan.
+func PrunePlan(indexDir, outDir, baseURL string) (entries []PruneEntry, total int64, err error) {
+	return (&Downloader{outDir: outDir}).PrunePlan(indexDir, baseURL, "")
+}
+
+// PrunePlan is PrunePlan for a mirror laid out by d's settings, as in
+// Downloader.Reconcile.
+func (d *Downloader) PrunePlan(indexDir, baseURL string, layout index.Layout) (entries []PruneEntry, total int64, err error) {
+	_, _, orphans, err := d.reconcile(indexDir, baseURL, layout)
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Strings(orphans)
+	entries = make([]PruneEntry, 0, len(orphans))
+	for _, p := range orphans {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // removed since the walk
+			}
+			return nil, 0, err
+		}
+		entries = append(entries, PruneEntry{Path: p, Size: fi.Size()})
+		total += fi.Size()
+	}
+	return entries, total, nil
+}
+
+// WritePrunePlan writes entries as NDJSON followed by a summary line
+// {"total_files":N,"total_bytes":B}.
+func WritePrunePlan(w io.Writer, entries []PruneEntry, total int64) error {
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return enc.Encode(struct {
+		Files int   `json:"total_files"`
+		Bytes int64 `json:"total_bytes"`
+	}{len(entries), total})
+}
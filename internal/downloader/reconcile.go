@@ -0,0 +1,157 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/index"
+)
+
+// reconcileSampleSize caps the example paths kept per category.
+const reconcileSampleSize = 20
+
+// ReconcileReport compares the crate files an index calls for with the
+// crate files present under an output directory.
+type ReconcileReport struct {
+	Expected      int      // non-yanked index entries
+	Present       int      // expected entries found on disk
+	Missing       int      // expected entries with no file (gaps)
+	Orphans       int      // .crate files with no index entry at all
+	MissingSample []string // URLs, sorted, at most reconcileSampleSize
+	OrphanSample  []string // paths, sorted, at most reconcileSampleSize
+}
+
+// Complete reports whether the mirror has no gaps and no orphans.
+func (r ReconcileReport) Complete() bool {
+	return r.Missing == 0 && r.Orphans == 0
+}
+
+// Print writes a summary line followed by the sampled gaps and orphans.
+func (r ReconcileReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "expected=%d present=%d missing=%d orphans=%d\n", r.Expected, r.Present, r.Missing, r.Orphans)
+	for _, u := range r.MissingSample {
+		fmt.Fprintf(w, "missing %s\n", u)
+	}
+	for _, p := range r.OrphanSample {
+		fmt.Fprintf(w, "orphan %s\n", p)
+	}
+}
+
+// Reconcile expands the index at indexDir and walks outDir for *.crate files.
+// Yanked versions are not required, but their files do not count as orphans.
+// It assumes the default layout; see Downloader.Reconcile.
+func Reconcile(indexDir, outDir, baseURL string) (ReconcileReport, error) {
+	return (&Downloader{outDir: outDir}).Reconcile(indexDir, baseURL, "")
+}
+
+// Reconcile is Reconcile for a mirror laid out by d's settings: file paths
+// follow SetNormalizeCase, SetNameRegex and SetStoreTransform, and every
+// SetRoutes directory is walked along with the output dir. layout is the
+// index layout, as in index.Options.
+func (d *Downloader) Reconcile(indexDir, baseURL string, layout index.Layout) (ReconcileReport, error) {
+	rep, missing, orphans, err := d.reconcile(indexDir, baseURL, layout)
+	if err != nil {
+		return ReconcileReport{}, err
+	}
+	rep.Missing, rep.Orphans = len(missing), len(orphans)
+	rep.MissingSample = sortedSample(missing)
+	rep.OrphanSample = sortedSample(orphans)
+	return rep, nil
+}
+
+// reconcile does the work of Reconcile and returns every missing URL and
+// orphaned path, unsorted.
+func (d *Downloader) reconcile(indexDir, baseURL string, layout index.Layout) (rep ReconcileReport, missing, orphans []string, err error) {
+	type want struct {
+		url    string
+		yanked bool
+		found  bool
+	}
+	expected := make(map[string]*want) // local path -> entry
+	base := strings.TrimRight(baseURL, "/")
+	_, err = ReadIndex(indexDir, IndexOptions{
+		BaseURL:       base,
+		IncludeYanked: true,
+		Walk:          index.Options{Layout: layout},
+		OnEntry: func(_ string, line []byte) {
+			var ie IndexEntry
+			if json.Unmarshal(line, &ie) != nil {
+				return
+			}
+			u := fmt.Sprintf("%s/%s/%s-%s.crate", base, ie.Name, ie.Name, ie.Vers)
+			dir, name := d.outPathFor(u)
+			expected[filepath.Join(dir, name)] = &want{url: u, yanked: ie.Yanked}
+			if !ie.Yanked {
+				rep.Expected++
+			}
+		},
+	})
+	if err != nil {
+		return ReconcileReport{}, nil, nil, err
+	}
+
+	suffix := d.transform.storedName(".crate")
+	seen := make(map[string]bool) // a route dir may sit inside another root
+	for i, root := range d.roots() {
+		err = filepath.WalkDir(root, func(path string, de os.DirEntry, err error) error {
+			if err != nil {
+				if i > 0 && path == root && os.IsNotExist(err) {
+					return filepath.SkipDir // route with nothing stored yet
+				}
+				return err
+			}
+			if de.IsDir() && de.Name() == QuarantineDirName {
+				return filepath.SkipDir
+			}
+			if de.IsDir() || !strings.HasSuffix(de.Name(), suffix) || seen[path] {
+				return nil
+			}
+			seen[path] = true
+			w, ok := expected[path]
+			if !ok {
+				orphans = append(orphans, path)
+				return nil
+			}
+			w.found = true
+			if !w.yanked {
+				rep.Present++
+			}
+			return nil
+		})
+		if err != nil {
+			return ReconcileReport{}, nil, nil, err
+		}
+	}
+
+	for _, w := range expected {
+		if !w.yanked && !w.found {
+			missing = append(missing, w.url)
+		}
+	}
+	return rep, missing, orphans, nil
+}
+
+// roots returns the output dir followed by each distinct route directory.
+func (d *Downloader) roots() []string {
+	roots := []string{d.outDir}
+	for _, r := range d.routes {
+		if !slices.Contains(roots, r.Dir) {
+			roots = append(roots, r.Dir)
+		}
+	}
+	return roots
+}
+
+func sortedSample(s []string) []string {
+	sort.Strings(s)
+	if len(s) > reconcileSampleSize {
+		s = s[:reconcileSampleSize]
+	}
+	return s
+}
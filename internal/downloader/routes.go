@@ -0,0 +1,87 @@
+package downloader
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Route sends crates whose lowercased names fall in a prefix range to their
+// own output directory; see SetRoutes.
+type Route struct {
+	From, To string // inclusive prefix bounds; equal for a single prefix
+	Dir      string
+}
+
+// ParseRoute parses a -route rule "<from>..<to>=<dir>" or "<prefix>=<dir>".
+// "a..m=/disk1" matches every crate starting with a to m, "serde=/disk3"
+// every crate starting with serde. Bounds compare against the same number
+// of leading characters of the name, so "a..cz" covers a, b and c up to cz.
+// Crate names may contain "-", so a prefix such as "serde-json" is one
+// prefix, not a range.
+func ParseRoute(s string) (Route, error) {
+	rng, dir, ok := strings.Cut(s, "=")
+	rng, dir = strings.ToLower(strings.TrimSpace(rng)), strings.TrimSpace(dir)
+	if !ok || rng == "" || dir == "" {
+		return Route{}, fmt.Errorf("route %q: want <from>..<to>=<dir> or <prefix>=<dir>", s)
+	}
+	from, to, isRange := strings.Cut(rng, "..")
+	if !isRange {
+		to = from
+	}
+	if from == "" || to == "" || from > to {
+		return Route{}, fmt.Errorf("route %q: bad prefix range %q", s, rng)
+	}
+	return Route{From: from, To: to, Dir: dir}, nil
+}
+
+// ReadRoutes reads one ParseRoute rule per line from path, skipping blank
+// lines and # comments.
+func ReadRoutes(path string) ([]Route, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var routes []Route
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := ParseRoute(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		routes = append(routes, r)
+	}
+	return routes, s.Err()
+}
+
+func (r Route) matches(crate string) bool {
+	head := func(n int) string { return crate[:min(n, len(crate))] }
+	return head(len(r.From)) >= r.From && head(len(r.To)) <= r.To
+}
+
+// SetRoutes splits the mirror across output directories by crate name: the
+// first matching route picks the directory that the usual shard layout is
+// built under, and crates no route matches stay in the output dir passed to
+// NewDownloader. Records carry the chosen directory in Root. Downloader.Reconcile
+// and Downloader.PrunePlan walk every route; bundle indexes still only look
+// at the main output dir.
+func (d *Downloader) SetRoutes(routes []Route) {
+	d.routes = routes
+}
+
+// rootFor returns the output directory for crate.
+func (d *Downloader) rootFor(crate string) string {
+	crate = strings.ToLower(crate)
+	for _, r := range d.routes {
+		if r.matches(crate) {
+			return r.Dir
+		}
+	}
+	return d.outDir
+}
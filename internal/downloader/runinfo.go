@@ -0,0 +1,44 @@
+package downloader
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// RunInfo describes one download run for reproducibility; see WriteRunInfo.
+type RunInfo struct {
+	SchemaVersion int    `json:"schema_version"`
+	IndexDir      string `json:"index_dir,omitempty"`
+	IndexCommit   string `json:"index_commit,omitempty"` // index git commit the URLs were read from
+	Manifest      string `json:"manifest,omitempty"`
+	StartedAt     string `json:"started_at"`
+	FinishedAt    string `json:"finished_at"`
+	URLs          int    `json:"urls"`
+	Processed     int64  `json:"processed"`
+	OK            int64  `json:"ok"`
+	Errors        int64  `json:"errors"`
+	Bytes         int64  `json:"bytes"`
+	Error         string `json:"error,omitempty"` // set when Run failed
+}
+
+// WriteRunInfo atomically writes info as indented JSON to path.
+func WriteRunInfo(path string, info RunInfo) error {
+	if info.SchemaVersion == 0 {
+		info.SchemaVersion = 1
+	}
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,115 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSampleMismatch is returned by Run when strict sample verification finds
+// a file whose content no longer matches the digest recorded when it was written.
+var ErrSampleMismatch = errors.New("sample verification found corrupted files")
+
+type sampledFile struct {
+	path   string
+	sha256 string
+}
+
+// SetVerifySample makes Run re-read and re-hash about pct percent of the files
+// it wrote, to catch silent disk corruption right away. Mismatches are logged
+// as errors; with strict, Run also returns ErrSampleMismatch.
+func (d *Downloader) SetVerifySample(pct float64, strict bool) {
+	d.samplePct = min(pct, 100)
+	d.sampleStrict = strict
+}
+
+// SetVerifyConcurrency sets how many files the sample verification of
+// SetVerifySample re-hashes at once. Re-hashing is bound by disk reads, not
+// the network, so it does not follow the download concurrency; n <= 0 means
+// runtime.NumCPU().
+func (d *Downloader) SetVerifyConcurrency(n int) {
+	d.verifyConc = n
+}
+
+func (d *Downloader) verifyWorkers() int {
+	if d.verifyConc > 0 {
+		return d.verifyConc
+	}
+	return runtime.NumCPU()
+}
+
+// noteWritten picks files written (not skipped) this run for verifySample.
+// Skipped records carry no digest, so they never qualify.
+func (d *Downloader) noteWritten(rec Record) {
+	if d.samplePct <= 0 || !rec.OK || rec.SHA256 == "" {
+		return
+	}
+	f := sampledFile{path: rec.Path, sha256: rec.SHA256}
+	if rec.StoredSHA256 != "" {
+		f.sha256 = rec.StoredSHA256
+	}
+	d.lastWritten = f
+	if rand.Float64()*100 < d.samplePct {
+		d.sampled = append(d.sampled, f)
+	}
+}
+
+// verifySample re-hashes the sampled files with a pool of verifyWorkers.
+func (d *Downloader) verifySample(ctx context.Context) error {
+	files := d.sampled
+	if len(files) == 0 && d.lastWritten.path != "" {
+		files = []sampledFile{d.lastWritten}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	start := time.Now()
+	jobs := make(chan sampledFile)
+	var (
+		wg         sync.WaitGroup
+		mu         sync.Mutex
+		mismatches int
+	)
+	for i := 0; i < min(d.verifyWorkers(), len(files)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range jobs {
+				got, err := d.hashFile(f.path)
+				if err == nil && strings.EqualFold(got, f.sha256) {
+					continue
+				}
+				mu.Lock()
+				mismatches++
+				mu.Unlock()
+				if err != nil {
+					slog.Error("sample_verify_failed", "path", f.path, "err", err)
+				} else {
+					slog.Error("sample_verify_mismatch", "path", f.path, "want", f.sha256, "got", got)
+				}
+			}
+		}()
+	}
+feed:
+	for _, f := range files {
+		select {
+		case <-ctx.Done():
+			break feed
+		case jobs <- f:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	slog.Info("sample_verify", "checked", len(files), "mismatches", mismatches, "pct", d.samplePct, "elapsed", time.Since(start).String())
+	if mismatches > 0 && d.sampleStrict {
+		return fmt.Errorf("%w: %d of %d sampled", ErrSampleMismatch, mismatches, len(files))
+	}
+	return nil
+}
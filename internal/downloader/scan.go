@@ -0,0 +1,116 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// StatusScanFailed marks a record whose bytes the SetScanCommand process
+// rejected (or that could not be scanned); the file was quarantined.
+const StatusScanFailed = "scan-failed"
+
+// ErrScanFailed wraps why a download did not pass SetScanCommand.
+var ErrScanFailed = errors.New("scan failed")
+
+// scanStderrMax caps the scanner output kept for the record's error.
+const scanStderrMax = 512
+
+// SetScanCommand streams every download to an external scanner, e.g. an
+// antivirus CLI reading stdin. argv is started once per download attempt
+// with the served bytes on stdin as they arrive, and CRATE_URL and
+// CRATE_PATH (the final path) in its environment. A non-zero exit, or a
+// command that cannot be started, records the file with StatusScanFailed
+// and moves it under QuarantineDirName. A scanner may exit before reading
+// everything; the download still completes and only the exit status counts.
+// Files already on disk are not scanned. Empty argv turns scanning off.
+func (d *Downloader) SetScanCommand(argv []string) {
+	d.scanCmd = argv
+}
+
+// scanProc is the scanner of one download attempt. A nil *scanProc is a
+// no-op, so callers need not check whether scanning is on.
+type scanProc struct {
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stderr   *capWriter
+	writeErr error // first failed write; later bytes are dropped
+	startErr error
+}
+
+// startScan starts the scanner for one attempt, or returns nil when
+// scanning is off. Start errors are reported by finish.
+func (d *Downloader) startScan(ctx context.Context, url, outPath string) *scanProc {
+	if len(d.scanCmd) == 0 {
+		return nil
+	}
+	s := &scanProc{stderr: &capWriter{max: scanStderrMax}}
+	s.cmd = exec.CommandContext(ctx, d.scanCmd[0], d.scanCmd[1:]...)
+	s.cmd.Env = append(os.Environ(), "CRATE_URL="+url, "CRATE_PATH="+outPath)
+	s.cmd.Stderr = s.stderr
+	if s.stdin, s.startErr = s.cmd.StdinPipe(); s.startErr == nil {
+		s.startErr = s.cmd.Start()
+	}
+	return s
+}
+
+// tee returns body with everything read from it also fed to the scanner.
+func (s *scanProc) tee(body io.Reader) io.Reader {
+	if s == nil || s.startErr != nil {
+		return body
+	}
+	return io.TeeReader(body, s)
+}
+
+// Write feeds the scanner. It never fails, so a scanner that stops reading
+// early cannot break the download.
+func (s *scanProc) Write(p []byte) (int, error) {
+	if s.writeErr == nil {
+		_, s.writeErr = s.stdin.Write(p)
+	}
+	return len(p), nil
+}
+
+// finish closes the scanner's stdin and waits for it. complete is false when
+// the attempt failed; the scanner is then stopped and its verdict ignored.
+func (s *scanProc) finish(complete bool) error {
+	if s == nil {
+		return nil
+	}
+	if s.startErr != nil {
+		return fmt.Errorf("%w: start %s: %v", ErrScanFailed, s.cmd.Path, s.startErr)
+	}
+	_ = s.stdin.Close()
+	if !complete {
+		_ = s.cmd.Process.Kill()
+		_ = s.cmd.Wait()
+		return nil
+	}
+	if err := s.cmd.Wait(); err != nil {
+		msg := strings.TrimSpace(s.stderr.String())
+		if msg == "" {
+			return fmt.Errorf("%w: %s: %v", ErrScanFailed, s.cmd.Path, err)
+		}
+		return fmt.Errorf("%w: %s: %v: %s", ErrScanFailed, s.cmd.Path, err, msg)
+	}
+	return nil
+}
+
+// capWriter keeps the first max bytes written to it and drops the rest.
+type capWriter struct {
+	buf []byte
+	max int
+}
+
+func (c *capWriter) Write(p []byte) (int, error) {
+	if room := c.max - len(c.buf); room > 0 {
+		c.buf = append(c.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+func (c *capWriter) String() string { return string(c.buf) }
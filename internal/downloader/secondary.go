@@ -0,0 +1,33 @@
+package downloader
+
+import "strings"
+
+// StatusChecksumDisagreement marks a record whose URL has different digests
+// in the primary checksum source (index cksum or -checksums) and the
+// secondary one, which points at a tampered index or CDN rather than a bad
+// transfer.
+const StatusChecksumDisagreement = "checksum-disagreement"
+
+// SetSecondaryChecksums adds an independent url -> sha256 source. A download
+// must match both sources where both have an entry.
+func (d *Downloader) SetSecondaryChecksums(m map[string]string) {
+	d.secondary = m
+}
+
+// sumMatches reports whether got satisfies every checksum known for url.
+func (d *Downloader) sumMatches(url, got string) bool {
+	if want := d.expectedSum(url); want != "" && !strings.EqualFold(want, got) {
+		return false
+	}
+	if want := d.secondary[url]; want != "" && !strings.EqualFold(want, got) {
+		return false
+	}
+	return true
+}
+
+// sourcesDisagree returns both digests when the primary and secondary
+// sources list different checksums for url.
+func (d *Downloader) sourcesDisagree(url string) (primary, secondary string, ok bool) {
+	primary, secondary = d.expectedSum(url), d.secondary[url]
+	return primary, secondary, primary != "" && secondary != "" && !strings.EqualFold(primary, secondary)
+}
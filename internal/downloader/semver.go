@@ -0,0 +1,142 @@
+package downloader
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semVersion is a parsed SemVer 2.0 version. Build metadata is dropped since
+// it does not affect precedence.
+type semVersion struct {
+	major, minor, patch uint64
+	pre                 []string // dot-separated pre-release identifiers
+}
+
+func parseSemver(s string) (semVersion, error) {
+	var v semVersion
+	core := strings.TrimSpace(s)
+	if i := strings.IndexByte(core, '+'); i >= 0 {
+		core = core[:i]
+	}
+	if i := strings.IndexByte(core, '-'); i >= 0 {
+		pre := core[i+1:]
+		core = core[:i]
+		if pre == "" {
+			return v, fmt.Errorf("invalid version %q: empty pre-release", s)
+		}
+		v.pre = strings.Split(pre, ".")
+		for _, id := range v.pre {
+			if id == "" {
+				return v, fmt.Errorf("invalid version %q: empty pre-release identifier", s)
+			}
+		}
+	}
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return v, fmt.Errorf("invalid version %q: want MAJOR.MINOR.PATCH", s)
+	}
+	nums := [3]*uint64{&v.major, &v.minor, &v.patch}
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return v, fmt.Errorf("invalid version %q: %w", s, err)
+		}
+		*nums[i] = n
+	}
+	return v, nil
+}
+
+// prerelease reports whether v has a pre-release suffix such as -alpha.1.
+func (v semVersion) prerelease() bool { return len(v.pre) > 0 }
+
+// compare returns -1, 0 or 1 following SemVer precedence rules.
+func (v semVersion) compare(o semVersion) int {
+	for _, d := range [][2]uint64{{v.major, o.major}, {v.minor, o.minor}, {v.patch, o.patch}} {
+		if d[0] != d[1] {
+			if d[0] < d[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(v.pre) == 0 && len(o.pre) == 0:
+		return 0
+	case len(v.pre) == 0:
+		return 1 // a release outranks its pre-releases
+	case len(o.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.pre) && i < len(o.pre); i++ {
+		if c := comparePreID(v.pre[i], o.pre[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(v.pre) < len(o.pre):
+		return -1
+	case len(v.pre) > len(o.pre):
+		return 1
+	}
+	return 0
+}
+
+// comparePreID orders numeric identifiers numerically and below alphanumeric ones.
+func comparePreID(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 64)
+	bn, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		if an < bn {
+			return -1
+		} else if an > bn {
+			return 1
+		}
+		return 0
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// versionFilter implements -skip-prerelease and -min-version.
+type versionFilter struct {
+	skipPre bool
+	min     *semVersion
+}
+
+func newVersionFilter(skipPre bool, minVersion string) (versionFilter, error) {
+	f := versionFilter{skipPre: skipPre}
+	if minVersion != "" {
+		v, err := parseSemver(minVersion)
+		if err != nil {
+			return f, fmt.Errorf("min version: %w", err)
+		}
+		f.min = &v
+	}
+	return f, nil
+}
+
+func (f versionFilter) active() bool { return f.skipPre || f.min != nil }
+
+// allow reports whether vers passes the filter. Versions that do not parse are
+// allowed, with the parse error returned so the caller can warn.
+func (f versionFilter) allow(vers string) (bool, error) {
+	if !f.active() {
+		return true, nil
+	}
+	v, err := parseSemver(vers)
+	if err != nil {
+		return true, err
+	}
+	if f.skipPre && v.prerelease() {
+		return false, nil
+	}
+	if f.min != nil && v.compare(*f.min) < 0 {
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,76 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// shardManifestName is the per-shard manifest written by -manifest-per-shard.
+const shardManifestName = "manifest.jsonl"
+
+// maxOpenShardManifests bounds open shard files; the index has far more shard
+// directories than a typical open-file limit allows.
+const maxOpenShardManifests = 256
+
+type shardManifest struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+// SetManifestPerShard writes each record to manifest.jsonl in the shard
+// directory of its crate (e.g. out/s/er/manifest.jsonl) instead of the
+// records writer passed to NewDownloader. Files are truncated on first use
+// by this Downloader and closed when Run returns.
+func (d *Downloader) SetManifestPerShard(v bool) {
+	d.manifestPerShard = v
+}
+
+// encodeShardRecord writes rec to its shard manifest, falling back to the
+// main records writer if the shard file cannot be created. It returns the
+// error of the write that should have stored rec.
+func (d *Downloader) encodeShardRecord(rec Record, fallback *json.Encoder) error {
+	dir, _ := d.outPathFor(rec.URL)
+	sm, ok := d.shardManifests[dir]
+	if !ok {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			slog.Warn("shard_manifest_failed", "dir", dir, "err", err)
+			return d.encodeRecord(fallback, rec)
+		}
+		if len(d.shardManifests) >= maxOpenShardManifests {
+			d.closeShardManifests()
+		}
+		// Truncate on first use in this run; reopen for append after eviction.
+		flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if _, seen := d.shardSeen[dir]; seen {
+			flag = os.O_WRONLY | os.O_APPEND
+		}
+		f, err := os.OpenFile(filepath.Join(dir, shardManifestName), flag, 0o644)
+		if err != nil {
+			slog.Warn("shard_manifest_failed", "dir", dir, "err", err)
+			return d.encodeRecord(fallback, rec)
+		}
+		if d.shardManifests == nil {
+			d.shardManifests = make(map[string]*shardManifest)
+			d.shardSeen = make(map[string]struct{})
+		}
+		d.shardSeen[dir] = struct{}{}
+		sm = &shardManifest{f: f, enc: json.NewEncoder(meteredWriter{&SafeWriter{w: f}})}
+		d.shardManifests[dir] = sm
+	}
+	if err := d.encodeRecord(sm.enc, rec); err != nil {
+		return fmt.Errorf("%s: %w", sm.f.Name(), err)
+	}
+	return nil
+}
+
+func (d *Downloader) closeShardManifests() {
+	for dir, sm := range d.shardManifests {
+		if err := sm.f.Close(); err != nil {
+			slog.Warn("shard_manifest_close_failed", "path", sm.f.Name(), "err", err)
+		}
+		delete(d.shardManifests, dir)
+	}
+}
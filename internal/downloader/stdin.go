@@ -0,0 +1,32 @@
+package downloader
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/mattn/go-isatty"
+)
+
+// StdinPath names standard input where ReadURLs and the ReadChecksums
+// functions take a path.
+const StdinPath = "-"
+
+// ErrStdinTerminal is returned when StdinPath is read while standard input is
+// a terminal, which would otherwise wait for typed input.
+var ErrStdinTerminal = errors.New("standard input is a terminal; pipe or redirect the list into it, e.g. `generate | download-crates -list -` or `-list - < urls.txt`")
+
+// stdin is swapped out by tests.
+var stdin = os.Stdin
+
+// openInput opens path for reading, or standard input for StdinPath. Closing
+// the result leaves standard input open.
+func openInput(path string) (io.ReadCloser, error) {
+	if path != StdinPath {
+		return os.Open(path)
+	}
+	if fd := stdin.Fd(); isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd) {
+		return nil, ErrStdinTerminal
+	}
+	return io.NopCloser(stdin), nil
+}
@@ -0,0 +1,39 @@
+package downloader
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// BlobStore is where downloaded crates are written. Paths are the same
+// shard-layout paths used for the local mirror. A download is written to a
+// temporary path and renamed into place once complete, which object stores
+// can map to a multipart upload and its completion.
+type BlobStore interface {
+	// Create opens path for writing, creating parents as needed.
+	Create(path string) (io.WriteCloser, error)
+	Open(path string) (io.ReadCloser, error)
+	Stat(path string) (fs.FileInfo, error)
+	Rename(oldPath, newPath string) error
+	Remove(path string) error
+}
+
+// LocalStore is the default BlobStore backed by the local filesystem.
+type LocalStore struct{}
+
+func (LocalStore) Create(path string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+func (LocalStore) Open(path string) (io.ReadCloser, error) { return os.Open(path) }
+
+func (LocalStore) Stat(path string) (fs.FileInfo, error) { return os.Stat(path) }
+
+func (LocalStore) Rename(oldPath, newPath string) error { return os.Rename(oldPath, newPath) }
+
+func (LocalStore) Remove(path string) error { return os.Remove(path) }
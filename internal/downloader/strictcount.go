@@ -0,0 +1,38 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// ErrCountMismatch is returned by Run, with SetStrictCount, when fewer
+// records were collected than URLs were given to it.
+var ErrCountMismatch = errors.New("processed count does not match input")
+
+// SetStrictCount makes Run fail with ErrCountMismatch when the records of its
+// main pass do not account for every URL, e.g. because a worker died and
+// silently dropped its items. A run stopped by SetMaxTotalBytes or
+// SetFailOnManifestError is only held to the URLs it dispatched. Without it
+// a shortfall is logged and the run succeeds.
+func (d *Downloader) SetStrictCount(on bool) {
+	d.strictCount = on
+}
+
+// countResult compares the records of the main pass with the input. processed
+// is the number of records collected, sent the number of URLs dispatched.
+func (d *Downloader) countResult(urls, sent int, processed int64) error {
+	expected, stopped := urls, d.BudgetReached() || d.manifestAbort()
+	if stopped {
+		expected = sent
+	}
+	if processed >= int64(expected) {
+		return nil
+	}
+	missing := int64(expected) - processed
+	slog.Error("records_unaccounted", "urls", urls, "dispatched", sent, "processed", processed, "unaccounted", missing, "strict", d.strictCount)
+	if d.strictCount {
+		return fmt.Errorf("%w: %d of %d URLs have no record", ErrCountMismatch, missing, expected)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package downloader
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ParseTLSVersion maps a -min-tls value to a crypto/tls version constant.
+// Versions below 1.2 are not accepted.
+func ParseTLSVersion(s string) (uint16, error) {
+	switch strings.TrimSpace(s) {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported minimum TLS version %q (want 1.2 or 1.3)", s)
+}
+
+// ParseCipherSuites resolves a comma-separated list of IANA cipher suite names,
+// e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Only suites Go considers secure
+// are accepted. An empty string returns nil, meaning Go's default list.
+func ParseCipherSuites(s string) ([]uint16, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	byName := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		byName[cs.Name] = cs.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ApplyTLSPolicy sets the minimum TLS version and, for TLS 1.2 connections,
+// the allowed cipher suites on tr. TLS 1.3 suites are not configurable in Go.
+func ApplyTLSPolicy(tr *http.Transport, minVersion uint16, ciphers []uint16) {
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	tr.TLSClientConfig.MinVersion = minVersion
+	if len(ciphers) > 0 {
+		tr.TLSClientConfig.CipherSuites = ciphers
+	}
+}
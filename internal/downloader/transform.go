@@ -0,0 +1,128 @@
+package downloader
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// StoreTransform selects how a downloaded .crate (a gzip tarball) is stored.
+// Checksums always apply to the bytes as served, before the transform.
+type StoreTransform string
+
+const (
+	TransformNone   StoreTransform = "none"
+	TransformGunzip StoreTransform = "gunzip" // plain tar, stored as {name}-{version}.tar
+	TransformZstd   StoreTransform = "zstd"   // tar recompressed with zstd, stored as .tar.zst
+)
+
+// ParseStoreTransform validates a -store-transform value.
+func ParseStoreTransform(s string) (StoreTransform, error) {
+	switch t := StoreTransform(s); t {
+	case TransformNone, TransformGunzip, TransformZstd:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown store transform %q (want none, gunzip or zstd)", s)
+}
+
+// storedName maps a downloaded file name to the name it is stored under.
+func (t StoreTransform) storedName(name string) string {
+	switch t {
+	case TransformGunzip:
+		return strings.TrimSuffix(name, ".crate") + ".tar"
+	case TransformZstd:
+		return strings.TrimSuffix(name, ".crate") + ".tar.zst"
+	}
+	return name
+}
+
+// apply streams body into w, decoding the gzip layer and re-encoding it as
+// the transform requires.
+func (t StoreTransform) apply(w io.Writer, body io.Reader) error {
+	if t == "" || t == TransformNone {
+		_, err := io.Copy(w, body)
+		return err
+	}
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("%s: %w", t, err)
+	}
+	defer zr.Close()
+	if t == TransformGunzip {
+		_, err = io.Copy(w, zr)
+		return err
+	}
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, zr); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// SetStoreTransform changes how downloaded files are stored; see StoreTransform.
+func (d *Downloader) SetStoreTransform(t StoreTransform) {
+	d.transform = t
+}
+
+func (d *Downloader) transformed() bool {
+	return d.transform != "" && d.transform != TransformNone
+}
+
+// fetched describes one response body written by download.
+type fetched struct {
+	n         int64  // bytes served
+	stored    int64  // bytes written to the store
+	sum       string // SHA256 of the served bytes; only set when transformed
+	storedSum string // SHA256 of the stored bytes; only set when transformed
+
+	// response details for SetWriteProvenance
+	status       int
+	etag         string
+	lastModified string
+
+	scanErr error // verdict of SetScanCommand; nil when it passed or is off
+}
+
+// writeBody writes body to w through the configured transform. Without one the
+// body is copied as is and verifyFile hashes it afterwards.
+func (d *Downloader) writeBody(w io.Writer, body io.Reader) (fetched, error) {
+	if !d.transformed() {
+		n, err := io.Copy(w, body)
+		return fetched{n: n, stored: n}, err
+	}
+	served, stored := sha256.New(), sha256.New()
+	in := &countWriter{w: served}
+	out := &countWriter{w: io.MultiWriter(w, stored)}
+	tee := io.TeeReader(body, in)
+	err := d.transform.apply(out, tee)
+	if err == nil {
+		// The gzip reader may stop before the end of the body; hash the rest too.
+		_, err = io.Copy(io.Discard, tee)
+	}
+	return fetched{
+		n:         in.n,
+		stored:    out.n,
+		sum:       hex.EncodeToString(served.Sum(nil)),
+		storedSum: hex.EncodeToString(stored.Sum(nil)),
+	}, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,39 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// StatusDeadline marks a record given up on because SetPerURLDeadline ran out.
+const StatusDeadline = "deadline"
+
+// ErrURLDeadline is the cause of a URL's context being cancelled by
+// SetPerURLDeadline.
+var ErrURLDeadline = errors.New("per-URL deadline exceeded")
+
+// SetPerURLDeadline bounds the total time spent on one URL, across all
+// attempts and backoff sleeps (0 = bounded by the timeout passed to
+// NewDownloader). The timeout still limits each request. URLs that run out
+// are recorded with StatusDeadline, so a few pathological URLs cannot drag
+// out the tail of a run.
+func (d *Downloader) SetPerURLDeadline(dur time.Duration) {
+	if dur < 0 {
+		dur = 0
+	}
+	d.urlDeadline = dur
+}
+
+// urlContext returns the context one URL is fetched under.
+func (d *Downloader) urlContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.urlDeadline > 0 {
+		return context.WithTimeoutCause(ctx, d.urlDeadline, ErrURLDeadline)
+	}
+	return context.WithTimeout(ctx, d.timeout)
+}
+
+// deadlineExceeded reports whether ctx ended because of SetPerURLDeadline.
+func deadlineExceeded(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrURLDeadline)
+}
@@ -0,0 +1,55 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// CrateURL is the download URL of one crate version under baseURL, as built
+// from index entries.
+func CrateURL(baseURL, name, vers string) string {
+	return fmt.Sprintf("%s/%s/%s-%s.crate", strings.TrimRight(baseURL, "/"), name, name, vers)
+}
+
+// Placement is where a crate version is stored; see Where.
+type Placement struct {
+	URL         string
+	Root        string // output dir chosen by SetRoutes; "" without routes
+	Dir         string
+	Name        string
+	Path        string
+	BundleEntry string // tar entry name under the bundler's header layout; "" without a bundler
+	Exists      bool
+}
+
+// Where reports where the crate version at url would be stored with the
+// current settings (output dir and routes, -normalize-case,
+// -store-transform, bundle header layout), without downloading anything.
+func (d *Downloader) Where(url string) Placement {
+	dir, name := d.outPathFor(url)
+	p := Placement{URL: url, Dir: dir, Name: name, Path: filepath.Join(dir, name)}
+	if d.routes != nil {
+		p.Root = d.rootFor(d.crateName(url))
+	}
+	if d.bundler != nil {
+		p.BundleEntry = d.bundler.headerName(url, p.Path)
+	}
+	_, err := d.storage().Stat(p.Path)
+	p.Exists = err == nil
+	return p
+}
+
+// Print writes one key=value line per field.
+func (p Placement) Print(w io.Writer) {
+	fmt.Fprintf(w, "url=%s\n", p.URL)
+	if p.Root != "" {
+		fmt.Fprintf(w, "root=%s\n", p.Root)
+	}
+	fmt.Fprintf(w, "dir=%s\nfile=%s\npath=%s\n", p.Dir, p.Name, p.Path)
+	if p.BundleEntry != "" {
+		fmt.Fprintf(w, "bundle_entry=%s\n", p.BundleEntry)
+	}
+	fmt.Fprintf(w, "exists=%t\n", p.Exists)
+}
@@ -0,0 +1,28 @@
+// Package fsinfo reports filesystem capacity and process limits used by
+// preflight checks. Values are best-effort and platform dependent.
+package fsinfo
+
+import "errors"
+
+// ErrUnsupported is returned when the current platform cannot report a value.
+var ErrUnsupported = errors.New("fsinfo: not supported on this platform")
+
+// Usage describes free and total capacity of the filesystem holding a path.
+// HasInodes is false on filesystems (or platforms) without inode accounting.
+type Usage struct {
+	FreeBytes   uint64
+	TotalBytes  uint64
+	FreeInodes  uint64
+	TotalInodes uint64
+	HasInodes   bool
+}
+
+// DiskUsage returns capacity information for the filesystem containing path.
+func DiskUsage(path string) (Usage, error) {
+	return diskUsage(path)
+}
+
+// OpenFileLimit returns the soft limit on open file descriptors for this process.
+func OpenFileLimit() (uint64, error) {
+	return openFileLimit()
+}
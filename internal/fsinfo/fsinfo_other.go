@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package fsinfo
+
+func diskUsage(path string) (Usage, error) {
+	return Usage{}, ErrUnsupported
+}
+
+func openFileLimit() (uint64, error) {
+	return 0, ErrUnsupported
+}
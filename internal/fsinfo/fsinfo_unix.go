@@ -0,0 +1,28 @@
+//go:build linux || darwin || freebsd
+
+package fsinfo
+
+import "syscall"
+
+func diskUsage(path string) (Usage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return Usage{}, err
+	}
+	bsize := uint64(st.Bsize)
+	return Usage{
+		FreeBytes:   uint64(st.Bavail) * bsize,
+		TotalBytes:  uint64(st.Blocks) * bsize,
+		FreeInodes:  uint64(st.Ffree),
+		TotalInodes: uint64(st.Files),
+		HasInodes:   st.Files > 0,
+	}, nil
+}
+
+func openFileLimit() (uint64, error) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, err
+	}
+	return uint64(rl.Cur), nil
+}
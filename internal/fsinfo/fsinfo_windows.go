@@ -0,0 +1,23 @@
+//go:build windows
+
+package fsinfo
+
+import "golang.org/x/sys/windows"
+
+func diskUsage(path string) (Usage, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return Usage{}, err
+	}
+	var freeAvail, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &freeAvail, &total, &totalFree); err != nil {
+		return Usage{}, err
+	}
+	// NTFS has no fixed inode table; leave inode fields unset.
+	return Usage{FreeBytes: freeAvail, TotalBytes: total}, nil
+}
+
+// Windows has no RLIMIT_NOFILE equivalent for sockets and files.
+func openFileLimit() (uint64, error) {
+	return 0, ErrUnsupported
+}
@@ -0,0 +1,88 @@
+// Package index holds crates.io-index reading helpers shared by the downloader
+// and the sidecar generator.
+package index
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Open opens one index file for reading. Gzip-compressed files (detected by a
+// .gz extension or the gzip magic bytes) are decompressed transparently.
+func Open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(2)
+	isGzip := len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b
+	if !isGzip && !strings.HasSuffix(path, ".gz") {
+		return readCloser{br, f}, nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return readCloser{zr, multiCloser{zr, f}}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var first error
+	for _, c := range m {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ErrMissingField reports an entry that parsed as JSON but lacks name or vers.
+var ErrMissingField = errors.New("entry missing name or vers")
+
+// LineError locates a malformed entry for strict index reading.
+type LineError struct {
+	File string // slash-separated, relative to the index root
+	Line int    // 1-based
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error { return e.Err }
+
+// ErrInvalidText reports a line with invalid UTF-8 or a field with control
+// characters, which would otherwise end up in directory and file names.
+var ErrInvalidText = errors.New("invalid text")
+
+// CheckText validates a raw input line and the fields decoded from it. The
+// raw line has to be checked because encoding/json silently replaces invalid
+// UTF-8 with U+FFFD.
+func CheckText(line string, fields ...string) error {
+	if !utf8.ValidString(line) {
+		return fmt.Errorf("%w: line is not valid UTF-8", ErrInvalidText)
+	}
+	for _, f := range fields {
+		if i := strings.IndexFunc(f, unicode.IsControl); i >= 0 {
+			return fmt.Errorf("%w: control character in %q", ErrInvalidText, f)
+		}
+	}
+	return nil
+}
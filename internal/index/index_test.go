@@ -0,0 +1,117 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWalkSkipPatterns(t *testing.T) {
+	root := t.TempDir()
+	for _, rel := range []string{"config.json", "s/er/serde", "s/er/serde.bak", "_meta/notes", "3/l/log"} {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("{}\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := Options{SkipFiles: []string{"*.bak"}, SkipDirs: []string{"_*"}}
+	var got []string
+	if err := Walk(root, opts, func(p string) error {
+		rel, _ := filepath.Rel(root, p)
+		got = append(got, filepath.ToSlash(rel))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != "3/l/log" || got[1] != "s/er/serde" {
+		t.Fatalf("walked %v, want [3/l/log s/er/serde]", got)
+	}
+	if !opts.SkipPath("_meta/notes") || opts.SkipPath("s/er/serde") {
+		t.Fatal("SkipPath disagrees with Walk")
+	}
+	if err := (Options{SkipFiles: []string{"["}}).Validate(); err == nil {
+		t.Fatal("expected bad pattern error")
+	}
+}
+
+func TestWalkLayouts(t *testing.T) {
+	root := t.TempDir()
+	for _, rel := range []string{"index.jsonl", "more.jsonl", "README.md", "sub/nested.jsonl"} {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("{}\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walk := func(root string, layout Layout) ([]string, error) {
+		var got []string
+		err := Walk(root, Options{Layout: layout}, func(p string) error {
+			got = append(got, RelPath(root, p))
+			return nil
+		})
+		return got, err
+	}
+
+	got, err := walk(root, LayoutFlat)
+	if err != nil || len(got) != 2 || got[0] != "index.jsonl" || got[1] != "more.jsonl" {
+		t.Fatalf("flat walked %v (err %v), want [index.jsonl more.jsonl]", got, err)
+	}
+	got, err = walk(filepath.Join(root, "index.jsonl"), LayoutSingle)
+	if err != nil || len(got) != 1 || got[0] != "index.jsonl" {
+		t.Fatalf("single walked %v (err %v), want [index.jsonl]", got, err)
+	}
+	if _, err := walk(root, LayoutSingle); err == nil {
+		t.Fatal("single layout accepted a directory")
+	}
+	if err := (Options{Layout: "tree"}).Validate(); err == nil {
+		t.Fatal("expected unknown layout error")
+	}
+}
+
+func TestWalkIncludeExclude(t *testing.T) {
+	root := t.TempDir()
+	for _, rel := range []string{"1/a", "a/bc/abcd", "a/xy/axyz", "s/er/serde", "s/ha/sha2"} {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("{}\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		include, exclude []string
+		want             string
+	}{
+		{include: []string{"a*"}, want: "a/bc/abcd,a/xy/axyz"},
+		{include: []string{"s/er/*", "1/*"}, want: "1/a,s/er/serde"},
+		{include: []string{"a", "s"}, exclude: []string{"a/xy", "s/ha/sha?"}, want: "a/bc/abcd,s/er/serde"},
+		{exclude: []string{"*"}, want: ""},
+	} {
+		opts := Options{Include: tc.include, Exclude: tc.exclude}
+		var got []string
+		if err := Walk(root, opts, func(p string) error {
+			got = append(got, RelPath(root, p))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, ",") != tc.want {
+			t.Errorf("include %v exclude %v: walked %v, want %s", tc.include, tc.exclude, got, tc.want)
+		}
+		for _, rel := range got {
+			if opts.SkipPath(rel) {
+				t.Errorf("SkipPath(%s) disagrees with Walk", rel)
+			}
+		}
+	}
+	if err := (Options{Include: []string{"["}}).Validate(); err == nil {
+		t.Fatal("expected bad include pattern error")
+	}
+}
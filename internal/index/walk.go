@@ -0,0 +1,199 @@
+package index
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Layout describes how index files are arranged under the index root.
+type Layout string
+
+const (
+	LayoutSharded Layout = "sharded" // crates.io git layout: one file per crate in shard dirs
+	LayoutFlat    Layout = "flat"    // index files directly in the root directory
+	LayoutSingle  Layout = "single"  // the root is itself one JSONL file of all entries
+)
+
+// ParseLayout validates an -index-format value; empty means LayoutSharded.
+func ParseLayout(s string) (Layout, error) {
+	switch l := Layout(s); l {
+	case "":
+		return LayoutSharded, nil
+	case LayoutSharded, LayoutFlat, LayoutSingle:
+		return l, nil
+	}
+	return "", fmt.Errorf("unknown index format %q (want sharded, flat or single)", s)
+}
+
+// Options controls which entries of an index tree are treated as index files.
+// The built-in rules (skip .git, .github, config.json, README.md, *.keep) always
+// apply; the glob patterns here augment them and match base names.
+type Options struct {
+	SkipFiles []string // extra file name globs to ignore, e.g. "*.bak"
+	SkipDirs  []string // extra directory name globs to prune, e.g. "_*"
+	// Layout selects how index files are discovered; empty means LayoutSharded.
+	// Entries are parsed the same way in every layout.
+	Layout Layout
+	// Include and Exclude scope a run to part of the tree. Their globs match
+	// the slash-separated path relative to the index root, or any leading
+	// directories of it, so "a*" selects every crate under shard a and
+	// "s/er/*" one shard directory. A file is read if it matches no Exclude
+	// pattern and, when Include is set, at least one Include pattern.
+	Include []string
+	Exclude []string
+}
+
+// Validate reports malformed glob patterns up front instead of mid-walk.
+func (o Options) Validate() error {
+	if _, err := ParseLayout(string(o.Layout)); err != nil {
+		return err
+	}
+	for _, p := range append(append([]string{}, o.SkipFiles...), o.SkipDirs...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad index skip pattern %q: %w", p, err)
+		}
+	}
+	for _, p := range append(append([]string{}, o.Include...), o.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad index include/exclude pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// Selected applies Include and Exclude to a path relative to the index root.
+func (o Options) Selected(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	if matchPathPrefix(o.Exclude, rel) {
+		return false
+	}
+	return len(o.Include) == 0 || matchPathPrefix(o.Include, rel)
+}
+
+// matchPathPrefix reports whether a pattern matches rel or one of its leading
+// directory paths ("a", "a/bc" for "a/bc/abcd").
+func matchPathPrefix(patterns []string, rel string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	for i := 0; i <= len(rel); i++ {
+		if i < len(rel) && rel[i] != '/' {
+			continue
+		}
+		if matchAny(patterns, rel[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// SkipDir reports whether a directory with this base name should be pruned.
+func (o Options) SkipDir(name string) bool {
+	if name == ".git" || name == ".github" || name == ".gitignore" {
+		return true
+	}
+	return matchAny(o.SkipDirs, name)
+}
+
+// SkipFile reports whether a file with this base name is not an index file.
+func (o Options) SkipFile(name string) bool {
+	if name == "config.json" || strings.EqualFold(name, "README.md") || strings.HasSuffix(name, ".keep") {
+		return true
+	}
+	return matchAny(o.SkipFiles, name)
+}
+
+// SkipPath applies SkipDir to every parent and SkipFile to the base name of a
+// slash-separated path relative to the index root.
+func (o Options) SkipPath(rel string) bool {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for _, p := range parts[:len(parts)-1] {
+		if o.SkipDir(p) {
+			return true
+		}
+	}
+	return o.SkipFile(parts[len(parts)-1]) || !o.Selected(rel)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Walk calls fn for every index file under root in lexical order. fn may
+// return filepath.SkipAll to stop early.
+func Walk(root string, opts Options, fn func(path string) error) error {
+	switch opts.Layout {
+	case LayoutSingle:
+		fi, err := os.Stat(root)
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("index %s is not a file (single layout)", root)
+		}
+		if !opts.Selected(filepath.Base(root)) {
+			return nil
+		}
+		if err := fn(root); err != nil && err != filepath.SkipAll {
+			return err
+		}
+		return nil
+	case LayoutFlat:
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !e.Type().IsRegular() || opts.SkipFile(e.Name()) || !opts.Selected(e.Name()) {
+				continue
+			}
+			if err := fn(filepath.Join(root, e.Name())); err != nil {
+				if err == filepath.SkipAll {
+					return nil
+				}
+				return err
+			}
+		}
+		return nil
+	}
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if p != root && (opts.SkipDir(info.Name()) || matchPathPrefix(opts.Exclude, RelPath(root, p))) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// skip non-regular files
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if opts.SkipFile(info.Name()) || !opts.Selected(RelPath(root, p)) {
+			return nil
+		}
+		return fn(p)
+	})
+}
+
+// RelPath names an index file relative to root for logs, errors and sidecar
+// index_path values. A single-file index is named by its base name.
+func RelPath(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return path
+	}
+	if rel == "." {
+		return filepath.Base(path)
+	}
+	return filepath.ToSlash(rel)
+}
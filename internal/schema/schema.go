@@ -0,0 +1,92 @@
+// Package schema generates JSON Schemas for the manifest and sidecar formats
+// from the Go structs that define them, so the published contract cannot
+// drift from the code.
+package schema
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/downloader"
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/sidecar"
+)
+
+const draft = "https://json-schema.org/draft/2020-12/schema"
+
+// Names lists the formats For accepts.
+var Names = []string{"manifest", "sidecar"}
+
+// For returns the schema of one format: "manifest" (one JSONL line of
+// -manifest) or "sidecar" (one .crate.json file).
+func For(name string) (map[string]any, error) {
+	switch name {
+	case "manifest":
+		return document("Mirror-Crates manifest record", reflect.TypeOf(downloader.Record{})), nil
+	case "sidecar":
+		return document("Mirror-Crates crate sidecar", reflect.TypeOf(sidecar.Document{})), nil
+	}
+	return nil, fmt.Errorf("unknown schema %q (want %s)", name, strings.Join(Names, " or "))
+}
+
+func document(title string, t reflect.Type) map[string]any {
+	s := typeSchema(t)
+	s["$schema"] = draft
+	s["title"] = title
+	return s
+}
+
+// typeSchema maps a Go type to a schema. Struct fields follow encoding/json:
+// the tag names the property, "-" hides it, and fields without omitempty are
+// required.
+func typeSchema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := typeSchema(t.Elem())
+		if typ, ok := s["type"].(string); ok {
+			s["type"] = []string{typ, "null"}
+		}
+		return s
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		props := map[string]any{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, omitempty := jsonName(f)
+			if name == "-" {
+				continue
+			}
+			props[name] = typeSchema(f.Type)
+			if !omitempty {
+				required = append(required, name)
+			}
+		}
+		return map[string]any{"type": "object", "properties": props, "required": required}
+	}
+	return map[string]any{}
+}
+
+func jsonName(f reflect.StructField) (name string, omitempty bool) {
+	tag := f.Tag.Get("json")
+	name, opts, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = f.Name
+	}
+	return name, strings.Contains(opts, "omitempty")
+}
@@ -0,0 +1,165 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/downloader"
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/sidecar"
+)
+
+func TestSchemaCoversEveryField(t *testing.T) {
+	for name, typ := range map[string]reflect.Type{
+		"manifest": reflect.TypeOf(downloader.Record{}),
+		"sidecar":  reflect.TypeOf(sidecar.Document{}),
+	} {
+		s, err := For(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := json.Marshal(s); err != nil {
+			t.Fatalf("%s: schema does not marshal: %v", name, err)
+		}
+		checkFields(t, name, typ, s)
+	}
+	if _, err := For("nope"); err == nil {
+		t.Error("For accepted an unknown schema name")
+	}
+}
+
+// checkFields asserts that every exported field of typ, recursively, is a
+// property of the object schema s.
+func checkFields(t *testing.T, path string, typ reflect.Type, s map[string]any) {
+	t.Helper()
+	props, _ := s["properties"].(map[string]any)
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _ := jsonName(f)
+		p, ok := props[name].(map[string]any)
+		if !ok {
+			t.Errorf("%s: field %s (%q) missing from schema", path, f.Name, name)
+			continue
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Pointer || ft.Kind() == reflect.Slice {
+			if ft.Kind() == reflect.Slice {
+				p, _ = p["items"].(map[string]any)
+			}
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct {
+			checkFields(t, path+"."+name, ft, p)
+		}
+	}
+}
+
+func TestSchemaMatchesGeneratedSidecar(t *testing.T) {
+	idx := t.TempDir()
+	entry := `{"name":"serde","vers":"1.0.0","cksum":"` + strings.Repeat("ab", 32) + `",` +
+		`"deps":[{"name":"derive","package":"serde_derive","req":"=1.0.0","features":["std"],"optional":true,"default_features":false,"target":null,"kind":null},` +
+		`{"name":"toml","req":"^0.5","features":[],"optional":false,"default_features":true,"target":"cfg(unix)","kind":"dev"}],` +
+		`"features":{"std":[]},"features2":{"derive":["dep:serde_derive"]},"yanked":false,"links":null,"v":2,"rust_version":"1.31"}`
+	p := filepath.Join(idx, "se", "rd", "serde")
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(entry+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	cfg := sidecar.Config{IndexDir: idx, OutDir: out, Concurrency: 1, PublicBaseURL: "https://mirror.example/crates", Stamp: true}
+	if stats, err := sidecar.Generate(context.Background(), cfg); err != nil || stats.Wrote != 1 {
+		t.Fatalf("Generate = %+v, %v", stats, err)
+	}
+	files, _ := filepath.Glob(filepath.Join(out, "s", "er", "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("sidecars written: %v", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	s, err := For("sidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, "sidecar", s, doc)
+}
+
+// checkValue asserts that v, decoded from JSON, has the type s allows and,
+// for objects, only the properties s lists and all it requires.
+func checkValue(t *testing.T, path string, s map[string]any, v any) {
+	t.Helper()
+	var types []string
+	switch typ := s["type"].(type) {
+	case string:
+		types = []string{typ}
+	case []string:
+		types = typ
+	}
+	var got string
+	switch v.(type) {
+	case nil:
+		got = "null"
+	case bool:
+		got = "boolean"
+	case string:
+		got = "string"
+	case float64:
+		got = "number"
+		if f := v.(float64); f == float64(int64(f)) && !slices.Contains(types, "number") {
+			got = "integer"
+		}
+	case []any:
+		got = "array"
+	case map[string]any:
+		got = "object"
+	}
+	if !slices.Contains(types, got) {
+		t.Errorf("%s: %s value %v, schema allows %v", path, got, v, types)
+		return
+	}
+	switch v := v.(type) {
+	case []any:
+		items, _ := s["items"].(map[string]any)
+		for i, e := range v {
+			checkValue(t, path+"["+strconv.Itoa(i)+"]", items, e)
+		}
+	case map[string]any:
+		if extra, ok := s["additionalProperties"].(map[string]any); ok {
+			for k, e := range v {
+				checkValue(t, path+"."+k, extra, e)
+			}
+			return
+		}
+		props, _ := s["properties"].(map[string]any)
+		for k, e := range v {
+			p, ok := props[k].(map[string]any)
+			if !ok {
+				t.Errorf("%s: key %q is not in the schema", path, k)
+				continue
+			}
+			checkValue(t, path+"."+k, p, e)
+		}
+		required, _ := s["required"].([]string)
+		for _, k := range required {
+			if _, ok := v[k]; !ok {
+				t.Errorf("%s: required key %q missing", path, k)
+			}
+		}
+	}
+}
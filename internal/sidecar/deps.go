@@ -0,0 +1,165 @@
+package sidecar
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DepEdge is one line of the dependency graph file: a dependency declared by
+// one crate version on another crate.
+type DepEdge struct {
+	From        string `json:"from"`
+	FromVersion string `json:"from_version"`
+	To          string `json:"to"`
+	Req         string `json:"req"`
+	Kind        string `json:"kind"`
+	Optional    bool   `json:"optional"`
+}
+
+// depsSink serializes edge writes from concurrent index-file workers so the
+// lines of one entry are never interleaved with another's.
+type depsSink struct {
+	mu    sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	edges int64
+	err   error
+	done  bool
+}
+
+// openDepsSink starts the graph file at path. A fresh run (resumeFrom empty)
+// truncates it; a resumed run appends, after dropping the edges of crates
+// sorting after resumeFrom, which the earlier run may have written in part
+// and this one writes again.
+func openDepsSink(path, resumeFrom string) (*depsSink, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resumeFrom != "" {
+		if err := trimDepsAfter(path, resumeFrom); err != nil {
+			return nil, err
+		}
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &depsSink{f: f, w: bufio.NewWriterSize(f, 1<<20)}, nil
+}
+
+// trimDepsAfter rewrites the graph file at path without the edges whose
+// crate sorts after crate. A missing file is left missing.
+func trimDepsAfter(path, crate string) error {
+	in, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(out, 1<<20)
+	s := bufio.NewScanner(in)
+	s.Buffer(make([]byte, 64*1024), 16<<20)
+	for s.Scan() {
+		var e DepEdge
+		if json.Unmarshal(s.Bytes(), &e) == nil && strings.ToLower(e.From) > crate {
+			continue
+		}
+		w.Write(s.Bytes())
+		w.WriteByte('\n')
+	}
+	err = s.Err()
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// add appends the edges of one index entry. The first write error is kept and
+// reported by close; later entries are dropped.
+func (s *depsSink) add(name, vers string, deps any) {
+	if s == nil {
+		return
+	}
+	edges := depEdges(name, vers, deps)
+	if len(edges) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	enc := json.NewEncoder(s.w)
+	enc.SetEscapeHTML(false)
+	for _, e := range edges {
+		if err := enc.Encode(e); err != nil {
+			s.err = err
+			return
+		}
+		s.edges++
+	}
+}
+
+// close flushes and closes the file; it is safe to call more than once.
+func (s *depsSink) close() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return s.edges, s.err
+	}
+	s.done = true
+	if err := s.w.Flush(); err != nil && s.err == nil {
+		s.err = err
+	}
+	if err := s.f.Close(); err != nil && s.err == nil {
+		s.err = err
+	}
+	return s.edges, s.err
+}
+
+// depEdges extracts edges from an entry's "deps" array. Renamed dependencies
+// point at the real crate ("package"), and a missing kind means "normal", as
+// in the index format.
+func depEdges(name, vers string, deps any) []DepEdge {
+	list, _ := deps.([]any)
+	edges := make([]DepEdge, 0, len(list))
+	for _, d := range list {
+		dm, ok := d.(map[string]any)
+		if !ok {
+			continue
+		}
+		to, _ := dm["package"].(string)
+		if to == "" {
+			to, _ = dm["name"].(string)
+		}
+		if to == "" {
+			continue
+		}
+		req, _ := dm["req"].(string)
+		kind, _ := dm["kind"].(string)
+		if kind == "" {
+			kind = "normal"
+		}
+		optional, _ := dm["optional"].(bool)
+		edges = append(edges, DepEdge{From: name, FromVersion: vers, To: to, Req: req, Kind: kind, Optional: optional})
+	}
+	return edges
+}
@@ -0,0 +1,42 @@
+package sidecar
+
+// Document is the shape of a sidecar file: the crates.io index entry as
+// published, plus the fields Generate adds. Sidecars are written from the raw
+// entry, so fields the index gains later appear too; this type documents the
+// known ones and backs the published JSON Schema.
+type Document struct {
+	Name        string              `json:"name"`
+	Vers        string              `json:"vers"`
+	Deps        []Dependency        `json:"deps"`
+	Cksum       string              `json:"cksum"`
+	Features    map[string][]string `json:"features"`
+	Features2   map[string][]string `json:"features2,omitempty"`
+	Yanked      bool                `json:"yanked"`
+	Links       *string             `json:"links,omitempty"`
+	V           int                 `json:"v,omitempty"`
+	RustVersion *string             `json:"rust_version,omitempty"`
+
+	// Added by the generator.
+	CrateFile string `json:"crate_file"` // {name}-{vers}.crate
+	CrateURL  string `json:"crate_url"`
+	IndexPath string `json:"index_path"` // index file, relative to the index root
+
+	// Added with Config.PublicBaseURL.
+	PublicURL string `json:"public_url,omitempty"`
+
+	// Added with Config.Stamp.
+	GeneratedAt      string `json:"generated_at,omitempty"` // RFC3339, UTC
+	GeneratorVersion string `json:"generator_version,omitempty"`
+}
+
+// Dependency is one element of an index entry's deps array.
+type Dependency struct {
+	Name            string   `json:"name"`
+	Req             string   `json:"req"`
+	Features        []string `json:"features"`
+	Optional        bool     `json:"optional"`
+	DefaultFeatures bool     `json:"default_features"`
+	Target          *string  `json:"target"`
+	Kind            *string  `json:"kind"`              // normal, dev or build; null means normal
+	Package         *string  `json:"package,omitempty"` // real crate name when renamed
+}
@@ -1,10 +1,20 @@
 package sidecar
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/index"
 )
 
 func writeIndexFile(t *testing.T, dir string, lines []string) string {
@@ -58,3 +68,466 @@ func TestProcessIndexFile_IncludeYankedAndLimit(t *testing.T) {
 		t.Fatalf("expected limit2==0, got %d", limit2.Remaining())
 	}
 }
+
+func TestProcessIndexFile_Gzip(t *testing.T) {
+	tmp := t.TempDir()
+	idx := filepath.Join(tmp, "index", "s", "se", "serde.gz")
+	if err := os.MkdirAll(filepath.Dir(idx), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`{"name":"serde","vers":"1.0.0","cksum":"ab","yanked":false}` + "\n"))
+	zw.Close()
+	if err := os.WriteFile(idx, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(tmp, "out")
+	if err := ProcessIndexFile(filepath.Join(tmp, "index"), idx, out, false, nil, "https://static.crates.io/crates", &counters{}); err != nil {
+		t.Fatalf("ProcessIndexFile err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(CrateDirFor("serde", out), "serde-1.0.0.crate.json")); err != nil {
+		t.Fatalf("expected sidecar from gzip index: %v", err)
+	}
+}
+
+func TestGenerateSkipsCorruptGzip(t *testing.T) {
+	idx := t.TempDir()
+	writeIndexFile(t, filepath.Join(idx, "se", "rd", "serde"), []string{`{"name":"serde","vers":"1.0.0"}`})
+	if err := os.MkdirAll(filepath.Join(idx, "b", "ad"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(idx, "b", "ad", "bad.gz"), []byte("\x1f\x8bnot gzip"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	stats, err := Generate(context.Background(), Config{IndexDir: idx, OutDir: out, Concurrency: 1, Precount: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Wrote != 1 || stats.InvalidFiles != 1 {
+		t.Fatalf("stats = %+v, want 1 written and 1 invalid file", stats)
+	}
+	if _, err := os.Stat(filepath.Join(CrateDirFor("serde", out), "serde-1.0.0.crate.json")); err != nil {
+		t.Fatalf("sidecar next to the corrupt shard missing: %v", err)
+	}
+	if _, err := Generate(context.Background(), Config{IndexDir: idx, OutDir: t.TempDir(), Concurrency: 1, Strict: true}); err == nil {
+		t.Fatal("strict run over a corrupt shard succeeded")
+	}
+}
+
+func TestProcessIndexFile_AllMalformedCountsInvalid(t *testing.T) {
+	tmp := t.TempDir()
+	idx := filepath.Join(tmp, "index", "b", "ro", "broke")
+	writeIndexFile(t, idx, []string{`{not json`, `{"name":"broke"}`})
+
+	ctrs := &counters{}
+	if err := ProcessIndexFile(filepath.Join(tmp, "index"), idx, filepath.Join(tmp, "out"), false, nil, "https://static.crates.io/crates", ctrs); err != nil {
+		t.Fatalf("ProcessIndexFile err: %v", err)
+	}
+	if got := ctrs.snapshot().InvalidFiles; got != 1 {
+		t.Fatalf("InvalidFiles = %d, want 1", got)
+	}
+}
+
+func TestGenerateStrictMalformedLine(t *testing.T) {
+	idx := t.TempDir()
+	writeIndexFile(t, filepath.Join(idx, "s", "er", "serde"), []string{
+		`{"name":"serde","vers":"1.0.0"}`,
+		`{"name":"serde","vers":`,
+		`{"name":"serde","vers":"1.0.2"}`,
+	})
+
+	stats, err := Generate(context.Background(), Config{IndexDir: idx, OutDir: t.TempDir(), Concurrency: 1})
+	if err != nil {
+		t.Fatalf("lenient: %v", err)
+	}
+	if stats.Wrote != 2 {
+		t.Fatalf("lenient wrote %d, want 2", stats.Wrote)
+	}
+
+	_, err = Generate(context.Background(), Config{IndexDir: idx, OutDir: t.TempDir(), Concurrency: 1, Strict: true})
+	var le *index.LineError
+	if !errors.As(err, &le) || le.File != "s/er/serde" || le.Line != 2 {
+		t.Fatalf("strict: got %v, want s/er/serde:2", err)
+	}
+}
+
+func TestGenerateWritesCrateChecksums(t *testing.T) {
+	idx := t.TempDir()
+	writeIndexFile(t, filepath.Join(idx, "s", "er", "serde"), []string{
+		`{"name":"serde","vers":"1.0.0","cksum":"AA"}`,
+		`{"name":"serde","vers":"1.0.1","cksum":"bb","yanked":true}`,
+		`{"name":"serde","vers":"1.0.2","cksum":"cc"}`,
+	})
+	out := t.TempDir()
+	if _, err := Generate(context.Background(), Config{IndexDir: idx, OutDir: out, Concurrency: 1, CrateChecksums: true}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(out, "s", "er", "serde.checksums.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]string
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["1.0.0"] != "aa" || got["1.0.2"] != "cc" {
+		t.Fatalf("checksums = %v", got)
+	}
+}
+
+func TestGenerateNameTemplateAndSubdir(t *testing.T) {
+	idx := t.TempDir()
+	sum := strings.Repeat("a", 64)
+	writeIndexFile(t, filepath.Join(idx, "s", "er", "serde"), []string{`{"name":"serde","vers":"1.0.0","cksum":"` + sum + `"}`})
+	out := t.TempDir()
+	cfg := Config{IndexDir: idx, OutDir: out, Concurrency: 1, NameTemplate: "{name}-{version}.json", Subdir: ".cache"}
+	if _, err := Generate(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "s", "er", ".cache", "serde-1.0.0.json")); err != nil {
+		t.Fatalf("templated sidecar missing: %v", err)
+	}
+	src, err := NewChecksumSource(Config{OutDir: out, NameTemplate: cfg.NameTemplate, Subdir: cfg.Subdir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := src.Checksum("serde", "1.0.0"); !ok || got != sum {
+		t.Fatalf("templated lookup = %q, %v; want %q", got, ok, sum)
+	}
+
+	for _, bad := range []Config{
+		{IndexDir: idx, OutDir: out, NameTemplate: "{name}.json"},
+		{IndexDir: idx, OutDir: out, NameTemplate: "x/{name}-{version}.json"},
+		{IndexDir: idx, OutDir: out, Subdir: "../escape"},
+	} {
+		if _, err := Generate(context.Background(), bad); err == nil {
+			t.Errorf("Generate(%+v) accepted an invalid naming config", bad)
+		}
+	}
+}
+
+func TestGeneratePrecount(t *testing.T) {
+	idx := t.TempDir()
+	writeIndexFile(t, filepath.Join(idx, "s", "er", "serde"), []string{
+		`{"name":"serde","vers":"1.0.0"}`,
+		"",
+		"# comment",
+		`{"name":"serde","vers":"1.0.1","yanked":true}`,
+	})
+	writeIndexFile(t, filepath.Join(idx, "3", "l", "log"), []string{`{"name":"log","vers":"0.4.0"}`})
+
+	stats, err := Generate(context.Background(), Config{IndexDir: idx, OutDir: t.TempDir(), Concurrency: 2, Precount: true, ProgressInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TotalEntries != 3 {
+		t.Fatalf("TotalEntries = %d, want 3", stats.TotalEntries)
+	}
+	if processed := stats.Wrote + stats.Skipped + stats.Errors; processed != stats.TotalEntries {
+		t.Fatalf("processed %d of %d precounted entries", processed, stats.TotalEntries)
+	}
+}
+
+func TestGenerateDepsGraph(t *testing.T) {
+	idx := t.TempDir()
+	writeIndexFile(t, filepath.Join(idx, "s", "er", "serde"), []string{
+		`{"name":"serde","vers":"1.0.0","deps":[{"name":"derive","package":"serde_derive","req":"=1.0.0","optional":true,"kind":null},{"name":"toml","req":"^0.5","kind":"dev"}]}`,
+		`{"name":"serde","vers":"0.9.0","yanked":true,"deps":[{"name":"old","req":"*"}]}`,
+		`{"name":"serde","vers":"1.0.1","deps":[]}`,
+	})
+	graph := filepath.Join(t.TempDir(), "deps-graph.jsonl")
+	if err := os.WriteFile(graph, []byte("stale\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := Generate(context.Background(), Config{IndexDir: idx, OutDir: t.TempDir(), Concurrency: 1, DepsGraph: graph})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.DepEdges != 2 {
+		t.Fatalf("DepEdges = %d, want 2", stats.DepEdges)
+	}
+	data, err := os.ReadFile(graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []DepEdge
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var e DepEdge
+		if err := json.Unmarshal(line, &e); err != nil {
+			t.Fatalf("bad graph line %q: %v", line, err)
+		}
+		got = append(got, e)
+	}
+	want := []DepEdge{
+		{From: "serde", FromVersion: "1.0.0", To: "serde_derive", Req: "=1.0.0", Kind: "normal", Optional: true},
+		{From: "serde", FromVersion: "1.0.0", To: "toml", Req: "^0.5", Kind: "dev"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("graph = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("edge %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestGenerateLimitResumesContiguously(t *testing.T) {
+	idx := t.TempDir()
+	// Shard paths sort differently from crate names on purpose.
+	writeIndexFile(t, filepath.Join(idx, "zz", "aa", "aaaa"), []string{`{"name":"aaaa","vers":"1.0.0"}`})
+	writeIndexFile(t, filepath.Join(idx, "yy", "bb", "bbbb"), []string{`{"name":"bbbb","vers":"1.0.0"}`, `{"name":"bbbb","vers":"1.1.0"}`})
+	writeIndexFile(t, filepath.Join(idx, "xx", "cc", "cccc"), []string{`{"name":"cccc","vers":"1.0.0"}`})
+	writeIndexFile(t, filepath.Join(idx, "ww", "dd", "dddd"), []string{`{"name":"dddd","vers":"1.0.0"}`})
+	out := t.TempDir()
+
+	var resume string
+	var wrote int64
+	var lasts []string
+	for run := 0; run < 4 && resume != "dddd"; run++ {
+		before := sidecarSet(t, out)
+		stats, err := Generate(context.Background(), Config{IndexDir: idx, OutDir: out, Concurrency: 1, Limit: 2, ResumeFrom: resume})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name := range sidecarSet(t, out) {
+			if before[name] {
+				continue
+			}
+			if resume != "" && name[:4] <= resume {
+				t.Errorf("run %d wrote %s at or before resume point %q", run, name, resume)
+			}
+		}
+		wrote += stats.Wrote
+		resume = stats.LastCrate
+		lasts = append(lasts, resume)
+	}
+	if want := []string{"aaaa", "cccc", "dddd"}; len(lasts) != len(want) || lasts[0] != want[0] || lasts[1] != want[1] || lasts[2] != want[2] {
+		t.Fatalf("LastCrate per run = %v, want %v", lasts, want)
+	}
+	if got := len(sidecarSet(t, out)); got != 5 || wrote != 5 {
+		t.Fatalf("sidecars = %d, wrote = %d; want every version written exactly once (5)", got, wrote)
+	}
+}
+
+func TestGenerateDepsGraphResumesAppending(t *testing.T) {
+	idx := t.TempDir()
+	dep := `"deps":[{"name":"libc","req":"^0.2"}]`
+	writeIndexFile(t, filepath.Join(idx, "aa", "aa", "aaaa"), []string{`{"name":"aaaa","vers":"1.0.0",` + dep + `}`})
+	writeIndexFile(t, filepath.Join(idx, "bb", "bb", "bbbb"), []string{`{"name":"bbbb","vers":"1.0.0",` + dep + `}`, `{"name":"bbbb","vers":"1.1.0",` + dep + `}`})
+	writeIndexFile(t, filepath.Join(idx, "cc", "cc", "cccc"), []string{`{"name":"cccc","vers":"1.0.0",` + dep + `}`})
+	writeIndexFile(t, filepath.Join(idx, "dd", "dd", "dddd"), []string{`{"name":"dddd","vers":"1.0.0",` + dep + `}`})
+	out := t.TempDir()
+	graph := filepath.Join(t.TempDir(), "deps-graph.jsonl")
+
+	// The first run stops inside bbbb; the two resumed runs must keep the
+	// edges before their resume point and not repeat bbbb's.
+	var resume string
+	for run := 0; run < 3; run++ {
+		stats, err := Generate(context.Background(), Config{IndexDir: idx, OutDir: out, Concurrency: 1, Limit: 2, ResumeFrom: resume, DepsGraph: graph})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resume = stats.LastCrate
+	}
+	if resume != "dddd" {
+		t.Fatalf("LastCrate after three runs = %q, want dddd", resume)
+	}
+	data, err := os.ReadFile(graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var e DepEdge
+		if err := json.Unmarshal(line, &e); err != nil {
+			t.Fatalf("bad graph line %q: %v", line, err)
+		}
+		got = append(got, e.From+"@"+e.FromVersion)
+	}
+	sort.Strings(got)
+	if want := "aaaa@1.0.0 bbbb@1.0.0 bbbb@1.1.0 cccc@1.0.0 dddd@1.0.0"; strings.Join(got, " ") != want {
+		t.Fatalf("graph edges = %v, want %s", got, want)
+	}
+}
+
+func sidecarSet(t *testing.T, dir string) map[string]bool {
+	t.Helper()
+	set := map[string]bool{}
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			set[d.Name()] = true
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func TestGenerateTempSuffix(t *testing.T) {
+	idx := t.TempDir()
+	writeIndexFile(t, filepath.Join(idx, "s", "er", "serde"), []string{`{"name":"serde","vers":"1.0.0"}`})
+	out := t.TempDir()
+	dir := CrateDirFor("tokio", out)
+	stale := []string{"tokio-1.0.0.crate.json.0badf00d.inprogress", "tokio-1.0.0.crate.json.inprogress"}
+	keep := []string{"tokio-1.0.0.crate.json.tmp", "notes.inprogress"}
+	old := time.Now().Add(-2 * DefaultTempMaxAge)
+	for _, name := range append(stale, keep...) {
+		writeIndexFile(t, filepath.Join(dir, name), nil)
+		if err := os.Chtimes(filepath.Join(dir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := Generate(context.Background(), Config{IndexDir: idx, OutDir: out, Concurrency: 1, TempSuffix: ".inprogress"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range stale {
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("stale temp %s not removed: %v", name, err)
+		}
+	}
+	for _, name := range keep {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("unrelated file %s removed: %v", name, err)
+		}
+	}
+	if _, err := Generate(context.Background(), Config{IndexDir: idx, OutDir: out, TempSuffix: "tmp"}); err == nil {
+		t.Error("accepted a temp suffix without a leading dot")
+	}
+}
+
+func TestGenerateSingleFileLayout(t *testing.T) {
+	path := writeIndexFile(t, filepath.Join(t.TempDir(), "index.jsonl"), []string{
+		`{"name":"serde","vers":"1.0.0","cksum":"AA"}`,
+		`{"name":"tokio","vers":"1.0.0","cksum":"bb"}`,
+	})
+	out := t.TempDir()
+	cfg := Config{IndexDir: path, OutDir: out, Concurrency: 1, CrateChecksums: true, Walk: index.Options{Layout: index.LayoutSingle}}
+	stats, err := Generate(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Wrote != 2 {
+		t.Fatalf("wrote %d sidecars, want 2", stats.Wrote)
+	}
+	var doc map[string]any
+	data, err := os.ReadFile(filepath.Join(CrateDirFor("tokio", out), "tokio-1.0.0.crate.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &doc); err != nil || doc["index_path"] != "index.jsonl" {
+		t.Fatalf("index_path = %v (err %v), want index.jsonl", doc["index_path"], err)
+	}
+	for crate, want := range map[string]string{"serde": `{"1.0.0":"aa"}`, "tokio": `{"1.0.0":"bb"}`} {
+		data, err := os.ReadFile(filepath.Join(CrateDirFor(crate, out), crate+".checksums.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got, exp map[string]string
+		json.Unmarshal(data, &got)
+		json.Unmarshal([]byte(want), &exp)
+		if len(got) != 1 || got["1.0.0"] != exp["1.0.0"] {
+			t.Errorf("%s checksums = %v, want %v", crate, got, exp)
+		}
+	}
+}
+
+func TestGenerateStampAndUpdate(t *testing.T) {
+	idx := t.TempDir()
+	writeIndexFile(t, filepath.Join(idx, "s", "er", "serde"), []string{`{"name":"serde","vers":"1.0.0"}`})
+	out := t.TempDir()
+	path := filepath.Join(CrateDirFor("serde", out), "serde-1.0.0.crate.json")
+	read := func() map[string]any {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc map[string]any
+		if err := json.Unmarshal(data, &doc); err != nil {
+			t.Fatal(err)
+		}
+		return doc
+	}
+
+	cfg := Config{IndexDir: idx, OutDir: out, Concurrency: 1, Stamp: true}
+	start := time.Now().Add(-time.Second)
+	if _, err := Generate(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	doc := read()
+	at, err := time.Parse(time.RFC3339, fmt.Sprint(doc["generated_at"]))
+	if err != nil || at.Before(start.Truncate(time.Second)) {
+		t.Fatalf("generated_at = %v (err %v), want a recent RFC3339 time", doc["generated_at"], err)
+	}
+	if v, _ := doc["generator_version"].(string); v == "" || v != Version() {
+		t.Fatalf("generator_version = %v, want %q", doc["generator_version"], Version())
+	}
+
+	// Backdate the stamp; a plain run keeps it and -update refreshes it.
+	doc["generated_at"] = "2001-01-01T00:00:00Z"
+	data, _ := json.Marshal(doc)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Generate(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := read()["generated_at"]; got != "2001-01-01T00:00:00Z" {
+		t.Fatalf("run without update rewrote generated_at to %v", got)
+	}
+	cfg.Update = true
+	stats, err := Generate(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Wrote != 1 {
+		t.Fatalf("update wrote %d sidecars, want 1", stats.Wrote)
+	}
+	if at, err := time.Parse(time.RFC3339, fmt.Sprint(read()["generated_at"])); err != nil || at.Year() == 2001 {
+		t.Fatalf("update left generated_at at %v (err %v)", at, err)
+	}
+}
+
+func TestScanIndexStats(t *testing.T) {
+	idx := t.TempDir()
+	writeIndexFile(t, filepath.Join(idx, "s", "er", "serde"), []string{
+		`{"name":"serde","vers":"1.0.0","cksum":"ab","yanked":false}`,
+		`{"name":"serde","vers":"1.0.1","cksum":"cd","yanked":true}`,
+		`not json`,
+	})
+	writeIndexFile(t, filepath.Join(idx, "s", "ha", "sha2"), []string{
+		`{"name":"sha2","vers":"0.10.0","cksum":"ef","yanked":false}`,
+	})
+	writeIndexFile(t, filepath.Join(idx, "2", "ab"), []string{
+		`{"name":"ab","vers":"0.1.0","cksum":"01","yanked":true}`,
+		`{"name":"ab","vers":"0.2.0","cksum":"02","yanked":false}`,
+	})
+	out := filepath.Join(t.TempDir(), "out")
+	st, err := ScanIndex(context.Background(), Config{IndexDir: idx, OutDir: out, Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Files != 3 || st.Crates != 3 || st.Versions != 5 || st.Yanked != 2 || st.Malformed != 1 {
+		t.Fatalf("stats = %+v, want 3 files, 3 crates, 5 versions, 2 yanked, 1 malformed", st)
+	}
+	if st.ByLetter["s"] != 2 || st.ByLetter["a"] != 1 || len(st.ByLetter) != 2 {
+		t.Fatalf("by letter = %v, want a:1 s:2", st.ByLetter)
+	}
+	var buf bytes.Buffer
+	st.Print(&buf)
+	want := "files=3 crates=3 versions=5 yanked=2 yanked_ratio=0.4000 malformed=1\nfirst_letter=a crates=1\nfirst_letter=s crates=2\n"
+	if buf.String() != want {
+		t.Fatalf("Print:\n%s\nwant:\n%s", buf.String(), want)
+	}
+	if _, err := os.Stat(out); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("scan created the out dir: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package sidecar
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/fsinfo"
+)
+
+// ErrLowInodes is returned by Generate when writing the estimated number of
+// sidecars would leave fewer than Config.MinFreeInodes inodes free.
+var ErrLowInodes = errors.New("not enough free inodes")
+
+// diskUsage is fsinfo.DiskUsage; tests replace it.
+var diskUsage = fsinfo.DiskUsage
+
+// checkFreeInodes compares the free inodes of the filesystem holding dir
+// with want, the files the run is estimated to create. Below min (when > 0)
+// it fails with ErrLowInodes; otherwise it only warns when want exceeds what
+// is free. Filesystems that cannot report inodes are not checked.
+func checkFreeInodes(dir string, want, min int64) error {
+	u, err := diskUsage(dir)
+	if err == nil && !u.HasInodes {
+		err = fsinfo.ErrUnsupported
+	}
+	if err != nil {
+		slog.Warn("sidecar_inode_check_skipped", "out", dir, "err", err)
+		return nil
+	}
+	left := int64(u.FreeInodes) - want
+	if min > 0 && left < min {
+		return fmt.Errorf("%w on %s: %d free, about %d sidecars to write, want %d left over", ErrLowInodes, dir, u.FreeInodes, want, min)
+	}
+	if left < 0 {
+		slog.Warn("sidecar_low_inodes", "out", dir, "free_inodes", u.FreeInodes, "estimated_files", want,
+			"hint", "the run will likely fail part-way; free inodes or set -min-free-inodes to abort up front")
+	}
+	return nil
+}
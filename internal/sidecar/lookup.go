@@ -0,0 +1,59 @@
+package sidecar
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ChecksumSource reads cksum values back out of an existing sidecar tree, so
+// the downloader can verify crates without re-walking the index.
+type ChecksumSource struct {
+	cfg Config
+}
+
+// NewChecksumSource looks up sidecars under cfg.OutDir using the same
+// NameTemplate, Subdir and NormalizeCase settings they were written with.
+func NewChecksumSource(cfg Config) (*ChecksumSource, error) {
+	if cfg.OutDir == "" {
+		return nil, errors.New("sidecar dir is required")
+	}
+	if err := normalizeNaming(&cfg); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(cfg.OutDir); err != nil {
+		return nil, err
+	}
+	return &ChecksumSource{cfg: cfg}, nil
+}
+
+// Checksum returns the cksum recorded for name@vers. ok is false when the
+// sidecar is missing, unreadable or has no cksum.
+func (s *ChecksumSource) Checksum(name, vers string) (sum string, ok bool) {
+	fileName := name
+	if s.cfg.NormalizeCase {
+		fileName = strings.ToLower(name)
+	}
+	path := filepath.Join(sidecarDir(s.cfg, fileName), sidecarName(s.cfg, fileName, vers))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("sidecar read failed", "path", path, "err", err)
+		}
+		return "", false
+	}
+	var doc struct {
+		Cksum string `json:"cksum"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		slog.Warn("sidecar parse failed", "path", path, "err", err)
+		return "", false
+	}
+	if doc.Cksum == "" {
+		return "", false
+	}
+	return strings.ToLower(doc.Cksum), true
+}
@@ -0,0 +1,147 @@
+package sidecar
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultNameTemplate is the sidecar file name used unless Config.NameTemplate is set.
+const DefaultNameTemplate = "{name}-{version}.crate.json"
+
+// DefaultTempSuffix ends the names of sidecars being written, unless
+// Config.TempSuffix is set.
+const DefaultTempSuffix = ".tmp"
+
+// DefaultTempMaxAge is how long a sidecar temp file must go unmodified before
+// startup cleanup removes it, unless Config.TempMaxAge is set.
+const DefaultTempMaxAge = time.Hour
+
+// normalizeNaming fills in the default template and rejects templates or
+// subdirectories that would write outside the crate directory.
+func normalizeNaming(cfg *Config) error {
+	if cfg.NameTemplate == "" {
+		cfg.NameTemplate = DefaultNameTemplate
+	}
+	t := cfg.NameTemplate
+	if !strings.Contains(t, "{name}") || !strings.Contains(t, "{version}") {
+		return fmt.Errorf("sidecar name template %q must contain {name} and {version}", t)
+	}
+	if strings.ContainsAny(t, `/\`) {
+		return fmt.Errorf("sidecar name template %q must not contain path separators; use the subdir option", t)
+	}
+	if cfg.Subdir != "" && !filepath.IsLocal(cfg.Subdir) {
+		return fmt.Errorf("sidecar subdir %q must be a relative path inside the crate directory", cfg.Subdir)
+	}
+	if cfg.TempSuffix == "" {
+		cfg.TempSuffix = DefaultTempSuffix
+	}
+	if len(cfg.TempSuffix) < 2 || cfg.TempSuffix[0] != '.' || strings.ContainsAny(cfg.TempSuffix, `/\`) {
+		return fmt.Errorf("temp suffix %q must start with a dot and not contain path separators", cfg.TempSuffix)
+	}
+	return nil
+}
+
+// sidecarDir is where sidecars for crate fileName are written.
+func sidecarDir(cfg Config, fileName string) string {
+	return filepath.Join(CrateDirFor(fileName, cfg.OutDir), cfg.Subdir)
+}
+
+// sidecarName expands cfg.NameTemplate for one version.
+func sidecarName(cfg Config, fileName, vers string) string {
+	t := cfg.NameTemplate
+	if t == "" {
+		t = DefaultNameTemplate
+	}
+	return strings.NewReplacer("{name}", fileName, "{version}", vers).Replace(t)
+}
+
+// tempPath returns a unique temp name for outPath. The random token keeps
+// concurrent writers of the same target from sharing a temp file.
+func tempPath(cfg Config, outPath string) string {
+	suffix := cfg.TempSuffix
+	if suffix == "" {
+		suffix = DefaultTempSuffix
+	}
+	return fmt.Sprintf("%s.%08x%s", outPath, rand.Uint32(), suffix)
+}
+
+// createTemp creates a new, empty temp file for outPath. The file is opened
+// exclusively, so two workers writing the same target never share one; a
+// taken token is replaced by a fresh one.
+func createTemp(cfg Config, outPath string) (*os.File, error) {
+	for range 100 {
+		f, err := os.OpenFile(tempPath(cfg, outPath), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+		if !errors.Is(err, fs.ErrExist) {
+			return f, err
+		}
+	}
+	return nil, fmt.Errorf("no unused temp name for %s", outPath)
+}
+
+// writeAtomic replaces outPath with data via a temp file from createTemp and
+// a rename. Concurrent writers of one target each land whole; the last
+// rename wins.
+func writeAtomic(cfg Config, outPath string, data []byte) error {
+	f, err := createTemp(cfg, outPath)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), outPath)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// staleTemp reports whether name is a temp file this configuration writes,
+// with or without the random token, for cleanStaleTemps.
+func staleTemp(cfg Config) func(name string) bool {
+	suffix := cfg.TempSuffix
+	if suffix == "" {
+		suffix = DefaultTempSuffix
+	}
+	finals := []string{".checksums.json"}
+	t := cfg.NameTemplate
+	if i := strings.LastIndex(t, "}"); i >= 0 && i+1 < len(t) {
+		finals = append(finals, t[i+1:])
+	}
+	return func(name string) bool {
+		rest, ok := strings.CutSuffix(name, suffix)
+		if !ok {
+			return false
+		}
+		if i := strings.LastIndex(rest, "."); i >= 0 && isTempToken(rest[i+1:]) {
+			rest = rest[:i]
+		}
+		for _, f := range finals {
+			if strings.HasSuffix(rest, f) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func isTempToken(s string) bool {
+	if len(s) != 8 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+package sidecar
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/index"
+)
+
+// precountEntries counts the non-blank, non-comment lines of files without
+// parsing them, so progress can be reported against a known total. Files
+// that cannot be read count the lines read before the error; the main pass
+// reports them.
+func precountEntries(ctx context.Context, files []string, concurrency int) (int64, error) {
+	var total atomic.Int64
+	err := forEachFile(ctx, files, concurrency, func(path string) error {
+		n, err := countEntryLines(path)
+		if err != nil {
+			slog.Debug("precount: index file unreadable", "file", path, "err", err)
+		}
+		total.Add(n)
+		return nil
+	})
+	return total.Load(), err
+}
+
+// forEachFile runs fn over files on concurrency workers. It returns the first
+// error, or the context's, after every started call has finished.
+func forEachFile(ctx context.Context, files []string, concurrency int, fn func(path string) error) error {
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	jobs := make(chan string)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				if err := fn(path); err != nil {
+					errOnce.Do(func() { firstErr = err })
+				}
+			}
+		}()
+	}
+loop:
+	for _, f := range files {
+		select {
+		case <-ctx.Done():
+			break loop
+		case jobs <- f:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
+
+func countEntryLines(path string) (int64, error) {
+	f, err := index.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var n int64
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) > 0 && line[0] != '#' {
+			n++
+		}
+	}
+	return n, s.Err()
+}
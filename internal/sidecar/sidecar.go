@@ -2,6 +2,7 @@ package sidecar
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -11,9 +12,12 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/index"
 )
 
 type Config struct {
@@ -23,8 +27,47 @@ type Config struct {
 	Limit            int64
 	Concurrency      int
 	BaseURL          string
+	PublicBaseURL    string // if set, also write public_url under this base; crate_url stays the fetch URL
 	ProgressInterval time.Duration
 	ProgressEvery    int
+	NormalizeCase    bool // lowercase crate names in shard dirs and sidecar file names
+	Strict           bool // fail on the first malformed or schema-invalid index line or unreadable index file
+	CrateChecksums   bool // also write {crate}.checksums.json (version -> cksum) per crate
+	VerifyURLs       int  // HEAD-check this many sampled crate_urls before writing (0 = off)
+	// NameTemplate names sidecar files using {name} and {version};
+	// empty means DefaultNameTemplate.
+	NameTemplate string
+	// Subdir places sidecars in this directory relative to the crate's shard directory.
+	Subdir string
+	// Precount reads the index once up front to count entries, so progress
+	// logs can show a percentage and ETA.
+	Precount bool
+	// MinFreeInodes makes Generate fail with ErrLowInodes before writing
+	// anything if the out dir's filesystem would have fewer inodes than this
+	// left after one new file per index entry (counted with an extra read of
+	// the index unless Precount is set). 0 only warns, and only with Precount.
+	MinFreeInodes int64
+	// DepsGraph, if set, is a JSONL file that Generate rewrites with one
+	// DepEdge per dependency of every entry that passes the filters. With
+	// ResumeFrom it is appended to instead, continuing the earlier run's.
+	DepsGraph string
+	// ResumeFrom skips crates whose name sorts at or before it; pass the
+	// LastCrate of an interrupted or limited run to continue after it.
+	ResumeFrom string
+	// TempSuffix ends the names of files being written; empty means
+	// DefaultTempSuffix. A random token precedes it to keep names unique.
+	TempSuffix string
+	// TempMaxAge is how long a temp file must go unmodified before startup
+	// cleanup removes it as left behind by a crashed run; 0 means
+	// DefaultTempMaxAge. Younger temps may belong to a concurrent writer.
+	TempMaxAge time.Duration
+	// Stamp adds generated_at and generator_version to every sidecar written.
+	Stamp bool
+	// Update rewrites sidecars that already exist instead of skipping them.
+	Update bool
+	Walk   index.Options
+
+	deps *depsSink
 }
 
 type Stats struct {
@@ -32,25 +75,50 @@ type Stats struct {
 	Wrote        int64
 	Skipped      int64
 	Errors       int64
-	Duration     time.Duration
+	InvalidFiles int64 // index files without a single valid (name, vers) line, or that could not be read or decompressed
+	TotalEntries int64 // entries counted by Config.Precount (0 if not run)
+	DepEdges     int64 // lines written to Config.DepsGraph
+	// LastCrate is the last crate, in name order, up to which every index
+	// file was fully processed; use it as Config.ResumeFrom for the next run.
+	LastCrate string
+	Duration  time.Duration
+	// EmptyFiles lists index files (relative to IndexDir) that produced no
+	// sidecar candidates, either because they hold no entries or because
+	// filters excluded every entry. Only filled in by Generate.
+	EmptyFiles []string
 }
 
 type counters struct {
-	mu      sync.Mutex
-	total   int64
-	wrote   int64
-	skipped int64
-	errors  int64
+	mu         sync.Mutex
+	total      int64
+	wrote      int64
+	skipped    int64
+	errors     int64
+	invalid    int64
+	emptyFiles []string
 }
 
 func (c *counters) addTotal(n int64) { c.mu.Lock(); c.total += n; c.mu.Unlock() }
 func (c *counters) incWrote()        { c.mu.Lock(); c.wrote++; c.mu.Unlock() }
 func (c *counters) incSkipped()      { c.mu.Lock(); c.skipped++; c.mu.Unlock() }
 func (c *counters) incErrors()       { c.mu.Lock(); c.errors++; c.mu.Unlock() }
+func (c *counters) incInvalid()      { c.mu.Lock(); c.invalid++; c.mu.Unlock() }
+func (c *counters) addEmptyFile(rel string) {
+	c.mu.Lock()
+	c.emptyFiles = append(c.emptyFiles, rel)
+	c.mu.Unlock()
+}
+func (c *counters) sortedEmptyFiles() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := append([]string(nil), c.emptyFiles...)
+	sort.Strings(out)
+	return out
+}
 func (c *counters) snapshot() Stats {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return Stats{FilesScanned: c.total, Wrote: c.wrote, Skipped: c.skipped, Errors: c.errors}
+	return Stats{FilesScanned: c.total, Wrote: c.wrote, Skipped: c.skipped, Errors: c.errors, InvalidFiles: c.invalid}
 }
 
 type LimitCounter struct {
@@ -110,6 +178,9 @@ func Generate(ctx context.Context, cfg Config) (Stats, error) {
 	if cfg.BaseURL == "" {
 		cfg.BaseURL = "https://static.crates.io/crates"
 	}
+	if err := normalizeNaming(&cfg); err != nil {
+		return Stats{}, err
+	}
 
 	concurrency := cfg.Concurrency
 	if concurrency <= 0 {
@@ -119,48 +190,54 @@ func Generate(ctx context.Context, cfg Config) (Stats, error) {
 		concurrency = 1024
 	}
 
-	var files []string
-	if err := filepath.Walk(cfg.IndexDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			name := info.Name()
-			if name == ".git" || name == ".github" || name == ".gitignore" {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-		if !info.Mode().IsRegular() {
-			return nil
-		}
-		bn := info.Name()
-		if bn == "config.json" || strings.EqualFold(bn, "README.md") || strings.HasSuffix(bn, ".keep") {
-			return nil
-		}
-		files = append(files, path)
-		return nil
-	}); err != nil {
+	files, err := indexFiles(cfg)
+	if err != nil {
 		return Stats{}, err
 	}
+	if cfg.ResumeFrom != "" {
+		skip := sort.Search(len(files), func(i int) bool { return indexCrateName(files[i]) > cfg.ResumeFrom })
+		files = files[skip:]
+		slog.Info("sidecar_resume", "after", cfg.ResumeFrom, "skipped_files", skip, "remaining_files", len(files))
+		if len(files) == 0 {
+			return Stats{LastCrate: cfg.ResumeFrom}, nil
+		}
+	}
 
-	if len(files) == 0 {
-		return Stats{}, fmt.Errorf("no index files found under %s", cfg.IndexDir)
+	if cfg.VerifyURLs > 0 {
+		if err := verifyURLs(ctx, cfg, files, cfg.VerifyURLs); err != nil {
+			return Stats{}, err
+		}
 	}
 
 	if err := os.MkdirAll(cfg.OutDir, 0o755); err != nil {
 		return Stats{}, err
 	}
+	if err := cleanStaleTemps(cfg); err != nil {
+		return Stats{}, err
+	}
+	if cfg.DepsGraph != "" {
+		sink, err := openDepsSink(cfg.DepsGraph, cfg.ResumeFrom)
+		if err != nil {
+			return Stats{}, fmt.Errorf("deps graph: %w", err)
+		}
+		cfg.deps = sink
+		defer sink.close()
+	}
 
-	jobs := make(chan string, sidecarMax(1024, concurrency*2))
+	jobs := make(chan int, sidecarMax(1024, concurrency*2))
 	var wg sync.WaitGroup
 	ctrs := &counters{}
+	// done[i] marks files[i] as fully processed, for Stats.LastCrate.
+	var doneMu sync.Mutex
+	done := make([]bool, len(files))
 	var limitBudget *LimitCounter
 	if cfg.Limit > 0 {
 		limitBudget = NewLimitCounter(cfg.Limit)
 	}
 
 	errCh := make(chan error, concurrency)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	worker := func() {
 		defer wg.Done()
@@ -168,22 +245,30 @@ func Generate(ctx context.Context, cfg Config) (Stats, error) {
 			select {
 			case <-ctx.Done():
 				return
-			case path, ok := <-jobs:
+			case i, ok := <-jobs:
 				if !ok {
 					return
 				}
 				if limitBudget != nil && limitBudget.Remaining() <= 0 {
 					continue
 				}
-				if err := ProcessIndexFile(cfg.IndexDir, path, cfg.OutDir, cfg.IncludeYanked, limitBudget, cfg.BaseURL, ctrs); err != nil {
-					if errors.Is(err, ErrLimitReached) {
-						return
-					}
+				err := processIndexFile(cfg, files[i], limitBudget, ctrs)
+				if errors.Is(err, ErrLimitReached) {
+					return
+				}
+				doneMu.Lock()
+				done[i] = true
+				doneMu.Unlock()
+				if err != nil {
 					ctrs.incErrors()
 					select {
 					case errCh <- err:
 					default:
 					}
+					if cfg.Strict {
+						cancel()
+						return
+					}
 				}
 			}
 		}
@@ -194,6 +279,31 @@ func Generate(ctx context.Context, cfg Config) (Stats, error) {
 		go worker()
 	}
 
+	var totalEntries int64
+	if cfg.Precount {
+		pcStart := time.Now()
+		n, err := precountEntries(ctx, files, concurrency)
+		if err != nil {
+			return Stats{}, fmt.Errorf("precount: %w", err)
+		}
+		totalEntries = n
+		slog.Info("sidecar_precount", "entries", n, "files", len(files), "elapsed", time.Since(pcStart).String())
+	}
+	if cfg.Precount || cfg.MinFreeInodes > 0 {
+		want := totalEntries
+		if !cfg.Precount {
+			if want, err = precountEntries(ctx, files, concurrency); err != nil {
+				return Stats{}, fmt.Errorf("inode check: %w", err)
+			}
+		}
+		if cfg.Limit > 0 && want > cfg.Limit {
+			want = cfg.Limit
+		}
+		if err := checkFreeInodes(cfg.OutDir, want, cfg.MinFreeInodes); err != nil {
+			return Stats{}, err
+		}
+	}
+
 	start := time.Now()
 	if cfg.ProgressInterval > 0 || cfg.ProgressEvery > 0 {
 		interval := cfg.ProgressInterval
@@ -219,24 +329,32 @@ func Generate(ctx context.Context, cfg Config) (Stats, error) {
 					if elapsed > 0 {
 						rate = float64(processed) / elapsed.Seconds()
 					}
-					slog.Info("sidecar_progress", "processed", processed, "wrote", snap.Wrote, "skipped", snap.Skipped, "errors", snap.Errors, "files_scanned", snap.FilesScanned, "elapsed", elapsed.String(), "rate_per_sec", fmt.Sprintf("%.1f", rate))
+					attrs := []any{"processed", processed, "wrote", snap.Wrote, "skipped", snap.Skipped, "errors", snap.Errors, "files_scanned", snap.FilesScanned, "elapsed", elapsed.String(), "rate_per_sec", fmt.Sprintf("%.1f", rate)}
+					if totalEntries > 0 {
+						attrs = append(attrs, "total", totalEntries, "percent", fmt.Sprintf("%.1f", 100*float64(processed)/float64(totalEntries)))
+						if rate > 0 && processed < totalEntries {
+							eta := time.Duration(float64(totalEntries-processed) / rate * float64(time.Second))
+							attrs = append(attrs, "eta", eta.Round(time.Second).String())
+						}
+					}
+					slog.Info("sidecar_progress", attrs...)
 					lastReported = processed
 				}
 			}
 		}()
 	}
 
-	slog.Info("sidecar_start", "files", len(files), "concurrency", concurrency, "out", cfg.OutDir)
+	slog.Info("sidecar_start", "files", len(files), "concurrency", concurrency, "out", cfg.OutDir, "total_entries", totalEntries)
 
 loop:
-	for _, f := range files {
+	for i := range files {
 		if limitBudget != nil && limitBudget.Remaining() <= 0 {
 			break
 		}
 		select {
 		case <-ctx.Done():
 			break loop
-		case jobs <- f:
+		case jobs <- i:
 		}
 	}
 	close(jobs)
@@ -252,28 +370,84 @@ loop:
 
 	stats := ctrs.snapshot()
 	stats.Duration = time.Since(start)
-	slog.Info("sidecar_done", "wrote", stats.Wrote, "skipped", stats.Skipped, "errors", stats.Errors, "files_scanned", stats.FilesScanned, "elapsed", stats.Duration.String())
+	stats.EmptyFiles = ctrs.sortedEmptyFiles()
+	stats.TotalEntries = totalEntries
+	stats.LastCrate = cfg.ResumeFrom
+	for i, ok := range done {
+		if !ok {
+			break
+		}
+		stats.LastCrate = indexCrateName(files[i])
+	}
+	if cfg.deps != nil {
+		n, err := cfg.deps.close()
+		if err != nil {
+			return stats, fmt.Errorf("deps graph: %w", err)
+		}
+		stats.DepEdges = n
+	}
+	slog.Info("sidecar_done", "wrote", stats.Wrote, "skipped", stats.Skipped, "errors", stats.Errors, "files_scanned", stats.FilesScanned, "empty_files", len(stats.EmptyFiles), "invalid_files", stats.InvalidFiles, "dep_edges", stats.DepEdges, "last_crate", stats.LastCrate, "elapsed", stats.Duration.String())
 	return stats, nil
 }
 
+// indexFiles lists the index files selected by cfg.Walk in crate name order,
+// so a limited run covers a contiguous range that the next run can resume
+// after.
+func indexFiles(cfg Config) ([]string, error) {
+	if err := cfg.Walk.Validate(); err != nil {
+		return nil, err
+	}
+	var files []string
+	if err := index.Walk(cfg.IndexDir, cfg.Walk, func(path string) error {
+		files = append(files, path)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no index files found under %s", cfg.IndexDir)
+	}
+	sort.Slice(files, func(i, j int) bool { return indexCrateName(files[i]) < indexCrateName(files[j]) })
+	return files, nil
+}
+
+// indexCrateName returns the crate an index file describes: its base name
+// without a .gz suffix.
+func indexCrateName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".gz")
+}
+
 // ProcessIndexFile reads one index file and writes sidecar JSON documents for each version entry.
 func ProcessIndexFile(indexRoot, indexPath, outDir string, includeYanked bool, limit *LimitCounter, baseURL string, ctrs *counters) error {
-	f, err := os.Open(indexPath)
+	cfg := Config{IndexDir: indexRoot, OutDir: outDir, IncludeYanked: includeYanked, BaseURL: baseURL}
+	return processIndexFile(cfg, indexPath, limit, ctrs)
+}
+
+func processIndexFile(cfg Config, indexPath string, limit *LimitCounter, ctrs *counters) error {
+	relIndex := index.RelPath(cfg.IndexDir, indexPath)
+	f, err := index.Open(indexPath)
 	if err != nil {
-		return err
+		if cfg.Strict {
+			return err
+		}
+		slog.Warn("index file unreadable, skipping", "file", relIndex, "err", err)
+		ctrs.addEmptyFile(relIndex)
+		ctrs.incInvalid()
+		return nil
 	}
 	defer f.Close()
 
-	relIndex := indexPath
-	if rel, err := filepath.Rel(indexRoot, indexPath); err == nil {
-		relIndex = filepath.ToSlash(rel)
+	var sums *crateSums
+	if cfg.CrateChecksums {
+		sums = &crateSums{crates: map[string]map[string]string{}}
 	}
-
+	emitted, valid, lineNo := 0, 0, 0
 	s := bufio.NewScanner(f)
 	buf := make([]byte, 0, 1024*1024)
 	s.Buffer(buf, 64*1024*1024)
 
 	for s.Scan() {
+		lineNo++
 		line := strings.TrimSpace(s.Text())
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
@@ -284,91 +458,248 @@ func ProcessIndexFile(indexRoot, indexPath, outDir string, includeYanked bool, l
 			return ErrLimitReached
 		}
 
-		var m map[string]any
-		if err := json.Unmarshal([]byte(line), &m); err != nil {
-			ctrs.incErrors()
-			continue
+		kind, err := writeEntry(cfg, relIndex, []byte(line), limit, ctrs, sums)
+		if err != nil {
+			if kind == entryMalformed || kind == entryInvalid {
+				return &index.LineError{File: relIndex, Line: lineNo, Err: err}
+			}
+			if errors.Is(err, ErrLimitReached) {
+				writeCrateSums(cfg, sums, ctrs)
+			}
+			return err
 		}
-		name, _ := m["name"].(string)
-		vers, _ := m["vers"].(string)
-		if name == "" || vers == "" {
-			ctrs.incSkipped()
-			continue
+		switch kind {
+		case entryEmitted:
+			emitted++
+			valid++
+		case entryFiltered:
+			valid++
 		}
-		if !includeYanked {
-			if y, ok := m["yanked"].(bool); ok && y {
-				ctrs.incSkipped()
-				continue
-			}
+	}
+	damaged := false
+	if err := s.Err(); err != nil && !errors.Is(err, io.EOF) {
+		if cfg.Strict {
+			return fmt.Errorf("%s: %w", relIndex, err)
+		}
+		// Keep the sidecars written before the damage, but count the file.
+		slog.Warn("index file unreadable, skipping the rest", "file", relIndex, "line", lineNo, "err", err)
+		damaged = true
+	}
+	writeCrateSums(cfg, sums, ctrs)
+	if emitted == 0 {
+		slog.Debug("index file produced no entries", "file", relIndex)
+		ctrs.addEmptyFile(relIndex)
+		if valid == 0 && !damaged {
+			slog.Warn("index file has no valid entries", "file", relIndex)
 		}
+	}
+	if damaged || (emitted == 0 && valid == 0) {
+		ctrs.incInvalid()
+	}
+	return nil
+}
 
-		limitReserved := false
-		if limit != nil {
-			if !limit.Reserve() {
-				return ErrLimitReached
-			}
-			limitReserved = true
+// entryKind classifies one index line for empty/invalid file accounting.
+type entryKind int
+
+const (
+	entryMalformed entryKind = iota // not valid JSON
+	entryInvalid                    // JSON without name or vers
+	entryFiltered                   // valid but excluded, e.g. yanked
+	entryEmitted                    // passed filters; sidecar written or already present
+)
+
+// writeEntry writes the sidecar for one index line. Per-entry failures are
+// counted in ctrs rather than returned; only ErrLimitReached and, with
+// cfg.Strict, the reason a line was rejected are returned.
+func writeEntry(cfg Config, relIndex string, line []byte, limit *LimitCounter, ctrs *counters, sums *crateSums) (entryKind, error) {
+	var m map[string]any
+	if err := json.Unmarshal(line, &m); err != nil {
+		if cfg.Strict {
+			return entryMalformed, err
 		}
+		ctrs.incErrors()
+		return entryMalformed, nil
+	}
+	name, _ := m["name"].(string)
+	vers, _ := m["vers"].(string)
+	if name == "" || vers == "" {
+		if cfg.Strict {
+			return entryInvalid, index.ErrMissingField
+		}
+		ctrs.incSkipped()
+		return entryInvalid, nil
+	}
+	if !cfg.IncludeYanked {
+		if y, ok := m["yanked"].(bool); ok && y {
+			ctrs.incSkipped()
+			return entryFiltered, nil
+		}
+	}
 
-		dir := CrateDirFor(name, outDir)
-		if err := os.MkdirAll(dir, 0o755); err != nil {
-			if limitReserved {
-				limit.Release()
-			}
-			ctrs.incErrors()
-			continue
+	limitReserved := false
+	if limit != nil {
+		if !limit.Reserve() {
+			return entryEmitted, ErrLimitReached
+		}
+		limitReserved = true
+	}
+	cfg.deps.add(name, vers, m["deps"])
+	fail := func() (entryKind, error) {
+		if limitReserved {
+			limit.Release()
 		}
-		sidecarName := fmt.Sprintf("%s-%s.crate.json", name, vers)
-		outPath := filepath.Join(dir, sidecarName)
+		ctrs.incErrors()
+		return entryEmitted, nil
+	}
 
-		if _, err := os.Stat(outPath); err == nil {
-			if limitReserved {
-				limit.Release()
-			}
-			ctrs.incSkipped()
-			continue
+	fileName := name
+	if cfg.NormalizeCase {
+		fileName = strings.ToLower(name)
+	}
+	if sums != nil {
+		sums.add(fileName, vers, m["cksum"])
+	}
+	dir := sidecarDir(cfg, fileName)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fail()
+	}
+	outPath := filepath.Join(dir, sidecarName(cfg, fileName, vers))
+
+	if _, err := os.Stat(outPath); err == nil && !cfg.Update {
+		if limitReserved {
+			limit.Release()
 		}
+		ctrs.incSkipped()
+		return entryEmitted, nil
+	}
 
-		m["crate_file"] = fmt.Sprintf("%s-%s.crate", name, vers)
-		m["crate_url"] = fmt.Sprintf("%s/%s/%s-%s.crate", strings.TrimRight(baseURL, "/"), name, name, vers)
-		m["index_path"] = relIndex
+	m["crate_file"] = fmt.Sprintf("%s-%s.crate", fileName, vers)
+	m["crate_url"] = crateURL(cfg.BaseURL, name, vers)
+	if cfg.PublicBaseURL != "" {
+		m["public_url"] = crateURL(cfg.PublicBaseURL, name, vers)
+	}
+	m["index_path"] = relIndex
+	if cfg.Stamp {
+		m["generated_at"] = time.Now().UTC().Format(time.RFC3339)
+		m["generator_version"] = Version()
+	}
 
-		tmpPath := outPath + ".tmp"
-		of, err := os.Create(tmpPath)
-		if err != nil {
-			if limitReserved {
-				limit.Release()
-			}
-			ctrs.incErrors()
-			continue
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		return fail()
+	}
+	if err := writeAtomic(cfg, outPath, buf.Bytes()); err != nil {
+		return fail()
+	}
+	ctrs.incWrote()
+	return entryEmitted, nil
+}
+
+// crateSums accumulates version -> cksum per crate for one index file. In the
+// sharded layout that is a single crate; flat and single layouts mix crates.
+type crateSums struct {
+	crates map[string]map[string]string
+}
+
+func (c *crateSums) add(name, vers string, cksum any) {
+	if sum, ok := cksum.(string); ok && sum != "" {
+		if c.crates[name] == nil {
+			c.crates[name] = map[string]string{}
 		}
-		enc := json.NewEncoder(of)
-		enc.SetEscapeHTML(false)
-		enc.SetIndent("", "  ")
-		if err := enc.Encode(m); err != nil {
-			of.Close()
-			_ = os.Remove(tmpPath)
-			if limitReserved {
-				limit.Release()
-			}
-			ctrs.incErrors()
-			continue
+		c.crates[name][vers] = strings.ToLower(sum)
+	}
+}
+
+// writeCrateSums writes {crate}.checksums.json next to each crate's sidecars.
+// Crates share shard directories, so the crate name prefixes the file name.
+func writeCrateSums(cfg Config, sums *crateSums, ctrs *counters) {
+	if sums == nil {
+		return
+	}
+	for name, versions := range sums.crates {
+		outPath := filepath.Join(sidecarDir(cfg, name), name+".checksums.json")
+		data, err := json.MarshalIndent(versions, "", "  ")
+		if err == nil {
+			err = writeAtomic(cfg, outPath, append(data, '\n'))
 		}
-		of.Close()
-		if err := os.Rename(tmpPath, outPath); err != nil {
-			_ = os.Remove(tmpPath)
-			if limitReserved {
-				limit.Release()
-			}
+		if err != nil {
+			slog.Warn("crate checksums write failed", "crate", name, "err", err)
 			ctrs.incErrors()
-			continue
 		}
-		ctrs.incWrote()
 	}
-	if err := s.Err(); err != nil && !errors.Is(err, io.EOF) {
-		return err
+}
+
+// Writer writes sidecars for index lines supplied by a caller that already
+// walks the index, such as download-crates -with-sidecars.
+type Writer struct {
+	cfg  Config
+	ctrs *counters
+}
+
+// NewWriter prepares cfg.OutDir; cfg.IndexDir and cfg.Limit are not used.
+func NewWriter(cfg Config) (*Writer, error) {
+	if cfg.OutDir == "" {
+		return nil, errors.New("out dir is required")
 	}
-	return nil
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = "https://static.crates.io/crates"
+	}
+	if err := normalizeNaming(&cfg); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.OutDir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Writer{cfg: cfg, ctrs: &counters{}}, nil
+}
+
+// WriteLine writes the sidecar for one index line from relIndex (slash-separated,
+// relative to the index root). Failures are counted in Stats, not returned.
+func (w *Writer) WriteLine(relIndex string, line []byte) {
+	w.ctrs.addTotal(1)
+	_, _ = writeEntry(w.cfg, relIndex, line, nil, w.ctrs, nil)
+}
+
+// Stats returns the counters accumulated so far.
+func (w *Writer) Stats() Stats {
+	return w.ctrs.snapshot()
+}
+
+// cleanStaleTemps removes sidecar temp files that an interrupted run left
+// under cfg.OutDir and that are older than cfg.TempMaxAge. They are never
+// picked up again because the skip check only looks at final names.
+func cleanStaleTemps(cfg Config) error {
+	isTemp := staleTemp(cfg)
+	maxAge := cfg.TempMaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultTempMaxAge
+	}
+	cutoff := time.Now().Add(-maxAge)
+	removed := 0
+	err := filepath.WalkDir(cfg.OutDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isTemp(d.Name()) {
+			return nil
+		}
+		if fi, err := d.Info(); err != nil || fi.ModTime().After(cutoff) {
+			return nil // gone already, or possibly still being written
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if removed > 0 {
+		slog.Info("sidecar_tmp_cleanup", "removed", removed, "out", cfg.OutDir, "older_than", maxAge.String())
+	}
+	return err
 }
 
 // CrateDirFor mirrors the shard layout used for crate artifacts.
@@ -1,8 +1,20 @@
 package sidecar
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/fsinfo"
 )
 
 func TestSidecarCrateDirFor(t *testing.T) {
@@ -14,3 +26,212 @@ func TestSidecarCrateDirFor(t *testing.T) {
 		t.Fatalf("CrateDirFor short: got %q", got)
 	}
 }
+
+func TestGenerateRemovesStaleTemps(t *testing.T) {
+	tmp := t.TempDir()
+	idxRoot := filepath.Join(tmp, "index")
+	writeIndexFile(t, filepath.Join(idxRoot, "s", "se", "serde"), []string{
+		`{"name":"serde","vers":"1.0.0","cksum":"ab","yanked":false}`,
+	})
+	out := filepath.Join(tmp, "out")
+	stale := filepath.Join(CrateDirFor("tokio", out), "tokio-1.0.0.crate.json.tmp")
+	if err := os.MkdirAll(filepath.Dir(stale), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * DefaultTempMaxAge)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Generate(context.Background(), Config{IndexDir: idxRoot, OutDir: out, Concurrency: 1}); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if _, err := os.Stat(stale); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("stale tmp not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(CrateDirFor("serde", out), "serde-1.0.0.crate.json")); err != nil {
+		t.Fatalf("expected sidecar: %v", err)
+	}
+}
+
+func TestGenerateTempCleanupByAgeAndConcurrentWrites(t *testing.T) {
+	tmp := t.TempDir()
+	idxRoot := filepath.Join(tmp, "index")
+	writeIndexFile(t, filepath.Join(idxRoot, "s", "er", "serde"), []string{`{"name":"serde","vers":"1.0.0"}`})
+	out := filepath.Join(tmp, "out")
+	dir := CrateDirFor("tokio", out)
+	stale := filepath.Join(dir, "tokio-1.0.0.crate.json.0badf00d.tmp")
+	fresh := filepath.Join(dir, "tokio-1.0.1.crate.json.cafef00d.tmp")
+	writeIndexFile(t, stale, []string{"{"})
+	writeIndexFile(t, fresh, []string{"{"})
+	old := time.Now().Add(-10 * time.Minute)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Generate(context.Background(), Config{IndexDir: idxRoot, OutDir: out, Concurrency: 1, TempMaxAge: 5 * time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stale temp not removed: %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("recent temp of a possible concurrent writer removed: %v", err)
+	}
+
+	cfg := Config{TempSuffix: DefaultTempSuffix}
+	target := filepath.Join(t.TempDir(), "serde-1.0.0.crate.json")
+	want := map[string]bool{}
+	var wg sync.WaitGroup
+	for i := range 32 {
+		data := fmt.Sprintf("{\"writer\":%d,\"pad\":%q}\n", i, strings.Repeat("x", 64<<10))
+		want[data] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := writeAtomic(cfg, target, []byte(data)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	got, err := os.ReadFile(target)
+	if err != nil || !want[string(got)] {
+		t.Fatalf("target holds %d bytes not written whole by any writer: %v", len(got), err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(target))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("temp files left next to the target: %v %v", entries, err)
+	}
+}
+
+func TestGenerateReportsEmptyFiles(t *testing.T) {
+	tmp := t.TempDir()
+	idxRoot := filepath.Join(tmp, "index")
+	writeIndexFile(t, filepath.Join(idxRoot, "s", "se", "serde"), []string{`{"name":"serde","vers":"1.0.0"}`})
+	writeIndexFile(t, filepath.Join(idxRoot, "o", "ld", "oldie"), []string{`{"name":"oldie","vers":"0.1.0","yanked":true}`})
+
+	stats, err := Generate(context.Background(), Config{IndexDir: idxRoot, OutDir: filepath.Join(tmp, "out"), Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.EmptyFiles) != 1 || stats.EmptyFiles[0] != "o/ld/oldie" {
+		t.Fatalf("empty files = %v", stats.EmptyFiles)
+	}
+}
+
+func TestGenerateVerifyURLs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.Path != "/crates/serde/serde-1.0.0.crate" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	idx := t.TempDir()
+	p := filepath.Join(idx, "s", "er", "serde")
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(`{"name":"serde","vers":"1.0.0"}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{IndexDir: idx, OutDir: t.TempDir(), BaseURL: srv.URL + "/crates", VerifyURLs: DefaultVerifySample}
+	if _, err := Generate(context.Background(), cfg); err != nil {
+		t.Fatalf("good base URL: %v", err)
+	}
+
+	cfg.OutDir = t.TempDir()
+	cfg.BaseURL = srv.URL + "/typo"
+	if _, err := Generate(context.Background(), cfg); err == nil {
+		t.Fatal("expected wrong base URL to abort")
+	}
+	if entries, _ := os.ReadDir(cfg.OutDir); len(entries) != 0 {
+		t.Fatalf("wrote %d entries despite failed verification", len(entries))
+	}
+}
+
+func TestGeneratePublicURL(t *testing.T) {
+	tmp := t.TempDir()
+	idxRoot := filepath.Join(tmp, "index")
+	writeIndexFile(t, filepath.Join(idxRoot, "s", "er", "serde"), []string{`{"name":"serde","vers":"1.0.0"}`})
+	read := func(cfg Config) Document {
+		t.Helper()
+		cfg.IndexDir, cfg.OutDir = idxRoot, t.TempDir()
+		if _, err := Generate(context.Background(), cfg); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filepath.Join(CrateDirFor("serde", cfg.OutDir), "serde-1.0.0.crate.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc Document
+		if err := json.Unmarshal(b, &doc); err != nil {
+			t.Fatal(err)
+		}
+		return doc
+	}
+
+	doc := read(Config{BaseURL: "http://fetch.internal/crates-io/crates/", PublicBaseURL: "https://mirror.example/crates"})
+	if doc.CrateURL != "http://fetch.internal/crates-io/crates/serde/serde-1.0.0.crate" {
+		t.Errorf("crate_url = %s", doc.CrateURL)
+	}
+	if doc.PublicURL != "https://mirror.example/crates/serde/serde-1.0.0.crate" {
+		t.Errorf("public_url = %s", doc.PublicURL)
+	}
+	doc = read(Config{PublicBaseURL: "https://mirror.example/crates"})
+	if doc.CrateURL != "https://static.crates.io/crates/serde/serde-1.0.0.crate" || doc.PublicURL == "" {
+		t.Errorf("default crate_url with public_url: %+v", doc)
+	}
+	if doc := read(Config{}); doc.PublicURL != "" {
+		t.Errorf("public_url written without PublicBaseURL: %s", doc.PublicURL)
+	}
+}
+
+func TestCheckFreeInodes(t *testing.T) {
+	orig := diskUsage
+	defer func() { diskUsage = orig }()
+	usage := fsinfo.Usage{FreeInodes: 1000, TotalInodes: 5000, HasInodes: true}
+	diskUsage = func(string) (fsinfo.Usage, error) { return usage, nil }
+
+	for _, tc := range []struct {
+		want, min int64
+		fail      bool
+	}{
+		{want: 500, min: 0},
+		{want: 5000, min: 0}, // too few, but only warned about
+		{want: 500, min: 500},
+		{want: 500, min: 501, fail: true},
+		{want: 1500, min: 1, fail: true},
+	} {
+		err := checkFreeInodes("out", tc.want, tc.min)
+		if got := errors.Is(err, ErrLowInodes); got != tc.fail {
+			t.Errorf("want=%d min=%d: err %v, fail=%t expected", tc.want, tc.min, err, tc.fail)
+		}
+	}
+
+	usage.HasInodes = false
+	if err := checkFreeInodes("out", 5000, 1); err != nil {
+		t.Errorf("filesystem without inodes was checked: %v", err)
+	}
+
+	// Generate refuses to start, counting entries itself without -precount.
+	usage = fsinfo.Usage{FreeInodes: 2, HasInodes: true}
+	tmp := t.TempDir()
+	writeIndexFile(t, filepath.Join(tmp, "index", "s", "se", "serde"), []string{
+		`{"name":"serde","vers":"1.0.0","cksum":"ab","yanked":false}`,
+		`{"name":"serde","vers":"1.0.1","cksum":"cd","yanked":false}`,
+	})
+	out := filepath.Join(tmp, "out")
+	_, err := Generate(context.Background(), Config{IndexDir: filepath.Join(tmp, "index"), OutDir: out, MinFreeInodes: 1})
+	if !errors.Is(err, ErrLowInodes) {
+		t.Fatalf("Generate err %v, want ErrLowInodes", err)
+	}
+	if _, err := os.Stat(filepath.Join(CrateDirFor("serde", out), "serde-1.0.0.crate.json")); !os.IsNotExist(err) {
+		t.Fatalf("sidecar written despite the failed inode check (stat err %v)", err)
+	}
+}
@@ -0,0 +1,128 @@
+package sidecar
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/index"
+)
+
+// IndexStats summarizes an index without writing anything; see ScanIndex.
+type IndexStats struct {
+	Files     int64
+	Crates    int64            // distinct crate names (case-insensitive)
+	Versions  int64            // entries with a name and vers, yanked or not
+	Yanked    int64            // versions marked yanked
+	Malformed int64            // lines that are not JSON or lack name or vers
+	ByLetter  map[string]int64 // crates by the lowercased first character of their name
+}
+
+// YankedRatio is Yanked/Versions, or 0 for an empty index.
+func (s IndexStats) YankedRatio() float64 {
+	if s.Versions == 0 {
+		return 0
+	}
+	return float64(s.Yanked) / float64(s.Versions)
+}
+
+// Print writes a summary line followed by one line per first letter, in order.
+func (s IndexStats) Print(w io.Writer) {
+	fmt.Fprintf(w, "files=%d crates=%d versions=%d yanked=%d yanked_ratio=%.4f malformed=%d\n",
+		s.Files, s.Crates, s.Versions, s.Yanked, s.YankedRatio(), s.Malformed)
+	letters := make([]string, 0, len(s.ByLetter))
+	for l := range s.ByLetter {
+		letters = append(letters, l)
+	}
+	sort.Strings(letters)
+	for _, l := range letters {
+		fmt.Fprintf(w, "first_letter=%s crates=%d\n", l, s.ByLetter[l])
+	}
+}
+
+// ScanIndex walks the index selected by cfg.IndexDir and cfg.Walk and counts
+// crates and versions. Other Config fields are ignored and nothing is
+// written. A crate split across several files (flat or single layouts) is
+// counted once.
+func ScanIndex(ctx context.Context, cfg Config) (IndexStats, error) {
+	if cfg.IndexDir == "" {
+		return IndexStats{}, errors.New("index dir is required")
+	}
+	files, err := indexFiles(cfg)
+	if err != nil {
+		return IndexStats{}, err
+	}
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency()
+	}
+
+	var mu sync.Mutex
+	st := IndexStats{Files: int64(len(files)), ByLetter: map[string]int64{}}
+	crates := make(map[string]struct{})
+	err = forEachFile(ctx, files, concurrency, func(path string) error {
+		fs, names, err := scanIndexFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", index.RelPath(cfg.IndexDir, path), err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		st.Versions += fs.Versions
+		st.Yanked += fs.Yanked
+		st.Malformed += fs.Malformed
+		for name := range names {
+			if _, seen := crates[name]; seen {
+				continue
+			}
+			crates[name] = struct{}{}
+			r, _ := utf8.DecodeRuneInString(name)
+			st.ByLetter[string(r)]++
+		}
+		return nil
+	})
+	st.Crates = int64(len(crates))
+	return st, err
+}
+
+// scanIndexFile counts the versions of one index file and returns the
+// lowercased crate names it mentions.
+func scanIndexFile(path string) (IndexStats, map[string]struct{}, error) {
+	f, err := index.Open(path)
+	if err != nil {
+		return IndexStats{}, nil, err
+	}
+	defer f.Close()
+	var st IndexStats
+	names := make(map[string]struct{}, 1)
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		var e struct {
+			Name   string `json:"name"`
+			Vers   string `json:"vers"`
+			Yanked bool   `json:"yanked"`
+		}
+		if json.Unmarshal(line, &e) != nil || e.Name == "" || e.Vers == "" {
+			st.Malformed++
+			continue
+		}
+		st.Versions++
+		if e.Yanked {
+			st.Yanked++
+		}
+		names[strings.ToLower(e.Name)] = struct{}{}
+	}
+	return st, names, s.Err()
+}
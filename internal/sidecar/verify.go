@@ -0,0 +1,92 @@
+package sidecar
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/APTlantis/Mirror-Rust-Crates/internal/index"
+)
+
+// DefaultVerifySample is how many crate_urls -verify-urls checks.
+const DefaultVerifySample = 5
+
+// crateURL is the crate_url written into sidecars.
+func crateURL(baseURL, name, vers string) string {
+	return fmt.Sprintf("%s/%s/%s-%s.crate", strings.TrimRight(baseURL, "/"), name, name, vers)
+}
+
+// verifyURLs HEAD-checks the crate_url of one entry from each of up to n
+// randomly chosen index files. It fails only when every checked URL fails,
+// which points at a wrong base URL rather than one missing crate.
+func verifyURLs(ctx context.Context, cfg Config, files []string, n int) error {
+	cli := &http.Client{Timeout: 15 * time.Second}
+	checked, failed := 0, 0
+	var lastErr error
+	for _, i := range rand.Perm(len(files)) {
+		if checked >= n {
+			break
+		}
+		name, vers, ok := firstEntry(files[i])
+		if !ok {
+			continue
+		}
+		u := crateURL(cfg.BaseURL, name, vers)
+		checked++
+		if err := headOK(ctx, cli, u); err != nil {
+			slog.Warn("sidecar_verify_url_failed", "url", u, "err", err)
+			failed++
+			lastErr = err
+			continue
+		}
+		slog.Debug("sidecar_verify_url_ok", "url", u)
+	}
+	if checked > 0 && failed == checked {
+		return fmt.Errorf("all %d sampled crate URLs failed (check -crates-base-url %s): %w", checked, cfg.BaseURL, lastErr)
+	}
+	slog.Info("sidecar_verify_urls", "checked", checked, "failed", failed)
+	return nil
+}
+
+func firstEntry(path string) (name, vers string, ok bool) {
+	f, err := index.Open(path)
+	if err != nil {
+		return "", "", false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for s.Scan() {
+		var e struct {
+			Name string `json:"name"`
+			Vers string `json:"vers"`
+		}
+		if json.Unmarshal(s.Bytes(), &e) == nil && e.Name != "" && e.Vers != "" {
+			return e.Name, e.Vers, true
+		}
+	}
+	return "", "", false
+}
+
+func headOK(ctx context.Context, cli *http.Client, u string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "Aptlantis-crates-mirror/0.1")
+	resp, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
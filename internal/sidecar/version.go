@@ -0,0 +1,27 @@
+package sidecar
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+// Version identifies this build for generator_version: the module version
+// when built from a tagged module, else the VCS revision, else "devel".
+var Version = sync.OnceValue(func() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	if v := bi.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" && s.Value != "" {
+			if len(s.Value) > 12 {
+				return s.Value[:12]
+			}
+			return s.Value
+		}
+	}
+	return "devel"
+})